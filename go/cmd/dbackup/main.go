@@ -1,32 +1,131 @@
 package main
 
 import (
-	"crypto/md5"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	"local/backup/lib/backup"
 	"local/backup/lib/logging"
+	"local/backup/lib/s3_helpers"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 )
 
+// stringsFlag collects the values of a flag that can be given more than once.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
 func main() {
 	fMetaDbDir := flag.String("db", "", "database directory for local cache storage (if not provided, will be stored in ~/.dbackup/)")
 	fBackupName := flag.String("name", "", "name of the backup (if not provided, will be derived from the root directory)")
 	fRootDir := flag.String("dir", ".", "root directory for backup operation")
-	fSizeThreshold := flag.Int64("size_threshold", 1024*1024, "defines the threshold above which a file gets backed up by itself, as well as the max size of a directory to get zipped together")
+	var fRoots stringsFlag
+	flag.Var(&fRoots, "root", "directory to back up alongside the other -root directories as one backup, instead of -dir; can be given more than once, and requires -name")
+	fSizeThreshold := flag.Int64("size_threshold", backup.DefaultSizeThreshold, "defines the threshold above which a file gets backed up by itself, as well as the max size of a directory to get zipped together")
 	// TODO: default value
 	fBucket := flag.String("bucket", "my-bucket", "S3 bucket")
 	fPrefix := flag.String("prefix", "backups", "Custom prefix for the files stored in the S3 bucket")
 	fDoRecover := flag.Bool("recover", false, "If true, recovers FROM the remote location TO the local location")
-	fDryRun := flag.Bool("dry_run", true, "if true, print a plan and don't actually send any files to the backup destination")
+	fDryRun := flag.Bool("dry_run", false, "if true, print a plan and don't actually send any files to the backup destination")
 	fLogLevel := flag.String("log_level", "info", "controls logging verbosity")
 	fS3Url := flag.String("s3_url", "http://localhost:9000", "URL of S3 service")
+	fSFTP := flag.String("sftp", "", "if set, stores the backup on this SFTP server instead of in S3, in a directory named after -bucket under the URL's directory, like sftp://user@host:22/backups (relative to the home directory; use // for an absolute path)")
+	fSFTPKey := flag.String("sftp_key", "", "private key to log into the -sftp server with (defaults to ~/.ssh/id_ed25519)")
+	fSFTPKnownHosts := flag.String("sftp_known_hosts", "", "known_hosts file to check the -sftp server's host key against (defaults to ~/.ssh/known_hosts)")
 	fForce := flag.Bool("force", false, "if true, will overwrite any existing files in the remote backup regardless of the check")
+	fMergeRemote := flag.Bool("merge_remote", false, "if true and the remote backup has changed since the last backup, merges the changes instead of aborting, only uploading files that are newer locally")
+	fSnapshot := flag.Bool("snapshot", false, "if true, writes a new full snapshot of the directory instead of updating the backup in place")
+	fWaitForRestore := flag.Bool("wait_for_restore", false, "when recovering, wait for objects in archival storage (e.g. GLACIER) to be restored instead of failing")
+	fSnapshotID := flag.String("snapshot_id", "", "when recovering, the snapshot to recover (defaults to the latest)")
+	fCreateBucket := flag.Bool("create_bucket", false, "if true, creates the bucket if it doesn't exist yet")
+	fDialTimeout := flag.Duration("dial_timeout", 0, "max time to wait for a connection to S3 (0 means no limit)")
+	fResponseHeaderTimeout := flag.Duration("response_header_timeout", 0, "max time to wait for S3 to respond to a request (0 means no limit)")
+	fProxyURL := flag.String("proxy_url", "", "HTTP proxy to send S3 requests through")
+	fCABundle := flag.String("ca_bundle", "", "PEM file of extra CA certs to trust for a custom S3 endpoint")
+	fInsecureSkipVerify := flag.Bool("insecure_skip_verify", false, "DANGEROUS: disables TLS certificate verification for a custom S3 endpoint")
+	fRoleARN := flag.String("role_arn", "", "IAM role to assume for accessing S3")
+	fRoleSessionName := flag.String("role_session_name", "", "session name to use when assuming -role_arn")
+	fRoleExternalID := flag.String("role_external_id", "", "external id to use when assuming -role_arn")
+	fContinueOnError := flag.Bool("continue_on_error", false, "if true, skips batches and files that fail to back up and reports them at the end instead of aborting")
+	fContentAddressed := flag.Bool("content_addressed", false, "if true, stores large files by the hash of their contents so identical files are only stored once (can't be changed for an existing backup)")
+	fKeyTemplate := flag.String("key_template", "", "if set, stores archives under keys made from this template, relative to the prefix, with {name}, {date} and {path} placeholders, like \"archives/{date}/{name}/{path}\" (can't be changed for an existing backup)")
+	fObfuscateKeys := flag.Bool("obfuscate_keys", false, "if true, stores archives under hashed keys so they don't reveal file and directory names (can't be changed for an existing backup)")
+	fStripComponents := flag.Int("strip_components", 0, "when recovering, strip this many leading path elements from each file")
+	fReplacePrefix := flag.String("replace_prefix", "", "when recovering, replace this leading path prefix with -with_prefix")
+	fWithPrefix := flag.String("with_prefix", "", "when recovering, the prefix to replace -replace_prefix with")
+	fConflict := flag.String("conflict", "overwrite", "when recovering, what to do with files that already exist locally: overwrite, skip-existing or keep-newer")
+	fConcurrency := flag.Int("concurrency", 4, "when recovering, how many archives to download and extract at once")
+	fVerify := flag.Bool("verify", false, "when recovering, check every recovered file against the hashes in the backup")
+	fVerifyOnly := flag.Bool("verify_only", false, "with -recover, checks that every object in the backup can be downloaded and decompressed without writing any files (with -verify, also checks the files' hashes)")
+	fStaging := flag.Bool("staging", false, "when recovering, recovers into a staging directory next to -dir and only replaces -dir (keeping the old one alongside) once the recovery succeeds")
+	fOriginalLocations := flag.Bool("original_locations", false, "when recovering a backup of several -root directories, put each one back where it was backed up from instead of under -dir")
+	fSince := flag.String("since", "", "if set (RFC 3339), only check files modified after this time for changes")
+	fPath := flag.String("path", "", "if set, only backs up this directory, relative to -dir")
+	fKeepDBVersions := flag.Int("keep_db_versions", 0, "if positive, keeps up to this many previous versions of the remote db")
+	fGlobalIgnoreFile := flag.String("global_ignore_file", os.Getenv("DBACKUP_IGNORE_FILE"), "ignore file whose patterns apply to every backup, before -ignore_file and the root's .dbignore (defaults to $DBACKUP_IGNORE_FILE)")
+	var fIgnoreFiles stringsFlag
+	flag.Var(&fIgnoreFiles, "ignore_file", "extra ignore file, in .gitignore syntax; can be given more than once, and later files take precedence")
+	var fExclude, fInclude stringsFlag
+	flag.Var(&fExclude, "exclude", "glob, in .gitignore syntax, for paths not to back up, on top of any ignore files; can be given more than once")
+	flag.Var(&fInclude, "include", "glob, in .gitignore syntax, for paths to back up even if an ignore file or -exclude ignores them; can be given more than once")
+	fExtensions := flag.String("extensions", "", "if set, only backs up files with these comma-separated extensions, like \"jpg,raw\"")
+	fNoCompressExtensions := flag.String("no_compress_extensions", "", "if set, files with these comma-separated extensions, like \"jpg,mp4,zip\", are stored without being compressed again")
+	var fMetadata stringsFlag
+	flag.Var(&fMetadata, "metadata", "key=value metadata to attach to every uploaded archive; can be given more than once")
+	fIgnoreDotfiles := flag.Bool("ignore_dotfiles", false, "if true, hidden files and directories aren't backed up unless an ignore file re-includes them")
+	fGitignore := flag.Bool("gitignore", false, "if true, files matched by .gitignore files in the tree aren't backed up")
+	fListDBVersions := flag.Bool("list_db_versions", false, "if true, lists the kept versions of the remote db")
+	fRestoreDBVersion := flag.Int64("restore_db_version", 0, "if set, replaces the remote db with this kept version")
+	fKeepArchives := flag.Bool("keep_archives", false, "when recovering, leaves the downloaded archives in a temporary directory instead of deleting them, for debugging")
+	fMaxExtractedBytes := flag.Int64("max_extracted_bytes", 0, "when recovering, fails once more than this many bytes would be extracted in total, to guard against decompression bombs (0 means no limit)")
+	fMaxExtractedFileBytes := flag.Int64("max_extracted_file_bytes", 0, "when recovering, fails on a file bigger than this many bytes (0 means no limit)")
+	fBestEffort := flag.Bool("best_effort", false, "when recovering, reports objects that are missing from the bucket and recovers everything else, instead of failing")
+	fRecoverDBVersion := flag.Int64("recover_db_version", 0, "when recovering, recovers the tree as it was in this kept version of the remote db (see -list_db_versions), as far as its archives haven't changed since")
+	fQuarantineAfter := flag.Int("quarantine_after", 0, "if positive, files that fail to back up this many times in a row are skipped until they're modified")
+	fPreserveHardlinks := flag.Bool("preserve_hardlinks", false, "if true, hard links between files in the same batch are stored once and recovered as hard links (Unix only)")
+	fChunkThreshold := flag.Int64("chunk_threshold", 0, "if positive, files of at least this many bytes are stored in chunks, so only the changed parts are uploaded again")
+	fMetricsAddr := flag.String("metrics_addr", "", "if set, serves backup metrics for Prometheus at /metrics on this address while the backup runs")
+	fSkipEmptyFiles := flag.Bool("skip_empty_files", false, "if true, empty files aren't backed up")
+	fVacuumEvery := flag.Int("vacuum_every", 0, "if positive, compacts the db before uploading it after every this many backups")
+	fChecksumAlgorithm := flag.String("checksum_algorithm", "", "if set (CRC32, CRC32C, SHA1 or SHA256), sends a checksum with every upload so S3 rejects corrupted uploads; not every S3-compatible service supports it")
+	fNoDelete := flag.Bool("no_delete", false, "if true, nothing is deleted from the bucket; archives of removed files are left for gc")
+	fSecondaryBucket := flag.String("secondary_bucket", "", "if set, mirrors every object written to or deleted from -bucket to this bucket, and when recovering, downloads objects from it that can't be downloaded from -bucket")
+	fSecondaryPolicy := flag.String("secondary_policy", "", "with -secondary_bucket, what to do when writing to it fails: fail (the default) or warn")
+	fAuditLog := flag.String("audit_log", "", "if set, appends a JSON line recording each backup or recovery and its outcome to this file")
+	fSkipRemoteCheck := flag.Bool("skip_remote_check", false, "if true, doesn't compare the remote db to the local one before backing up; only safe if nothing else writes to the backup")
+	fScanConcurrency := flag.Int("scan_concurrency", 0, "max number of directories to scan at once (defaults to 4)")
+	fMaxBufferBytes := flag.Int64("max_buffer_bytes", 0, "archives bigger than this many bytes are built in a temporary file in -tmp_dir instead of in memory (defaults to 64 MiB)")
+	fMaxInFlightBytes := flag.Int64("max_in_flight_bytes", 0, "if positive, uploads batches concurrently, as many at once as add up to at most this many bytes; a bigger batch is uploaded on its own")
+	fPartSize := flag.Int64("part_size", 0, "archives bigger than this many bytes are uploaded to S3 in parts of this size, at least 5 MiB (defaults to 5 MiB)")
+	fPartConcurrency := flag.Int("part_concurrency", 0, "max number of parts of an archive to upload at once (defaults to 5)")
+	fTempDir := flag.String("tmp_dir", "", "directory for temporary files, such as downloaded dbs and archives (defaults to the system temp dir)")
+	fEstimate := flag.Bool("estimate", false, "if true, reports how much the next backup would upload instead of running it")
+	fEstimateSampleBytes := flag.Int64("estimate_sample_bytes", 64*1024*1024, "with -estimate, how many bytes to compress to estimate the compression ratio (0 to skip)")
+	fExportCSV := flag.String("export_csv", "", "if set, writes the local db's index of files to this CSV file (\"-\" for stdout) instead of backing up")
+	fRecoverFile := flag.String("recover_file", "", "if set, recovers just this file, relative to the backup root, to -recover_file_to")
+	fRecoverFileTo := flag.String("recover_file_to", "", "with -recover_file, the path or directory to recover the file to (defaults to where it was backed up from, under -dir)")
+	fTimeout := flag.Duration("timeout", 0, "if positive, stops a backup or recovery once it's run this long, after finishing the batch or archives in progress; a backup uploads the db for the batches it finished")
+	fStream := flag.String("stream", "", "if set, backs up stdin as a stream with this name instead of backing up files, or with -recover, writes the stream to stdout")
+	fTargets := flag.String("targets", "", "if set, backs up each target listed in this JSON file in turn, instead of -dir (see lib/backup/targets.go for the format)")
+	fStopOnError := flag.Bool("stop_on_error", false, "with -targets, skips the remaining targets once one fails")
 	flag.Parse()
 
 	var cfg *aws.Config
@@ -34,7 +133,31 @@ func main() {
 	if *fS3Url != "" {
 		cfg = backup.GetMinioConfig(*fS3Url)
 	} else {
-		cfg = backup.GetS3Config()
+		var err error
+		cfg, err = backup.GetS3Config()
+		if err != nil {
+			log.Fatalf("error configuring S3: %v", err)
+		}
+	}
+	err := backup.SetHTTPOptions(cfg, backup.HTTPOptions{
+		DialTimeout:           *fDialTimeout,
+		ResponseHeaderTimeout: *fResponseHeaderTimeout,
+		ProxyURL:              *fProxyURL,
+		CABundle:              *fCABundle,
+		InsecureSkipVerify:    *fInsecureSkipVerify,
+	})
+	if err != nil {
+		log.Fatalf("error configuring HTTP client: %v", err)
+	}
+	if *fRoleARN != "" {
+		err := backup.SetAssumeRole(cfg, backup.AssumeRoleOptions{
+			RoleARN:     *fRoleARN,
+			SessionName: *fRoleSessionName,
+			ExternalID:  *fRoleExternalID,
+		})
+		if err != nil {
+			log.Fatalf("error configuring role: %v", err)
+		}
 	}
 
 	logger := &logging.DefaultLogger{
@@ -50,17 +173,49 @@ func main() {
 	}
 
 	backupName := *fBackupName
+	if backupName == "" && len(fRoots) > 0 {
+		log.Fatalf("-name is required with -root")
+	}
 	if backupName == "" {
-		// MD5 hash of the normalized absolute root directory
-		absRootDir, err := filepath.Abs(*fRootDir)
+		var err error
+		backupName, err = backup.DefaultBackupName(*fRootDir)
 		if err != nil {
 			log.Fatal(err)
 		}
-		hashBs := md5.Sum([]byte(filepath.Clean(absRootDir)))
-		backupName = fmt.Sprintf("%x", hashBs)
 	}
 
 	bucket := *fBucket
+	// Targets can each be in a different bucket, so they're left alone here.
+	if *fS3Url == "" && *fTargets == "" && *fSFTP == "" {
+		if err := backup.SetBucketRegion(logger, cfg, bucket); err != nil {
+			log.Fatalf("error configuring S3: %v", err)
+		}
+	}
+
+	var storage s3_helpers.Client
+	if *fSFTP != "" {
+		if *fTargets != "" || *fListDBVersions || *fRestoreDBVersion != 0 || *fStream != "" {
+			log.Fatalf("-sftp only works for backing up and recovering files")
+		}
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			log.Fatal(err)
+		}
+		keyFile := *fSFTPKey
+		if keyFile == "" {
+			keyFile = filepath.Join(homeDir, ".ssh", "id_ed25519")
+		}
+		knownHostsFile := *fSFTPKnownHosts
+		if knownHostsFile == "" {
+			knownHostsFile = filepath.Join(homeDir, ".ssh", "known_hosts")
+		}
+		client, err := s3_helpers.DialSFTP(*fSFTP, keyFile, knownHostsFile)
+		if err != nil {
+			log.Fatalf("error connecting to sftp server: %v", err)
+		}
+		defer client.Close()
+		storage = client
+	}
 
 	dbDir := *fMetaDbDir
 	if dbDir == "" {
@@ -79,8 +234,180 @@ func main() {
 	dbFile = filepath.Clean(absDbFile)
 	logger.Infof("using db file: %s", dbFile)
 
-	if *fDoRecover {
-		err := backup.RecoverFiles(
+	// The options a backup would run with, for the backup itself and for estimating it.
+	backupOptions := func() backup.BackupOptions {
+		var since time.Time
+		if *fSince != "" {
+			var err error
+			since, err = time.Parse(time.RFC3339, *fSince)
+			if err != nil {
+				log.Fatalf("invalid -since: %v", err)
+			}
+		}
+		var ignoreFiles []string
+		if *fGlobalIgnoreFile != "" {
+			ignoreFiles = append(ignoreFiles, *fGlobalIgnoreFile)
+		}
+		ignoreFiles = append(ignoreFiles, fIgnoreFiles...)
+		var noCompressExtensions []string
+		if *fNoCompressExtensions != "" {
+			noCompressExtensions = strings.Split(*fNoCompressExtensions, ",")
+		}
+		metadata := make(map[string]string)
+		for _, kv := range fMetadata {
+			k, v, ok := strings.Cut(kv, "=")
+			if !ok {
+				log.Fatalf("invalid -metadata %q, expected key=value", kv)
+			}
+			metadata[k] = v
+		}
+		var extensions []string
+		if *fExtensions != "" {
+			extensions = strings.Split(*fExtensions, ",")
+		}
+
+		return backup.BackupOptions{
+			DryRun:                *fDryRun,
+			Force:                 *fForce,
+			MergeRemote:           *fMergeRemote,
+			Snapshot:              *fSnapshot,
+			CreateBucketIfMissing: *fCreateBucket,
+			ContinueOnError:       *fContinueOnError,
+			ContentAddressed:      *fContentAddressed,
+			ObfuscateKeys:         *fObfuscateKeys,
+			KeyTemplate:           *fKeyTemplate,
+			Since:                 since,
+			Path:                  *fPath,
+			KeepDBVersions:        *fKeepDBVersions,
+			Gitignore:             *fGitignore,
+			IgnoreFiles:           ignoreFiles,
+			IgnoreDotfiles:        *fIgnoreDotfiles,
+			Exclude:               fExclude,
+			Include:               fInclude,
+			Extensions:            extensions,
+			NoCompressExtensions:  noCompressExtensions,
+			ObjectMetadata:        metadata,
+			QuarantineAfter:       *fQuarantineAfter,
+			PreserveHardlinks:     *fPreserveHardlinks,
+			ChunkThreshold:        *fChunkThreshold,
+			TempDir:               *fTempDir,
+			MaxBufferBytes:        *fMaxBufferBytes,
+			MaxInFlightBytes:      *fMaxInFlightBytes,
+			PartSize:              *fPartSize,
+			PartConcurrency:       *fPartConcurrency,
+			ScanConcurrency:       *fScanConcurrency,
+			SkipRemoteCheck:       *fSkipRemoteCheck,
+			SkipEmptyFiles:        *fSkipEmptyFiles,
+			VacuumEvery:           *fVacuumEvery,
+			ChecksumAlgorithm:     *fChecksumAlgorithm,
+			NoDelete:              *fNoDelete,
+			SecondaryBucket:       *fSecondaryBucket,
+			SecondaryPolicy:       backup.MirrorPolicy(*fSecondaryPolicy),
+			AuditLog:              *fAuditLog,
+			Storage:               storage,
+		}
+	}
+
+	if *fTargets != "" {
+		targets, err := backup.LoadTargets(*fTargets)
+		if err != nil {
+			log.Fatalf("error loading targets: %v", err)
+		}
+		ctx, cancel := interruptContext(logger, *fTimeout)
+		defer cancel()
+		results, err := backup.BackupTargets(ctx, logger, cfg, targets, backup.TargetsOptions{
+			StopOnError: *fStopOnError,
+		})
+		for _, result := range results {
+			if result.Err != nil {
+				logger.Infof("%s: failed: %v", result.Target, result.Err)
+			} else {
+				logger.Infof("%s: ok", result.Target)
+			}
+		}
+		if err != nil {
+			log.Fatalf("error backing up targets: %v", err)
+		}
+	} else if *fListDBVersions {
+		versions, err := backup.ListDBVersions(cfg, bucket, *fPrefix, backupName)
+		if err != nil {
+			log.Fatalf("error listing db versions: %v", err)
+		}
+		for _, version := range versions {
+			logger.Infof("%d (%s)", version, time.Unix(0, version).Format(time.RFC3339))
+		}
+	} else if *fRestoreDBVersion != 0 {
+		err := backup.RestoreDBVersion(logger, cfg, bucket, *fPrefix, backupName, *fRestoreDBVersion)
+		if err != nil {
+			log.Fatalf("error restoring db version: %v", err)
+		}
+	} else if *fExportCSV != "" {
+		if err := exportCSV(dbFile, *fExportCSV); err != nil {
+			log.Fatalf("error exporting db: %v", err)
+		}
+	} else if *fEstimate {
+		options := backup.EstimateOptions{
+			SampleBytes: *fEstimateSampleBytes,
+			Backup:      backupOptions(),
+		}
+		var report *backup.EstimateReport
+		var err error
+		if len(fRoots) > 0 {
+			report, err = backup.EstimateRoots(logger, dbFile, fRoots, *fSizeThreshold, options)
+		} else {
+			report, err = backup.Estimate(logger, dbFile, *fRootDir, *fSizeThreshold, options)
+		}
+		if err != nil {
+			log.Fatalf("error estimating backup: %v", err)
+		}
+		logger.Infof("batches to upload: %d", report.Batches)
+		logger.Infof("logical size: %d bytes", report.LogicalBytes)
+		logger.Infof("estimated compressed size: %d bytes (sampled %d bytes)", report.EstimatedCompressedBytes, report.SampledBytes)
+	} else if *fStream != "" && *fDoRecover {
+		err := backup.RecoverStream(logger, cfg, bucket, *fPrefix, backupName, *fStream, os.Stdout, backup.StreamOptions{
+			TempDir: *fTempDir,
+		})
+		if err != nil {
+			log.Fatalf("error recovering stream: %v", err)
+		}
+	} else if *fStream != "" {
+		err := backup.BackupStream(logger, cfg, dbFile, bucket, *fPrefix, backupName, *fStream, os.Stdin, backup.StreamOptions{
+			Force:   *fForce,
+			TempDir: *fTempDir,
+		})
+		if err != nil {
+			log.Fatalf("error backing up stream: %v", err)
+		}
+	} else if *fRecoverFile != "" {
+		conflict, err := backup.ParseConflictPolicy(*fConflict)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		dest := *fRecoverFileTo
+		if dest == "" {
+			dest = filepath.Join(*fRootDir, filepath.FromSlash(*fRecoverFile))
+		}
+		ctx, cancel := interruptContext(logger, *fTimeout)
+		defer cancel()
+		err = backup.RecoverFile(ctx, logger, cfg, bucket, *fPrefix, backupName, *fRecoverFile, dest, backup.RecoveryOptions{
+			Snapshot:        *fSnapshotID,
+			Conflict:        conflict,
+			TempDir:         *fTempDir,
+			SecondaryBucket: *fSecondaryBucket,
+			Storage:         storage,
+		})
+		if err != nil {
+			log.Fatalf("error recovering file: %v", err)
+		}
+	} else if *fDoRecover {
+		conflict, err := backup.ParseConflictPolicy(*fConflict)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		ctx, cancel := interruptContext(logger, *fTimeout)
+		defer cancel()
+		err = backup.RecoverFiles(
+			ctx,
 			logger,
 			cfg,
 			dbFile,
@@ -89,29 +416,126 @@ func main() {
 			backupName,
 			*fRootDir,
 			backup.RecoveryOptions{
-				Force: *fForce,
+				Force:                 *fForce,
+				Snapshot:              *fSnapshotID,
+				DBVersion:             *fRecoverDBVersion,
+				BestEffort:            *fBestEffort,
+				KeepArchives:          *fKeepArchives,
+				MaxExtractedBytes:     *fMaxExtractedBytes,
+				MaxExtractedFileBytes: *fMaxExtractedFileBytes,
+				WaitForRestore:        *fWaitForRestore,
+				StripComponents:       *fStripComponents,
+				ReplacePrefix:         *fReplacePrefix,
+				WithPrefix:            *fWithPrefix,
+				Conflict:              conflict,
+				Concurrency:           *fConcurrency,
+				Verify:                *fVerify,
+				VerifyOnly:            *fVerifyOnly,
+				Staging:               *fStaging,
+				OriginalLocations:     *fOriginalLocations,
+				TempDir:               *fTempDir,
+				SecondaryBucket:       *fSecondaryBucket,
+				AuditLog:              *fAuditLog,
+				Storage:               storage,
 			},
 		)
 		if err != nil {
 			log.Fatalf("error recovering files: %+v", err)
 		}
 	} else {
-		err := backup.BackupFiles(
-			logger,
-			cfg,
-			dbFile,
-			*fRootDir,
-			bucket,
-			*fPrefix,
-			backupName,
-			*fSizeThreshold,
-			backup.BackupOptions{
-				DryRun: *fDryRun,
-				Force:  *fForce,
-			},
-		)
+		var metrics backup.Metrics
+		if *fMetricsAddr != "" {
+			counters := &backup.CounterMetrics{}
+			serveMetrics(logger, *fMetricsAddr, counters)
+			metrics = counters
+		}
+
+		ctx, cancel := interruptContext(logger, *fTimeout)
+		defer cancel()
+
+		options := backupOptions()
+		options.Metrics = metrics
+		var err error
+		if len(fRoots) > 0 {
+			err = backup.BackupRoots(ctx, logger, cfg, dbFile, fRoots, bucket, *fPrefix, backupName, *fSizeThreshold, options)
+		} else {
+			err = backup.BackupFiles(ctx, logger, cfg, dbFile, *fRootDir, bucket, *fPrefix, backupName, *fSizeThreshold, options)
+		}
 		if err != nil {
 			log.Fatalf("error backing up files: %+v", err)
 		}
 	}
 }
+
+// interruptContext returns a context that's cancelled on Ctrl-C, so a backup finishes the batch
+// that's in progress and uploads the db before exiting, leaving the backup in a consistent state. A
+// second Ctrl-C exits immediately. If timeout is positive, the context's deadline is that far away,
+// which stops the run the same way.
+func interruptContext(logger logging.Logger, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, timeout)
+		stop := context.AfterFunc(ctx, func() {
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				logger.Infof("timed out after %v, finishing the current batch", timeout)
+			}
+		})
+		cancelAll := cancel
+		cancel = func() {
+			stop()
+			cancelTimeout()
+			cancelAll()
+		}
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		logger.Infof("interrupted, finishing the current batch (interrupt again to exit immediately)")
+		signal.Stop(signals)
+		cancel()
+	}()
+	return ctx, cancel
+}
+
+// exportCSV writes the db's index of files to the given file, or to stdout for "-".
+func exportCSV(dbFile string, filename string) error {
+	if _, err := os.Stat(dbFile); err != nil {
+		return err
+	}
+	db, err := backup.NewDB(dbFile)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if filename == "-" {
+		return db.ExportCSV(os.Stdout)
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := db.ExportCSV(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// serveMetrics serves the metrics in the background, for as long as the process runs.
+func serveMetrics(logger logging.Logger, addr string, metrics *backup.CounterMetrics) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := metrics.WritePrometheus(w); err != nil {
+			logger.Infof("error writing metrics: %v", err)
+		}
+	})
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Fatalf("error serving metrics: %v", err)
+		}
+	}()
+}
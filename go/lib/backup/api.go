@@ -0,0 +1,188 @@
+package backup
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+
+	"local/backup/lib/logging"
+)
+
+// Report describes what a backup or recovery did.
+type Report struct {
+	// The snapshot that was created or recovered, if any.
+	SnapshotID string
+
+	// Set by backups. Paths are relative to the backup root.
+	FilesAdded   []string
+	FilesChanged []string
+	FilesRemoved []string
+	// Files that were modified while they were being backed up. See backupSummary.
+	FilesChangedDuringBackup []string
+	BatchesWritten           int
+	// How well each batch that was written compressed, by batch root. See CompressionStats.
+	Compression map[string]CompressionStats
+	// Batches that were copied from an existing archive instead of being uploaded.
+	BatchesCopied  int
+	BatchesDeleted int
+	// Files that were skipped because they keep failing to back up. See quarantine.go.
+	FilesQuarantined []string
+
+	// Set by recoveries.
+	ArchivesRecovered int
+	// Objects that were downloaded and checked by a recovery with RecoveryOptions.VerifyOnly.
+	ObjectsVerified int
+	// Objects in archival storage that have been requested but aren't available yet.
+	PendingRestores []string
+	// Objects that the db refers to but that are missing from the bucket, which a recovery with
+	// RecoveryOptions.BestEffort skipped.
+	MissingObjects []string
+}
+
+// CompressionStats compares the bytes that went into the compressor (the tar stream for archives,
+// or a file's contents for blobs and chunks) to the compressed bytes that came out.
+type CompressionStats struct {
+	Uncompressed int64
+	Compressed   int64
+}
+
+// Ratio returns the compressed size as a fraction of the uncompressed size, so smaller is better,
+// and anything at or above 1 didn't compress at all. It's 0 if nothing was compressed.
+func (s CompressionStats) Ratio() float64 {
+	if s.Uncompressed == 0 {
+		return 0
+	}
+	return float64(s.Compressed) / float64(s.Uncompressed)
+}
+
+const DefaultSizeThreshold = 1024 * 1024
+
+type BackuperConfig struct {
+	AWS *aws.Config
+	// Defaults to logging at the Info level.
+	Logger logging.Logger
+
+	// The local directory to back up, and to recover into.
+	Root   string
+	Bucket string
+	Prefix string
+	// Defaults to DefaultBackupName(Root).
+	Name string
+	// Defaults to DefaultDBFile(Name).
+	DBFile string
+	// Defaults to DefaultSizeThreshold.
+	SizeThreshold int64
+
+	Options BackupOptions
+}
+
+// Backuper backs up a directory to, and recovers it from, a bucket. It's the API for using this
+// package from other programs.
+type Backuper struct {
+	config BackuperConfig
+}
+
+func NewBackuper(config BackuperConfig) (*Backuper, error) {
+	if config.AWS == nil {
+		return nil, fmt.Errorf("AWS config is required")
+	}
+	if config.Root == "" {
+		return nil, fmt.Errorf("root directory is required")
+	}
+	if config.Bucket == "" {
+		return nil, fmt.Errorf("bucket is required")
+	}
+	if config.Logger == nil {
+		config.Logger = &logging.DefaultLogger{Level: logging.Info}
+	}
+	if config.SizeThreshold == 0 {
+		config.SizeThreshold = DefaultSizeThreshold
+	}
+	if err := validateSizeThreshold(config.SizeThreshold); err != nil {
+		return nil, err
+	}
+	if err := config.Options.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid options: %v", err)
+	}
+	var err error
+	if config.Name == "" {
+		config.Name, err = DefaultBackupName(config.Root)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.DBFile == "" {
+		config.DBFile, err = DefaultDBFile(config.Name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Backuper{config: config}, nil
+}
+
+// Backup backs up the root directory. Cancelling ctx stops the backup between batches.
+func (b *Backuper) Backup(ctx context.Context) (*Report, error) {
+	c := b.config
+	return backupFiles(ctx, c.Logger, c.AWS, c.DBFile, c.Root, c.Bucket, c.Prefix, c.Name, c.SizeThreshold, c.Options)
+}
+
+// Recover recovers the backup into the root directory. Cancelling ctx stops the recovery between
+// archives.
+func (b *Backuper) Recover(ctx context.Context, options RecoveryOptions) (*Report, error) {
+	c := b.config
+	return recoverFiles(ctx, c.Logger, c.AWS, c.DBFile, c.Bucket, c.Prefix, c.Name, c.Root, options)
+}
+
+// RecoverFile recovers the file at relPath, relative to the root directory, to dest, or to where it
+// was backed up from if dest is empty. See RecoverFile.
+func (b *Backuper) RecoverFile(ctx context.Context, relPath string, dest string, options RecoveryOptions) error {
+	c := b.config
+	if dest == "" {
+		dest = filepath.Join(c.Root, filepath.FromSlash(relPath))
+	}
+	return RecoverFile(ctx, c.Logger, c.AWS, c.Bucket, c.Prefix, c.Name, relPath, dest, options)
+}
+
+// BackupStream stores everything read from r in the backup under the given stream name. See
+// streams.go.
+func (b *Backuper) BackupStream(name string, r io.Reader) error {
+	c := b.config
+	return BackupStream(c.Logger, c.AWS, c.DBFile, c.Bucket, c.Prefix, c.Name, name, r, c.streamOptions())
+}
+
+// RecoverStream writes the contents of the named stream to w.
+func (b *Backuper) RecoverStream(name string, w io.Writer) error {
+	c := b.config
+	return RecoverStream(c.Logger, c.AWS, c.Bucket, c.Prefix, c.Name, name, w, c.streamOptions())
+}
+
+func (c BackuperConfig) streamOptions() StreamOptions {
+	return StreamOptions{
+		Force:          c.Options.Force,
+		TempDir:        c.Options.TempDir,
+		ObjectMetadata: c.Options.ObjectMetadata,
+	}
+}
+
+// DefaultBackupName names a backup by the MD5 hash of its absolute root directory.
+func DefaultBackupName(root string) (string, error) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", md5.Sum([]byte(filepath.Clean(absRoot)))), nil
+}
+
+// DefaultDBFile returns the path of the local db for the given backup, under ~/.dbackup/.
+func DefaultDBFile(name string) (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(homeDir, ".dbackup", fmt.Sprintf("%s.db", name)), nil
+}
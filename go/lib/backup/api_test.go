@@ -0,0 +1,121 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"local/backup/lib/logging"
+)
+
+func TestBackuper_RoundTrip(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "b.txt"), 9))
+	must(createTestFile(filepath.Join(testBaseDir, "subdir-1/c.txt"), 2000))
+
+	backuper, err := NewBackuper(BackuperConfig{
+		AWS:           GetMinioConfig(minioUrl),
+		Logger:        logger,
+		Root:          testBaseDir,
+		Bucket:        config.Bucket,
+		Prefix:        config.S3Prefix,
+		Name:          config.BackupName,
+		DBFile:        config.DBFile,
+		SizeThreshold: 1000,
+	})
+	must(err)
+
+	report, err := backuper.Backup(context.Background())
+	must(err)
+	assert.ElementsMatch(t, []string{"a.txt", "b.txt", filepath.Join("subdir-1", "c.txt")}, report.FilesAdded)
+	assert.Equal(t, 2, report.BatchesWritten)
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 6))
+	report, err = backuper.Backup(context.Background())
+	must(err)
+	assert.Empty(t, report.FilesAdded)
+	assert.Equal(t, []string{"a.txt"}, report.FilesChanged)
+	assert.Equal(t, 1, report.BatchesWritten)
+
+	// Recover into a different directory, with a fresh local db.
+	recoveryDir := t.TempDir()
+	recoverer, err := NewBackuper(BackuperConfig{
+		AWS:    GetMinioConfig(minioUrl),
+		Logger: logger,
+		Root:   recoveryDir,
+		Bucket: config.Bucket,
+		Prefix: config.S3Prefix,
+		Name:   config.BackupName,
+		DBFile: filepath.Join(t.TempDir(), "recovery.db"),
+	})
+	must(err)
+	report, err = recoverer.Recover(context.Background(), RecoveryOptions{Verify: true})
+	must(err)
+	assert.Equal(t, 2, report.ArchivesRecovered)
+	compareDirectories(testBaseDir, recoveryDir, t)
+}
+
+func TestNewBackuper_Defaults(t *testing.T) {
+	_, err := NewBackuper(BackuperConfig{Root: ".", Bucket: "bucket"})
+	assert.Error(t, err)
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	root := t.TempDir()
+	backuper, err := NewBackuper(BackuperConfig{AWS: GetMinioConfig(minioUrl), Root: root, Bucket: "bucket"})
+	must(err)
+	name, err := DefaultBackupName(root)
+	must(err)
+	assert.Equal(t, name, backuper.config.Name)
+	assert.Equal(t, filepath.Join(home, ".dbackup", name+".db"), backuper.config.DBFile)
+	assert.Equal(t, int64(DefaultSizeThreshold), backuper.config.SizeThreshold)
+}
+
+func TestBackuper_CompressionStats(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+
+	// A highly compressible file by itself, and a batch of two small ones.
+	must(os.WriteFile(filepath.Join(testBaseDir, "zeros.bin"), make([]byte, 100*1024), 0644))
+	must(createTestFile(filepath.Join(testBaseDir, "subdir/a.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "subdir/b.txt"), 5))
+
+	backuper, err := NewBackuper(BackuperConfig{
+		AWS:           GetMinioConfig(minioUrl),
+		Logger:        logger,
+		Root:          testBaseDir,
+		Bucket:        config.Bucket,
+		Prefix:        config.S3Prefix,
+		Name:          config.BackupName,
+		DBFile:        config.DBFile,
+		SizeThreshold: 1000,
+	})
+	must(err)
+	report, err := backuper.Backup(context.Background())
+	must(err)
+
+	if assert.Contains(t, report.Compression, "zeros.bin") {
+		stats := report.Compression["zeros.bin"]
+		// The tar stream holds the file along with its header and padding.
+		assert.GreaterOrEqual(t, stats.Uncompressed, int64(100*1024))
+		assert.Less(t, stats.Ratio(), 0.05)
+	}
+	if assert.Contains(t, report.Compression, "subdir") {
+		assert.Greater(t, report.Compression["subdir"].Compressed, int64(0))
+	}
+	assert.Equal(t, 0.0, CompressionStats{}.Ratio())
+}
@@ -0,0 +1,98 @@
+package backup
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"local/backup/lib/logging"
+)
+
+// With an audit log, every backup, recovery, GC and prune appends a line of JSON to a local file,
+// recording when it ran, what it did and how it ended. The file is only ever appended to. The audit
+// log is a record of the operations rather than part of them, so failing to write it is logged but
+// never fails the operation.
+
+// AuditEntry is one line of the audit log.
+type AuditEntry struct {
+	Time time.Time `json:"time"`
+	// "backup", "recover", "gc" or "prune".
+	Operation string `json:"operation"`
+	// The backup's name.
+	Backup string `json:"backup"`
+	// What the operation did, like "files_added" or "objects_deleted". Only non-zero counts are
+	// included.
+	Counts map[string]int `json:"counts,omitempty"`
+	// "ok" or "error".
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+}
+
+func newAuditEntry(operation string, name string, counts map[string]int, err error) AuditEntry {
+	entry := AuditEntry{
+		Time:      time.Now().UTC(),
+		Operation: operation,
+		Backup:    name,
+		Counts:    make(map[string]int),
+		Outcome:   "ok",
+	}
+	for k, v := range counts {
+		if v != 0 {
+			entry.Counts[k] = v
+		}
+	}
+	if err != nil {
+		entry.Outcome = "error"
+		entry.Error = err.Error()
+	}
+	return entry
+}
+
+// appendAuditLog appends the entry to the audit log at the given path, if there is one.
+func appendAuditLog(logger logging.Logger, path string, entry AuditEntry) {
+	if path == "" {
+		return
+	}
+	if err := writeAuditEntry(path, entry); err != nil {
+		logger.Infof("failed to write to audit log %q: %v", path, err)
+	}
+}
+
+func writeAuditEntry(path string, entry AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	// A single write, so concurrent runs don't interleave their lines.
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// auditCounts returns what the backup or recovery did, for the audit log.
+func (r *Report) auditCounts() map[string]int {
+	if r == nil {
+		return nil
+	}
+	return map[string]int{
+		"files_added":        len(r.FilesAdded),
+		"files_changed":      len(r.FilesChanged),
+		"files_removed":      len(r.FilesRemoved),
+		"files_quarantined":  len(r.FilesQuarantined),
+		"batches_written":    r.BatchesWritten,
+		"batches_copied":     r.BatchesCopied,
+		"batches_deleted":    r.BatchesDeleted,
+		"archives_recovered": r.ArchivesRecovered,
+		"pending_restores":   len(r.PendingRestores),
+	}
+}
@@ -0,0 +1,89 @@
+package backup
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"local/backup/lib/logging"
+)
+
+func readAuditLog(t *testing.T, path string) []AuditEntry {
+	f, err := os.Open(path)
+	must(err)
+	defer f.Close()
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry AuditEntry
+		must(json.Unmarshal(scanner.Bytes(), &entry))
+		entries = append(entries, entry)
+	}
+	must(scanner.Err())
+	return entries
+}
+
+func TestAuditLog(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+	auditLog := filepath.Join(t.TempDir(), "audit", "dbackup.log")
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 50))
+	must(createTestFile(filepath.Join(testBaseDir, "subdir/b.txt"), 50))
+
+	cfg := GetMinioConfig(minioUrl)
+	backup := func(options BackupOptions) error {
+		return BackupFiles(
+			context.Background(),
+			logger,
+			cfg,
+			config.DBFile,
+			testBaseDir,
+			config.Bucket,
+			config.S3Prefix,
+			config.BackupName,
+			config.SizeThreshold,
+			options,
+		)
+	}
+	must(backup(BackupOptions{AuditLog: auditLog}))
+	entries := readAuditLog(t, auditLog)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "backup", entries[0].Operation)
+		assert.Equal(t, config.BackupName, entries[0].Backup)
+		assert.Equal(t, "ok", entries[0].Outcome)
+		assert.Equal(t, 2, entries[0].Counts["files_added"])
+		assert.False(t, entries[0].Time.IsZero())
+	}
+
+	// Failures are recorded too, and entries are only ever appended.
+	assert.Error(t, backup(BackupOptions{AuditLog: auditLog, KeepDBVersions: -1}))
+	testRecoveryDir := t.TempDir()
+	must(RecoverFiles(context.Background(), logger, cfg, config.DBFile, config.Bucket, config.S3Prefix, config.BackupName, testRecoveryDir, RecoveryOptions{AuditLog: auditLog}))
+	_, err := GC(logger, cfg, config.DBFile, config.Bucket, config.S3Prefix, config.BackupName, GCOptions{AuditLog: auditLog})
+	must(err)
+	entries = readAuditLog(t, auditLog)
+	if assert.Len(t, entries, 4) {
+		assert.Equal(t, "backup", entries[1].Operation)
+		assert.Equal(t, "error", entries[1].Outcome)
+		assert.NotEmpty(t, entries[1].Error)
+		assert.Equal(t, "recover", entries[2].Operation)
+		assert.Equal(t, "ok", entries[2].Outcome)
+		assert.Equal(t, 2, entries[2].Counts["archives_recovered"])
+		assert.Equal(t, "gc", entries[3].Operation)
+	}
+
+	// An audit log that can't be written doesn't get in the way of the backup.
+	unwritable := filepath.Join(t.TempDir(), "file")
+	must(os.WriteFile(unwritable, nil, 0644))
+	must(backup(BackupOptions{AuditLog: filepath.Join(unwritable, "dbackup.log")}))
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/md5"
 	"database/sql"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -11,6 +12,9 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -18,17 +22,201 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 
 	"local/backup/lib/logging"
-	"local/backup/lib/util"
+	"local/backup/lib/s3_helpers"
 )
 
 type BackupOptions struct {
 	Force  bool
 	DryRun bool
+	// If true and files have changed in storage since the last backup, the changes are merged instead
+	// of aborting: only files that are newer on disk than in storage are uploaded, and files that are
+	// only in storage are kept. See drift.go.
+	MergeRemote bool
+	// If true, the remote db isn't downloaded and compared to the local one before the backup, which
+	// saves time for a big backup, but means changes to the backup from anywhere else go unnoticed
+	// and are overwritten. Only use this if nothing else writes to the backup.
+	SkipRemoteCheck bool
+	// If true, writes a full, new snapshot of the tree instead of updating the backup in place. Once
+	// a backup has a snapshot, it can't be updated in place any more. See snapshot.go for the layout.
+	Snapshot bool
+	// If true, creates the bucket if it doesn't exist yet. Otherwise a missing bucket is an error.
+	CreateBucketIfMissing bool
+	// If true, batches and files that fail to back up are skipped and reported at the end instead of
+	// aborting the backup. Everything that succeeded is still recorded.
+	ContinueOnError bool
+	// If true, files that are backed up by themselves are stored by the hash of their contents, so
+	// identical files are only stored once. See blobs.go. A backup can't switch modes once it has
+	// files in it.
+	ContentAddressed bool
+	// If true, archives are stored under hashes of their paths, so keys don't reveal the names of
+	// files and directories. See obfuscate.go. A backup can't switch modes once it has files in it.
+	ObfuscateKeys bool
+	// If set, archives are stored under keys made from this template, like
+	// "archives/{date}/{name}/{path}", instead of under <name>/<path>. See keytemplate.go. A backup
+	// can't switch templates once it has files in it.
+	KeyTemplate string
+	// If set, files that are already in the db and haven't been modified since this time are assumed
+	// to be unchanged, without hashing them. This makes for a quicker incremental backup, at the risk
+	// of missing changes that didn't update the modtime.
+	Since time.Time
+	// If set, only backs up this directory (relative to the root) instead of the whole tree. See
+	// subtree.go.
+	Path string
+	// If positive, the remote db is kept as a version before it's overwritten, and up to this many
+	// versions are retained. See db_versions.go.
+	KeepDBVersions int
+	// If true, files matched by .gitignore files in the tree aren't backed up, in addition to the
+	// ones matched by the .dbignore. See ignore.go.
+	Gitignore bool
+	// Extra ignore files, in .gitignore syntax, such as a global one shared by several backups. They
+	// take precedence over .gitignore files, and later ones over earlier ones, but the root's
+	// .dbignore has the final say.
+	IgnoreFiles []string
+	// If true, hidden files and directories, whose names start with ".", aren't backed up unless an
+	// ignore file re-includes them.
+	IgnoreDotfiles bool
+	// Globs, in .gitignore syntax and relative to the root, for paths that aren't backed up, on top
+	// of the ignore files. See ignore.go.
+	Exclude []string
+	// Globs for paths to back up even if an ignore file or Exclude ignores them.
+	Include []string
+	// If set, only files with one of these extensions (like ".jpg", compared case-insensitively) are
+	// backed up. Other files are treated as if they were ignored.
+	Extensions []string
+	// Files with one of these extensions (like ".jpg", compared case-insensitively) are most likely
+	// compressed already, so they're stored without being compressed again. See compressionLevel.
+	NoCompressExtensions []string
+	// Custom metadata attached to every archive that's uploaded, along with the backup's name and
+	// each archive's file count and source path.
+	ObjectMetadata map[string]string
+	// If set, receives events from the backup for monitoring. See metrics.go.
+	Metrics Metrics
+	// If set, receives structured events as the backup progresses. See observer.go.
+	Observer Observer
+	// If positive, files that fail to back up this many times in a row without being modified are
+	// quarantined: they're skipped and reported until they change. See quarantine.go.
+	QuarantineAfter int
+	// If true, hard links between files in the same batch are stored once and recovered as hard
+	// links, on platforms where they can be detected. See hardlinks.go.
+	PreserveHardlinks bool
+	// If positive, files of at least this many bytes that are backed up by themselves are split into
+	// chunks, so that when they change only the chunks that changed are uploaded. See chunks.go.
+	ChunkThreshold int64
+	// Where to put temporary files, such as the downloaded remote db. Defaults to os.TempDir().
+	TempDir string
+	// Max number of directories to scan at once. Defaults to defaultScanConcurrency; 1 scans the tree
+	// one directory at a time. The batches are the same either way.
+	ScanConcurrency int
+	// Archives up to this many bytes are built in memory before they're uploaded. Bigger ones, such
+	// as a single enormous file, are built in a temporary file in TempDir instead. Defaults to 64 MiB.
+	MaxBufferBytes int64
+	// If positive, batches are uploaded concurrently, as many at once as add up to at most this many
+	// bytes, so that small batches go up in parallel while a batch bigger than this goes up on its
+	// own. By default batches are uploaded one at a time. See inflight.go.
+	MaxInFlightBytes int64
+	// Archives bigger than this many bytes are uploaded to S3 in parts of this size. Must be at least
+	// 5 MiB, which is also the default. See multipart.go.
+	PartSize int64
+	// Max number of parts of an archive to upload at once. Defaults to 5.
+	PartConcurrency int
+	// If true, empty files aren't backed up. Files that were backed up before they were emptied are
+	// removed from the backup.
+	SkipEmptyFiles bool
+	// If positive, the db is vacuumed before it's uploaded after every this many backups, so that it
+	// doesn't keep growing as files are added and removed.
+	VacuumEvery int
+	// If set, every uploaded object is sent with a checksum computed with this algorithm (CRC32,
+	// CRC32C, SHA1 or SHA256), which S3 verifies on write. See checksums.go.
+	ChecksumAlgorithm string
+	// If set, every object written to or deleted from the bucket is written to or deleted from this
+	// bucket too. See mirror.go.
+	SecondaryBucket string
+	// What to do when writing to SecondaryBucket fails. Defaults to MirrorFail.
+	SecondaryPolicy MirrorPolicy
+	// If set, a line recording the backup and its outcome is appended to this file. See audit.go.
+	AuditLog string
+	// If set, the backup is stored here instead of in S3, under the same bucket and keys, e.g. on an
+	// SFTP server with s3_helpers.SFTPClient. The config is then only used for its region.
+	Storage s3_helpers.Client
+	// If true, nothing is deleted from the bucket: archives of batches that no longer exist are
+	// dropped from the db but left in storage for GC, and old db versions aren't pruned. See
+	// nodelete.go.
+	NoDelete bool
+
+	// The directory archives are stored in, from KeyTemplate. Set by runBackup; the prefix if empty.
+	archiveDir string
+	// Set by runBackup when batches are uploaded concurrently, see lockBatch.
+	batchLock sync.Locker
+}
+
+// archiveDirFor returns the directory the backup's archives are stored in, given its prefix.
+func (o BackupOptions) archiveDirFor(prefix string) string {
+	if o.archiveDir != "" {
+		return o.archiveDir
+	}
+	return prefix
+}
+
+// scanOptions returns the options that decide which files the backup scans.
+func (o BackupOptions) scanOptions() scanOptions {
+	return scanOptions{
+		Since:           o.Since,
+		Path:            o.Path,
+		Gitignore:       o.Gitignore,
+		IgnoreFiles:     o.IgnoreFiles,
+		IgnoreDotfiles:  o.IgnoreDotfiles,
+		Exclude:         o.Exclude,
+		Include:         o.Include,
+		Extensions:      o.Extensions,
+		Observer:        o.Observer,
+		QuarantineAfter: o.QuarantineAfter,
+		SkipEmptyFiles:  o.SkipEmptyFiles,
+		Concurrency:     o.ScanConcurrency,
+	}
+}
+
+// scanOptions control how the local tree is compared to the db.
+type scanOptions struct {
+	// See BackupOptions.Since.
+	Since time.Time
+	// See BackupOptions.Path.
+	Path string
+	// See BackupOptions.Gitignore.
+	Gitignore bool
+	// See BackupOptions.IgnoreFiles.
+	IgnoreFiles []string
+	// See BackupOptions.IgnoreDotfiles.
+	IgnoreDotfiles bool
+	// See BackupOptions.Exclude.
+	Exclude []string
+	// See BackupOptions.Include.
+	Include []string
+	// See BackupOptions.Extensions.
+	Extensions []string
+	// See BackupOptions.Observer.
+	Observer Observer
+	// See BackupOptions.QuarantineAfter.
+	QuarantineAfter int
+	// See BackupOptions.SkipEmptyFiles.
+	SkipEmptyFiles bool
+	// See BackupOptions.ScanConcurrency.
+	Concurrency int
+
+	// For a backup with several roots, the top-level directory of the root being scanned. See
+	// roots.go.
+	label string
+
+	// Set by planBackup.
+	ignore      *ignoreMatcher
+	quarantined map[string]*FileFailure
+	// Filled in by the scan, with the modtime of every directory it descends into.
+	dirModTimes map[string]time.Time
+	// Held by each goroutine scanning a subdirectory, to bound how many run at once. See scan.go.
+	slots chan struct{}
 }
 
-// TODO: return errors rather than Fatal-ing
-// TODO: options argument (with validation)
 func BackupFiles(
+	ctx context.Context,
 	logger logging.Logger,
 	cfg *aws.Config,
 	dbFile string,
@@ -39,244 +227,858 @@ func BackupFiles(
 	sizeThreshold int64,
 	options BackupOptions,
 ) error {
-	prefix := filepath.Join(prefixBase, name)
+	_, err := backupFiles(ctx, logger, cfg, dbFile, localRoot, bucket, prefixBase, name, sizeThreshold, options)
+	return err
+}
+
+// backupFiles does the work of BackupFiles, and reports what it did. If the backup fails part-way
+// through, the report describes what was done before the failure.
+func backupFiles(
+	ctx context.Context,
+	logger logging.Logger,
+	cfg *aws.Config,
+	dbFile string,
+	localRoot string,
+	bucket string,
+	prefixBase string,
+	name string,
+	sizeThreshold int64,
+	options BackupOptions,
+) (*Report, error) {
+	// Clean up the root path, since it was user input (e.g. resolve '..' elements).
+	roots := []backupRoot{{Path: filepath.Clean(localRoot)}}
+	return backupRoots(ctx, logger, cfg, dbFile, roots, bucket, prefixBase, name, sizeThreshold, options)
+}
+
+// backupRoots backs up one or more roots, and reports the outcome to the metrics and the audit log.
+func backupRoots(
+	ctx context.Context,
+	logger logging.Logger,
+	cfg *aws.Config,
+	dbFile string,
+	roots []backupRoot,
+	bucket string,
+	prefixBase string,
+	name string,
+	sizeThreshold int64,
+	options BackupOptions,
+) (*Report, error) {
+	if options.Metrics == nil {
+		options.Metrics = noopMetrics{}
+	}
+	start := time.Now()
+	report, err := runBackup(ctx, logger, cfg, dbFile, roots, bucket, prefixBase, name, sizeThreshold, options)
+	options.Metrics.BackupFinished(time.Since(start), err)
+	appendAuditLog(logger, options.AuditLog, newAuditEntry("backup", name, report.auditCounts(), err))
+	return report, err
+}
+
+// runBackup is backupRoots, apart from reporting the outcome.
+func runBackup(
+	ctx context.Context,
+	logger logging.Logger,
+	cfg *aws.Config,
+	dbFile string,
+	roots []backupRoot,
+	bucket string,
+	prefixBase string,
+	name string,
+	sizeThreshold int64,
+	options BackupOptions,
+) (*Report, error) {
+	if err := options.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid options: %v", err)
+	}
+	if err := validateSizeThreshold(sizeThreshold); err != nil {
+		return nil, err
+	}
+	if roots[0].Label != "" && options.Path != "" {
+		return nil, fmt.Errorf("can't back up a subtree of a backup with several roots")
+	}
+	report := &Report{}
+
+	// Make sure no other run is working on the same backup.
+	unlock, err := acquireLock(logger, dbFile)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// A snapshot is written as a separate backup, named by its id, nested under the usual prefix.
+	// Since every snapshot is a full backup it's built from an empty db, which replaces the local db
+	// once the snapshot has been uploaded.
+	snapshotPrefixBase, snapshotName := prefixBase, name
+	snapshotID := ""
+	runDBFile := dbFile
+	if options.Snapshot {
+		snapshotID = newSnapshotID(time.Now())
+		logger.Infof("creating snapshot %s", snapshotID)
+		prefixBase, name = snapshotLocation(prefixBase, name, snapshotID)
+		runDBFile = dbFile + ".snapshot"
+		os.Remove(runDBFile)
+		defer os.Remove(runDBFile)
+	}
+
+	prefix := s3Key(prefixBase, name)
 	logger.Infof("using s3 prefix: s3://%s/%s", bucket, prefix)
 
 	logger.Debugf("size threshold: %d", sizeThreshold)
 
 	// Load the db
-	db, err := NewDB(dbFile)
+	db, err := NewDB(runDBFile)
 	if err != nil {
-		log.Fatalf("error loading db: %v", err)
+		return nil, fmt.Errorf("error loading db: %v", err)
 	}
+	defer db.Close()
 
-	// Create an Amazon S3 service client
-	client := s3.NewFromConfig(*cfg)
+	// Create an Amazon S3 service client, unless the backup is stored elsewhere
+	client, err := withMirror(logger, storageClient(cfg, options.Storage), bucket, options.SecondaryBucket, options.SecondaryPolicy)
+	if err != nil {
+		return nil, err
+	}
+	client, err = withChecksums(client, options.ChecksumAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	client = withNoDelete(logger, client, options.NoDelete)
 
-	// Clean up the root path, since it was user input (e.g. resolve '..' elements).
-	cleanRoot := filepath.Clean(localRoot)
+	logger.Debugf("Bucket: %s", bucket)
+	err = ensureBucket(logger, client, bucket, cfg.Region, options.CreateBucketIfMissing)
+	if err != nil {
+		return nil, err
+	}
+
+	if !options.Snapshot {
+		if err := checkSnapshotMode(client, db, bucket, prefixBase, name); err != nil {
+			return nil, err
+		}
+	}
+
+	// Make sure this is the same backup as the one in storage, before comparing them.
+	err = checkSourceRoots(logger, client, db, bucket, prefixBase, name, roots, options.TempDir)
+	if err != nil && options.Force {
+		logger.Infof("forcing backup despite a different source directory: %v", err)
+	} else if err != nil {
+		return nil, err
+	}
 
 	// Download the backup db from S3 and check if any files have changed since the last time we did a
 	// backup.
-	changes, err := downloadAndCompareDB(logger, client, dbFile, bucket, prefixBase, name)
-	if err != nil {
-		log.Fatalf("error downloading and comparing db: %v", err)
+	var drift []fileDrift
+	if options.SkipRemoteCheck {
+		logger.Infof("skipping the comparison with the remote db")
+	} else {
+		drift, err = downloadAndDiffDB(logger, client, runDBFile, bucket, prefixBase, name, options.TempDir)
+		if err != nil {
+			return nil, fmt.Errorf("error downloading and comparing db: %v", err)
+		}
 	}
-	if len(changes) > 0 {
+	// The remote modtimes of files that changed in storage, if they're being merged. See drift.go.
+	var remoteDrift map[string]time.Time
+	if len(drift) > 0 && options.MergeRemote {
+		logger.Infof("files have changed in storage since the last backup, merging:")
+		printDrift(logger, drift)
+		remoteDrift, err = mergeRemoteDrift(db, drift)
+		if err != nil {
+			return nil, err
+		}
+	} else if len(drift) > 0 {
 		logger.Infof("files have changed in storage since the last backup, aborting:")
-		printChanges(changes)
+		for _, d := range drift {
+			printChanges(d.changes())
+		}
 		if options.Force {
 			logger.Infof("forcing backup despite changes in storage")
 		} else {
-			return fmt.Errorf("files have changed in storage since the last backup")
+			return nil, fmt.Errorf("files have changed in storage since the last backup")
 		}
 	}
 
-	summary := &backupSummary{}
-
-	// Scan through all the files in the directory and arrange them into batches.
-	logger.Verbosef("> Scanning files")
-	batches, err := getFilesToBackup(logger, db, cleanRoot, cleanRoot, sizeThreshold, summary)
-	if err != nil {
-		log.Fatalf("error finding files to backup: %v", err)
+	if err := checkContentAddressed(db, options.ContentAddressed); err != nil {
+		return nil, err
+	}
+	if !options.DryRun {
+		if err := db.setMeta(metaContentAddressed, strconv.FormatBool(options.ContentAddressed)); err != nil {
+			return nil, fmt.Errorf("error recording storage mode: %v", err)
+		}
 	}
-	batchesToDelete, err := getBatchesToDelete(db, batches)
+	if err := checkObfuscateKeys(db, options.ObfuscateKeys); err != nil {
+		return nil, err
+	}
+	if !options.DryRun {
+		if err := db.setMeta(metaObfuscateKeys, strconv.FormatBool(options.ObfuscateKeys)); err != nil {
+			return nil, fmt.Errorf("error recording storage mode: %v", err)
+		}
+	}
+	archiveDir, keyDate, err := checkKeyTemplate(db, prefixBase, name, options.KeyTemplate, time.Now())
 	if err != nil {
-		log.Fatalf("error finding batches to delete: %v", err)
+		return nil, err
 	}
-	logger.Verbosef("< Scanning files")
+	if !options.DryRun {
+		if err := db.setKeyTemplate(options.KeyTemplate, keyDate); err != nil {
+			return nil, fmt.Errorf("error recording key template: %v", err)
+		}
+	}
+	if archiveDir != prefix {
+		logger.Infof("storing archives under s3://%s/%s", bucket, archiveDir)
+	}
+	options.archiveDir = archiveDir
 
-	// Diff the list of files in the db with the list of files in the directory
-	deletedFiles, err := getFilesNotInBatches(db, batches)
+	if err := checkRoots(db, roots); err != nil {
+		return nil, err
+	}
+	if !options.DryRun {
+		if err := db.setRoots(roots); err != nil {
+			return nil, fmt.Errorf("error recording roots: %v", err)
+		}
+		if err := db.setSourceRoot(roots); err != nil {
+			return nil, fmt.Errorf("error recording source directory: %v", err)
+		}
+	}
+
+	// Scan through all the files in the directory and arrange them into batches.
+	plan, err := planBackupRoots(logger, db, roots, sizeThreshold, options.scanOptions())
 	if err != nil {
-		log.Fatalf("error getting files in db: %v", err)
+		return nil, fmt.Errorf("error planning backup: %v", err)
 	}
-	for _, file := range deletedFiles {
-		summary.AddFile(file, backupOpRemove)
+	if err := keepRemoteFiles(logger, db, plan, remoteDrift); err != nil {
+		return nil, err
 	}
+	batches := plan.Batches
+	batchesToDelete := plan.BatchesToDelete
+
 	// Print the summary
-	summary.Print(logger)
+	plan.Summary.Print(logger)
+	report.SnapshotID = snapshotID
+	report.FilesAdded = plan.Summary.FilesAdded
+	report.FilesChanged = plan.Summary.FilesChanged
+	report.FilesRemoved = plan.Summary.FilesRemoved
+	report.FilesQuarantined = plan.Summary.FilesQuarantined
 
 	// Log the batches for debugging
 	logger.Verbosef("> Found files")
 	for _, batch := range batches {
-		logger.Verbosef("batch %s (%d bytes)", batch.Root, batch.Size())
+		logger.Verbosef("batch %s (%d bytes)", displayPath(batch.Root), batch.Size())
 		for _, file := range batch.Files {
-			dirty := ""
-			if file.IsDirty {
-				dirty = "[dirty] "
-			}
-			logger.Verbosef("  %s%s (%d bytes)", dirty, file.Path, file.Size())
+			logger.Verbosef("  %s%s (%d bytes)", file.dirtyMarker(), displayPath(file.Path), file.Size())
 		}
 	}
 	logger.Verbosef(("batches to delete:"))
 	for _, batch := range batchesToDelete {
-		logger.Verbosef("  %s (%b)", batch.Path, batch.IsSingleFile)
+		logger.Verbosef("  %s (%t)", displayPath(batch.Path), batch.IsSingleFile)
 	}
 	logger.Verbosef("< Found files")
+	if options.DryRun {
+		logger.Infof("planned batches:")
+		for _, line := range strings.Split(strings.TrimSuffix(RenderBatchTree(batches), "\n"), "\n") {
+			logger.Infof("  %s", line)
+		}
+	}
 
 	logger.Verbosef("> Backing up files")
 
-	logger.Debugf("Bucket: %s", bucket)
-	// Make sure the bucket exists
-	_, err = client.HeadBucket(context.TODO(), &s3.HeadBucketInput{
-		Bucket: aws.String(bucket),
-	})
-	if err != nil {
-		log.Fatalf("bucket doesn't exist: %v", err)
+	if err := checkBatches(batches); err != nil {
+		return report, fmt.Errorf("invalid backup plan: %v", err)
 	}
-	logger.Debugf("Bucket exists")
 
-	// TODO: check for duplicate batches by path
+	// Cancelling ctx stops the backup between batches, so every batch that was written is also
+	// marked in the db.
+	// Keep track of whether anything in storage changed, since otherwise the db doesn't need to be
+	// uploaded again.
+	changed := false
+
+	// Copy moved files from their old archives before anything is deleted. If a copy fails the file
+	// is simply uploaded instead. Content-addressed backups never store the same contents twice, so
+	// there's nothing to copy.
+	logger.Verbosef(">> Copying moved files")
+	for _, c := range plan.Copies {
+		if ctx.Err() != nil || options.ContentAddressed {
+			break
+		}
+		err = copyBatch(logger, db, client, bucket, prefix, c, options)
+		if err != nil {
+			logger.Infof("%v, uploading instead", err)
+		} else {
+			changed = true
+			report.BatchesCopied++
+		}
+	}
+	logger.Verbosef("<< Copying moved files")
 
 	// Delete any batches in the existing backup that no longer exist. Do this first as a precaution
 	// so we don't accidentally delete files that should still be in the backup.
+	var failures []error
 	logger.Verbosef(">> Clearing unnecessary batches")
 	for _, batch := range batchesToDelete {
-		err = deleteBatch(logger, db, client, cleanRoot, bucket, prefix, batch, options.DryRun)
+		if ctx.Err() != nil {
+			break
+		}
+		err = deleteBatch(logger, db, client, localRootFor(roots, batch.Path), bucket, prefix, batch, options)
 		if err != nil {
-			log.Fatalf("error deleting batch: %+v", err)
+			options.Metrics.Error()
+		}
+		if err != nil && options.ContinueOnError {
+			logger.Infof("error deleting batch %q: %v", batch.Path, err)
+			failures = append(failures, fmt.Errorf("error deleting batch %q: %v", batch.Path, err))
+		} else if err != nil {
+			return report, fmt.Errorf("error deleting batch %q: %v", batch.Path, err)
+		} else {
+			changed = true
+			report.BatchesDeleted++
 		}
 	}
 	logger.Verbosef("<< Clearing unnecessary batches")
 
 	// Backup all batches that have dirty files
 	logger.Verbosef(">> Backing up batches")
-	for _, batch := range batches {
-		err = backupBatch(logger, db, client, cleanRoot, bucket, prefix, batch, options.DryRun)
+	options.ObjectMetadata = objectMetadata(name, options.ObjectMetadata)
+	if options.MaxInFlightBytes > 0 {
+		options.batchLock = &sync.Mutex{}
+	}
+	// Guards the results below, in case batches are backed up concurrently.
+	var mu sync.Mutex
+	batchesDone := 0
+	backupOne := func(batch *BackupBatch) error {
+		written, err := backupBatch(logger, db, client, localRootFor(roots, batch.Root), bucket, prefix, batch, options, plan.Summary)
+		mu.Lock()
+		defer mu.Unlock()
+		if written {
+			changed = true
+			report.BatchesWritten++
+		}
 		if err != nil {
-			log.Fatalf("error backing up batch: %+v", err)
+			options.Metrics.Error()
+		}
+		if err != nil && options.ContinueOnError {
+			logger.Infof("error backing up batch %q: %v", batch.Root, err)
+			failures = append(failures, err)
+		} else if err != nil {
+			return fmt.Errorf("error backing up batch %q: %v", batch.Root, err)
+		}
+		batchesDone++
+		return nil
+	}
+	if options.MaxInFlightBytes > 0 {
+		err = backupConcurrently(ctx, batches, options.MaxInFlightBytes, backupOne)
+	} else {
+		for _, batch := range batches {
+			if ctx.Err() != nil {
+				break
+			}
+			if err = backupOne(batch); err != nil {
+				break
+			}
 		}
 	}
+	if err != nil {
+		return report, err
+	}
 	logger.Verbosef("<< Backing up batches")
 	logger.Verbosef("< Backing up files")
+	plan.Summary.PrintChangedDuringBackup(logger)
+	report.FilesChangedDuringBackup = plan.Summary.FilesChangedDuringBackup
+	report.Compression = plan.Summary.Compression
+
+	if err := ctx.Err(); err != nil {
+		logger.Infof("backup interrupted after %d of %d batches", batchesDone, len(batches))
+		// Upload the db so the remote state matches the batches that were written. An interrupted
+		// snapshot is incomplete, so it's abandoned instead.
+		if !options.DryRun && snapshotID == "" && changed {
+			if err := uploadDB(logger, client, runDBFile, bucket, prefixBase, name, options); err != nil {
+				return report, fmt.Errorf("error backing up db: %v", err)
+			}
+		}
+		return report, fmt.Errorf("backup interrupted after %d of %d batches: %w", batchesDone, len(batches), err)
+	}
 
 	// Back up the DB file to the S3 prefix
 	if !options.DryRun {
-		logger.Verbosef("> Backing up db")
-		err = backupDB(logger, client, dbFile, bucket, prefixBase)
+		dirsChanged, err := db.SetDirModTimes(plan.DirModTimes)
+		if err != nil {
+			return report, fmt.Errorf("error recording directory modtimes: %v", err)
+		}
+		changed = changed || dirsChanged
+		err = db.MarkBackupComplete(time.Now(), sizeThreshold)
+		if err != nil {
+			return report, fmt.Errorf("error recording backup metadata: %v", err)
+		}
+		if snapshotID != "" {
+			if err := db.setMeta(metaSnapshotID, snapshotID); err != nil {
+				return report, fmt.Errorf("error recording snapshot id: %v", err)
+			}
+		}
+		if options.VacuumEvery > 0 {
+			due, err := db.countBackupForVacuum(options.VacuumEvery)
+			if err != nil {
+				return report, fmt.Errorf("error counting backups since the db was vacuumed: %v", err)
+			}
+			if due {
+				logger.Verbosef("vacuuming db")
+				if err := db.Vacuum(); err != nil {
+					return report, fmt.Errorf("error vacuuming db: %v", err)
+				}
+			}
+		}
+
+		// A snapshot always needs its db, and forcing a backup re-uploads it regardless.
+		if changed || snapshotID != "" || options.Force {
+			logger.Verbosef("> Backing up db")
+			err = uploadDB(logger, client, runDBFile, bucket, prefixBase, name, options)
+			if err != nil {
+				return report, fmt.Errorf("error backing up db: %v", err)
+			}
+			logger.Verbosef("< Backing up db")
+		} else {
+			logger.Verbosef("nothing changed in storage, not uploading db")
+		}
+
+		if snapshotID != "" {
+			// Only point at the new snapshot once it's complete.
+			err = setLatestSnapshot(client, bucket, snapshotPrefixBase, snapshotName, snapshotID)
+			if err != nil {
+				return report, fmt.Errorf("error updating latest snapshot: %v", err)
+			}
+			db.Close()
+			if err := os.Rename(runDBFile, dbFile); err != nil {
+				return report, fmt.Errorf("error replacing local db with snapshot db: %v", err)
+			}
+			logger.Infof("created snapshot %s", snapshotID)
+		}
+	}
+
+	if len(failures) > 0 {
+		logger.Infof("%d error(s) during backup:", len(failures))
+		for _, failure := range failures {
+			logger.Infof("  %v", failure)
+		}
+		return report, fmt.Errorf("%d error(s) during backup: %w", len(failures), errors.Join(failures...))
+	}
+
+	return report, nil
+}
+
+// uploadDB replaces the remote db with the local one, keeping the previous version if requested.
+// Snapshots get a new db every time, so there's nothing to keep for them.
+func uploadDB(
+	logger logging.Logger,
+	client s3_helpers.Client,
+	dbFile string,
+	bucket string,
+	prefixBase string,
+	name string,
+	options BackupOptions,
+) error {
+	if options.KeepDBVersions > 0 && !options.Snapshot {
+		if err := keepDBVersion(logger, client, bucket, prefixBase, name, options.KeepDBVersions); err != nil {
+			return fmt.Errorf("error keeping previous db version: %v", err)
+		}
+	}
+	return backupDB(logger, client, dbFile, bucket, prefixBase, name)
+}
+
+// planBackup scans the local tree and works out which batches need to be written and which
+// batches and files have disappeared since the last backup. It doesn't touch remote storage.
+func planBackup(
+	logger logging.Logger,
+	db *DB,
+	root string,
+	sizeThreshold int64,
+	scan scanOptions,
+) (*backupPlan, error) {
+	summary := &backupSummary{}
+
+	// Load the whole db up front, rather than querying it for every file we scan.
+	filesByPath, err := db.GetAllFilesByPath()
+	if err != nil {
+		return nil, fmt.Errorf("error loading files from db: %v", err)
+	}
+	fileInfos := fileInfoCache(filesByPath)
+
+	scope := "."
+	if scan.Path != "" {
+		scope, err = subtreeScope(root, scan.Path, fileInfos)
+		if err != nil {
+			return nil, fmt.Errorf("error finding subtree to back up: %v", err)
+		}
+		logger.Infof("backing up subtree %q", scope)
+	}
+
+	scan.ignore, err = newIgnoreMatcher(root, scan)
+	if err != nil {
+		return nil, err
+	}
+	scan.quarantined, err = quarantinedFiles(db, scan.QuarantineAfter)
+	if err != nil {
+		return nil, err
+	}
+	scan.dirModTimes = make(map[string]time.Time)
+	concurrency := scan.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultScanConcurrency
+	}
+	// This goroutine does its share of the scanning, so it takes up one of the slots.
+	scan.slots = make(chan struct{}, concurrency-1)
+
+	logger.Verbosef("> Scanning files")
+	batches, err := getFilesToBackup(logger, fileInfos, root, filepath.Join(root, scope), sizeThreshold, scan, summary)
+	if err != nil {
+		return nil, fmt.Errorf("error finding files to backup: %v", err)
+	}
+	// Batches come out grouped by how they were rolled up, so put them in path order to keep the logs
+	// and the order of uploads the same from run to run.
+	sort.Slice(batches, func(i, j int) bool {
+		return batches[i].Root < batches[j].Root
+	})
+	allBatchesToDelete, err := getBatchesToDelete(db, batches)
+	if err != nil {
+		return nil, fmt.Errorf("error finding batches to delete: %v", err)
+	}
+	// Anything outside of the scanned subtree wasn't seen, so it can't have been deleted.
+	var batchesToDelete []BatchMeta
+	for _, batch := range allBatchesToDelete {
+		if inScope(batch.Path, scope) {
+			batchesToDelete = append(batchesToDelete, batch)
+		}
+	}
+	logger.Verbosef("< Scanning files")
+
+	// Diff the list of files in the db with the list of files in the directory
+	deletedFiles, err := getFilesNotInBatches(db, batches)
+	if err != nil {
+		return nil, fmt.Errorf("error getting files in db: %v", err)
+	}
+	for _, file := range deletedFiles {
+		if inScope(file, scope) {
+			summary.AddFile(file, backupOpRemove, backupReasonNone)
+		}
+	}
+
+	copies, err := findBatchCopies(logger, root, batches, fileInfos)
+	if err != nil {
+		return nil, fmt.Errorf("error looking for moved files: %v", err)
+	}
+
+	return &backupPlan{
+		Batches:         batches,
+		BatchesToDelete: batchesToDelete,
+		Summary:         summary,
+		FileInfos:       fileInfos,
+		Copies:          copies,
+		DirModTimes:     scan.dirModTimes,
+	}, nil
+}
+
+type backupPlan struct {
+	// All batches in the local tree, dirty or not.
+	Batches []*BackupBatch
+	// Batches present in the db that no longer exist in the local tree.
+	BatchesToDelete []BatchMeta
+	Summary         *backupSummary
+	// The state of the db when the plan was made.
+	FileInfos fileInfoCache
+	// New batches that can be copied from existing archives instead of uploaded.
+	Copies []*batchCopy
+	// The modtimes of the directories that were scanned, by path. See dirs.go.
+	DirModTimes map[string]time.Time
+}
+
+// batchNeedsBackup returns true if any file in the batch is dirty, or if any file has moved into
+// this batch from a different one.
+func batchNeedsBackup(logger logging.Logger, db fileInfoLookup, batch *BackupBatch) (bool, error) {
+	for _, file := range batch.Files {
+		if file.IsDirty {
+			return true, nil
+		}
+		// Check if this file has moved to a different batch (potentially due to other files changing
+		// the batching structure). In this case even if the file is unchanged, we want to update it,
+		// so our backup structure is fully up to date.
+		changed, err := fileHasChangedBatch(db, file.Path, batch.Root)
 		if err != nil {
-			log.Fatalf("error backing up db: %+v", err)
+			return false, fmt.Errorf("failed to check if file has changed batch %q: %v", file.Path, err)
+		}
+		if changed {
+			logger.Debugf("file %q has changed batches", file.Path)
+			return true, nil
 		}
-		logger.Verbosef("< Backing up db")
 	}
+	return false, nil
+}
 
+// checkBatches makes sure that no two batches claim the same root or file, or would be stored in the
+// same archive, since one batch's upload would then clobber the other's. A file whose name happens to
+// match a grouped batch's archive, like a big file named "_files" next to smaller ones, would.
+func checkBatches(batches []*BackupBatch) error {
+	roots := make(map[string]struct{})
+	archives := make(map[string]string)
+	files := make(map[string]string)
+	for _, batch := range batches {
+		if len(batch.Files) == 0 {
+			continue
+		}
+		if _, ok := roots[batch.Root]; ok {
+			return fmt.Errorf("more than one batch has root %q", batch.Root)
+		}
+		roots[batch.Root] = struct{}{}
+		name := batchArchiveName(batch.meta())
+		if other, ok := archives[name]; ok {
+			return fmt.Errorf("batches %q and %q would both be stored in archive %q", other, batch.Root, name)
+		}
+		archives[name] = batch.Root
+		for _, file := range batch.Files {
+			if other, ok := files[file.Path]; ok {
+				return fmt.Errorf("file %q is in both batch %q and batch %q", file.Path, other, batch.Root)
+			}
+			files[file.Path] = batch.Root
+		}
+	}
 	return nil
 }
 
+// backupBatch uploads the batch if any of its files need backing up, and records them in the db. It
+// returns true if the batch was written.
 func backupBatch(
 	logger logging.Logger,
 	db *DB,
-	client *s3.Client,
+	client s3_helpers.Client,
 	root string,
 	bucket string,
 	prefix string,
 	batch *BackupBatch,
-	dryRun bool,
-) error {
+	options BackupOptions,
+	summary *backupSummary,
+) (written bool, err error) {
 	if len(batch.Files) == 0 {
-		return nil
+		return false, nil
 	}
+	// Only the upload itself runs alongside other batches, everything else uses the db or summary.
+	unlock := options.lockBatch()
+	defer func() { unlock() }()
 
-	anyDirty := false
-	for _, file := range batch.Files {
-		if file.IsDirty {
-			anyDirty = true
-		} else {
-			// Check if this file has moved to a different batch (potentially due to other files changing
-			// the batching structure). In this case even if the file is unchanged, we want to update it,
-			// so our backup structure is fully up to date.
-			changed, err := fileHasChangedBatch(db, root, file.Path, batch.Root)
-			if err != nil {
-				return fmt.Errorf("failed to check if file has changed batch %q: %v", file.Path, err)
-			}
-			if changed {
-				logger.Debugf("file %q has changed batches", file.Path)
-				anyDirty = true
-			}
-		}
+	anyDirty, err := batchNeedsBackup(logger, db, batch)
+	if err != nil {
+		return false, err
+	}
+	// The archive still has any files that were deleted from the batch, so it has to be replaced.
+	removed, err := filesRemovedFromBatch(db, batch, summary)
+	if err != nil {
+		return false, err
+	}
+	if len(removed) > 0 {
+		logger.Debugf("files were removed from batch %q: %q", batch.Root, removed)
+		anyDirty = true
 	}
 	if !anyDirty {
 		logger.Verbosef("no dirty files in batch, skipping: %q", batch.Root)
-		return nil
+		return false, nil
 	}
 
-	if dryRun {
+	if options.DryRun {
 		logger.Infof("dry run, would have backed up batch %q, files:", batch.Root)
 		for _, file := range batch.Files {
-			logger.Infof("  %s", file.Path)
+			logger.Infof("  %s", displayPath(file.Path))
 		}
-		return nil
+		return false, nil
+	}
+
+	observer := observerOrNoop(options.Observer)
+	event := BatchEvent{Root: batch.Root, Bytes: batch.Size()}
+	for _, file := range batch.Files {
+		event.Files = append(event.Files, file.Path)
+	}
+	observer.BatchStarted(event)
+	defer func() { observer.BatchFinished(event, err) }()
+	modTimes := make(map[string]time.Time)
+	for _, file := range batch.Files {
+		modTimes[file.Path] = file.ModTime
+	}
+	defer func() {
+		var fe *fileError
+		if errors.As(err, &fe) {
+			if _, recordErr := db.RecordFailure(fe.Path, modTimes[fe.Path], fe.Err); recordErr != nil {
+				logger.Infof("error recording failure of file %q: %v", fe.Path, recordErr)
+			}
+		}
+	}()
+
+	archiveOpts := archiveOptions{
+		SkipUnreadable:       options.ContinueOnError,
+		ObfuscateKeys:        options.ObfuscateKeys,
+		PreserveHardlinks:    options.PreserveHardlinks,
+		Metadata:             options.ObjectMetadata,
+		NoCompressExtensions: options.NoCompressExtensions,
+		MaxBufferBytes:       options.MaxBufferBytes,
+		TempDir:              options.TempDir,
+		SecondaryBucket:      options.SecondaryBucket,
+		PartSize:             options.PartSize,
+		PartConcurrency:      options.PartConcurrency,
+	}
+	unlock()
+	uploaded, err := uploadBatch(logger, client, root, bucket, prefix, batch, archiveOpts, options)
+	unlock = options.lockBatch()
+	if err != nil {
+		return false, err
+	}
+	if uploaded.Size > 0 && options.Metrics != nil {
+		options.Metrics.ArchiveUploaded(uploaded.Size)
+	}
+	if stats := uploaded.Compression; stats.Uncompressed > 0 {
+		logger.Verbosef("compressed batch %q from %d to %d bytes (ratio %.2f)", batch.Root, stats.Uncompressed, stats.Compressed, stats.Ratio())
+		summary.AddCompression(batch.Root, stats)
+	}
+
+	// Mark the files with the modtime and hash of what actually went into the archive, rather than
+	// what's on disk now, so that a file modified during the backup gets picked up next time.
+	marks := batchMarks{
+		Batch:      batch.Root,
+		Checksum:   uploaded.Checksum,
+		SingleFile: len(batch.Files) == 1,
+		Chunks:     uploaded.Chunks,
+		Removed:    removed,
+	}
+	var skipped []*BackupFile
+	for _, file := range batch.Files {
+		af := uploaded.Files[file.Path]
+		if af.Err != nil {
+			marks.Forgotten = append(marks.Forgotten, file.Path)
+			skipped = append(skipped, file)
+			continue
+		}
+		// TODO: only mark files if they were dirty?
+		marks.Files = append(marks.Files, &FileInfo{
+			Path:    file.Path,
+			ModTime: af.ModTime,
+			Hash:    af.Hash,
+			Batch:   batch.Root,
+		})
+		if af.Changed || !modTimesEqual(af.ModTime, file.ModTime) {
+			logger.Infof("file %q changed during the backup", file.Path)
+			summary.AddChangedDuringBackup(file.Path)
+		}
+	}
+	if err := db.MarkBatch(marks); err != nil {
+		return false, fmt.Errorf("error marking files in batch %q as processed: %v", batch.Root, err)
 	}
 
+	var skippedErrs []error
+	for _, file := range skipped {
+		af := uploaded.Files[file.Path]
+		skippedErrs = append(skippedErrs, fmt.Errorf("failed to back up file %q: %v", file.Path, af.Err))
+		if _, err := db.RecordFailure(file.Path, file.ModTime, af.Err); err != nil {
+			return false, fmt.Errorf("error recording failure of file %q: %v", file.Path, err)
+		}
+		observer.FileSkipped(FileSkippedEvent{Path: file.Path, Reason: SkipUnreadable, Err: af.Err})
+	}
+	return true, errors.Join(skippedErrs...)
+}
+
+// uploadBatch writes the batch's archive, or its single file as chunks or a blob, to storage. It
+// doesn't use the db, so it can run alongside other batches.
+func uploadBatch(
+	logger logging.Logger,
+	client s3_helpers.Client,
+	root string,
+	bucket string,
+	prefix string,
+	batch *BackupBatch,
+	archiveOpts archiveOptions,
+	options BackupOptions,
+) (*uploadedArchive, error) {
 	if len(batch.Files) > 1 {
 		var files []string
 		for _, file := range batch.Files {
 			files = append(files, file.Path)
 		}
-		logger.Verbosef("Backing up file batch: %s, dirty files: %v", batch.Root, files)
+		logger.Verbosef("Backing up file batch: %q, dirty files: %q", batch.Root, files)
 
-		err := backupDirectory(logger, client, bucket, prefix, root, batch.Root, files)
+		uploaded, err := backupDirectory(logger, client, bucket, options.archiveDirFor(prefix), root, batch.Root, files, archiveOpts)
 		if err != nil {
-			return fmt.Errorf("failed to backup batch %q: %+v", batch.Root, err)
-		}
-		for _, f := range files {
-			// TODO: only mark files if they were dirty?
-			markFile(db, root, f, batch.Root)
+			return nil, fmt.Errorf("failed to backup batch %q: %w", batch.Root, err)
 		}
+		return uploaded, nil
+	}
+
+	// Root == file path signifies that this file was not in a batch and was backed up individually
+	logger.Verbosef("Backing up file: %q", batch.Root)
+	filePath := batch.Files[0].Path
+	var uploaded *uploadedArchive
+	var err error
+	if options.ChunkThreshold > 0 && batch.Files[0].FileSize >= options.ChunkThreshold {
+		uploaded, err = backupChunkedFile(logger, client, bucket, prefix, root, filePath, options.ObjectMetadata, compressionLevel(filePath, options.NoCompressExtensions))
+	} else if options.ContentAddressed {
+		uploaded, err = backupBlob(logger, client, bucket, prefix, root, filePath, options.ObjectMetadata, compressionLevel(filePath, options.NoCompressExtensions))
 	} else {
-		logger.Verbosef("Backing up file: %s", batch.Root)
-		filePath := batch.Files[0].Path
-		err := backupFile(logger, client, bucket, prefix, root, filePath)
-		if err != nil {
-			return fmt.Errorf("failed to backup file %q: %+v", filePath, err)
-		}
-		// Root == file path signifies that this file was not in a batch and was backed up individually
-		err = markFile(db, root, filePath, filePath)
-		if err != nil {
-			log.Fatalf("error marking file as processed: %v", err)
+		uploaded, err = backupFile(logger, client, bucket, options.archiveDirFor(prefix), root, filePath, archiveOpts)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to backup file %q: %w", filePath, err)
+	}
+	return uploaded, nil
+}
+
+// filesRemovedFromBatch returns the files that the db has in the batch, but that the scan found had
+// been deleted. Files that have only moved to another batch are left for that batch to update.
+func filesRemovedFromBatch(db *DB, batch *BackupBatch, summary *backupSummary) ([]string, error) {
+	if summary == nil || len(summary.FilesRemoved) == 0 {
+		return nil, nil
+	}
+	files, err := db.GetFilesInBatch(batch.Root)
+	if err != nil {
+		return nil, fmt.Errorf("error getting files in batch %q: %v", batch.Root, err)
+	}
+	deleted := make(map[string]struct{})
+	for _, path := range summary.FilesRemoved {
+		deleted[path] = struct{}{}
+	}
+	var removed []string
+	for _, path := range files {
+		if _, ok := deleted[path]; ok {
+			removed = append(removed, path)
 		}
 	}
-	return nil
+	return removed, nil
 }
 
 func deleteBatch(
 	logger logging.Logger,
 	db *DB,
-	client *s3.Client,
+	client s3_helpers.Client,
 	root string,
 	bucket string,
 	prefix string,
 	batch BatchMeta,
-	dryRun bool,
+	options BackupOptions,
 ) error {
-	keyPath := filepath.Join(prefix, batch.Path)
-	if batch.IsSingleFile {
-		keyPath = keyPath + ".tar.gz"
-	} else {
-		// If it's a directory, delete the archive
-		keyPath = filepath.Join(keyPath, "_files.tar.gz")
+	keyPath := batchKey(options.archiveDirFor(prefix), batch, options.ObfuscateKeys)
+	// Blobs may be shared with other files, so they're left for GC.
+	keepObject := options.ContentAddressed && batch.IsSingleFile
+	if options.NoDelete && !keepObject {
+		logger.Infof("deletes are disabled, leaving S3 file %q for gc", keyPath)
+		keepObject = true
 	}
 
-	if dryRun {
-		logger.Infof("dry run, would have deleted S3 file %q", keyPath)
+	if options.DryRun {
+		if !keepObject {
+			logger.Infof("dry run, would have deleted S3 file %q", keyPath)
+		}
 		return nil
 	}
 
-	logger.Debugf("deleting S3 file %q", keyPath)
+	if !keepObject {
+		logger.Debugf("deleting S3 file %q", keyPath)
 
-	_, err := client.DeleteObjects(context.TODO(), &s3.DeleteObjectsInput{
-		Bucket: aws.String(bucket),
-		Delete: &types.Delete{
-			Objects: []types.ObjectIdentifier{
-				{
-					Key: aws.String(keyPath),
+		_, err := client.DeleteObjects(context.TODO(), &s3.DeleteObjectsInput{
+			Bucket: aws.String(bucket),
+			Delete: &types.Delete{
+				Objects: []types.ObjectIdentifier{
+					{
+						Key: aws.String(keyPath),
+					},
 				},
 			},
-		},
-	})
-	if err != nil {
-		return err
+		})
+		if err != nil {
+			return err
+		}
 	}
 
 	logger.Debugf("deleting batch from db: %q", batch.Path)
@@ -285,7 +1087,7 @@ func deleteBatch(
 		return fmt.Errorf("error getting files in batch: %v", err)
 	}
 	for _, file := range files {
-		logger.Debugf("  %s", file)
+		logger.Debugf("  %s", displayPath(file))
 	}
 
 	// Delete the batch from the db
@@ -297,22 +1099,13 @@ func deleteBatch(
 	return nil
 }
 
-func markFile(db *DB, localRoot string, path string, batch string) error {
-	absolutePath := filepath.Join(localRoot, path)
-	info, err := os.Stat(absolutePath)
-	if err != nil {
-		return util.ErrorOrPanic("error stat-ing file: %v", err)
-	}
-	hash, err := getFileHash(absolutePath)
-	if err != nil {
-		return util.ErrorOrPanic("error hashing file: %v", err)
-	}
-
-	return db.MarkFile(path, info.ModTime(), hash, batch)
+// batchKey returns the S3 key of the archive holding the given batch.
+func batchKey(prefix string, batch BatchMeta, obfuscate bool) string {
+	return archiveKey(prefix, batchArchiveName(batch), obfuscate)
 }
 
 func getFileHash(path string) (string, error) {
-	f, err := os.Open(path)
+	f, err := openRegularFile(path)
 	if err != nil {
 		return "", err
 	}
@@ -326,9 +1119,9 @@ func getFileHash(path string) (string, error) {
 	return fmt.Sprintf("%x", h.Sum(nil)), nil
 }
 
-func fileHasChangedBatch(db *DB, root string, path string, batch string) (bool, error) {
-	absolutePath := filepath.Join(root, path)
-	fi, err := db.GetFileInfo(absolutePath)
+// The path should be relative to the backup root, since that's how files are keyed in the db.
+func fileHasChangedBatch(db fileInfoLookup, path string, batch string) (bool, error) {
+	fi, err := db.GetFileInfo(path)
 	if err != nil && err != sql.ErrNoRows {
 		return false, err
 	}
@@ -342,8 +1135,20 @@ func fileHasChangedBatch(db *DB, root string, path string, batch string) (bool,
 	return batch != fi.Batch, nil
 }
 
-func doesFileNeedBackup(db *DB, path string, info fs.FileInfo) (bool, backupOp, backupReason, error) {
-	fi, err := db.GetFileInfo(path)
+// Modtimes up to this far in the future are put down to small differences between clocks, e.g. on
+// a network filesystem. Beyond that, the clock that set the modtime is assumed to be wrong.
+const futureModTimeTolerance = 5 * time.Minute
+
+// isFutureModTime reports whether the modtime is too far in the future to be trusted.
+func isFutureModTime(modTime time.Time, now time.Time) bool {
+	return modTime.After(now.Add(futureModTimeTolerance))
+}
+
+// The relative path is used to look up the file in the db, and the absolute path is used to read
+// the file's contents. Files already in the db that haven't been modified since `since` are assumed
+// to be clean. Files with a modtime in the future are compared by hash only.
+func doesFileNeedBackup(db fileInfoLookup, relPath string, path string, info fs.FileInfo, since time.Time) (bool, backupOp, backupReason, error) {
+	fi, err := db.GetFileInfo(relPath)
 	if err != nil && err != sql.ErrNoRows {
 		return false, backupOpNone, backupReasonNone, err
 	}
@@ -352,8 +1157,11 @@ func doesFileNeedBackup(db *DB, path string, info fs.FileInfo) (bool, backupOp,
 		return true, backupOpAdd, backupReasonNew, nil
 	}
 
-	// As far as I can tell, modtimes are only guaranteed to be equal to the second.
-	modTimeChanged := !info.ModTime().Truncate(time.Second).Equal(fi.ModTime.Truncate(time.Second))
+	if !since.IsZero() && info.ModTime().Before(since) {
+		return false, backupOpNone, backupReasonNone, nil
+	}
+
+	modTimeChanged := !modTimesEqual(info.ModTime(), fi.ModTime)
 
 	hash, err := getFileHash(path)
 	if err != nil {
@@ -361,6 +1169,12 @@ func doesFileNeedBackup(db *DB, path string, info fs.FileInfo) (bool, backupOp,
 	}
 	hashChanged := hash != fi.Hash
 
+	// A modtime in the future was set by a wrong clock, so it can keep changing without the file
+	// changing, e.g. if the clock is reset every time the file is written.
+	if modTimeChanged && isFutureModTime(info.ModTime(), time.Now()) {
+		modTimeChanged = false
+	}
+
 	// Only hold off updating the file if:
 	//   - Its mod time is the same
 	//   - Its hash is the same
@@ -391,6 +1205,12 @@ type BackupRequest struct {
 	SubFilesToBackup []string
 }
 
+// isSpecialFile reports whether the file is something other than a regular file, a directory or a
+// symlink.
+func isSpecialFile(mode fs.FileMode) bool {
+	return mode&(fs.ModeNamedPipe|fs.ModeSocket|fs.ModeDevice|fs.ModeCharDevice|fs.ModeIrregular) != 0
+}
+
 func doBackupFile(path string) bool {
 	filename := filepath.Base(path)
 
@@ -403,8 +1223,23 @@ func doBackupFile(path string) bool {
 
 type BackupFile struct {
 	FileSize int64
-	Path     string
-	IsDirty  bool
+	// The file's modtime as of the scan.
+	ModTime time.Time
+	Path    string
+	IsDirty bool
+	// Why the file is dirty.
+	reason backupReason
+}
+
+// dirtyMarker returns a prefix marking the file as dirty, and why, for listing it in the plan.
+func (b *BackupFile) dirtyMarker() string {
+	if !b.IsDirty {
+		return ""
+	}
+	if b.reason == backupReasonNone {
+		return "[dirty] "
+	}
+	return fmt.Sprintf("[dirty: %s] ", b.reason)
 }
 
 func (b *BackupFile) Size() int64 {
@@ -419,6 +1254,12 @@ type BackupBatch struct {
 	Files     []*BackupFile
 }
 
+// meta describes the batch the way the db does once it's backed up. A batch of one file is stored on
+// its own, and anything bigger is grouped.
+func (b *BackupBatch) meta() BatchMeta {
+	return BatchMeta{Path: b.Root, IsSingleFile: len(b.Files) == 1}
+}
+
 func (b *BackupBatch) Size() int64 {
 	return b.TotalSize
 }
@@ -441,10 +1282,11 @@ func sumSizes[T WithSize](arr []T) int64 {
 // then repeat until we are below the max.
 func getFilesToBackup(
 	logger logging.Logger,
-	db *DB,
+	db fileInfoLookup,
 	root string,
 	searchPath string,
 	sizeThreshold int64,
+	scan scanOptions,
 	summary *backupSummary,
 ) ([]*BackupBatch, error) {
 	// Get files in directory
@@ -453,15 +1295,62 @@ func getFilesToBackup(
 		return nil, fmt.Errorf("error scanning directory: %v", err)
 	}
 
+	// Decide which entries are ignored, and start scanning the subdirectories that aren't, so they
+	// can be scanned alongside this one. Everything they find is merged in below, in the same order
+	// as if they'd been scanned one at a time.
+	relPaths := make([]string, len(files))
+	ignored := make([]bool, len(files))
+	subdirs := make([]*subdirScan, len(files))
+	defer func() {
+		// Don't leave any scans running if this one fails.
+		for _, subdir := range subdirs {
+			if subdir != nil {
+				<-subdir.done
+			}
+		}
+	}()
+	for i, file := range files {
+		path := filepath.Join(searchPath, file.Name())
+		// Use relative paths for the files in the batch.
+		relPaths[i], err = filepath.Rel(root, path)
+		if err != nil {
+			return nil, err
+		}
+		if scan.ignore != nil {
+			ignored[i], err = scan.ignore.IsIgnored(relPaths[i], file.IsDir())
+			if err != nil {
+				return nil, err
+			}
+		}
+		if file.IsDir() && !ignored[i] {
+			subdirs[i] = startSubdirScan(logger, db, root, path, sizeThreshold, scan)
+		}
+	}
+
 	var dirFiles []*BackupFile
 	var maybeRollupBatches []*BackupBatch
 	var otherBatches []*BackupBatch
-	for _, file := range files {
+	for i, file := range files {
 		path := filepath.Join(searchPath, file.Name())
 		logger.Verbosef("scanning path %q", path)
+		relPath := relPaths[i]
+
+		if ignored[i] {
+			logger.Verbosef("  ignoring %q", path)
+			summary.AddIgnored(relPath, file.IsDir())
+			observerOrNoop(scan.Observer).FileSkipped(FileSkippedEvent{Path: relPath, IsDir: file.IsDir(), Reason: SkipIgnored})
+			continue
+		}
 
 		if file.IsDir() {
-			subBatches, err := getFilesToBackup(logger, db, root, path, sizeThreshold, summary)
+			if scan.dirModTimes != nil {
+				info, err := file.Info()
+				if err != nil {
+					return nil, err
+				}
+				scan.dirModTimes[relPath] = info.ModTime()
+			}
+			subBatches, err := subdirs[i].merge(scan, summary)
 			if err != nil {
 				return nil, err
 			}
@@ -474,24 +1363,51 @@ func getFilesToBackup(
 			if !doBackupFile(path) {
 				continue
 			}
+			if !hasExtension(path, scan.Extensions) {
+				logger.Verbosef("  skipping %q, which doesn't have an allowed extension", path)
+				summary.AddSkipped(relPath)
+				observerOrNoop(scan.Observer).FileSkipped(FileSkippedEvent{Path: relPath, Reason: SkipExtension})
+				continue
+			}
 			info, err := file.Info()
 			if err != nil {
-				log.Fatal(err)
+				return nil, err
 			}
-			isDirty, op, reason, err := doesFileNeedBackup(db, path, info)
-			if err != nil {
-				log.Fatal(err)
+			// Reading a FIFO blocks until something writes to it, and sockets and devices can't be
+			// read like files at all.
+			if isSpecialFile(info.Mode()) {
+				logger.Infof("skipping special file %q (%s)", path, info.Mode().Type())
+				summary.AddSpecial(relPath)
+				observerOrNoop(scan.Observer).FileSkipped(FileSkippedEvent{Path: relPath, Reason: SkipSpecial})
+				continue
+			}
+			if scan.SkipEmptyFiles && info.Size() == 0 {
+				logger.Verbosef("  skipping empty file %q", path)
+				summary.AddEmpty(relPath)
+				observerOrNoop(scan.Observer).FileSkipped(FileSkippedEvent{Path: relPath, Reason: SkipEmpty})
+				continue
 			}
-			// Use relative paths for the files in the batch.
-			relPath, err := filepath.Rel(root, path)
+			if isQuarantined(scan.quarantined, relPath, info.ModTime()) {
+				logger.Verbosef("  skipping quarantined file %q", path)
+				summary.AddQuarantined(relPath)
+				observerOrNoop(scan.Observer).FileSkipped(FileSkippedEvent{Path: relPath, Reason: SkipQuarantined})
+				continue
+			}
+			if isFutureModTime(info.ModTime(), time.Now()) {
+				logger.Infof("warning: file %q has a modtime in the future (%v), comparing it by hash only", path, info.ModTime())
+				summary.AddFutureModTime(relPath)
+			}
+			isDirty, op, reason, err := doesFileNeedBackup(db, relPath, path, info, scan.Since)
 			if err != nil {
-				log.Fatal(err)
+				return nil, err
 			}
-			summary.AddFile(path, op)
+			summary.AddFile(relPath, op, reason)
 			dirFiles = append(dirFiles, &BackupFile{
 				Path:     relPath,
 				FileSize: info.Size(),
+				ModTime:  info.ModTime(),
 				IsDirty:  isDirty,
+				reason:   reason,
 			})
 			logger.Verbosef("  found file %q (dirty op: %d, reason: %d)", path, op, reason)
 		}
@@ -627,6 +1543,9 @@ func getBatchesToDelete(db *DB, batches []*BackupBatch) ([]BatchMeta, error) {
 	for _, b := range existingBatchSet {
 		batchesToDelete = append(batchesToDelete, b)
 	}
+	sort.Slice(batchesToDelete, func(i, j int) bool {
+		return batchesToDelete[i].Path < batchesToDelete[j].Path
+	})
 
 	return batchesToDelete, nil
 }
@@ -0,0 +1,1104 @@
+package backup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+
+	"local/backup/lib/logging"
+	"local/backup/lib/s3_helpers"
+	"local/backup/lib/util"
+)
+
+func TestBackupBatch_FileChangedDuringBackup(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "b.txt"), 9))
+	must(createTestFile(filepath.Join(testBaseDir, "c.txt"), 25))
+	config.SizeThreshold = 1000
+
+	cfg := GetMinioConfig(minioUrl)
+	client := s3.NewFromConfig(*cfg)
+	db, err := NewDB(config.DBFile)
+	must(err)
+	defer db.Close()
+
+	plan, err := planBackup(logger, db, testBaseDir, config.SizeThreshold, scanOptions{})
+	must(err)
+
+	// Modify a file after it was scanned but before it gets uploaded.
+	changedFile := filepath.Join(testBaseDir, "b.txt")
+	must(createTestFile(changedFile, 12))
+	modTime := time.Now().Add(time.Minute)
+	must(os.Chtimes(changedFile, modTime, modTime))
+
+	for _, batch := range plan.Batches {
+		_, err := backupBatch(logger, db, client, testBaseDir, config.Bucket, config.FullS3Prefix, batch, BackupOptions{}, plan.Summary)
+		must(err)
+	}
+
+	assert.Equal(t, []string{"b.txt"}, plan.Summary.FilesChangedDuringBackup)
+
+	// The db should describe the version of the file that was actually uploaded.
+	fi, err := db.GetFileInfo("b.txt")
+	must(err)
+	hash, err := getFileHash(changedFile)
+	must(err)
+	assert.Equal(t, hash, fi.Hash)
+	assert.True(t, modTimesEqual(modTime, fi.ModTime))
+}
+
+func TestDoesFileNeedBackup_CacheMatchesDB(t *testing.T) {
+	testBaseDir, err := os.MkdirTemp("/tmp", "dave-backup-test-")
+	must(err)
+	defer os.RemoveAll(testBaseDir)
+	db := newTestDB(t)
+
+	for _, name := range []string{"unchanged.txt", "new.txt", "hash.txt", "modtime.txt"} {
+		must(createTestFile(filepath.Join(testBaseDir, name), 10))
+	}
+	markCurrent := func(name string) {
+		path := filepath.Join(testBaseDir, name)
+		info, err := os.Stat(path)
+		must(err)
+		hash, err := getFileHash(path)
+		must(err)
+		must(db.MarkFile(name, info.ModTime(), hash, name))
+	}
+	markCurrent("unchanged.txt")
+	markCurrent("hash.txt")
+	markCurrent("modtime.txt")
+	// Change the contents of one file (keeping the modtime) and the modtime of another.
+	hashPath := filepath.Join(testBaseDir, "hash.txt")
+	info, err := os.Stat(hashPath)
+	must(err)
+	must(createTestFile(hashPath, 11))
+	must(os.Chtimes(hashPath, info.ModTime(), info.ModTime()))
+	modTime := time.Now().Add(-time.Hour)
+	must(os.Chtimes(filepath.Join(testBaseDir, "modtime.txt"), modTime, modTime))
+
+	filesByPath, err := db.GetAllFilesByPath()
+	must(err)
+	cache := fileInfoCache(filesByPath)
+
+	type decision struct {
+		IsDirty bool
+		Op      backupOp
+		Reason  backupReason
+	}
+	expected := map[string]decision{
+		"unchanged.txt": {false, backupOpNone, backupReasonNone},
+		"new.txt":       {true, backupOpAdd, backupReasonNew},
+		"hash.txt":      {true, backupOpChange, backupReasonHash},
+		"modtime.txt":   {true, backupOpChange, backupReasonModtime},
+	}
+	for name, want := range expected {
+		path := filepath.Join(testBaseDir, name)
+		info, err := os.Stat(path)
+		must(err)
+		for _, lookup := range []fileInfoLookup{db, cache} {
+			isDirty, op, reason, err := doesFileNeedBackup(lookup, name, path, info, time.Time{})
+			must(err)
+			assert.Equal(t, want, decision{isDirty, op, reason}, "%s (%T)", name, lookup)
+		}
+	}
+}
+
+func TestPlanBackup_FutureModTime(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	testBaseDir, err := os.MkdirTemp("/tmp", "dave-backup-test-")
+	must(err)
+	defer os.RemoveAll(testBaseDir)
+	db := newTestDB(t)
+
+	// Both files were backed up with a modtime in the future, which has since moved further ahead,
+	// but only one of them has actually changed.
+	future := time.Now().Add(24 * time.Hour)
+	for _, name := range []string{"same.txt", "changed.txt"} {
+		path := filepath.Join(testBaseDir, name)
+		must(createTestFile(path, 10))
+		must(os.Chtimes(path, future, future))
+		hash, err := getFileHash(path)
+		must(err)
+		must(db.MarkFile(name, future, hash, name))
+	}
+	must(createTestFile(filepath.Join(testBaseDir, "changed.txt"), 11))
+	later := future.Add(time.Hour)
+	for _, name := range []string{"same.txt", "changed.txt"} {
+		must(os.Chtimes(filepath.Join(testBaseDir, name), later, later))
+	}
+
+	plan, err := planBackup(logger, db, testBaseDir, 10, scanOptions{})
+	must(err)
+	assert.ElementsMatch(t, []string{"same.txt", "changed.txt"}, plan.Summary.FilesFutureModTime)
+	assert.Equal(t, []string{"changed.txt"}, plan.Summary.FilesChanged)
+
+	info, err := os.Stat(filepath.Join(testBaseDir, "changed.txt"))
+	must(err)
+	isDirty, _, reason, err := doesFileNeedBackup(db, "changed.txt", filepath.Join(testBaseDir, "changed.txt"), info, time.Time{})
+	must(err)
+	assert.True(t, isDirty)
+	assert.Equal(t, backupReasonHash, reason)
+}
+
+func TestPlanBackup_DirtyReasons(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	testBaseDir, err := os.MkdirTemp("/tmp", "dave-backup-test-")
+	must(err)
+	defer os.RemoveAll(testBaseDir)
+	db := newTestDB(t)
+
+	backedUp := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for _, name := range []string{"touched.txt", "edited.txt", "same.txt"} {
+		path := filepath.Join(testBaseDir, name)
+		must(createTestFile(path, 10))
+		must(os.Chtimes(path, backedUp, backedUp))
+		hash, err := getFileHash(path)
+		must(err)
+		must(db.MarkFile(name, backedUp, hash, name))
+	}
+	// Only the modtime changes for one file, and only the contents for the other.
+	later := backedUp.Add(time.Minute)
+	must(os.Chtimes(filepath.Join(testBaseDir, "touched.txt"), later, later))
+	must(os.WriteFile(filepath.Join(testBaseDir, "edited.txt"), []byte("new contents"), 0644))
+	must(os.Chtimes(filepath.Join(testBaseDir, "edited.txt"), backedUp, backedUp))
+	must(createTestFile(filepath.Join(testBaseDir, "added.txt"), 10))
+
+	plan, err := planBackup(logger, db, testBaseDir, 1000, scanOptions{})
+	must(err)
+	assert.Equal(t, map[string]backupReason{
+		"added.txt":   backupReasonNew,
+		"edited.txt":  backupReasonHash,
+		"touched.txt": backupReasonModtime,
+	}, plan.Summary.Reasons)
+
+	tree := RenderBatchTree(plan.Batches)
+	assert.Contains(t, tree, "[dirty: new] added.txt")
+	assert.Contains(t, tree, "[dirty: hash] edited.txt")
+	assert.Contains(t, tree, "[dirty: modtime] touched.txt")
+	assert.Contains(t, tree, "  same.txt")
+}
+
+func TestPlanBackup_DeterministicOrder(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Info,
+	}
+	testBaseDir, err := os.MkdirTemp("/tmp", "dave-backup-test-")
+	must(err)
+	defer os.RemoveAll(testBaseDir)
+	db := newTestDB(t)
+
+	// A mix of big files that get their own batches and small directories that get rolled up.
+	must(createTestFile(filepath.Join(testBaseDir, "z.txt"), 20))
+	must(createTestFile(filepath.Join(testBaseDir, "big/b.txt"), 20))
+	must(createTestFile(filepath.Join(testBaseDir, "big/a.txt"), 30))
+	must(createTestFile(filepath.Join(testBaseDir, "small/a.txt"), 2))
+	must(createTestFile(filepath.Join(testBaseDir, "small/b.txt"), 2))
+	must(createTestFile(filepath.Join(testBaseDir, "a/nested/c.txt"), 15))
+	// Batches in the db that no longer exist locally.
+	for _, name := range []string{"gone/e.txt", "gone/a.txt", "gone/c.txt", "gone/b.txt", "gone/d.txt"} {
+		must(db.MarkFile(name, time.Now(), "hash", name))
+	}
+
+	plan, err := planBackup(logger, db, testBaseDir, 10, scanOptions{})
+	must(err)
+	var roots []string
+	for _, batch := range plan.Batches {
+		roots = append(roots, batch.Root)
+	}
+	assert.Equal(t, []string{"a/nested/c.txt", "big/a.txt", "big/b.txt", "small", "z.txt"}, roots)
+
+	var deletes []string
+	for _, batch := range plan.BatchesToDelete {
+		deletes = append(deletes, batch.Path)
+	}
+	assert.Equal(t, []string{"gone/a.txt", "gone/b.txt", "gone/c.txt", "gone/d.txt", "gone/e.txt"}, deletes)
+
+	for i := 0; i < 10; i++ {
+		again, err := planBackup(logger, db, testBaseDir, 10, scanOptions{})
+		must(err)
+		assert.Equal(t, plan.Batches, again.Batches)
+		assert.Equal(t, plan.BatchesToDelete, again.BatchesToDelete)
+	}
+}
+
+// createWideTree creates a tree of width directories at each of depth levels, with files of mixed
+// sizes in each, some of them excluded by the exclude pattern in planWideTree.
+func createWideTree(dir string, width int, depth int) {
+	if depth == 0 {
+		return
+	}
+	for i := 0; i < width; i++ {
+		sub := filepath.Join(dir, fmt.Sprintf("d%d", i))
+		must(createTestFile(filepath.Join(sub, "small.txt"), 1+i))
+		must(createTestFile(filepath.Join(sub, "big.txt"), 10*(i+1)))
+		must(createTestFile(filepath.Join(sub, "skip.log"), 1))
+		createWideTree(sub, width, depth-1)
+	}
+}
+
+func planWideTree(logger logging.Logger, db *DB, root string, concurrency int) (*backupPlan, []string) {
+	observer := &recordingObserver{}
+	plan, err := planBackup(logger, db, root, 40, scanOptions{
+		Exclude:     []string{"*.log"},
+		Observer:    observer,
+		Concurrency: concurrency,
+	})
+	must(err)
+	return plan, observer.events
+}
+
+func TestPlanBackup_ConcurrentScanMatchesSerial(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Info,
+	}
+	testBaseDir := t.TempDir()
+	createWideTree(testBaseDir, 4, 3)
+	db := newTestDB(t)
+	// Some files are already backed up, so the plan has a mix of clean and dirty files.
+	must(db.MarkFile("d0/small.txt", time.Now(), "hash", "d0/small.txt"))
+	must(db.MarkFile("d1/d2/big.txt", time.Now(), "hash", "d1/d2/big.txt"))
+
+	serial, serialEvents := planWideTree(logger, db, testBaseDir, 1)
+	assert.NotEmpty(t, serialEvents)
+	for _, concurrency := range []int{2, 8, 64} {
+		plan, events := planWideTree(logger, db, testBaseDir, concurrency)
+		assert.Equal(t, serial.Batches, plan.Batches, "concurrency %d", concurrency)
+		assert.Equal(t, RenderBatchTree(serial.Batches), RenderBatchTree(plan.Batches), "concurrency %d", concurrency)
+		assert.Equal(t, serial.Summary, plan.Summary, "concurrency %d", concurrency)
+		assert.Equal(t, serial.DirModTimes, plan.DirModTimes, "concurrency %d", concurrency)
+		assert.Equal(t, serialEvents, events, "concurrency %d", concurrency)
+	}
+}
+
+func BenchmarkPlanBackup(b *testing.B) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Info,
+	}
+	testBaseDir := b.TempDir()
+	createWideTree(testBaseDir, 6, 3)
+	db := newTestDB(b)
+
+	for _, concurrency := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				planWideTree(logger, db, testBaseDir, concurrency)
+			}
+		})
+	}
+}
+
+// cancelAfterUploadClient cancels a context once the first archive has been uploaded.
+type cancelAfterUploadClient struct {
+	cancel func()
+}
+
+func (c *cancelAfterUploadClient) Do(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if req.Method == http.MethodPut && strings.HasSuffix(req.URL.Path, ".tar.gz") {
+		c.cancel()
+	}
+	return resp, err
+}
+
+func TestBackupFiles_CancelBetweenBatches(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+
+	// Each file is over the size threshold, so each is its own batch.
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 20))
+	must(createTestFile(filepath.Join(testBaseDir, "b.txt"), 20))
+	must(createTestFile(filepath.Join(testBaseDir, "c.txt"), 20))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cfg := GetMinioConfig(minioUrl)
+	cfg.HTTPClient = &cancelAfterUploadClient{cancel: cancel}
+	err := BackupFiles(
+		ctx,
+		logger,
+		cfg,
+		config.DBFile,
+		testBaseDir,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		config.SizeThreshold,
+		BackupOptions{},
+	)
+	assert.True(t, errors.Is(err, context.Canceled), "expected context.Canceled, got %v", err)
+
+	// Only the batch that was in progress should have been written, and it should be in the db.
+	assertBatchCount(t, config, 1)
+	// The remote db should match the local one.
+	changes, err := downloadAndCompareDB(logger, s3.NewFromConfig(*GetMinioConfig(minioUrl)), config.DBFile, config.Bucket, config.S3Prefix, config.BackupName, "")
+	must(err)
+	assert.Empty(t, changes)
+
+	// A later run picks up where the interrupted one left off.
+	config.LeaveBucketContents = true
+	roundTripTest(config, t)
+	assertBatchCount(t, config, 3)
+}
+
+// blockingUploadClient holds up the first archive upload until ctx is done, e.g. until its deadline
+// has passed.
+type blockingUploadClient struct {
+	s3_helpers.Client
+	ctx  context.Context
+	once sync.Once
+}
+
+func (c *blockingUploadClient) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	if strings.HasSuffix(aws.ToString(params.Key), ".tar.gz") {
+		c.once.Do(func() { <-c.ctx.Done() })
+	}
+	return c.Client.PutObject(ctx, params, optFns...)
+}
+
+func TestBackupFiles_Timeout(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getMemoryTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+
+	// Each file is over the size threshold, so each is its own batch.
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 20))
+	must(createTestFile(filepath.Join(testBaseDir, "b.txt"), 20))
+	must(createTestFile(filepath.Join(testBaseDir, "c.txt"), 20))
+
+	// The deadline is far enough away for the first batch to start, which then runs past it.
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	err := BackupFiles(
+		ctx,
+		logger,
+		&aws.Config{},
+		config.DBFile,
+		testBaseDir,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		config.SizeThreshold,
+		BackupOptions{Storage: &blockingUploadClient{Client: config.Storage, ctx: ctx}},
+	)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "expected context.DeadlineExceeded, got %v", err)
+	assert.ErrorContains(t, err, "after 1 of 3 batches")
+
+	// The batch that was in progress was finished, and the db with it was uploaded.
+	db, err := NewDB(config.DBFile)
+	must(err)
+	batches, err := db.GetExistingBatches(false)
+	db.Close()
+	must(err)
+	assert.Len(t, batches, 1)
+	changes, err := downloadAndCompareDB(logger, config.Storage, config.DBFile, config.Bucket, config.S3Prefix, config.BackupName, "")
+	must(err)
+	assert.Empty(t, changes)
+
+	// A later run picks up where the timed out one left off.
+	config.LeaveBucketContents = true
+	roundTripTest(config, t)
+}
+
+// failingUploadClient rejects uploads of keys with the given suffix.
+type failingUploadClient struct {
+	suffix string
+}
+
+func (c *failingUploadClient) Do(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodPut && strings.HasSuffix(req.URL.Path, c.suffix) {
+		return &http.Response{
+			StatusCode: http.StatusForbidden,
+			Status:     "403 Forbidden",
+			Header:     http.Header{},
+			Body:       io.NopCloser(strings.NewReader("<Error><Code>AccessDenied</Code><Message>denied</Message></Error>")),
+			Request:    req,
+		}, nil
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// failingAfterUploadClient fails PUTs to keys containing the given string once it has let through
+// the given number of them.
+type failingAfterUploadClient struct {
+	contains string
+	allow    int
+}
+
+func (c *failingAfterUploadClient) Do(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodPut && strings.Contains(req.URL.Path, c.contains) {
+		if c.allow == 0 {
+			return (&failingUploadClient{}).Do(req)
+		}
+		c.allow--
+	}
+	return http.DefaultClient.Do(req)
+}
+
+func TestBackupFiles_RerunAfterCrash(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+
+	must(createTestFile(filepath.Join(testBaseDir, "dir1/a.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "dir1/b.txt"), 5))
+	backup := func(httpClient aws.HTTPClient) error {
+		cfg := GetMinioConfig(minioUrl)
+		cfg.HTTPClient = httpClient
+		return BackupFiles(
+			context.Background(),
+			logger,
+			cfg,
+			config.DBFile,
+			testBaseDir,
+			config.Bucket,
+			config.S3Prefix,
+			config.BackupName,
+			config.SizeThreshold,
+			BackupOptions{},
+		)
+	}
+	must(backup(http.DefaultClient))
+	savedDB := config.DBFile + ".saved"
+	must(util.CopyFile(config.DBFile, savedDB))
+	defer os.Remove(savedDB)
+
+	// Crash after the archive is uploaded, but before the db is: neither the local nor the remote db
+	// knows about the new archive.
+	must(createTestFile(filepath.Join(testBaseDir, "dir1/a.txt"), 6))
+	assert.Error(t, backup(&failingUploadClient{suffix: ".db.gz.tmp"}))
+	must(util.CopyFile(savedDB, config.DBFile))
+
+	// The rerun finds the archive that's already stored, and only updates the db.
+	uploads := &countingUploadClient{}
+	must(backup(uploads))
+	assert.Empty(t, uploads.puts)
+	db, err := NewDB(config.DBFile)
+	must(err)
+	defer db.Close()
+	fi, err := db.GetFileInfo("dir1/a.txt")
+	must(err)
+	hash, err := getFileHash(filepath.Join(testBaseDir, "dir1/a.txt"))
+	must(err)
+	assert.Equal(t, hash, fi.Hash)
+
+	// An archive that's different from the stored one is uploaded as usual.
+	must(createTestFile(filepath.Join(testBaseDir, "dir1/a.txt"), 7))
+	must(backup(uploads))
+	assert.Len(t, uploads.puts, 1)
+}
+
+func TestBackupFiles_FailedUploadLeavesDBUnchanged(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+	useTestChunkSizes(t)
+
+	data := make([]byte, 256*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	bigFile := filepath.Join(testBaseDir, "big.bin")
+	must(os.WriteFile(bigFile, data, 0644))
+	must(createTestFile(filepath.Join(testBaseDir, "dir1/a.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "dir1/b.txt"), 5))
+
+	backup := func(httpClient aws.HTTPClient) error {
+		cfg := GetMinioConfig(minioUrl)
+		if httpClient != nil {
+			cfg.HTTPClient = httpClient
+		}
+		return BackupFiles(
+			context.Background(),
+			logger,
+			cfg,
+			config.DBFile,
+			testBaseDir,
+			config.Bucket,
+			config.S3Prefix,
+			config.BackupName,
+			100,
+			BackupOptions{ChunkThreshold: 100 * 1024, ContinueOnError: true},
+		)
+	}
+	dbState := func() (map[string]*FileInfo, map[string][]chunkRef, map[string]string) {
+		db, err := NewDB(config.DBFile)
+		must(err)
+		defer db.Close()
+		files, err := db.GetAllFilesByPath()
+		must(err)
+		chunks, err := db.GetAllFileChunks()
+		must(err)
+		checksums, err := db.GetBatchChecksums()
+		must(err)
+		return files, chunks, checksums
+	}
+
+	// The batch that fails isn't marked at all.
+	assert.Error(t, backup(&failingUploadClient{suffix: "dir1/_files.tar.gz"}))
+	files, _, _ := dbState()
+	assert.Contains(t, files, "big.bin")
+	assert.NotContains(t, files, "dir1/a.txt")
+	assert.NotContains(t, files, "dir1/b.txt")
+	must(backup(nil))
+
+	// Nor is a file that fails partway through uploading its chunks.
+	files, chunks, checksums := dbState()
+	rand.New(rand.NewSource(2)).Read(data)
+	must(os.WriteFile(bigFile, data, 0644))
+	later := time.Now().Add(time.Minute)
+	must(os.Chtimes(bigFile, later, later))
+	assert.Error(t, backup(&failingAfterUploadClient{contains: "/chunks/", allow: 2}))
+	filesAfter, chunksAfter, checksumsAfter := dbState()
+	assert.Equal(t, files, filesAfter)
+	assert.Equal(t, chunks, chunksAfter)
+	assert.Equal(t, checksums, checksumsAfter)
+
+	// The next backup picks up where the failed one left off.
+	must(backup(nil))
+	recoveryDir := t.TempDir()
+	must(RecoverFiles(
+		context.Background(),
+		logger,
+		GetMinioConfig(minioUrl),
+		filepath.Join(t.TempDir(), "recovery.db"),
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		recoveryDir,
+		RecoveryOptions{Verify: true},
+	))
+	compareDirectories(testBaseDir, recoveryDir, t)
+}
+
+func TestBackupFiles_ContinueOnError(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+
+	// Each file is over the size threshold, so each is its own batch.
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 20))
+	must(createTestFile(filepath.Join(testBaseDir, "b.txt"), 20))
+	must(createTestFile(filepath.Join(testBaseDir, "c.txt"), 20))
+
+	cfg := GetMinioConfig(minioUrl)
+	cfg.HTTPClient = &failingUploadClient{suffix: "b.txt.tar.gz"}
+	err := BackupFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		testBaseDir,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		config.SizeThreshold,
+		BackupOptions{ContinueOnError: true},
+	)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "b.txt")
+	}
+
+	// The other batches were written and recorded, and the db was uploaded.
+	assertBatchCount(t, config, 2)
+	changes, err := downloadAndCompareDB(logger, s3.NewFromConfig(*GetMinioConfig(minioUrl)), config.DBFile, config.Bucket, config.S3Prefix, config.BackupName, "")
+	must(err)
+	assert.Empty(t, changes)
+
+	// The failed batch is retried on the next run.
+	config.LeaveBucketContents = true
+	roundTripTest(config, t)
+	assertBatchCount(t, config, 3)
+}
+
+func TestBackupFiles_Since(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+
+	// Each file is over the size threshold, so each is its own batch.
+	longAgo := time.Now().Add(-48 * time.Hour)
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		must(createTestFile(filepath.Join(testBaseDir, name), 20))
+		must(os.Chtimes(filepath.Join(testBaseDir, name), longAgo, longAgo))
+	}
+	roundTripTest(config, t)
+
+	// a.txt is touched after the cutoff. b.txt is changed too, but keeps an old modtime, so it's
+	// assumed to be unchanged.
+	since := time.Now().Add(-time.Hour)
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 20))
+	must(createTestFile(filepath.Join(testBaseDir, "b.txt"), 20))
+	must(os.Chtimes(filepath.Join(testBaseDir, "b.txt"), longAgo, longAgo))
+
+	counter := &countingUploadClient{}
+	cfg := GetMinioConfig(minioUrl)
+	cfg.HTTPClient = counter
+	must(BackupFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		testBaseDir,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		config.SizeThreshold,
+		BackupOptions{Since: since},
+	))
+	if assert.Len(t, counter.puts, 1) {
+		assert.True(t, strings.HasSuffix(counter.puts[0], "/a.txt.tar.gz"), counter.puts[0])
+	}
+	// Nothing was deleted.
+	assertBatchCount(t, config, 3)
+}
+
+// putCountingClient counts every PUT request, i.e. every object that's written or copied.
+type putCountingClient struct {
+	mu   sync.Mutex
+	puts []string
+}
+
+func (c *putCountingClient) Do(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodPut {
+		c.mu.Lock()
+		c.puts = append(c.puts, req.URL.Path)
+		c.mu.Unlock()
+	}
+	return http.DefaultClient.Do(req)
+}
+
+func TestBackupFiles_NoChangesSkipsDBUpload(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "subdir-1/b.txt"), 9))
+
+	backup := func(options BackupOptions) []string {
+		counter := &putCountingClient{}
+		cfg := GetMinioConfig(minioUrl)
+		cfg.HTTPClient = counter
+		must(BackupFiles(
+			context.Background(),
+			logger,
+			cfg,
+			config.DBFile,
+			testBaseDir,
+			config.Bucket,
+			config.S3Prefix,
+			config.BackupName,
+			config.SizeThreshold,
+			options,
+		))
+		return counter.puts
+	}
+	assert.NotEmpty(t, backup(BackupOptions{}))
+
+	// Nothing changed, so nothing is written.
+	assert.Empty(t, backup(BackupOptions{}))
+
+	// Unless forced, in which case the db is uploaded anyway.
+	assert.NotEmpty(t, backup(BackupOptions{Force: true}))
+
+	// Deleting a file is a change.
+	must(os.Remove(filepath.Join(testBaseDir, "a.txt")))
+	assert.NotEmpty(t, backup(BackupOptions{}))
+	assert.Empty(t, backup(BackupOptions{}))
+
+	config.LeaveBucketContents = true
+	roundTripTest(config, t)
+}
+
+func TestBackupFiles_ObjectMetadata(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+	config.SizeThreshold = 100
+
+	must(createTestFile(filepath.Join(testBaseDir, "big.txt"), 200))
+	must(createTestFile(filepath.Join(testBaseDir, "subdir/a.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "subdir/b.txt"), 5))
+
+	cfg := GetMinioConfig(minioUrl)
+	must(BackupFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		testBaseDir,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		config.SizeThreshold,
+		BackupOptions{ObjectMetadata: map[string]string{"owner": "me"}},
+	))
+
+	client := s3.NewFromConfig(*cfg)
+	for key, expected := range map[string]map[string]string{
+		"big.txt.tar.gz": {
+			"owner":       "me",
+			"backup-name": config.BackupName,
+			"file-count":  "1",
+			"source-path": ".",
+		},
+		"subdir/_files.tar.gz": {
+			"owner":       "me",
+			"backup-name": config.BackupName,
+			"file-count":  "2",
+			"source-path": "subdir",
+		},
+	} {
+		head, err := client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+			Bucket: &config.Bucket,
+			Key:    aws.String(s3Key(config.FullS3Prefix, key)),
+		})
+		must(err)
+		assert.Equal(t, "application/gzip", aws.ToString(head.ContentType), key)
+		assert.Equal(t, expected, head.Metadata, key)
+	}
+}
+
+func TestBackupFiles_SkipEmptyFiles(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+
+	for _, skip := range []bool{false, true} {
+		config := getDefaultTestConfig()
+		defer config.Cleanup()
+		testBaseDir := config.TestBaseDir
+
+		must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 50))
+		must(os.WriteFile(filepath.Join(testBaseDir, "done.marker"), nil, 0644))
+		must(os.MkdirAll(filepath.Join(testBaseDir, "subdir"), os.ModePerm))
+		must(os.WriteFile(filepath.Join(testBaseDir, "subdir/.keep"), nil, 0644))
+
+		must(BackupFiles(
+			context.Background(),
+			logger,
+			GetMinioConfig(minioUrl),
+			config.DBFile,
+			testBaseDir,
+			config.Bucket,
+			config.S3Prefix,
+			config.BackupName,
+			config.SizeThreshold,
+			BackupOptions{SkipEmptyFiles: skip},
+		))
+
+		db, err := NewDB(config.DBFile)
+		must(err)
+		files, err := db.GetAllFilesByPath()
+		must(err)
+		db.Close()
+		var paths []string
+		for path := range files {
+			paths = append(paths, path)
+		}
+		if skip {
+			assert.ElementsMatch(t, []string{"a.txt"}, paths)
+		} else {
+			assert.ElementsMatch(t, []string{"a.txt", "done.marker", "subdir/.keep"}, paths)
+		}
+	}
+}
+
+func TestBackupFiles_ControlCharactersInNames(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+
+	// Grouped together in one batch, and backed up by itself.
+	must(createTestFile(filepath.Join(testBaseDir, "subdir/new\nline.txt"), 3))
+	must(createTestFile(filepath.Join(testBaseDir, "subdir/tab\tand,comma.txt"), 3))
+	must(createTestFile(filepath.Join(testBaseDir, "subdir/plain.txt"), 3))
+	must(createTestFile(filepath.Join(testBaseDir, "big\ttab.txt"), 50))
+
+	cfg := GetMinioConfig(minioUrl)
+	must(BackupFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		testBaseDir,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		config.SizeThreshold,
+		BackupOptions{},
+	))
+
+	db, err := NewDB(config.DBFile)
+	must(err)
+	batches, err := db.GetExistingBatches(true)
+	must(err)
+	db.Close()
+	assert.ElementsMatch(t, []BatchMeta{
+		{Path: "subdir", Filenames: []string{"subdir/new\nline.txt", "subdir/plain.txt", "subdir/tab\tand,comma.txt"}},
+		{Path: "big\ttab.txt", IsSingleFile: true, Filenames: []string{"big\ttab.txt"}},
+	}, batches)
+
+	testRecoveryDir := t.TempDir()
+	must(RecoverFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		testRecoveryDir,
+		RecoveryOptions{Verify: true},
+	))
+	compareDirectories(testBaseDir, testRecoveryDir, t)
+}
+
+func TestDisplayPath(t *testing.T) {
+	assert.Equal(t, "dir/a file, with punctuation.txt", displayPath("dir/a file, with punctuation.txt"))
+	assert.Equal(t, "fotos/año.jpg", displayPath("fotos/año.jpg"))
+	assert.Equal(t, `"new\nline.txt"`, displayPath("new\nline.txt"))
+	assert.Equal(t, `"tab\there.txt"`, displayPath("tab\there.txt"))
+	assert.Equal(t, `"bell\a"`, displayPath("bell\a"))
+}
+
+func TestBackupFiles_NoCompressExtensions(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+
+	random := func(n int) []byte {
+		data := make([]byte, n)
+		rand.New(rand.NewSource(int64(n))).Read(data)
+		return data
+	}
+	// An incompressible file by itself, and a batch that mixes stored and compressed files.
+	must(os.WriteFile(filepath.Join(testBaseDir, "photo.JPG"), random(200*1024), 0644))
+	must(os.MkdirAll(filepath.Join(testBaseDir, "mixed"), os.ModePerm))
+	must(os.WriteFile(filepath.Join(testBaseDir, "mixed/small.jpg"), random(500), 0644))
+	must(os.WriteFile(filepath.Join(testBaseDir, "mixed/notes.txt"), make([]byte, 500), 0644))
+	must(os.WriteFile(filepath.Join(testBaseDir, "mixed/more.zip"), random(300), 0644))
+
+	backuper, err := NewBackuper(BackuperConfig{
+		AWS:           GetMinioConfig(minioUrl),
+		Logger:        logger,
+		Root:          testBaseDir,
+		Bucket:        config.Bucket,
+		Prefix:        config.S3Prefix,
+		Name:          config.BackupName,
+		DBFile:        config.DBFile,
+		SizeThreshold: 2000,
+		Options:       BackupOptions{NoCompressExtensions: []string{"jpg", ".zip"}},
+	})
+	must(err)
+	report, err := backuper.Backup(context.Background())
+	must(err)
+
+	// Storing the file only adds gzip's framing.
+	photo := report.Compression["photo.JPG"]
+	assert.LessOrEqual(t, photo.Compressed, photo.Uncompressed+64)
+	mixed := report.Compression["mixed"]
+	assert.Less(t, mixed.Compressed, mixed.Uncompressed)
+
+	recoveryDir := t.TempDir()
+	must(RecoverFiles(
+		context.Background(),
+		logger,
+		GetMinioConfig(minioUrl),
+		filepath.Join(t.TempDir(), "recovery.db"),
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		recoveryDir,
+		RecoveryOptions{Verify: true},
+	))
+	compareDirectories(testBaseDir, recoveryDir, t)
+}
+
+func TestBackupFiles_LargerThanBuffer(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+
+	// Incompressible, so the archive is bigger than the buffer too.
+	data := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	must(os.WriteFile(filepath.Join(testBaseDir, "huge.bin"), data, 0644))
+	must(createTestFile(filepath.Join(testBaseDir, "small.txt"), 5))
+
+	tempDir := t.TempDir()
+	backuper, err := NewBackuper(BackuperConfig{
+		AWS:           GetMinioConfig(minioUrl),
+		Logger:        logger,
+		Root:          testBaseDir,
+		Bucket:        config.Bucket,
+		Prefix:        config.S3Prefix,
+		Name:          config.BackupName,
+		DBFile:        config.DBFile,
+		SizeThreshold: config.SizeThreshold,
+		Options:       BackupOptions{MaxBufferBytes: 64 * 1024, TempDir: tempDir},
+	})
+	must(err)
+	report, err := backuper.Backup(context.Background())
+	must(err)
+	assert.Equal(t, 2, report.BatchesWritten)
+
+	// The spooled archive is cleaned up once it's uploaded.
+	entries, err := os.ReadDir(tempDir)
+	must(err)
+	assert.Empty(t, entries)
+
+	recoveryDir := t.TempDir()
+	must(RecoverFiles(
+		context.Background(),
+		logger,
+		GetMinioConfig(minioUrl),
+		filepath.Join(t.TempDir(), "recovery.db"),
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		recoveryDir,
+		RecoveryOptions{Verify: true},
+	))
+	compareDirectories(testBaseDir, recoveryDir, t)
+}
+
+func TestLevelWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := newLevelWriter(&buf, gzip.DefaultCompression)
+	must(err)
+	// Switching before anything's written doesn't leave an empty member behind.
+	_, err = w.Write(nil)
+	must(err)
+	must(w.SetLevel(gzip.NoCompression))
+	must(w.SetLevel(gzip.DefaultCompression))
+	assert.Zero(t, buf.Len())
+
+	var expected []byte
+	for i, level := range []int{gzip.DefaultCompression, gzip.NoCompression, gzip.NoCompression, gzip.BestSpeed} {
+		must(w.SetLevel(level))
+		data := bytes.Repeat([]byte{byte('a' + i)}, 1000)
+		_, err := w.Write(data)
+		must(err)
+		expected = append(expected, data...)
+	}
+	must(w.Close())
+
+	gzr, err := gzip.NewReader(&buf)
+	must(err)
+	actual, err := io.ReadAll(gzr)
+	must(err)
+	assert.Equal(t, expected, actual)
+	assert.Equal(t, gzip.DefaultCompression, compressionLevel("notes.txt", []string{"jpg"}))
+	assert.Equal(t, gzip.NoCompression, compressionLevel("dir/photo.Jpg", []string{"jpg"}))
+	assert.Equal(t, gzip.DefaultCompression, compressionLevel("photo.jpg", nil))
+}
+
+func TestCheckBatches(t *testing.T) {
+	file := func(path string) *BackupFile {
+		return &BackupFile{Path: path}
+	}
+	assert.NoError(t, checkBatches([]*BackupBatch{
+		{Root: "dir", Files: []*BackupFile{file("dir/a.txt"), file("dir/b.txt")}},
+		{Root: "dir/nested/c.txt", Files: []*BackupFile{file("dir/nested/c.txt")}},
+		{Root: "dir/nested", Files: []*BackupFile{file("dir/nested/d.txt"), file("dir/nested/e.txt")}},
+	}))
+	assert.ErrorContains(t, checkBatches([]*BackupBatch{
+		{Root: "dir", Files: []*BackupFile{file("dir/a.txt"), file("dir/b.txt")}},
+		{Root: "dir", Files: []*BackupFile{file("dir/c.txt"), file("dir/d.txt")}},
+	}), "more than one batch")
+	assert.ErrorContains(t, checkBatches([]*BackupBatch{
+		{Root: "dir", Files: []*BackupFile{file("dir/a.txt"), file("dir/b.txt")}},
+		{Root: "dir/a.txt", Files: []*BackupFile{file("dir/a.txt")}},
+	}), "is in both")
+	assert.ErrorContains(t, checkBatches([]*BackupBatch{
+		{Root: "dir", Files: []*BackupFile{file("dir/a.txt"), file("dir/b.txt")}},
+		{Root: "dir/_files", Files: []*BackupFile{file("dir/_files")}},
+	}), "would both be stored")
+}
+
+func TestBackupFiles_OverlappingArchives(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getMemoryTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+
+	// The big file gets a batch of its own, whose archive would be the one the small files are
+	// grouped into.
+	must(createTestFile(filepath.Join(testBaseDir, "dir/a.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "dir/b.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "dir/_files"), 500))
+
+	err := BackupFiles(context.Background(), logger, &aws.Config{}, config.DBFile, testBaseDir, config.Bucket, config.S3Prefix, config.BackupName, 100, BackupOptions{
+		Storage: config.Storage,
+	})
+	assert.ErrorContains(t, err, "would both be stored")
+
+	// Nothing was uploaded.
+	output, err := config.Storage.ListObjectsV2(context.TODO(), &s3.ListObjectsV2Input{
+		Bucket: aws.String(config.Bucket),
+		Prefix: aws.String(config.FullS3Prefix + "/"),
+	})
+	must(err)
+	assert.Empty(t, output.Contents)
+}
@@ -0,0 +1,247 @@
+package backup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"local/backup/lib/logging"
+	"local/backup/lib/s3_helpers"
+)
+
+// In content-addressed mode, files that are backed up by themselves are stored as gzipped blobs
+// named by the hash of their contents:
+//
+//	<prefix>/blobs/<hash>
+//
+// so identical files are only stored once. The db's path -> hash mapping is the only record of
+// where each blob belongs, and of the files' modtimes, so recovery restores them from the db.
+// Grouped batches are stored as usual. Blobs are shared, so they're never deleted during a backup;
+// GC removes the ones that are no longer referenced.
+
+func blobKey(prefix string, hash string) string {
+	return s3Key(prefix, "blobs", hash)
+}
+
+// isBlobKey tells blobs apart from archives of a directory that happens to be called "blobs".
+func isBlobKey(prefix string, key string) bool {
+	return strings.HasPrefix(key, s3Key(prefix, "blobs")+"/") && !strings.HasSuffix(key, ".tar.gz")
+}
+
+// checkContentAddressed makes sure a backup doesn't switch storage modes, which would leave the db
+// pointing at the wrong keys.
+func checkContentAddressed(db *DB, contentAddressed bool) error {
+	stored, err := db.IsContentAddressed()
+	if err != nil {
+		return err
+	}
+	if stored == contentAddressed {
+		return nil
+	}
+	files, err := db.GetAllFiles()
+	if err != nil {
+		return err
+	}
+	// Nothing has been stored yet, so the mode can still be picked.
+	if len(files) == 0 {
+		return nil
+	}
+	if stored {
+		return fmt.Errorf("backup is content-addressed, but content addressing isn't enabled")
+	}
+	return fmt.Errorf("backup isn't content-addressed, but content addressing is enabled")
+}
+
+// IsContentAddressed reports whether the backup stores single files as content-addressed blobs.
+func (db *DB) IsContentAddressed() (bool, error) {
+	value, err := db.getMeta(metaContentAddressed)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return value == "true", nil
+}
+
+// backupBlob stores a file's contents under their hash, unless a blob with that hash already
+// exists. The hash is computed from the bytes that were read, so the blob always matches its key
+// even if the file changes during the backup.
+func backupBlob(
+	logger logging.Logger,
+	client s3_helpers.Client,
+	bucket string,
+	prefix string,
+	localRoot string,
+	// Relative to the local root
+	filePath string,
+	// Blobs can be shared by several files, so they only get the backup's metadata.
+	metadata map[string]string,
+	// See compressionLevel.
+	level int,
+) (*uploadedArchive, error) {
+	localPath := filepath.Join(localRoot, filePath)
+	file, err := openRegularFile(localPath)
+	if err != nil {
+		return nil, &fileError{Path: filePath, Err: err}
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	gw, err := gzip.NewWriterLevel(buf, level)
+	if err != nil {
+		return nil, err
+	}
+	h := md5.New()
+	if _, err := io.CopyN(io.MultiWriter(gw, h), file, info.Size()); err != nil {
+		return nil, fmt.Errorf("failed to read file %q: %v", localPath, err)
+	}
+	if err := gw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close gzip writer: %v", err)
+	}
+
+	after, err := os.Stat(localPath)
+	if err != nil {
+		return nil, err
+	}
+	af := &archivedFile{
+		ModTime: info.ModTime(),
+		Hash:    fmt.Sprintf("%x", h.Sum(nil)),
+		Changed: !after.ModTime().Equal(info.ModTime()) || after.Size() != info.Size(),
+	}
+
+	// gzip output is deterministic, so an existing blob has the same checksum.
+	uploaded := &uploadedArchive{
+		Files:    map[string]*archivedFile{filePath: af},
+		Checksum: fmt.Sprintf("%x", md5.Sum(buf.Bytes())),
+		Compression: CompressionStats{
+			Uncompressed: info.Size(),
+			Compressed:   int64(buf.Len()),
+		},
+	}
+
+	key := blobKey(prefix, af.Hash)
+	exists, err := s3_helpers.ObjectExists(client, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		logger.Verbosef("contents of %q are already stored at %q", filePath, key)
+		return uploaded, nil
+	}
+
+	logger.Verbosef("backing up file %q to %q", filePath, key)
+	_, err = client.PutObject(context.TODO(), &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(buf.Bytes()),
+		ContentType: aws.String(gzipContentType),
+		Metadata:    metadata,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload file %q to %q: %v", localPath, key, err)
+	}
+	uploaded.Size = int64(buf.Len())
+	return uploaded, nil
+}
+
+// recoverBlobs restores every file that's stored as a blob, using the db to find each file's
+// contents and modtime. Each blob is only downloaded once, however many files share it.
+func recoverBlobs(
+	logger logging.Logger,
+	client s3_helpers.Client,
+	db *DB,
+	bucket string,
+	prefix string,
+	localRoot string,
+	options RecoveryOptions,
+) ([]string, error) {
+	files, err := db.GetAllFiles()
+	if err != nil {
+		return nil, fmt.Errorf("error loading files from db: %v", err)
+	}
+	// Large files may be stored in chunks instead. See chunks.go.
+	chunked, err := db.GetAllFileChunks()
+	if err != nil {
+		return nil, fmt.Errorf("error loading chunks from db: %v", err)
+	}
+
+	tmpDir, err := os.MkdirTemp(options.TempDir, "dbackup-blobs-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	downloaded := make(map[string]string)
+	var missing []string
+	for _, file := range files {
+		if _, ok := chunked[file.Path]; ok || file.Batch != file.Path {
+			continue
+		}
+		relPath, ok := options.remapPath(file.Path)
+		if !ok {
+			continue
+		}
+		localPath, err := safeJoin(localRoot, relPath)
+		if err != nil {
+			return missing, err
+		}
+		write, err := shouldWriteFile(localPath, file.ModTime, options.Conflict)
+		if err != nil {
+			return missing, err
+		}
+		if !write {
+			logger.Verbosef("keeping existing file %q", localPath)
+			continue
+		}
+
+		blobFile, ok := downloaded[file.Hash]
+		if ok && blobFile == "" {
+			// Missing, and already reported.
+			continue
+		}
+		if !ok {
+			key := blobKey(prefix, file.Hash)
+			blobFile = filepath.Join(tmpDir, file.Hash)
+			logger.Verbosef("downloading blob %q", key)
+			err := s3_helpers.DownloadFile(client, bucket, key, blobFile)
+			if errors.Is(err, s3_helpers.ErrNotFound) {
+				logger.Infof("blob %q, holding %q, is missing from the bucket", key, displayPath(file.Path))
+				if !options.BestEffort {
+					return missing, &MissingObjectsError{Keys: []string{key}}
+				}
+				missing = append(missing, key)
+				downloaded[file.Hash] = ""
+				continue
+			}
+			if err != nil {
+				return missing, fmt.Errorf("failed to download blob for %q: %v", file.Path, err)
+			}
+			downloaded[file.Hash] = blobFile
+		}
+
+		logger.Verbosef("restoring %q", localPath)
+		if err := gunzipFile(blobFile, localPath, options.extractLimit); err != nil {
+			return missing, fmt.Errorf("failed to restore %q: %w", localPath, err)
+		}
+		if err := os.Chtimes(localPath, file.ModTime, file.ModTime); err != nil {
+			return missing, fmt.Errorf("failed to set modtime of %q: %v", localPath, err)
+		}
+	}
+	return missing, nil
+}
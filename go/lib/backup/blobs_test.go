@@ -0,0 +1,85 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+
+	"local/backup/lib/logging"
+)
+
+func TestBackupFiles_ContentAddressedDedup(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+	config.SizeThreshold = 100
+
+	// Several identical files, each large enough to be backed up by itself, plus a small one that
+	// goes in a grouped batch.
+	contents := []byte(randSeq(500))
+	for _, name := range []string{"a.bin", "dir1/b.bin", "dir2/c.bin"} {
+		path := filepath.Join(testBaseDir, name)
+		must(os.MkdirAll(filepath.Dir(path), os.ModePerm))
+		must(os.WriteFile(path, contents, 0644))
+	}
+	must(createTestFile(filepath.Join(testBaseDir, "dir1/small.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "dir1/small2.txt"), 5))
+
+	cfg := GetMinioConfig(minioUrl)
+	client := s3.NewFromConfig(*cfg)
+	backup := func(options BackupOptions) error {
+		return BackupFiles(
+			context.Background(),
+			logger,
+			cfg,
+			config.DBFile,
+			testBaseDir,
+			config.Bucket,
+			config.S3Prefix,
+			config.BackupName,
+			config.SizeThreshold,
+			options,
+		)
+	}
+	must(backup(BackupOptions{ContentAddressed: true}))
+
+	output, err := client.ListObjectsV2(context.TODO(), &s3.ListObjectsV2Input{
+		Bucket: aws.String(config.Bucket),
+		Prefix: aws.String(config.FullS3Prefix + "/blobs/"),
+	})
+	must(err)
+	assert.Len(t, output.Contents, 1)
+
+	// Switching modes on an existing backup is refused.
+	assert.Error(t, backup(BackupOptions{}))
+
+	// Nothing is considered orphaned.
+	orphans, err := GC(logger, cfg, config.DBFile, config.Bucket, config.S3Prefix, config.BackupName, GCOptions{})
+	must(err)
+	assert.Empty(t, orphans)
+
+	// Recovery puts the blob back at every path.
+	testRecoveryDir, err := os.MkdirTemp("/tmp", "dave-recovery-test-")
+	must(err)
+	defer os.RemoveAll(testRecoveryDir)
+	must(RecoverFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		testRecoveryDir,
+		RecoveryOptions{},
+	))
+	compareDirectories(testBaseDir, testRecoveryDir, t)
+}
@@ -0,0 +1,95 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+
+	"local/backup/lib/logging"
+	"local/backup/lib/s3_helpers"
+)
+
+// ensureBucket makes sure the bucket exists, creating it in the given region if it's missing and
+// create is set.
+func ensureBucket(logger logging.Logger, client s3_helpers.Client, bucket string, region string, create bool) error {
+	_, err := client.HeadBucket(context.TODO(), &s3.HeadBucketInput{
+		Bucket: aws.String(bucket),
+	})
+	if err == nil {
+		logger.Debugf("Bucket exists")
+		return nil
+	}
+	var notFound *types.NotFound
+	if !errors.As(err, &notFound) || !create {
+		return fmt.Errorf("bucket doesn't exist: %v", err)
+	}
+
+	logger.Infof("creating bucket %q in region %q", bucket, region)
+	input := &s3.CreateBucketInput{
+		Bucket: aws.String(bucket),
+	}
+	// us-east-1 is the default, and S3 rejects it as an explicit location constraint.
+	if region != "" && region != "us-east-1" {
+		input.CreateBucketConfiguration = &types.CreateBucketConfiguration{
+			LocationConstraint: types.BucketLocationConstraint(region),
+		}
+	}
+	if _, err := client.CreateBucket(context.TODO(), input); err != nil {
+		return fmt.Errorf("failed to create bucket %q: %v", bucket, err)
+	}
+	return nil
+}
+
+// SetBucketRegion switches the config to the region the bucket is actually in, if that's not the one
+// configured. S3 otherwise rejects every request with a redirect that doesn't say where the bucket
+// is. This is meant for real S3; custom endpoints like minio don't have regions to speak of. A
+// missing bucket is left for ensureBucket to deal with.
+func SetBucketRegion(logger logging.Logger, cfg *aws.Config, bucket string) error {
+	region, err := bucketRegion(s3.NewFromConfig(*cfg), bucket)
+	if err != nil {
+		return fmt.Errorf("failed to look up the region of bucket %q: %v", bucket, err)
+	}
+	if region == "" || region == cfg.Region {
+		return nil
+	}
+	logger.Infof("bucket %q is in region %q, not the configured %q, switching to it", bucket, region, cfg.Region)
+	cfg.Region = region
+	return nil
+}
+
+// bucketRegion returns the region the bucket is in, or "" if the bucket doesn't exist. S3 reports
+// the region in a header on HeadBucket responses, including the redirect it sends when the request
+// went to the wrong region.
+func bucketRegion(client s3_helpers.Client, bucket string) (string, error) {
+	output, err := client.HeadBucket(context.TODO(), &s3.HeadBucketInput{
+		Bucket: aws.String(bucket),
+	})
+	if err == nil {
+		return aws.ToString(output.BucketRegion), nil
+	}
+	var responseErr interface{ HTTPResponse() *smithyhttp.Response }
+	if errors.As(err, &responseErr) {
+		if region := responseErr.HTTPResponse().Header.Get("X-Amz-Bucket-Region"); region != "" {
+			return region, nil
+		}
+	}
+	var notFound *types.NotFound
+	if errors.As(err, &notFound) {
+		return "", nil
+	}
+	return "", err
+}
+
+// storageClient returns the client for the storage the backup is in: the given one if it's set, and
+// otherwise S3, as configured by cfg.
+func storageClient(cfg *aws.Config, storage s3_helpers.Client) s3_helpers.Client {
+	if storage != nil {
+		return storage
+	}
+	return s3.NewFromConfig(*cfg)
+}
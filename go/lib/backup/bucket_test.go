@@ -0,0 +1,128 @@
+package backup
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+
+	"local/backup/lib/logging"
+)
+
+func TestBackupFiles_CreateBucketIfMissing(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+
+	// Bucket names must be lowercase.
+	freshBucket := "test-bucket-" + strings.ToLower(randSeq(12))
+	cfg := GetMinioConfig(minioUrl)
+	client := s3.NewFromConfig(*cfg)
+	defer (func() {
+		must(clearBucket(client, freshBucket, config.S3Prefix))
+		_, err := client.DeleteBucket(context.TODO(), &s3.DeleteBucketInput{
+			Bucket: aws.String(freshBucket),
+		})
+		must(err)
+	})()
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 5))
+
+	backup := func(options BackupOptions) error {
+		return BackupFiles(
+			context.Background(),
+			logger,
+			cfg,
+			config.DBFile,
+			testBaseDir,
+			freshBucket,
+			config.S3Prefix,
+			config.BackupName,
+			config.SizeThreshold,
+			options,
+		)
+	}
+
+	// By default a missing bucket is an error.
+	assert.Error(t, ensureBucket(logger, client, freshBucket, cfg.Region, false))
+
+	must(backup(BackupOptions{CreateBucketIfMissing: true}))
+
+	_, err := client.HeadBucket(context.TODO(), &s3.HeadBucketInput{
+		Bucket: aws.String(freshBucket),
+	})
+	assert.NoError(t, err)
+	_, err = client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+		Bucket: aws.String(freshBucket),
+		Key:    aws.String(dbKey(config.S3Prefix, config.BackupName)),
+	})
+	assert.NoError(t, err)
+}
+
+func TestSetBucketRegion(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+
+	// Acts like S3 for a bucket in eu-west-2, which redirects requests signed for any other region.
+	signingRegion := regexp.MustCompile(`Credential=[^/]+/[^/]+/([^/]+)/`)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/regional-bucket" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("X-Amz-Bucket-Region", "eu-west-2")
+		match := signingRegion.FindStringSubmatch(r.Header.Get("Authorization"))
+		if match == nil || match[1] != "eu-west-2" {
+			w.WriteHeader(http.StatusMovedPermanently)
+		}
+	}))
+	defer server.Close()
+
+	newConfig := func() *aws.Config {
+		return &aws.Config{
+			Region:      "us-east-1",
+			Credentials: credentials.NewStaticCredentialsProvider("key", "secret", ""),
+			// Signs for whichever region is configured, as real S3 endpoints do.
+			EndpointResolver: aws.EndpointResolverFunc(func(service, region string) (aws.Endpoint, error) {
+				return aws.Endpoint{
+					URL:               server.URL,
+					SigningRegion:     region,
+					HostnameImmutable: true,
+				}, nil
+			}),
+		}
+	}
+	headBucket := func(cfg *aws.Config) error {
+		_, err := s3.NewFromConfig(*cfg).HeadBucket(context.TODO(), &s3.HeadBucketInput{
+			Bucket: aws.String("regional-bucket"),
+		})
+		return err
+	}
+
+	cfg := newConfig()
+	assert.Error(t, headBucket(cfg))
+	must(SetBucketRegion(logger, cfg, "regional-bucket"))
+	assert.Equal(t, "eu-west-2", cfg.Region)
+	assert.NoError(t, headBucket(cfg))
+
+	// Already in the right region.
+	must(SetBucketRegion(logger, cfg, "regional-bucket"))
+	assert.Equal(t, "eu-west-2", cfg.Region)
+
+	// A missing bucket leaves the config alone.
+	cfg = newConfig()
+	must(SetBucketRegion(logger, cfg, "missing-bucket"))
+	assert.Equal(t, "us-east-1", cfg.Region)
+}
@@ -0,0 +1,55 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"local/backup/lib/s3_helpers"
+)
+
+// With BackupOptions.ChecksumAlgorithm, every object that a backup uploads is sent with a checksum
+// of its contents, which S3 verifies before storing it, so an upload that's corrupted on the way is
+// rejected instead of being stored. Not every S3-compatible service supports checksums, so they're
+// off by default.
+
+// parseChecksumAlgorithm returns the checksum algorithm with the given name, like "SHA256",
+// compared case-insensitively.
+func parseChecksumAlgorithm(name string) (types.ChecksumAlgorithm, error) {
+	for _, algorithm := range types.ChecksumAlgorithm("").Values() {
+		if strings.EqualFold(name, string(algorithm)) {
+			return algorithm, nil
+		}
+	}
+	return "", fmt.Errorf("unknown checksum algorithm %q", name)
+}
+
+// checksumClient asks the SDK to send a checksum with every object that's uploaded.
+type checksumClient struct {
+	s3_helpers.Client
+	algorithm types.ChecksumAlgorithm
+}
+
+func (c *checksumClient) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	if params.ChecksumAlgorithm == "" {
+		withChecksum := *params
+		withChecksum.ChecksumAlgorithm = c.algorithm
+		params = &withChecksum
+	}
+	return c.Client.PutObject(ctx, params, optFns...)
+}
+
+// withChecksums wraps the client to send checksums computed with the named algorithm, if any.
+func withChecksums(client s3_helpers.Client, algorithm string) (s3_helpers.Client, error) {
+	if algorithm == "" {
+		return client, nil
+	}
+	parsed, err := parseChecksumAlgorithm(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return &checksumClient{Client: client, algorithm: parsed}, nil
+}
@@ -0,0 +1,97 @@
+package backup
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+
+	"local/backup/lib/logging"
+	"local/backup/lib/s3_helpers"
+)
+
+// putRecordingClient records the objects that are uploaded.
+type putRecordingClient struct {
+	s3_helpers.Client
+	puts []*s3.PutObjectInput
+}
+
+func (c *putRecordingClient) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	c.puts = append(c.puts, params)
+	return &s3.PutObjectOutput{}, nil
+}
+
+func TestWithChecksums(t *testing.T) {
+	recorder := &putRecordingClient{}
+	client, err := withChecksums(recorder, "sha256")
+	must(err)
+	input := &s3.PutObjectInput{Bucket: aws.String("bucket"), Key: aws.String("key")}
+	_, err = client.PutObject(context.Background(), input)
+	must(err)
+	if assert.Len(t, recorder.puts, 1) {
+		assert.Equal(t, types.ChecksumAlgorithmSha256, recorder.puts[0].ChecksumAlgorithm)
+	}
+	// The caller's input is left alone.
+	assert.Empty(t, input.ChecksumAlgorithm)
+
+	client, err = withChecksums(recorder, "")
+	must(err)
+	assert.Same(t, recorder, client)
+	_, err = withChecksums(recorder, "md5")
+	assert.Error(t, err)
+}
+
+// checksumHeaderClient records the checksum header of every upload.
+type checksumHeaderClient struct {
+	mu        sync.Mutex
+	checksums map[string]string
+}
+
+func (c *checksumHeaderClient) Do(req *http.Request) (*http.Response, error) {
+	// Copies don't upload anything.
+	if req.Method == http.MethodPut && req.Header.Get("X-Amz-Copy-Source") == "" {
+		c.mu.Lock()
+		c.checksums[req.URL.Path] = req.Header.Get("X-Amz-Checksum-Crc32c")
+		c.mu.Unlock()
+	}
+	return http.DefaultClient.Do(req)
+}
+
+func TestBackupFiles_ChecksumAlgorithm(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 50))
+	must(createTestFile(filepath.Join(testBaseDir, "subdir/b.txt"), 50))
+
+	recorder := &checksumHeaderClient{checksums: make(map[string]string)}
+	cfg := GetMinioConfig(minioUrl)
+	cfg.HTTPClient = recorder
+	must(BackupFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		testBaseDir,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		config.SizeThreshold,
+		BackupOptions{ChecksumAlgorithm: "CRC32C"},
+	))
+	// Both archives and the db.
+	assert.GreaterOrEqual(t, len(recorder.checksums), 3)
+	for path, checksum := range recorder.checksums {
+		assert.NotEmpty(t, checksum, path)
+	}
+}
@@ -0,0 +1,336 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"local/backup/lib/logging"
+	"local/backup/lib/s3_helpers"
+)
+
+// With BackupOptions.ChunkThreshold, large files that are backed up by themselves are split into
+// content-defined chunks, each stored as a gzipped object named by the hash of its contents:
+//
+//	<prefix>/chunks/<hash>
+//
+// Chunk boundaries are picked by a rolling hash of the contents, so an edit only changes the chunks
+// around it, and only those need to be uploaded again. The db lists each file's chunks in order,
+// and is the only record of how to put the files back together, so recovery restores them from the
+// db and ReconcileDB can't rebuild them. Chunks can be shared between files and versions, so they're
+// never deleted during a backup; GC removes the ones that are no longer referenced.
+
+func chunkKey(prefix string, hash string) string {
+	return s3Key(prefix, "chunks", hash)
+}
+
+// isChunkKey tells chunks apart from archives of a directory that happens to be called "chunks".
+func isChunkKey(prefix string, key string) bool {
+	return strings.HasPrefix(key, s3Key(prefix, "chunks")+"/") && !strings.HasSuffix(key, ".tar.gz")
+}
+
+// chunkRef is one chunk of a file.
+type chunkRef struct {
+	// MD5 of the chunk's bytes.
+	Hash string
+	Size int64
+}
+
+type chunkParams struct {
+	// Chunks are cut where the rolling hash has this many low bits set to 0, unless that would make
+	// them smaller than Min or larger than Max. Chunks average around 2^AvgBits bytes.
+	Min     int
+	AvgBits uint
+	Max     int
+}
+
+// The chunk sizes to split files with. Changing them changes where files are cut, so unchanged
+// files would be stored again.
+var chunkSizes = chunkParams{
+	Min:     256 * 1024,
+	AvgBits: 20,
+	Max:     4 * 1024 * 1024,
+}
+
+// gearTable holds a pseudo-random value for each byte, for the rolling hash.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	// splitmix64, from a fixed seed so that chunk boundaries never change.
+	x := uint64(0x6a09e667f3bcc908)
+	for i := range table {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// splitChunks splits the reader's contents into content-defined chunks, and calls fn with each of
+// them in order. The slice passed to fn is reused afterwards.
+func splitChunks(r io.Reader, params chunkParams, fn func(chunk []byte) error) error {
+	mask := uint64(1)<<params.AvgBits - 1
+	br := bufio.NewReader(r)
+	buf := make([]byte, 0, params.Max)
+	var hash uint64
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		buf = append(buf, b)
+		hash = hash<<1 + gearTable[b]
+		if (len(buf) >= params.Min && hash&mask == 0) || len(buf) >= params.Max {
+			if err := fn(buf); err != nil {
+				return err
+			}
+			buf = buf[:0]
+			hash = 0
+		}
+	}
+	if len(buf) > 0 {
+		return fn(buf)
+	}
+	return nil
+}
+
+// backupChunkedFile uploads the chunks of a file that aren't already stored, and returns the file's
+// chunks to be recorded in the db. Like backupBlob, the file's hash is computed from the bytes that
+// were read.
+func backupChunkedFile(
+	logger logging.Logger,
+	client s3_helpers.Client,
+	bucket string,
+	prefix string,
+	localRoot string,
+	// Relative to the local root
+	filePath string,
+	// Chunks can be shared by several files, so they only get the backup's metadata.
+	metadata map[string]string,
+	// See compressionLevel.
+	level int,
+) (*uploadedArchive, error) {
+	localPath := filepath.Join(localRoot, filePath)
+	file, err := openRegularFile(localPath)
+	if err != nil {
+		return nil, &fileError{Path: filePath, Err: err}
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Verbosef("backing up file %q in chunks", filePath)
+	h := md5.New()
+	var chunks []chunkRef
+	var uploadedBytes int64
+	// Only the chunks that were uploaded were compressed.
+	var compression CompressionStats
+	reader := io.TeeReader(io.LimitReader(file, info.Size()), h)
+	err = splitChunks(reader, chunkSizes, func(chunk []byte) error {
+		ref := chunkRef{
+			Hash: fmt.Sprintf("%x", md5.Sum(chunk)),
+			Size: int64(len(chunk)),
+		}
+		chunks = append(chunks, ref)
+
+		key := chunkKey(prefix, ref.Hash)
+		exists, err := s3_helpers.ObjectExists(client, bucket, key)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return nil
+		}
+		buf := &bytes.Buffer{}
+		gw, err := gzip.NewWriterLevel(buf, level)
+		if err != nil {
+			return err
+		}
+		if _, err := gw.Write(chunk); err != nil {
+			return err
+		}
+		if err := gw.Close(); err != nil {
+			return fmt.Errorf("failed to close gzip writer: %v", err)
+		}
+		logger.Verbosef("  uploading chunk %q (%d bytes)", key, len(chunk))
+		_, err = client.PutObject(context.TODO(), &s3.PutObjectInput{
+			Bucket:      aws.String(bucket),
+			Key:         aws.String(key),
+			Body:        bytes.NewReader(buf.Bytes()),
+			ContentType: aws.String(gzipContentType),
+			Metadata:    metadata,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to upload chunk %q: %v", key, err)
+		}
+		uploadedBytes += int64(buf.Len())
+		compression.Uncompressed += int64(len(chunk))
+		compression.Compressed += int64(buf.Len())
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to back up file %q in chunks: %v", localPath, err)
+	}
+
+	after, err := os.Stat(localPath)
+	if err != nil {
+		return nil, err
+	}
+	af := &archivedFile{
+		ModTime: info.ModTime(),
+		Hash:    fmt.Sprintf("%x", h.Sum(nil)),
+		Changed: !after.ModTime().Equal(info.ModTime()) || after.Size() != info.Size(),
+	}
+	logger.Verbosef("  uploaded %d of %d bytes", uploadedBytes, info.Size())
+	return &uploadedArchive{
+		Files:       map[string]*archivedFile{filePath: af},
+		Size:        uploadedBytes,
+		Compression: compression,
+		Chunks:      chunks,
+	}, nil
+}
+
+// recoverChunkedFiles restores every file that's stored in chunks, using the db to find each file's
+// chunks and modtime.
+func recoverChunkedFiles(
+	logger logging.Logger,
+	client s3_helpers.Client,
+	db *DB,
+	bucket string,
+	prefix string,
+	localRoot string,
+	options RecoveryOptions,
+) ([]string, error) {
+	chunked, err := db.GetAllFileChunks()
+	if err != nil {
+		return nil, fmt.Errorf("error loading chunks from db: %v", err)
+	}
+	if len(chunked) == 0 {
+		return nil, nil
+	}
+	files, err := db.GetAllFiles()
+	if err != nil {
+		return nil, fmt.Errorf("error loading files from db: %v", err)
+	}
+
+	var missing []string
+	for _, file := range files {
+		chunks, ok := chunked[file.Path]
+		if !ok || file.Batch != file.Path {
+			continue
+		}
+		relPath, ok := options.remapPath(file.Path)
+		if !ok {
+			continue
+		}
+		localPath, err := safeJoin(localRoot, relPath)
+		if err != nil {
+			return missing, err
+		}
+		write, err := shouldWriteFile(localPath, file.ModTime, options.Conflict)
+		if err != nil {
+			return missing, err
+		}
+		if !write {
+			logger.Verbosef("keeping existing file %q", localPath)
+			continue
+		}
+
+		logger.Verbosef("restoring %q from %d chunks", localPath, len(chunks))
+		err = restoreChunks(client, bucket, prefix, chunks, localPath, options.extractLimit)
+		var missingErr *MissingObjectsError
+		if errors.As(err, &missingErr) {
+			logger.Infof("chunk %q, holding part of %q, is missing from the bucket", missingErr.Keys[0], displayPath(file.Path))
+			if !options.BestEffort {
+				return missing, err
+			}
+			missing = append(missing, missingErr.Keys...)
+			continue
+		}
+		if err != nil {
+			return missing, fmt.Errorf("failed to restore %q: %w", localPath, err)
+		}
+		if err := os.Chtimes(localPath, file.ModTime, file.ModTime); err != nil {
+			return missing, fmt.Errorf("failed to set modtime of %q: %v", localPath, err)
+		}
+	}
+	return missing, nil
+}
+
+// restoreChunks writes the chunks to a temporary file next to localPath, and moves it into place
+// once they've all been written, within the limit if there is one.
+func restoreChunks(client s3_helpers.Client, bucket string, prefix string, chunks []chunkRef, localPath string, limit *extractLimit) error {
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(localPath), filepath.Base(localPath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	w := limit.writer(tmp, localPath)
+	for _, chunk := range chunks {
+		key := chunkKey(prefix, chunk.Hash)
+		body, err := s3_helpers.OpenObject(client, bucket, key)
+		if errors.Is(err, s3_helpers.ErrNotFound) {
+			return &MissingObjectsError{Keys: []string{key}}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to download chunk %q: %v", key, err)
+		}
+		err = gunzipTo(w, body)
+		body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to decompress chunk %q: %w", key, err)
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), localPath)
+}
+
+// DeleteFileChunks forgets the file's chunks, once it's no longer stored in chunks.
+func (db *DB) DeleteFileChunks(path string) error {
+	_, err := db.db.Exec(`DELETE FROM chunks WHERE path = ?`, path)
+	return err
+}
+
+// GetAllFileChunks returns the chunks of every file that's stored in chunks, by path.
+func (db *DB) GetAllFileChunks() (map[string][]chunkRef, error) {
+	rows, err := db.db.Query(`SELECT path, hash, size FROM chunks ORDER BY path, idx`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chunks := make(map[string][]chunkRef)
+	for rows.Next() {
+		var path string
+		var chunk chunkRef
+		if err := rows.Scan(&path, &chunk.Hash, &chunk.Size); err != nil {
+			return nil, err
+		}
+		chunks[path] = append(chunks[path], chunk)
+	}
+	return chunks, rows.Err()
+}
@@ -0,0 +1,139 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"local/backup/lib/logging"
+)
+
+var testChunkSizes = chunkParams{
+	Min:     4 * 1024,
+	AvgBits: 14,
+	Max:     64 * 1024,
+}
+
+func useTestChunkSizes(t *testing.T) {
+	saved := chunkSizes
+	chunkSizes = testChunkSizes
+	t.Cleanup(func() { chunkSizes = saved })
+}
+
+func collectChunks(t *testing.T, data []byte) [][]byte {
+	var chunks [][]byte
+	must(splitChunks(bytes.NewReader(data), testChunkSizes, func(chunk []byte) error {
+		chunks = append(chunks, append([]byte(nil), chunk...))
+		return nil
+	}))
+	return chunks
+}
+
+func TestSplitChunks(t *testing.T) {
+	data := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	chunks := collectChunks(t, data)
+	assert.Equal(t, data, bytes.Join(chunks, nil))
+	for _, chunk := range chunks[:len(chunks)-1] {
+		assert.GreaterOrEqual(t, len(chunk), testChunkSizes.Min)
+		assert.LessOrEqual(t, len(chunk), testChunkSizes.Max)
+	}
+
+	// Inserting bytes only changes the chunks around them.
+	edited := append(append(append([]byte(nil), data[:500000]...), "inserted"...), data[500000:]...)
+	editedChunks := collectChunks(t, edited)
+	assert.Equal(t, edited, bytes.Join(editedChunks, nil))
+	unchanged := make(map[string]bool)
+	for _, chunk := range chunks {
+		unchanged[string(chunk)] = true
+	}
+	changed := 0
+	for _, chunk := range editedChunks {
+		if !unchanged[string(chunk)] {
+			changed++
+		}
+	}
+	assert.LessOrEqual(t, changed, 2)
+}
+
+func TestBackupFiles_Chunked(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+	config.SizeThreshold = 100
+	useTestChunkSizes(t)
+
+	data := make([]byte, 2*1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	bigFile := filepath.Join(testBaseDir, "dir1/big.bin")
+	must(os.MkdirAll(filepath.Dir(bigFile), os.ModePerm))
+	must(os.WriteFile(bigFile, data, 0644))
+	must(createTestFile(filepath.Join(testBaseDir, "dir1/small.txt"), 5))
+
+	cfg := GetMinioConfig(minioUrl)
+	metrics := &CounterMetrics{}
+	backup := func() error {
+		return BackupFiles(
+			context.Background(),
+			logger,
+			cfg,
+			config.DBFile,
+			testBaseDir,
+			config.Bucket,
+			config.S3Prefix,
+			config.BackupName,
+			config.SizeThreshold,
+			BackupOptions{
+				ChunkThreshold: 1024 * 1024,
+				Metrics:        metrics,
+			},
+		)
+	}
+	must(backup())
+	firstUpload := metrics.BytesUploaded.Load()
+	assert.Greater(t, firstUpload, int64(len(data)))
+
+	// Edit a few bytes in the middle of the file. Only the chunk around them is uploaded again.
+	copy(data[1000000:], "edited")
+	must(os.WriteFile(bigFile, data, 0644))
+	later := time.Now().Add(time.Minute)
+	must(os.Chtimes(bigFile, later, later))
+	must(backup())
+	secondUpload := metrics.BytesUploaded.Load() - firstUpload
+	assert.Greater(t, secondUpload, int64(0))
+	assert.Less(t, secondUpload, firstUpload/10)
+
+	// The chunks of both versions are kept until GC removes the unused ones.
+	orphans, err := GC(logger, cfg, config.DBFile, config.Bucket, config.S3Prefix, config.BackupName, GCOptions{})
+	must(err)
+	assert.NotEmpty(t, orphans)
+	for _, key := range orphans {
+		assert.True(t, isChunkKey(config.FullS3Prefix, key), key)
+	}
+
+	testRecoveryDir, err := os.MkdirTemp("/tmp", "dave-recovery-test-")
+	must(err)
+	defer os.RemoveAll(testRecoveryDir)
+	must(RecoverFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		testRecoveryDir,
+		RecoveryOptions{Verify: true},
+	))
+	compareDirectories(testBaseDir, testRecoveryDir, t)
+}
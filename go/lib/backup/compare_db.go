@@ -1,41 +1,98 @@
 package backup
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"local/backup/lib/logging"
 	"local/backup/lib/s3_helpers"
 	"os"
-	"path/filepath"
 	"sort"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
-func backupDB(logger logging.Logger, client *s3.Client, dbFile string, bucket string, prefix string) error {
-	dir := filepath.Dir(dbFile)
-	file := filepath.Base(dbFile)
+// backupDB replaces the remote db with the local one. The db is uploaded to a temporary key and
+// checked before being copied over the canonical key, so a failed or partial upload never leaves
+// the canonical db truncated.
+func backupDB(logger logging.Logger, client s3_helpers.Client, dbFile string, bucket string, prefixBase string, backupName string) error {
+	key := dbKey(prefixBase, backupName)
+	tmpKey := key + ".tmp"
 
 	// Explicitly don't use the archive, since changing the modtime of an SQLite database is
 	// potentially dangerous.
-	return backupFileNoArchive(logger, client, bucket, prefix, dir, file)
-	//return backupFile(logger, client, bucket, prefix, dir, file)
+	size, err := backupFileNoArchive(logger, client, bucket, tmpKey, dbFile)
+	if err != nil {
+		return err
+	}
+	head, err := client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(tmpKey),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to check uploaded db %q: %v", tmpKey, err)
+	}
+	if aws.ToInt64(head.ContentLength) != size {
+		return fmt.Errorf("uploaded db %q is %d bytes, expected %d", tmpKey, aws.ToInt64(head.ContentLength), size)
+	}
+
+	logger.Verbosef("copying %q to %q", tmpKey, key)
+	_, err = client.CopyObject(context.TODO(), &s3.CopyObjectInput{
+		Bucket:     aws.String(bucket),
+		CopySource: aws.String(copySource(bucket, tmpKey)),
+		Key:        aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to copy %q to %q: %v", tmpKey, key, err)
+	}
+	if err := deleteObject(client, bucket, tmpKey); err != nil {
+		return fmt.Errorf("failed to delete %q: %v", tmpKey, err)
+	}
+	return nil
 }
 
 func downloadAndCompareDB(
 	logger logging.Logger,
-	client *s3.Client,
+	client s3_helpers.Client,
 	dbFile string,
 	bucket string,
 	prefixBase string,
 	backupName string,
+	// Where to download the remote db to. Defaults to os.TempDir().
+	tmpDir string,
 ) ([]string, error) {
+	drift, err := downloadAndDiffDB(logger, client, dbFile, bucket, prefixBase, backupName, tmpDir)
+	if err != nil {
+		return nil, err
+	}
+	var changes []string
+	for _, d := range drift {
+		changes = append(changes, d.changes()...)
+	}
+	return changes, nil
+}
+
+// downloadAndDiffDB is downloadAndCompareDB, returning the files that differ between the local and
+// remote db, in path order, instead of describing them.
+func downloadAndDiffDB(
+	logger logging.Logger,
+	client s3_helpers.Client,
+	dbFile string,
+	bucket string,
+	prefixBase string,
+	backupName string,
+	tmpDir string,
+) ([]fileDrift, error) {
 	// Check if the local db exists. If not, then we're doing a fresh backup or recovery.
 	if _, err := os.Stat(dbFile); os.IsNotExist(err) {
 		return nil, nil
 	}
 
-	remoteDBFile, err := downloadDB(logger, client, bucket, prefixBase, backupName, os.TempDir())
+	if tmpDir == "" {
+		tmpDir = os.TempDir()
+	}
+	remoteDBFile, err := downloadDB(logger, client, bucket, prefixBase, backupName, tmpDir)
 	if err != nil {
 		if errors.Is(err, s3_helpers.ErrNotFound) {
 			// This just means the backup doesn't exist yet.
@@ -70,14 +127,19 @@ func downloadAndCompareDB(
 		return nil, fmt.Errorf("failed to get all files from remote db: %v", err)
 	}
 
-	// Sort each list by path.
-	sort.Slice(localFiles, func(i, j int) bool {
-		return localFiles[i].Path < localFiles[j].Path
-	})
-	sort.Slice(remoteFiles, func(i, j int) bool {
-		return remoteFiles[i].Path < remoteFiles[j].Path
-	})
+	return diffFiles(localFiles, remoteFiles), nil
+}
+
+// fileDrift is a file whose entry differs between the local and remote db. Local or Remote is nil
+// if that db doesn't have the file.
+type fileDrift struct {
+	Path   string
+	Local  *FileInfo
+	Remote *FileInfo
+}
 
+// diffFiles returns the files that differ between the local and remote db, in path order.
+func diffFiles(localFiles []*FileInfo, remoteFiles []*FileInfo) []fileDrift {
 	// Put each list in a map by path.
 	localFilesMap := make(map[string]*FileInfo)
 	for _, file := range localFiles {
@@ -88,67 +150,94 @@ func downloadAndCompareDB(
 		remoteFilesMap[file.Path] = file
 	}
 
-	var changes []string
-
-	// Compare each file in the local db to the remote db.
+	var drift []fileDrift
 	for _, localFile := range localFiles {
 		remoteFile, ok := remoteFilesMap[localFile.Path]
-		if !ok {
-			changes = append(changes, fmt.Sprintf("%q not found in remote db", localFile.Path))
-			continue
-		}
-		if localFile.ModTime != remoteFile.ModTime {
-			changes = append(changes, fmt.Sprintf("%q has different mod time in local and remote db", localFile.Path))
-		}
-		if localFile.Hash != remoteFile.Hash {
-			changes = append(changes, fmt.Sprintf("%q has different hash in local and remote db", localFile.Path))
-		}
-		if localFile.Batch != remoteFile.Batch {
-			changes = append(changes, fmt.Sprintf("%q has different batch in local and remote db", localFile.Path))
+		if !ok || !sameFileInfo(localFile, remoteFile) {
+			drift = append(drift, fileDrift{Path: localFile.Path, Local: localFile, Remote: remoteFile})
 		}
 	}
-
 	// Finally, check for files that are in the remote db but not the local db.
 	for _, remoteFile := range remoteFiles {
 		if _, ok := localFilesMap[remoteFile.Path]; !ok {
-			changes = append(changes, fmt.Sprintf("%q not found in local db", remoteFile.Path))
+			drift = append(drift, fileDrift{Path: remoteFile.Path, Remote: remoteFile})
 		}
 	}
 
-	return changes, nil
+	sort.Slice(drift, func(i, j int) bool {
+		return drift[i].Path < drift[j].Path
+	})
+	return drift
+}
+
+func sameFileInfo(a *FileInfo, b *FileInfo) bool {
+	return modTimesEqual(a.ModTime, b.ModTime) && a.Hash == b.Hash && a.Batch == b.Batch
+}
+
+// changes describes how the file differs, one line per difference.
+func (d fileDrift) changes() []string {
+	if d.Remote == nil {
+		return []string{fmt.Sprintf("%q not found in remote db", d.Path)}
+	}
+	if d.Local == nil {
+		return []string{fmt.Sprintf("%q not found in local db", d.Path)}
+	}
+	var changes []string
+	if !modTimesEqual(d.Local.ModTime, d.Remote.ModTime) {
+		changes = append(changes, fmt.Sprintf("%q has different mod time in local and remote db", d.Path))
+	}
+	if d.Local.Hash != d.Remote.Hash {
+		changes = append(changes, fmt.Sprintf("%q has different hash in local and remote db", d.Path))
+	}
+	if d.Local.Batch != d.Remote.Batch {
+		changes = append(changes, fmt.Sprintf("%q has different batch in local and remote db", d.Path))
+	}
+	return changes
 }
 
+// downloadDB downloads and decompresses the remote db to a new file in localDir, and returns its
+// path. The file gets a name of its own, so it never replaces a db that's already in localDir, such
+// as the local one. If the download fails, nothing is left behind.
 func downloadDB(
 	logger logging.Logger,
-	client *s3.Client,
+	client s3_helpers.Client,
 	bucket string,
 	prefixBase string,
 	backupName string,
 	localDir string,
 ) (string, error) {
-	// Download the remote DB file.
-	remoteDBKey := filepath.Join(prefixBase, fmt.Sprintf("%s.db.gz", backupName))
-	remoteDBFileCompressed := filepath.Join(localDir, fmt.Sprintf("%s.db.gz", backupName))
-	logger.Verbosef("downloading db from %q to %q", remoteDBKey, remoteDBFileCompressed)
-	err := s3_helpers.DownloadFile(client, bucket, remoteDBKey, remoteDBFileCompressed)
+	return downloadDBKey(logger, client, bucket, dbKey(prefixBase, backupName), backupName, localDir)
+}
+
+// downloadDBKey is downloadDB for the db stored under the given key, such as a kept version.
+func downloadDBKey(
+	logger logging.Logger,
+	client s3_helpers.Client,
+	bucket string,
+	remoteDBKey string,
+	backupName string,
+	localDir string,
+) (string, error) {
+	body, err := s3_helpers.OpenObject(client, bucket, remoteDBKey)
 	if err != nil {
 		return "", err
 	}
-	defer os.Remove(remoteDBFileCompressed)
+	defer body.Close()
 
-	// Decompress the remote db file.
-	remoteDBFile, err := decompressFile(remoteDBFileCompressed, localDir)
+	remoteDBFile, err := os.CreateTemp(localDir, fmt.Sprintf("%s.remote.*.db", backupName))
 	if err != nil {
+		return "", fmt.Errorf("failed to create temporary db file: %v", err)
+	}
+	logger.Verbosef("downloading db from %q to %q", remoteDBKey, remoteDBFile.Name())
+	err = gunzipTo(remoteDBFile, body)
+	if closeErr := remoteDBFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(remoteDBFile.Name())
 		return "", fmt.Errorf("failed to decompress db file: %v", err)
 	}
-
-	//err = unTar(remoteDBFileCompressed, localDir)
-	//if err != nil {
-	//	return "", fmt.Errorf("failed to untar db file: %v", err)
-	//}
-	//remoteDBFile := strings.TrimSuffix(remoteDBFileCompressed, ".tar.gz")
-
-	return remoteDBFile, nil
+	return remoteDBFile.Name(), nil
 }
 
 func printChanges(changes []string) {
@@ -1,14 +1,22 @@
 package backup
 
 import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
 
 	"local/backup/lib/logging"
+	"local/backup/lib/s3_helpers"
 	"local/backup/lib/util"
 )
 
@@ -28,6 +36,7 @@ func TestCompareDB(t *testing.T) {
 	s3Client := s3.NewFromConfig(*cfg)
 
 	must(BackupFiles(
+		context.Background(),
 		logger,
 		cfg,
 		testConfig.DBFile,
@@ -106,6 +115,7 @@ func TestCompareDB(t *testing.T) {
 				testConfig.Bucket,
 				testConfig.S3Prefix,
 				testConfig.BackupName,
+				"",
 			)
 			must(err)
 			if len(changes) == 0 {
@@ -114,3 +124,210 @@ func TestCompareDB(t *testing.T) {
 		})
 	}
 }
+
+// truncatingUploadClient uploads only the first half of the body of PUTs to keys with the given
+// suffix, as if the upload had been cut off.
+type truncatingUploadClient struct {
+	suffix string
+}
+
+func (c *truncatingUploadClient) Do(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodPut && strings.HasSuffix(req.URL.Path, c.suffix) && req.Body != nil {
+		data, err := io.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		data = data[:len(data)/2]
+		req.Body = io.NopCloser(bytes.NewReader(data))
+		req.ContentLength = int64(len(data))
+	}
+	return http.DefaultClient.Do(req)
+}
+
+func TestBackupDB_InterruptedUpload(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 5))
+	cfg := GetMinioConfig(minioUrl)
+	client := s3.NewFromConfig(*cfg)
+	must(BackupFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		testBaseDir,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		config.SizeThreshold,
+		BackupOptions{},
+	))
+	key := dbKey(config.S3Prefix, config.BackupName)
+	original, err := s3_helpers.DownloadBytes(client, config.Bucket, key)
+	must(err)
+
+	// Change the local db, so a successful upload would be noticed.
+	db, err := NewDB(config.DBFile)
+	must(err)
+	must(db.setMeta(metaToolVersion, "changed"))
+	must(db.Close())
+
+	for _, httpClient := range []aws.HTTPClient{
+		&truncatingUploadClient{suffix: ".db.gz.tmp"},
+		&failingUploadClient{suffix: ".db.gz.tmp"},
+	} {
+		failingCfg := GetMinioConfig(minioUrl)
+		failingCfg.HTTPClient = httpClient
+		err := backupDB(logger, s3.NewFromConfig(*failingCfg), config.DBFile, config.Bucket, config.S3Prefix, config.BackupName)
+		assert.Error(t, err)
+
+		data, err := s3_helpers.DownloadBytes(client, config.Bucket, key)
+		must(err)
+		assert.Equal(t, original, data)
+	}
+
+	// A successful upload replaces the db and cleans up after itself.
+	must(backupDB(logger, client, config.DBFile, config.Bucket, config.S3Prefix, config.BackupName))
+	data, err := s3_helpers.DownloadBytes(client, config.Bucket, key)
+	must(err)
+	assert.NotEqual(t, original, data)
+	exists, err := s3_helpers.ObjectExists(client, config.Bucket, key+".tmp")
+	must(err)
+	assert.False(t, exists)
+}
+
+func TestDownloadDB_NoTempFilesRemain(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+
+	must(createTestFile(filepath.Join(config.TestBaseDir, "a.txt"), 5))
+	cfg := GetMinioConfig(minioUrl)
+	client := s3.NewFromConfig(*cfg)
+	must(BackupFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		config.TestBaseDir,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		config.SizeThreshold,
+		BackupOptions{},
+	))
+
+	localDir := t.TempDir()
+	dbFile, err := downloadDB(logger, client, config.Bucket, config.S3Prefix, config.BackupName, localDir)
+	must(err)
+	assert.Equal(t, localDir, filepath.Dir(dbFile))
+	db, err := NewDB(dbFile)
+	must(err)
+	files, err := db.GetAllFiles()
+	must(err)
+	assert.Len(t, files, 1)
+	must(db.Close())
+	entries, err := os.ReadDir(localDir)
+	must(err)
+	assert.Len(t, entries, 1)
+
+	// A corrupt db leaves nothing behind either.
+	must(s3_helpers.UploadBytes(client, config.Bucket, dbKey(config.S3Prefix, config.BackupName), []byte("not gzipped")))
+	localDir = t.TempDir()
+	_, err = downloadDB(logger, client, config.Bucket, config.S3Prefix, config.BackupName, localDir)
+	assert.Error(t, err)
+	entries, err = os.ReadDir(localDir)
+	must(err)
+	assert.Empty(t, entries)
+}
+
+// countingDownloadClient counts the downloads of objects whose keys end with suffix.
+type countingDownloadClient struct {
+	suffix string
+	count  int
+}
+
+func (c *countingDownloadClient) Do(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodGet && strings.HasSuffix(req.URL.Path, c.suffix) {
+		c.count++
+	}
+	return http.DefaultClient.Do(req)
+}
+
+func TestBackupFiles_TempDirIsDBDir(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getMemoryTestConfig()
+	defer config.Cleanup()
+
+	// The remote db is downloaded next to the local one, which has the name it would get.
+	backup := func() {
+		must(BackupFiles(context.Background(), logger, &aws.Config{}, config.DBFile, config.TestBaseDir, config.Bucket, config.S3Prefix, config.BackupName, config.SizeThreshold, BackupOptions{
+			Storage: config.Storage,
+			TempDir: filepath.Dir(config.DBFile),
+		}))
+	}
+	must(createTestFile(filepath.Join(config.TestBaseDir, "a.txt"), 5))
+	backup()
+	must(createTestFile(filepath.Join(config.TestBaseDir, "b.txt"), 5))
+	backup()
+
+	db, err := NewDB(config.DBFile)
+	must(err)
+	defer db.Close()
+	files, err := db.GetAllFiles()
+	must(err)
+	assert.Len(t, files, 2)
+	entries, err := os.ReadDir(filepath.Dir(config.DBFile))
+	must(err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	assert.Equal(t, []string{filepath.Base(config.DBFile)}, names)
+}
+
+func TestBackupFiles_SkipRemoteCheck(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 5))
+	backup := func(options BackupOptions) int {
+		httpClient := &countingDownloadClient{suffix: dbKey(config.S3Prefix, config.BackupName)}
+		cfg := GetMinioConfig(minioUrl)
+		cfg.HTTPClient = httpClient
+		must(BackupFiles(
+			context.Background(),
+			logger,
+			cfg,
+			config.DBFile,
+			testBaseDir,
+			config.Bucket,
+			config.S3Prefix,
+			config.BackupName,
+			config.SizeThreshold,
+			options,
+		))
+		return httpClient.count
+	}
+	backup(BackupOptions{})
+
+	// By default the remote db is downloaded to compare it to the local one.
+	must(createTestFile(filepath.Join(testBaseDir, "b.txt"), 5))
+	assert.Equal(t, 1, backup(BackupOptions{}))
+
+	must(createTestFile(filepath.Join(testBaseDir, "c.txt"), 5))
+	assert.Equal(t, 0, backup(BackupOptions{SkipRemoteCheck: true}))
+}
@@ -3,45 +3,92 @@ package backup
 import (
 	"archive/tar"
 	"compress/gzip"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
-func decompressFile(sourcePath string, destinationDir string) (string, error) {
-	archiveFile, err := os.Open(sourcePath)
-	if err != nil {
-		return "", err
-	}
-	defer archiveFile.Close()
+// The content type of everything that's uploaded, since it's all gzipped.
+const gzipContentType = "application/gzip"
 
-	gzr, err := gzip.NewReader(archiveFile)
-	if err != nil {
-		return "", err
+type extractOptions struct {
+	// If set, maps each entry's slash-separated name to the path to extract it to, relative to the
+	// destination directory, or returns false to skip the entry. Entries can never be extracted
+	// outside of the destination directory.
+	MapName func(name string) (string, bool)
+	// What to do about files that already exist.
+	Conflict ConflictPolicy
+	// If set, caps how much is extracted. See extractLimit.
+	Limit *extractLimit
+}
+
+// Returned when recovery would extract more than RecoveryOptions.MaxExtractedBytes or
+// MaxExtractedFileBytes allow.
+var ErrExtractLimitExceeded = errors.New("extraction limit exceeded")
+
+// extractLimit caps how many bytes a recovery extracts, per file and in total, so that an archive
+// that decompresses to far more than it should (a decompression bomb, say, in a bucket that others
+// can write to) can't fill up the disk. It's shared by all the archives being extracted at once. A
+// nil extractLimit doesn't limit anything.
+type extractLimit struct {
+	maxFile  int64
+	maxTotal int64
+	total    atomic.Int64
+}
+
+// newExtractLimit returns a limit with the given maximums, where 0 means unlimited, or nil if
+// neither is set.
+func newExtractLimit(maxFile int64, maxTotal int64) *extractLimit {
+	if maxFile <= 0 && maxTotal <= 0 {
+		return nil
 	}
-	defer gzr.Close()
+	return &extractLimit{maxFile: maxFile, maxTotal: maxTotal}
+}
 
-	destinationFilename := filepath.Join(destinationDir, filepath.Base(sourcePath))
-	destinationFilename = strings.TrimSuffix(destinationFilename, ".gz")
-	destinationFile, err := os.Create(destinationFilename)
-	if err != nil {
-		return "", err
+// checkSize fails early for a file that's declared to be bigger than the limit per file.
+func (l *extractLimit) checkSize(name string, size int64) error {
+	if l != nil && l.maxFile > 0 && size > l.maxFile {
+		return fmt.Errorf("%w: %q is %d bytes, more than the limit of %d bytes per file", ErrExtractLimitExceeded, name, size, l.maxFile)
 	}
-	defer destinationFile.Close()
+	return nil
+}
 
-	_, err = io.Copy(destinationFile, gzr)
-	if err != nil {
-		return "", err
+// writer wraps w, which the file with the given name is extracted to, so that writes fail once
+// either limit would be exceeded.
+func (l *extractLimit) writer(w io.Writer, name string) io.Writer {
+	if l == nil {
+		return w
 	}
+	return &limitedWriter{w: w, limit: l, name: name}
+}
 
-	return destinationFilename, nil
+type limitedWriter struct {
+	w     io.Writer
+	limit *extractLimit
+	name  string
+	n     int64
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	if w.limit.maxFile > 0 && w.n > w.limit.maxFile {
+		return 0, fmt.Errorf("%w: %q is more than the limit of %d bytes per file", ErrExtractLimitExceeded, w.name, w.limit.maxFile)
+	}
+	if total := w.limit.total.Add(int64(len(p))); w.limit.maxTotal > 0 && total > w.limit.maxTotal {
+		return 0, fmt.Errorf("%w: extracting %q goes past the limit of %d bytes in total", ErrExtractLimitExceeded, w.name, w.limit.maxTotal)
+	}
+	return w.w.Write(p)
 }
 
 // Mostly from https://medium.com/@skdomino/taring-untaring-files-in-go-6b07cf56bc07
-func unTar(path string, destinationDir string) error {
+func unTar(path string, destinationDir string, options extractOptions) error {
 	archiveFile, err := os.Open(path)
 	if err != nil {
 		return err
@@ -74,7 +121,18 @@ func unTar(path string, destinationDir string) error {
 		}
 
 		// the target location where the dir/file should be created
-		target := filepath.Join(destinationDir, header.Name)
+		name := filepath.ToSlash(header.Name)
+		if options.MapName != nil {
+			var ok bool
+			name, ok = options.MapName(name)
+			if !ok {
+				continue
+			}
+		}
+		target, err := safeJoin(destinationDir, name)
+		if err != nil {
+			return err
+		}
 		log.Printf("extracting %q", target)
 
 		// the following switch could also be done using fi.Mode(), not sure if there
@@ -94,6 +152,17 @@ func unTar(path string, destinationDir string) error {
 
 		// if it's a file create it
 		case tar.TypeReg:
+			if err := options.Limit.checkSize(name, header.Size); err != nil {
+				return err
+			}
+			write, err := shouldWriteFile(target, header.ModTime, options.Conflict)
+			if err != nil {
+				return err
+			}
+			if !write {
+				log.Printf("keeping existing file %q", target)
+				continue
+			}
 			// Create all intermediate directories required
 			dirPath := filepath.Dir(target)
 			if _, err := os.Stat(dirPath); err != nil {
@@ -102,13 +171,14 @@ func unTar(path string, destinationDir string) error {
 					return err
 				}
 			}
-			f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR, os.FileMode(header.Mode))
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR|os.O_TRUNC, os.FileMode(header.Mode))
 			if err != nil {
 				return err
 			}
 
 			// copy over contents
-			if _, err := io.Copy(f, tr); err != nil {
+			if _, err := io.Copy(options.Limit.writer(f, name), tr); err != nil {
+				f.Close()
 				return err
 			}
 
@@ -121,6 +191,189 @@ func unTar(path string, destinationDir string) error {
 			// manually close here after each file operation; defering would cause each file close
 			// to wait until all operations have completed.
 			f.Close()
+
+		// A hard link to a file earlier in the archive. See hardlinks.go.
+		case tar.TypeLink:
+			linkname := filepath.ToSlash(header.Linkname)
+			if options.MapName != nil {
+				var ok bool
+				linkname, ok = options.MapName(linkname)
+				if !ok {
+					log.Printf("skipping link %q to a file that wasn't extracted", target)
+					continue
+				}
+			}
+			linkTarget, err := safeJoin(destinationDir, linkname)
+			if err != nil {
+				return err
+			}
+			write, err := shouldWriteFile(target, header.ModTime, options.Conflict)
+			if err != nil {
+				return err
+			}
+			if !write {
+				log.Printf("keeping existing file %q", target)
+				continue
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err := os.Link(linkTarget, target); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// ConflictPolicy controls what recovery does when a file it's restoring already exists locally.
+type ConflictPolicy string
+
+const (
+	// Replace the local file. This is the default.
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	// Leave the local file alone.
+	ConflictSkipExisting ConflictPolicy = "skip-existing"
+	// Only replace the local file if the backed up version has a newer modtime.
+	ConflictKeepNewer ConflictPolicy = "keep-newer"
+)
+
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch policy := ConflictPolicy(s); policy {
+	case ConflictOverwrite, ConflictSkipExisting, ConflictKeepNewer:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown conflict policy %q", s)
+}
+
+// shouldWriteFile decides whether to restore a file with the given modtime over target.
+func shouldWriteFile(target string, modTime time.Time, policy ConflictPolicy) (bool, error) {
+	if policy == "" || policy == ConflictOverwrite {
+		return true, nil
+	}
+	info, err := os.Stat(target)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	switch policy {
+	case ConflictSkipExisting:
+		return false, nil
+	case ConflictKeepNewer:
+		return !modTimesEqual(modTime, info.ModTime()) && modTime.After(info.ModTime()), nil
+	}
+	return false, fmt.Errorf("unknown conflict policy %q", policy)
+}
+
+// safeJoin joins a slash-separated relative path onto root, refusing paths that would end up
+// outside of root.
+func safeJoin(root string, name string) (string, error) {
+	cleaned := path.Clean(name)
+	if path.IsAbs(cleaned) || cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("refusing to extract %q outside of %q", name, root)
+	}
+	return filepath.Join(root, filepath.FromSlash(cleaned)), nil
+}
+
+// gunzipFile decompresses sourcePath into destinationPath, creating its parent directories.
+func gunzipFile(sourcePath string, destinationPath string, limit *extractLimit) error {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	if err := os.MkdirAll(filepath.Dir(destinationPath), os.ModePerm); err != nil {
+		return err
+	}
+	destination, err := os.Create(destinationPath)
+	if err != nil {
+		return err
+	}
+	defer destination.Close()
+
+	return gunzipTo(limit.writer(destination, destinationPath), source)
+}
+
+// gunzipTo decompresses the gzipped source into destination.
+func gunzipTo(destination io.Writer, source io.Reader) error {
+	gzr, err := gzip.NewReader(source)
+	if err != nil {
+		return err
+	}
+	defer gzr.Close()
+
+	_, err = io.Copy(destination, gzr)
+	return err
+}
+
+// compressionLevel returns the gzip level to store a file at. Files with one of the given
+// extensions are most likely compressed already (like JPEGs or zip files), so compressing them
+// again would only waste time and could make them bigger. They're stored instead, which is still
+// valid gzip, so recovering them is no different.
+func compressionLevel(path string, noCompressExtensions []string) int {
+	if len(noCompressExtensions) > 0 && hasExtension(path, noCompressExtensions) {
+		return gzip.NoCompression
+	}
+	return gzip.DefaultCompression
+}
+
+// levelWriter gzips everything written to it, at a level that can be changed between writes, so an
+// archive can store some files and compress others. Changing the level starts a new gzip member.
+// Gzip readers read concatenated members as a single stream, so the output can be read like any
+// other gzip file.
+type levelWriter struct {
+	dst   io.Writer
+	level int
+	gw    *gzip.Writer
+	// Whether anything has been written to the current member.
+	written bool
+}
+
+func newLevelWriter(dst io.Writer, level int) (*levelWriter, error) {
+	gw, err := gzip.NewWriterLevel(dst, level)
+	if err != nil {
+		return nil, err
+	}
+	return &levelWriter{dst: dst, level: level, gw: gw}, nil
+}
+
+func (w *levelWriter) Write(p []byte) (int, error) {
+	// Even an empty write makes the gzip writer write its header, e.g. when the tar writer flushes
+	// a file that doesn't need padding.
+	if len(p) == 0 {
+		return 0, nil
+	}
+	w.written = true
+	return w.gw.Write(p)
+}
+
+// SetLevel compresses whatever's written next at the given level.
+func (w *levelWriter) SetLevel(level int) error {
+	if level == w.level {
+		return nil
+	}
+	// A gzip writer doesn't write anything until it's written to or closed, so an empty member can
+	// just be dropped.
+	if w.written {
+		if err := w.gw.Close(); err != nil {
+			return err
 		}
 	}
+	gw, err := gzip.NewWriterLevel(w.dst, level)
+	if err != nil {
+		return err
+	}
+	w.gw = gw
+	w.level = level
+	w.written = false
+	return nil
+}
+
+func (w *levelWriter) Close() error {
+	return w.gw.Close()
 }
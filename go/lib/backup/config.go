@@ -1,10 +1,21 @@
 package backup
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 )
 
 func GetMinioConfig(url string) *aws.Config {
@@ -27,7 +38,10 @@ func GetMinioConfig(url string) *aws.Config {
 	return cfg
 }
 
-func GetS3Config() *aws.Config {
+// GetS3Config builds a config for real S3 from the standard AWS environment variables. It returns
+// an error naming whichever of them are missing, rather than letting the SDK fail with an opaque
+// auth error partway through a run.
+func GetS3Config() (*aws.Config, error) {
 	// These should all be the same as what the AWS SDK defaults to, we just want to explicitly _only_
 	// look at these.
 	// TODO: there's gotta be a way to set up a custom credential chain so we don't have to do this
@@ -37,6 +51,20 @@ func GetS3Config() *aws.Config {
 	secret := os.Getenv("AWS_SECRET_ACCESS_KEY")
 	session := os.Getenv("AWS_SESSION_TOKEN")
 
+	var missing []string
+	for _, v := range []struct{ name, value string }{
+		{"AWS_REGION", region},
+		{"AWS_ACCESS_KEY_ID", key},
+		{"AWS_SECRET_ACCESS_KEY", secret},
+	} {
+		if v.value == "" {
+			missing = append(missing, v.name)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("missing AWS credentials: %s not set (credentials are only read from the environment, not from ~/.aws profiles)", strings.Join(missing, ", "))
+	}
+
 	cfg := &aws.Config{
 		Region: region,
 		Credentials: credentials.NewStaticCredentialsProvider(
@@ -45,5 +73,120 @@ func GetS3Config() *aws.Config {
 			session,
 		),
 	}
-	return cfg
+	return cfg, nil
+}
+
+// HTTPOptions configure the HTTP client used to talk to S3. Zero values leave the SDK's defaults in
+// place, which means no timeouts at all.
+type HTTPOptions struct {
+	// Max time to wait for a connection to be established.
+	DialTimeout time.Duration
+	// Max time to wait for a response's headers after the request has been sent.
+	ResponseHeaderTimeout time.Duration
+	// If set, all requests are sent through this proxy. Otherwise the usual HTTP_PROXY/HTTPS_PROXY
+	// environment variables apply.
+	ProxyURL string
+
+	// TLS settings for self-hosted endpoints (e.g. minio with a self-signed cert). These are only
+	// allowed on configs with a custom endpoint, never real AWS.
+	// Path to a PEM file of CA certs to trust, in addition to the system's.
+	CABundle string
+	// Disables certificate verification entirely. Only use this for testing.
+	InsecureSkipVerify bool
+}
+
+// SetHTTPOptions replaces the config's HTTP client with one built from the given options.
+func SetHTTPOptions(cfg *aws.Config, options HTTPOptions) error {
+	if (options.CABundle != "" || options.InsecureSkipVerify) && cfg.EndpointResolver == nil {
+		return fmt.Errorf("custom TLS settings are only supported with a custom S3 endpoint")
+	}
+	transport, err := newHTTPTransport(options)
+	if err != nil {
+		return err
+	}
+	cfg.HTTPClient = &http.Client{Transport: transport}
+	return nil
+}
+
+func newHTTPTransport(options HTTPOptions) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if options.DialTimeout > 0 {
+		dialer := &net.Dialer{
+			Timeout:   options.DialTimeout,
+			KeepAlive: 30 * time.Second,
+		}
+		transport.DialContext = dialer.DialContext
+	}
+	transport.ResponseHeaderTimeout = options.ResponseHeaderTimeout
+	if options.ProxyURL != "" {
+		proxyURL, err := url.Parse(options.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy url %q: %v", options.ProxyURL, err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	if options.CABundle != "" || options.InsecureSkipVerify {
+		tlsConfig, err := newTLSConfig(options)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	return transport, nil
+}
+
+func newTLSConfig(options HTTPOptions) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if options.CABundle != "" {
+		pem, err := os.ReadFile(options.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %q", options.CABundle)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if options.InsecureSkipVerify {
+		log.Printf("WARNING: TLS certificate verification is disabled, connections to S3 are not secure")
+		tlsConfig.InsecureSkipVerify = true
+	}
+	return tlsConfig, nil
+}
+
+// AssumeRoleOptions describe an IAM role to assume, e.g. for backing up to another account's bucket.
+type AssumeRoleOptions struct {
+	RoleARN string
+	// Defaults to "dbackup".
+	SessionName string
+	// Only needed if the role's trust policy requires one.
+	ExternalID string
+}
+
+// SetAssumeRole switches the config to use temporary credentials for the given role. The config's
+// existing credentials are used to call sts:AssumeRole, and the role's credentials are refreshed
+// automatically before they expire.
+func SetAssumeRole(cfg *aws.Config, options AssumeRoleOptions) error {
+	if options.RoleARN == "" {
+		return fmt.Errorf("role ARN is required")
+	}
+	stsClient := sts.NewFromConfig(*cfg)
+	cfg.Credentials = aws.NewCredentialsCache(newAssumeRoleProvider(stsClient, options))
+	return nil
+}
+
+func newAssumeRoleProvider(client stscreds.AssumeRoleAPIClient, options AssumeRoleOptions) *stscreds.AssumeRoleProvider {
+	return stscreds.NewAssumeRoleProvider(client, options.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+		o.RoleSessionName = options.SessionName
+		if o.RoleSessionName == "" {
+			o.RoleSessionName = "dbackup"
+		}
+		if options.ExternalID != "" {
+			o.ExternalID = aws.String(options.ExternalID)
+		}
+	})
 }
@@ -0,0 +1,166 @@
+package backup
+
+import (
+	"context"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	ststypes "github.com/aws/aws-sdk-go-v2/service/sts/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetHTTPOptions_TimeoutAgainstUnresponsiveEndpoint(t *testing.T) {
+	// Accept connections but never respond to them.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	must(err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	cfg := GetMinioConfig("http://" + listener.Addr().String())
+	cfg.RetryMaxAttempts = 1
+	must(SetHTTPOptions(cfg, HTTPOptions{
+		DialTimeout:           time.Second,
+		ResponseHeaderTimeout: 100 * time.Millisecond,
+	}))
+	client := s3.NewFromConfig(*cfg)
+
+	start := time.Now()
+	_, err = client.HeadBucket(context.TODO(), &s3.HeadBucketInput{
+		Bucket: aws.String(bucket),
+	})
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestSetHTTPOptions_InvalidProxy(t *testing.T) {
+	cfg := GetMinioConfig(minioUrl)
+	assert.Error(t, SetHTTPOptions(cfg, HTTPOptions{ProxyURL: "://bad"}))
+}
+
+func TestSetHTTPOptions_CustomTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	caBundle := filepath.Join(t.TempDir(), "ca.pem")
+	must(os.WriteFile(caBundle, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: server.Certificate().Raw,
+	}), 0644))
+
+	headBucket := func(options HTTPOptions) error {
+		cfg := GetMinioConfig(server.URL)
+		cfg.RetryMaxAttempts = 1
+		must(SetHTTPOptions(cfg, options))
+		client := s3.NewFromConfig(*cfg)
+		_, err := client.HeadBucket(context.TODO(), &s3.HeadBucketInput{
+			Bucket: aws.String(bucket),
+		})
+		return err
+	}
+
+	// The server's cert is self-signed, so the default transport rejects it.
+	assert.Error(t, headBucket(HTTPOptions{}))
+	assert.NoError(t, headBucket(HTTPOptions{CABundle: caBundle}))
+	assert.NoError(t, headBucket(HTTPOptions{InsecureSkipVerify: true}))
+}
+
+func TestSetHTTPOptions_TLSRequiresCustomEndpoint(t *testing.T) {
+	cfg := getTestS3Config(t)
+	assert.Error(t, SetHTTPOptions(cfg, HTTPOptions{InsecureSkipVerify: true}))
+}
+
+type stubSTSClient struct {
+	calls []*sts.AssumeRoleInput
+}
+
+func (c *stubSTSClient) AssumeRole(ctx context.Context, params *sts.AssumeRoleInput, optFns ...func(*sts.Options)) (*sts.AssumeRoleOutput, error) {
+	c.calls = append(c.calls, params)
+	return &sts.AssumeRoleOutput{
+		Credentials: &ststypes.Credentials{
+			AccessKeyId:     aws.String("role-key"),
+			SecretAccessKey: aws.String("role-secret"),
+			SessionToken:    aws.String("role-token"),
+			Expiration:      aws.Time(time.Now().Add(time.Hour)),
+		},
+	}, nil
+}
+
+func TestAssumeRoleProvider(t *testing.T) {
+	client := &stubSTSClient{}
+	provider := newAssumeRoleProvider(client, AssumeRoleOptions{
+		RoleARN:    "arn:aws:iam::123456789012:role/backup",
+		ExternalID: "external",
+	})
+
+	creds, err := provider.Retrieve(context.TODO())
+	must(err)
+	assert.Equal(t, "role-key", creds.AccessKeyID)
+	assert.Equal(t, "role-token", creds.SessionToken)
+	assert.True(t, creds.CanExpire)
+
+	if assert.Len(t, client.calls, 1) {
+		assert.Equal(t, "arn:aws:iam::123456789012:role/backup", aws.ToString(client.calls[0].RoleArn))
+		assert.Equal(t, "dbackup", aws.ToString(client.calls[0].RoleSessionName))
+		assert.Equal(t, "external", aws.ToString(client.calls[0].ExternalId))
+	}
+}
+
+func TestSetAssumeRole(t *testing.T) {
+	cfg := getTestS3Config(t)
+	assert.Error(t, SetAssumeRole(cfg, AssumeRoleOptions{}))
+
+	must(SetAssumeRole(cfg, AssumeRoleOptions{RoleARN: "arn:aws:iam::123456789012:role/backup"}))
+	_, ok := cfg.Credentials.(*aws.CredentialsCache)
+	assert.True(t, ok)
+}
+
+func getTestS3Config(t *testing.T) *aws.Config {
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_ACCESS_KEY_ID", "key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	cfg, err := GetS3Config()
+	must(err)
+	return cfg
+}
+
+func TestGetS3Config_MissingCredentials(t *testing.T) {
+	for _, name := range []string{"AWS_REGION", "AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN"} {
+		t.Setenv(name, "")
+	}
+	_, err := GetS3Config()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "AWS_REGION, AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY not set")
+	}
+
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_ACCESS_KEY_ID", "key")
+	_, err = GetS3Config()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "AWS_SECRET_ACCESS_KEY not set")
+		assert.NotContains(t, err.Error(), "AWS_ACCESS_KEY_ID")
+	}
+
+	// The session token is optional.
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	_, err = GetS3Config()
+	assert.NoError(t, err)
+}
@@ -2,16 +2,30 @@ package backup
 
 import (
 	"database/sql"
+	"encoding/csv"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	_ "github.com/glebarez/go-sqlite"
 )
 
+// Modtimes are stored in the db with millisecond precision, so all modtime comparisons (db vs. local
+// file, local vs. remote db, original vs. restored file) are done at that resolution. Archives keep
+// sub-second modtimes (see addFileToArchive), so a restored file compares equal to the original.
+const modTimePrecision = time.Millisecond
+
+func modTimesEqual(a time.Time, b time.Time) bool {
+	return a.Truncate(modTimePrecision).Equal(b.Truncate(modTimePrecision))
+}
+
 type FileInfo struct {
 	Path    string
 	ModTime time.Time
@@ -32,8 +46,13 @@ func NewDB(path string) (*DB, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := checkIntegrity(db, path); err != nil {
+		db.Close()
+		return nil, err
+	}
 	err = initDB(db)
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
 	return &DB{
@@ -41,8 +60,44 @@ func NewDB(path string) (*DB, error) {
 	}, nil
 }
 
-func initDB(db *sql.DB) error {
-	_, err := db.Exec(`
+// ErrCorruptDB is returned by NewDB if the db file is damaged.
+var ErrCorruptDB = errors.New("db is corrupted")
+
+// checkIntegrity makes sure the db file isn't damaged, so that's reported up front with a way out,
+// rather than as a cryptic error partway through a run.
+func checkIntegrity(db *sql.DB, path string) error {
+	rows, err := db.Query("PRAGMA integrity_check")
+	if err != nil {
+		return corruptDBError(path, err.Error())
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			return corruptDBError(path, err.Error())
+		}
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return corruptDBError(path, err.Error())
+	}
+	if len(problems) > 0 {
+		return corruptDBError(path, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func corruptDBError(path string, detail string) error {
+	return fmt.Errorf("%w: %q (%s); move it aside and rebuild it from the backup with ReconcileDB, or recover the backup to replace it with the remote db", ErrCorruptDB, path, detail)
+}
+
+// Schema migrations, applied in order. The db's user_version records how many of them have been
+// applied, so only ever append to this list.
+var migrations = []string{
+	`
 		CREATE TABLE IF NOT EXISTS files (
 			path text,
 			mod_time bigint,
@@ -51,8 +106,97 @@ func initDB(db *sql.DB) error {
 			batch text,
 			PRIMARY KEY (path)
 		)
-	`)
-	return err
+	`,
+	// Most batch operations look up or group files by batch.
+	`CREATE INDEX IF NOT EXISTS files_batch ON files (batch)`,
+	// Key/value metadata about the backup as a whole.
+	`
+		CREATE TABLE IF NOT EXISTS meta (
+			key text,
+			value text,
+			PRIMARY KEY (key)
+		)
+	`,
+	// MD5 of each batch's object, as of when it was uploaded.
+	`
+		CREATE TABLE IF NOT EXISTS batches (
+			batch text,
+			checksum text,
+			PRIMARY KEY (batch)
+		)
+	`,
+	// Files that failed to back up. See quarantine.go.
+	`
+		CREATE TABLE IF NOT EXISTS failures (
+			path text,
+			mod_time bigint,
+			count integer,
+			last_error text,
+			PRIMARY KEY (path)
+		)
+	`,
+	// The chunks of files that are stored in chunks, in order. See chunks.go.
+	`
+		CREATE TABLE IF NOT EXISTS chunks (
+			path text,
+			idx integer,
+			hash text,
+			size bigint,
+			PRIMARY KEY (path, idx)
+		)
+	`,
+	// The original locations of the roots of a backup with several roots. See roots.go.
+	`
+		CREATE TABLE IF NOT EXISTS roots (
+			label text,
+			path text,
+			PRIMARY KEY (label)
+		)
+	`,
+	// The modtimes of directories that contain backed up files. See dirs.go.
+	`
+		CREATE TABLE IF NOT EXISTS dirs (
+			path text,
+			mod_time integer,
+			PRIMARY KEY (path)
+		)
+	`,
+	// Streams that are backed up by themselves. See streams.go.
+	`
+		CREATE TABLE IF NOT EXISTS streams (
+			name text,
+			hash text,
+			size bigint,
+			mod_time integer,
+			PRIMARY KEY (name)
+		)
+	`,
+}
+
+func initDB(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("failed to read db version: %v", err)
+	}
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to apply migration %d: %v", i, err)
+		}
+		// PRAGMA doesn't support placeholders.
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to update db version: %v", err)
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (db *DB) Close() error {
@@ -86,6 +230,34 @@ func (db *DB) DumpDB() error {
 	return nil
 }
 
+// ExportCSV writes every file in the db to w as CSV, with a header row, for inspecting the backup
+// in a spreadsheet. Modtimes are written in RFC 3339 format.
+func (db *DB) ExportCSV(w io.Writer) error {
+	files, err := db.GetAllFiles()
+	if err != nil {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"path", "mod_time", "hash", "batch"}); err != nil {
+		return err
+	}
+	for _, file := range files {
+		record := []string{
+			file.Path,
+			file.ModTime.UTC().Format(time.RFC3339Nano),
+			file.Hash,
+			file.Batch,
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
 func (db *DB) GetAllFiles() ([]*FileInfo, error) {
 	rows, err := db.db.Query(`
 		SELECT
@@ -118,6 +290,37 @@ func (db *DB) GetAllFiles() ([]*FileInfo, error) {
 	return files, nil
 }
 
+// GetAllFilesByPath loads the whole files table in one query, keyed by path.
+func (db *DB) GetAllFilesByPath() (map[string]*FileInfo, error) {
+	files, err := db.GetAllFiles()
+	if err != nil {
+		return nil, err
+	}
+	filesByPath := make(map[string]*FileInfo, len(files))
+	for _, file := range files {
+		filesByPath[file.Path] = file
+	}
+	return filesByPath, nil
+}
+
+// fileInfoLookup is implemented by DB, which does a query per lookup, and fileInfoCache, which
+// answers from memory.
+type fileInfoLookup interface {
+	GetFileInfo(path string) (*FileInfo, error)
+}
+
+// fileInfoCache is an in-memory snapshot of the files table, used to avoid a query per file when
+// scanning a large tree. Like DB.GetFileInfo, it returns sql.ErrNoRows for unknown paths.
+type fileInfoCache map[string]*FileInfo
+
+func (c fileInfoCache) GetFileInfo(path string) (*FileInfo, error) {
+	fi, ok := c[path]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return fi, nil
+}
+
 func (db *DB) GetFileInfo(path string) (*FileInfo, error) {
 	row := db.db.QueryRow("SELECT mod_time, hash, batch FROM files WHERE path = ?", path)
 	if row.Err() != nil {
@@ -135,21 +338,47 @@ func (db *DB) GetFileInfo(path string) (*FileInfo, error) {
 	return fileInfo, nil
 }
 
+const markFileQuery = `
+	INSERT INTO files (
+		path, mod_time, hash, batch
+	)
+	VALUES ( ?, ?, ?, ? )
+	ON CONFLICT (path)
+	DO UPDATE SET
+		mod_time = excluded.mod_time,
+		hash = excluded.hash,
+		batch = excluded.batch
+`
+
 func (db *DB) MarkFile(path string, modTime time.Time, hash string, batch string) error {
-	_, err := db.db.Exec(`
-		INSERT INTO files (
-			path, mod_time, hash, batch
-		)
-		VALUES ( ?, ?, ?, ? )
-		ON CONFLICT (path)
-		DO UPDATE SET
-			mod_time = excluded.mod_time,
-			hash = excluded.hash,
-			batch = excluded.batch
-	`, path, modTime.UnixMilli(), hash, batch)
+	_, err := db.db.Exec(markFileQuery, path, modTime.UnixMilli(), hash, batch)
 	return err
 }
 
+// MarkFiles is the same as calling MarkFile for each file, but does all the updates in a single
+// transaction. Either all of the files are marked or none of them are.
+func (db *DB) MarkFiles(files []*FileInfo) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(markFileQuery)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, file := range files {
+		_, err := stmt.Exec(file.Path, file.ModTime.UnixMilli(), file.Hash, file.Batch)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to mark file %q: %v", file.Path, err)
+		}
+	}
+	return tx.Commit()
+}
+
 func (db *DB) GetFilesInBatch(batch string) ([]string, error) {
 	rows, err := db.db.Query(`
 		SELECT path FROM files WHERE batch = ?
@@ -175,14 +404,132 @@ func (db *DB) DeleteBatch(batch string) error {
 		DELETE FROM files
 		WHERE batch = ?
 	`, batch)
+	if err != nil {
+		return err
+	}
+	_, err = db.db.Exec(`
+		DELETE FROM batches
+		WHERE batch = ?
+	`, batch)
+	if err != nil {
+		return err
+	}
+	// Only single files are chunked, and their batch is their path.
+	return db.DeleteFileChunks(batch)
+}
+
+const setBatchChecksumQuery = `
+	INSERT INTO batches (batch, checksum)
+	VALUES ( ?, ? )
+	ON CONFLICT (batch)
+	DO UPDATE SET checksum = excluded.checksum
+`
+
+func (db *DB) SetBatchChecksum(batch string, checksum string) error {
+	_, err := db.db.Exec(setBatchChecksumQuery, batch, checksum)
 	return err
 }
 
+// batchMarks is everything that's recorded about a batch once it has been uploaded. See MarkBatch.
+type batchMarks struct {
+	Batch string
+	// The files that went into the batch's archive.
+	Files []*FileInfo
+	// Files that were left out of the archive. They're forgotten, so the next backup treats them as
+	// new rather than assuming they're in this batch.
+	Forgotten []string
+	// Files that used to be in the batch but have been deleted locally. They're forgotten too.
+	Removed []string
+	// MD5 of the uploaded archive, or "" if the batch isn't stored in an archive.
+	Checksum string
+	// If true, the batch is a single file, whose list of chunks is replaced with Chunks. It's cleared
+	// if the file isn't stored in chunks (anymore).
+	SingleFile bool
+	Chunks     []chunkRef
+}
+
+// MarkBatch records a batch that has been uploaded: its files are marked, and their failures are
+// cleared. It's all done in a single transaction, so if anything fails the db is left as it was
+// before the batch, and the next backup tries the whole batch again.
+func (db *DB) MarkBatch(marks batchMarks) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := markBatch(tx, marks); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func markBatch(tx *sql.Tx, marks batchMarks) error {
+	for _, path := range append(append([]string(nil), marks.Forgotten...), marks.Removed...) {
+		if _, err := tx.Exec(deleteFileQuery, path); err != nil {
+			return fmt.Errorf("failed to remove file %q: %v", path, err)
+		}
+	}
+	for _, file := range marks.Files {
+		if _, err := tx.Exec(markFileQuery, file.Path, file.ModTime.UnixMilli(), file.Hash, file.Batch); err != nil {
+			return fmt.Errorf("failed to mark file %q: %v", file.Path, err)
+		}
+		if _, err := tx.Exec(`DELETE FROM failures WHERE path = ?`, file.Path); err != nil {
+			return fmt.Errorf("failed to clear failures of file %q: %v", file.Path, err)
+		}
+	}
+	if marks.SingleFile {
+		if _, err := tx.Exec(`DELETE FROM chunks WHERE path = ?`, marks.Batch); err != nil {
+			return fmt.Errorf("failed to clear chunks of file %q: %v", marks.Batch, err)
+		}
+		for i, chunk := range marks.Chunks {
+			if _, err := tx.Exec(`INSERT INTO chunks (path, idx, hash, size) VALUES (?, ?, ?, ?)`, marks.Batch, i, chunk.Hash, chunk.Size); err != nil {
+				return fmt.Errorf("failed to record chunks of file %q: %v", marks.Batch, err)
+			}
+		}
+	}
+	if _, err := tx.Exec(setBatchChecksumQuery, marks.Batch, marks.Checksum); err != nil {
+		return fmt.Errorf("failed to record checksum: %v", err)
+	}
+	return nil
+}
+
+// GetBatchChecksum returns sql.ErrNoRows if no checksum was recorded for the batch, e.g. because it
+// was uploaded by an older version.
+func (db *DB) GetBatchChecksum(batch string) (string, error) {
+	var checksum string
+	err := db.db.QueryRow("SELECT checksum FROM batches WHERE batch = ?", batch).Scan(&checksum)
+	return checksum, err
+}
+
+// GetBatchChecksums returns all recorded checksums, keyed by batch.
+func (db *DB) GetBatchChecksums() (map[string]string, error) {
+	rows, err := db.db.Query("SELECT batch, checksum FROM batches")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	checksums := make(map[string]string)
+	for rows.Next() {
+		var batch string
+		var checksum string
+		if err := rows.Scan(&batch, &checksum); err != nil {
+			return nil, err
+		}
+		checksums[batch] = checksum
+	}
+	return checksums, rows.Err()
+}
+
+const deleteFileQuery = `
+	DELETE FROM files
+	WHERE path = ?
+`
+
+// DeleteFile forgets a single file, leaving the rest of its batch alone. Use DeleteBatch when the
+// whole batch is gone.
 func (db *DB) DeleteFile(path string) error {
-	_, err := db.db.Exec(`
-		DELETE FROM files
-		WHERE path = ?
-	`, path)
+	_, err := db.db.Exec(deleteFileQuery, path)
 	return err
 }
 
@@ -193,47 +540,24 @@ type BatchMeta struct {
 }
 
 func (db *DB) GetExistingBatches(includeFilenames bool) ([]BatchMeta, error) {
-	var rows *sql.Rows
-	var err error
-	if includeFilenames {
-		// TODO: what happens if the DB has files in a batch with a name that is also the same as one of the filenames?
-		rows, err = db.db.Query(`
-			SELECT
-				batch,
-				count(*) as num_files,
-				sum(is_dir) as num_grouped_files,
-				group_concat(path) as filenames
-			FROM (
-				SELECT
-					batch,
-					path,
-					CASE
-						WHEN batch != path THEN 1
-						ELSE 0
-					END as is_dir
-				FROM files
-			)
-			GROUP BY batch
-		`)
-	} else {
-		rows, err = db.db.Query(`
+	// TODO: what happens if the DB has files in a batch with a name that is also the same as one of the filenames?
+	rows, err := db.db.Query(`
+		SELECT
+			batch,
+			count(*) as num_files,
+			sum(is_dir) as num_grouped_files
+		FROM (
 			SELECT
 				batch,
-				count(*) as num_files,
-				sum(is_dir) as num_grouped_files
-			FROM (
-				SELECT
-					batch,
-					path,
-					CASE
-						WHEN batch != path THEN 1
-						ELSE 0
-					END as is_dir
-				FROM files
-			)
-			GROUP BY batch
-		`)
-	}
+				path,
+				CASE
+					WHEN batch != path THEN 1
+					ELSE 0
+				END as is_dir
+			FROM files
+		)
+		GROUP BY batch
+	`)
 	if err != nil {
 		return nil, err
 	}
@@ -244,17 +568,8 @@ func (db *DB) GetExistingBatches(includeFilenames bool) ([]BatchMeta, error) {
 		var batch string
 		var numFiles int64
 		var numGroupedFiles int64
-		var filenames []string
-		if includeFilenames {
-			var filenamesString string
-			if err := rows.Scan(&batch, &numFiles, &numGroupedFiles, &filenamesString); err != nil {
-				return nil, err
-			}
-			filenames = strings.Split(filenamesString, ",")
-		} else {
-			if err := rows.Scan(&batch, &numFiles, &numGroupedFiles); err != nil {
-				return nil, err
-			}
+		if err := rows.Scan(&batch, &numFiles, &numGroupedFiles); err != nil {
+			return nil, err
 		}
 		if numGroupedFiles > 0 && numGroupedFiles != numFiles {
 			return nil, fmt.Errorf("detected a batch with multiple files, where one of the filenames matches the batch name: %q", batch)
@@ -262,8 +577,149 @@ func (db *DB) GetExistingBatches(includeFilenames bool) ([]BatchMeta, error) {
 		batches = append(batches, BatchMeta{
 			Path:         batch,
 			IsSingleFile: numGroupedFiles == 0,
-			Filenames:    filenames,
 		})
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if includeFilenames {
+		filenames, err := db.getFilenamesByBatch()
+		if err != nil {
+			return nil, err
+		}
+		for i := range batches {
+			batches[i].Filenames = filenames[batches[i].Path]
+		}
+	}
 	return batches, nil
 }
+
+// getFilenamesByBatch returns the paths of the files in each batch. They're read row by row rather
+// than aggregated in SQL, since a path can contain any byte, including whatever separator the
+// aggregation would use.
+func (db *DB) getFilenamesByBatch() (map[string][]string, error) {
+	rows, err := db.db.Query(`SELECT batch, path FROM files ORDER BY batch, path`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	filenames := make(map[string][]string)
+	for rows.Next() {
+		var batch string
+		var path string
+		if err := rows.Scan(&batch, &path); err != nil {
+			return nil, err
+		}
+		filenames[batch] = append(filenames[batch], path)
+	}
+	return filenames, rows.Err()
+}
+
+const (
+	metaLastBackupTime = "last_backup_time"
+	metaToolVersion    = "tool_version"
+	metaSizeThreshold  = "size_threshold"
+	metaSnapshotID     = "snapshot_id"
+	// "true" if single files are stored as content-addressed blobs, see blobs.go.
+	metaContentAddressed = "content_addressed"
+	// "true" if archives are stored under hashed keys, see obfuscate.go.
+	metaObfuscateKeys = "obfuscate_keys"
+	// The template that archive keys are made with, and the date filled into it, see keytemplate.go.
+	metaKeyTemplate = "key_template"
+	metaKeyDate     = "key_date"
+	// The absolute path of the directory that a backup with a single root was made from, see
+	// roots.go.
+	metaSourceRoot = "source_root"
+	// How many backups have finished since the db was last vacuumed, see BackupOptions.VacuumEvery.
+	metaBackupsSinceVacuum = "backups_since_vacuum"
+)
+
+func (db *DB) setMeta(key string, value string) error {
+	_, err := db.db.Exec(setMetaQuery, key, value)
+	return err
+}
+
+const setMetaQuery = `
+	INSERT INTO meta (key, value)
+	VALUES ( ?, ? )
+	ON CONFLICT (key)
+	DO UPDATE SET value = excluded.value
+`
+
+// getMeta returns sql.ErrNoRows if the key has never been set.
+func (db *DB) getMeta(key string) (string, error) {
+	var value string
+	err := db.db.QueryRow("SELECT value FROM meta WHERE key = ?", key).Scan(&value)
+	return value, err
+}
+
+// MarkBackupComplete records when a backup finished, which version of the tool wrote it, and the
+// size threshold it used.
+func (db *DB) MarkBackupComplete(backupTime time.Time, sizeThreshold int64) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	values := map[string]string{
+		metaLastBackupTime: strconv.FormatInt(backupTime.UnixMilli(), 10),
+		metaToolVersion:    Version,
+		metaSizeThreshold:  strconv.FormatInt(sizeThreshold, 10),
+	}
+	for key, value := range values {
+		_, err := tx.Exec(setMetaQuery, key, value)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetLastBackupTime returns the time the last successful backup finished, or the zero time if
+// there hasn't been one.
+func (db *DB) GetLastBackupTime() (time.Time, error) {
+	value, err := db.getMeta(metaLastBackupTime)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid last backup time %q: %v", value, err)
+	}
+	return time.UnixMilli(ms), nil
+}
+
+// countBackupForVacuum counts another finished backup, and reports whether the db is due to be
+// vacuumed, which it is every `every` backups. The count starts over once it's due.
+func (db *DB) countBackupForVacuum(every int) (bool, error) {
+	count := 0
+	value, err := db.getMeta(metaBackupsSinceVacuum)
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+	if err == nil {
+		count, err = strconv.Atoi(value)
+		if err != nil {
+			return false, fmt.Errorf("invalid backup count %q: %v", value, err)
+		}
+	}
+	count++
+	due := count >= every
+	if due {
+		count = 0
+	}
+	return due, db.setMeta(metaBackupsSinceVacuum, strconv.Itoa(count))
+}
+
+// Vacuum rebuilds the db file without the free pages that are left behind as rows are deleted, so
+// that it's smaller to upload. VACUUM fails if a transaction is open on any connection, so it must
+// only be called once the run is otherwise done with the db.
+func (db *DB) Vacuum() error {
+	_, err := db.db.Exec(`VACUUM`)
+	return err
+}
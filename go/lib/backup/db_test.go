@@ -0,0 +1,287 @@
+package backup
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"local/backup/lib/logging"
+)
+
+func newTestDB(t testing.TB) *DB {
+	dir, err := os.MkdirTemp("/tmp", "dave-backup-db-")
+	must(err)
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	db, err := NewDB(filepath.Join(dir, "test.db"))
+	must(err)
+	t.Cleanup(func() {
+		db.Close()
+	})
+	return db
+}
+
+// fillTestDB inserts numFiles synthetic files spread across batches of batchSize files each.
+func fillTestDB(db *DB, numFiles int, batchSize int) {
+	tx, err := db.db.Begin()
+	must(err)
+	for i := 0; i < numFiles; i++ {
+		batch := fmt.Sprintf("dir-%d", i/batchSize)
+		_, err := tx.Exec(
+			"INSERT INTO files (path, mod_time, hash, batch) VALUES (?, ?, ?, ?)",
+			fmt.Sprintf("%s/file-%d.txt", batch, i),
+			time.Now().UnixMilli(),
+			"hash",
+			batch,
+		)
+		must(err)
+	}
+	must(tx.Commit())
+}
+
+func TestDB_BatchQueriesUseIndex(t *testing.T) {
+	db := newTestDB(t)
+
+	queries := []string{
+		"SELECT path FROM files WHERE batch = 'a'",
+		"DELETE FROM files WHERE batch = 'a'",
+	}
+	for _, query := range queries {
+		rows, err := db.db.Query("EXPLAIN QUERY PLAN " + query)
+		must(err)
+		var details []string
+		for rows.Next() {
+			var id, parent, notUsed int
+			var detail string
+			must(rows.Scan(&id, &parent, &notUsed, &detail))
+			details = append(details, detail)
+		}
+		rows.Close()
+		assert.Contains(t, strings.Join(details, "\n"), "INDEX files_batch", query)
+	}
+}
+
+func TestDB_DeleteFile(t *testing.T) {
+	db := newTestDB(t)
+	fillTestDB(db, 3, 3)
+
+	must(db.DeleteFile("dir-0/file-1.txt"))
+	files, err := db.GetFilesInBatch("dir-0")
+	must(err)
+	assert.ElementsMatch(t, []string{"dir-0/file-0.txt", "dir-0/file-2.txt"}, files)
+	batches, err := db.GetExistingBatches(false)
+	must(err)
+	assert.Len(t, batches, 1)
+}
+
+func TestDB_MigrationsAreIdempotent(t *testing.T) {
+	db := newTestDB(t)
+	must(db.MarkFile("a.txt", time.Now(), "hash", "a.txt"))
+
+	// Running the migrations again should be a no-op.
+	must(initDB(db.db))
+	var version int
+	must(db.db.QueryRow("PRAGMA user_version").Scan(&version))
+	assert.Equal(t, len(migrations), version)
+
+	files, err := db.GetAllFiles()
+	must(err)
+	assert.Len(t, files, 1)
+}
+
+func TestDB_MarkFilesMatchesMarkFile(t *testing.T) {
+	now := time.Now()
+	files := []*FileInfo{
+		{Path: "a.txt", ModTime: now, Hash: "a", Batch: "."},
+		{Path: "b.txt", ModTime: now.Add(time.Second), Hash: "b", Batch: "."},
+		{Path: "subdir/c.txt", ModTime: now.Add(2 * time.Second), Hash: "c", Batch: "subdir/c.txt"},
+		// Re-marking a file should update it in place.
+		{Path: "a.txt", ModTime: now.Add(3 * time.Second), Hash: "a2", Batch: "."},
+	}
+
+	perFileDB := newTestDB(t)
+	for _, file := range files {
+		must(perFileDB.MarkFile(file.Path, file.ModTime, file.Hash, file.Batch))
+	}
+	transactionalDB := newTestDB(t)
+	must(transactionalDB.MarkFiles(files))
+
+	expected, err := perFileDB.GetAllFiles()
+	must(err)
+	actual, err := transactionalDB.GetAllFiles()
+	must(err)
+	assert.Len(t, actual, 3)
+	assert.ElementsMatch(t, expected, actual)
+}
+
+func BenchmarkDB_GetFilesInBatch(b *testing.B) {
+	for _, withIndex := range []bool{true, false} {
+		b.Run(fmt.Sprintf("index=%t", withIndex), func(b *testing.B) {
+			db := newTestDB(b)
+			fillTestDB(db, 200000, 100)
+			if !withIndex {
+				_, err := db.db.Exec("DROP INDEX files_batch")
+				must(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := db.GetFilesInBatch(fmt.Sprintf("dir-%d", i%2000))
+				must(err)
+			}
+		})
+	}
+}
+
+func BenchmarkDB_GetExistingBatches(b *testing.B) {
+	for _, withIndex := range []bool{true, false} {
+		b.Run(fmt.Sprintf("index=%t", withIndex), func(b *testing.B) {
+			db := newTestDB(b)
+			fillTestDB(db, 200000, 100)
+			if !withIndex {
+				_, err := db.db.Exec("DROP INDEX files_batch")
+				must(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := db.GetExistingBatches(false)
+				must(err)
+			}
+		})
+	}
+}
+
+func TestDB_LastBackupTimeAdvances(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	must(createTestFile(filepath.Join(config.TestBaseDir, "a.txt"), 5))
+
+	cfg := GetMinioConfig(minioUrl)
+	backup := func() time.Time {
+		must(BackupFiles(
+			context.Background(),
+			logger,
+			cfg,
+			config.DBFile,
+			config.TestBaseDir,
+			config.Bucket,
+			config.S3Prefix,
+			config.BackupName,
+			config.SizeThreshold,
+			BackupOptions{},
+		))
+		db, err := NewDB(config.DBFile)
+		must(err)
+		defer db.Close()
+		lastBackupTime, err := db.GetLastBackupTime()
+		must(err)
+		version, err := db.getMeta(metaToolVersion)
+		must(err)
+		assert.Equal(t, Version, version)
+		return lastBackupTime
+	}
+
+	first := backup()
+	assert.False(t, first.IsZero())
+	time.Sleep(10 * time.Millisecond)
+	second := backup()
+	assert.True(t, second.After(first), "expected %v to be after %v", second, first)
+}
+
+func TestDB_LastBackupTimeZeroWithoutBackup(t *testing.T) {
+	db := newTestDB(t)
+	lastBackupTime, err := db.GetLastBackupTime()
+	must(err)
+	assert.True(t, lastBackupTime.IsZero())
+}
+
+func TestDB_VacuumShrinksDB(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "test.db")
+	db, err := NewDB(dbFile)
+	must(err)
+	defer db.Close()
+	size := func() int64 {
+		info, err := os.Stat(dbFile)
+		must(err)
+		return info.Size()
+	}
+
+	fillTestDB(db, 20000, 100)
+	full := size()
+	_, err = db.db.Exec(`DELETE FROM files`)
+	must(err)
+	// Deleting rows only frees their pages, it doesn't give them back.
+	assert.Equal(t, full, size())
+
+	must(db.Vacuum())
+	assert.Less(t, size(), full/10)
+}
+
+func TestDB_CountBackupForVacuum(t *testing.T) {
+	db := newTestDB(t)
+	var due []bool
+	for i := 0; i < 7; i++ {
+		d, err := db.countBackupForVacuum(3)
+		must(err)
+		due = append(due, d)
+	}
+	assert.Equal(t, []bool{false, false, true, false, false, true, false}, due)
+}
+
+func TestNewDB_CorruptDB(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "test.db")
+	db, err := NewDB(dbFile)
+	must(err)
+	fillTestDB(db, 5000, 100)
+	must(db.Close())
+
+	info, err := os.Stat(dbFile)
+	must(err)
+	must(os.Truncate(dbFile, info.Size()/2))
+
+	_, err = NewDB(dbFile)
+	assert.ErrorIs(t, err, ErrCorruptDB)
+	assert.ErrorContains(t, err, "ReconcileDB")
+}
+
+func TestDB_ExportCSV(t *testing.T) {
+	db := newTestDB(t)
+	modTime := time.UnixMilli(1700000000123)
+	files := []*FileInfo{
+		{Path: "a.txt", ModTime: modTime, Hash: "hash-a", Batch: "."},
+		{Path: `dir/with, comma.txt`, ModTime: modTime, Hash: "hash-b", Batch: "dir"},
+		{Path: `dir/"quoted".txt`, ModTime: modTime, Hash: "hash-c", Batch: "dir"},
+		{Path: "dir/new\nline.txt", ModTime: modTime, Hash: "hash-d", Batch: "dir"},
+	}
+	must(db.MarkFiles(files))
+
+	var buf strings.Builder
+	must(db.ExportCSV(&buf))
+	records, err := csv.NewReader(strings.NewReader(buf.String())).ReadAll()
+	must(err)
+	assert.Equal(t, []string{"path", "mod_time", "hash", "batch"}, records[0])
+	exported := make(map[string]*FileInfo)
+	for _, record := range records[1:] {
+		parsed, err := time.Parse(time.RFC3339Nano, record[1])
+		must(err)
+		exported[record[0]] = &FileInfo{Path: record[0], ModTime: parsed, Hash: record[2], Batch: record[3]}
+	}
+	assert.Len(t, exported, len(files))
+	for _, file := range files {
+		if assert.Contains(t, exported, file.Path) {
+			assert.True(t, file.ModTime.Equal(exported[file.Path].ModTime), file.Path)
+			assert.Equal(t, file.Hash, exported[file.Path].Hash)
+			assert.Equal(t, file.Batch, exported[file.Path].Batch)
+		}
+	}
+}
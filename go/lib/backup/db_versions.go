@@ -0,0 +1,140 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"local/backup/lib/logging"
+	"local/backup/lib/s3_helpers"
+)
+
+// Before the remote db is overwritten, the previous one can be kept as a version next to it:
+//
+//	<prefix>/<name>.db.<version>.gz
+//
+// where the version is the time it was replaced, in Unix nanoseconds. Only the newest few versions
+// are kept. They're a safety net in case the canonical db gets corrupted, short of full snapshots.
+
+func dbVersionKey(prefixBase string, name string, version int64) string {
+	return s3Key(prefixBase, fmt.Sprintf("%s.db.%d.gz", name, version))
+}
+
+// keepDBVersion copies the current remote db, if there is one, to a new version, then deletes the
+// oldest versions so that at most keep of them remain.
+func keepDBVersion(logger logging.Logger, client s3_helpers.Client, bucket string, prefixBase string, name string, keep int) error {
+	if err := saveDBVersion(logger, client, bucket, prefixBase, name); err != nil {
+		return err
+	}
+
+	versions, err := listDBVersions(client, bucket, prefixBase, name)
+	if err != nil {
+		return err
+	}
+	for len(versions) > keep {
+		versionKey := dbVersionKey(prefixBase, name, versions[0])
+		logger.Verbosef("deleting old db version %q", versionKey)
+		if err := deleteObject(client, bucket, versionKey); err != nil {
+			return fmt.Errorf("failed to delete old db version %q: %v", versionKey, err)
+		}
+		versions = versions[1:]
+	}
+	return nil
+}
+
+// saveDBVersion copies the current remote db, if there is one, to a new version.
+func saveDBVersion(logger logging.Logger, client s3_helpers.Client, bucket string, prefixBase string, name string) error {
+	key := dbKey(prefixBase, name)
+	exists, err := s3_helpers.ObjectExists(client, bucket, key)
+	if err != nil {
+		return err
+	}
+	if exists {
+		versionKey := dbVersionKey(prefixBase, name, time.Now().UnixNano())
+		logger.Verbosef("keeping previous db as %q", versionKey)
+		_, err := client.CopyObject(context.TODO(), &s3.CopyObjectInput{
+			Bucket:     aws.String(bucket),
+			CopySource: aws.String(copySource(bucket, key)),
+			Key:        aws.String(versionKey),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to copy %q to %q: %v", key, versionKey, err)
+		}
+	}
+	return nil
+}
+
+// listDBVersions returns the backup's db versions, oldest first.
+func listDBVersions(client s3_helpers.Client, bucket string, prefixBase string, name string) ([]int64, error) {
+	keyPrefix := s3Key(prefixBase, name+".db.")
+	var versions []int64
+	paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(keyPrefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return nil, fmt.Errorf("failed to list db versions: %v", err)
+		}
+		for _, object := range page.Contents {
+			rest := strings.TrimPrefix(aws.ToString(object.Key), keyPrefix)
+			version, err := strconv.ParseInt(strings.TrimSuffix(rest, ".gz"), 10, 64)
+			if err != nil || !strings.HasSuffix(rest, ".gz") {
+				// The canonical db, or something else.
+				continue
+			}
+			versions = append(versions, version)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	return versions, nil
+}
+
+// ListDBVersions returns the versions of the remote db that were kept, oldest first.
+func ListDBVersions(cfg *aws.Config, bucket string, prefixBase string, name string) ([]int64, error) {
+	return listDBVersions(s3.NewFromConfig(*cfg), bucket, prefixBase, name)
+}
+
+// RestoreDBVersion replaces the remote db with the given version. The current remote db is kept as
+// a version first, so a restore can be undone. The local db won't match the restored one, so the
+// next backup needs to be forced, or preceded by a recovery.
+func RestoreDBVersion(
+	logger logging.Logger,
+	cfg *aws.Config,
+	bucket string,
+	prefixBase string,
+	name string,
+	version int64,
+) error {
+	client := s3.NewFromConfig(*cfg)
+	versionKey := dbVersionKey(prefixBase, name, version)
+	exists, err := s3_helpers.ObjectExists(client, bucket, versionKey)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("db version %d doesn't exist", version)
+	}
+
+	if err := saveDBVersion(logger, client, bucket, prefixBase, name); err != nil {
+		return fmt.Errorf("error keeping current db: %v", err)
+	}
+	key := dbKey(prefixBase, name)
+	logger.Infof("restoring db version %d", version)
+	_, err = client.CopyObject(context.TODO(), &s3.CopyObjectInput{
+		Bucket:     aws.String(bucket),
+		CopySource: aws.String(copySource(bucket, versionKey)),
+		Key:        aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to copy %q to %q: %v", versionKey, key, err)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+
+	"local/backup/lib/logging"
+	"local/backup/lib/s3_helpers"
+)
+
+func TestBackupFiles_KeepDBVersions(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+
+	cfg := GetMinioConfig(minioUrl)
+	client := s3.NewFromConfig(*cfg)
+
+	// Each run changes a file, so every db is different.
+	var dbs [][]byte
+	var versions [][]int64
+	for i := 0; i < 4; i++ {
+		must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 5+i))
+		must(BackupFiles(
+			context.Background(),
+			logger,
+			cfg,
+			config.DBFile,
+			testBaseDir,
+			config.Bucket,
+			config.S3Prefix,
+			config.BackupName,
+			config.SizeThreshold,
+			BackupOptions{KeepDBVersions: 2},
+		))
+		data, err := s3_helpers.DownloadBytes(client, config.Bucket, dbKey(config.S3Prefix, config.BackupName))
+		must(err)
+		dbs = append(dbs, data)
+		v, err := ListDBVersions(cfg, config.Bucket, config.S3Prefix, config.BackupName)
+		must(err)
+		versions = append(versions, v)
+	}
+
+	// Versions accumulate up to the cap, then the oldest ones roll off.
+	assert.Len(t, versions[0], 0)
+	assert.Len(t, versions[1], 1)
+	assert.Len(t, versions[2], 2)
+	assert.Len(t, versions[3], 2)
+	assert.Equal(t, versions[2][1], versions[3][0])
+
+	// The kept versions are the dbs of the previous two runs.
+	for i, version := range versions[3] {
+		data, err := s3_helpers.DownloadBytes(client, config.Bucket, dbVersionKey(config.S3Prefix, config.BackupName, version))
+		must(err)
+		assert.Equal(t, dbs[i+1], data)
+	}
+
+	// Restoring a version makes it the canonical db again, keeping the one it replaced.
+	must(RestoreDBVersion(logger, cfg, config.Bucket, config.S3Prefix, config.BackupName, versions[3][0]))
+	data, err := s3_helpers.DownloadBytes(client, config.Bucket, dbKey(config.S3Prefix, config.BackupName))
+	must(err)
+	assert.Equal(t, dbs[1], data)
+	v, err := ListDBVersions(cfg, config.Bucket, config.S3Prefix, config.BackupName)
+	must(err)
+	assert.Len(t, v, 3)
+
+	assert.Error(t, RestoreDBVersion(logger, cfg, config.Bucket, config.S3Prefix, config.BackupName, 12345))
+}
+
+func TestRecoverFiles_DBVersion(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+
+	cfg := GetMinioConfig(minioUrl)
+	backup := func() {
+		must(BackupFiles(
+			context.Background(),
+			logger,
+			cfg,
+			config.DBFile,
+			testBaseDir,
+			config.Bucket,
+			config.S3Prefix,
+			config.BackupName,
+			config.SizeThreshold,
+			BackupOptions{KeepDBVersions: 2},
+		))
+	}
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "dir/b.txt"), 10))
+	backup()
+	must(createTestFile(filepath.Join(testBaseDir, "new.txt"), 15))
+	must(createTestFile(filepath.Join(testBaseDir, "newdir/c.txt"), 20))
+	backup()
+
+	versions, err := ListDBVersions(cfg, config.Bucket, config.S3Prefix, config.BackupName)
+	must(err)
+	assert.Len(t, versions, 1)
+	localDB, err := os.ReadFile(config.DBFile)
+	must(err)
+
+	testRecoveryDir, err := os.MkdirTemp("/tmp", "dave-recovery-test-")
+	must(err)
+	defer os.RemoveAll(testRecoveryDir)
+	must(RecoverFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		testRecoveryDir,
+		RecoveryOptions{DBVersion: versions[0], Verify: true},
+	))
+
+	// Only the files from the first backup are recovered.
+	must(os.Remove(filepath.Join(testBaseDir, "new.txt")))
+	must(os.RemoveAll(filepath.Join(testBaseDir, "newdir")))
+	compareDirectories(testBaseDir, testRecoveryDir, t)
+
+	// The local db still matches the latest remote db.
+	data, err := os.ReadFile(config.DBFile)
+	must(err)
+	assert.Equal(t, localDB, data)
+
+	assert.Error(t, RecoverFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		testRecoveryDir,
+		RecoveryOptions{DBVersion: 12345},
+	))
+}
@@ -0,0 +1,118 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"local/backup/lib/logging"
+)
+
+// Directories aren't archived, since a directory's files can be spread over several batches, so
+// their modtimes are kept in the db instead. Every backup records the modtimes of the directories
+// it scans, and forgets directories that no longer have any backed up files in them. Recovery sets
+// them once all the files have been written, since writing a file updates its directory's modtime.
+
+// SetDirModTimes records the modtimes of the given directories, and forgets any directories that
+// don't contain backed up files. It returns true if anything changed.
+func (db *DB) SetDirModTimes(dirs map[string]time.Time) (bool, error) {
+	existing, err := db.GetDirModTimes()
+	if err != nil {
+		return false, err
+	}
+	files, err := db.GetAllFiles()
+	if err != nil {
+		return false, err
+	}
+	keep := make(map[string]bool)
+	for _, file := range files {
+		for dir := filepath.Dir(file.Path); dir != "." && dir != string(filepath.Separator); dir = filepath.Dir(dir) {
+			keep[dir] = true
+		}
+	}
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	changed := false
+	for dir := range existing {
+		if keep[dir] {
+			continue
+		}
+		if _, err := tx.Exec(`DELETE FROM dirs WHERE path = ?`, dir); err != nil {
+			tx.Rollback()
+			return false, err
+		}
+		changed = true
+	}
+	for dir, modTime := range dirs {
+		if !keep[dir] {
+			continue
+		}
+		if old, ok := existing[dir]; ok && modTimesEqual(old, modTime) {
+			continue
+		}
+		_, err := tx.Exec(`
+			INSERT INTO dirs (path, mod_time)
+			VALUES (?, ?)
+			ON CONFLICT (path) DO UPDATE SET mod_time = excluded.mod_time
+		`, dir, modTime.UnixMilli())
+		if err != nil {
+			tx.Rollback()
+			return false, err
+		}
+		changed = true
+	}
+	return changed, tx.Commit()
+}
+
+// GetDirModTimes returns the recorded directory modtimes, by path.
+func (db *DB) GetDirModTimes() (map[string]time.Time, error) {
+	rows, err := db.db.Query(`SELECT path, mod_time FROM dirs`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	dirs := make(map[string]time.Time)
+	for rows.Next() {
+		var path string
+		var modTimeMS int64
+		if err := rows.Scan(&path, &modTimeMS); err != nil {
+			return nil, err
+		}
+		dirs[path] = time.UnixMilli(modTimeMS)
+	}
+	return dirs, rows.Err()
+}
+
+// restoreDirModTimes sets the modtimes of the recovered directories. Directories that weren't
+// recovered, e.g. because of the path rewriting options, are left alone.
+func restoreDirModTimes(logger logging.Logger, db *DB, localRoot string, options RecoveryOptions) error {
+	dirs, err := db.GetDirModTimes()
+	if err != nil {
+		return fmt.Errorf("error loading directory modtimes from db: %v", err)
+	}
+	for dir, modTime := range dirs {
+		relPath, ok := options.remapPath(filepath.ToSlash(dir))
+		if !ok {
+			continue
+		}
+		localPath, err := safeJoin(localRoot, relPath)
+		if err != nil {
+			return err
+		}
+		err = os.Chtimes(localPath, modTime, modTime)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to set modtime of directory %q: %v", localPath, err)
+		}
+		logger.Debugf("set modtime of directory %q", localPath)
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package backup
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"local/backup/lib/logging"
+)
+
+// Before a backup, the local db is compared to the one in storage, and if they differ, e.g. because
+// another machine backed up to the same place, the backup stops rather than overwrite the other
+// changes. Force overwrites them regardless. With BackupOptions.MergeRemote, the backup merges them
+// instead: it starts from the remote db, so files are only uploaded if they're newer on disk than
+// in storage, and files that are only in storage are kept. If keeping a newer file in storage would
+// mean rewriting or deleting its archive, e.g. because it shares a batch with files that changed
+// locally, the backup stops with a mergeConflictError instead.
+
+// describe describes the file in both dbs, for reporting drift in detail.
+func (d fileDrift) describe() string {
+	switch {
+	case d.Remote == nil:
+		return fmt.Sprintf("%q is only in the local db (%s)", d.Path, describeFileInfo(d.Local))
+	case d.Local == nil:
+		return fmt.Sprintf("%q is only in the remote db (%s)", d.Path, describeFileInfo(d.Remote))
+	}
+	return fmt.Sprintf("%q differs: local %s, remote %s", d.Path, describeFileInfo(d.Local), describeFileInfo(d.Remote))
+}
+
+func describeFileInfo(fi *FileInfo) string {
+	return fmt.Sprintf("modified %s, hash %s, batch %q", fi.ModTime.Format(time.RFC3339Nano), fi.Hash, fi.Batch)
+}
+
+// printDrift logs every file that differs between the local and remote db.
+func printDrift(logger logging.Logger, drift []fileDrift) {
+	for _, d := range drift {
+		logger.Infof("  %s", d.describe())
+	}
+}
+
+// mergeRemoteDrift makes the db agree with the remote one about every drifted file, so the backup
+// starts from what's actually in storage: files only in the local db are forgotten, and the rest take
+// their remote entries. Anything on disk that differs from storage is then uploaded as usual. It
+// returns the remote modtimes of the files that are in storage, for keepRemoteFiles.
+func mergeRemoteDrift(db *DB, drift []fileDrift) (map[string]time.Time, error) {
+	remote := make(map[string]time.Time)
+	var toMark []*FileInfo
+	for _, d := range drift {
+		if d.Remote == nil {
+			if err := db.DeleteFile(d.Path); err != nil {
+				return nil, fmt.Errorf("error forgetting file %q: %v", d.Path, err)
+			}
+			continue
+		}
+		toMark = append(toMark, d.Remote)
+		remote[d.Path] = d.Remote.ModTime
+	}
+	if err := db.MarkFiles(toMark); err != nil {
+		return nil, fmt.Errorf("error merging remote files into db: %v", err)
+	}
+	return remote, nil
+}
+
+// mergeConflictError lists the files in storage that merging would overwrite or drop.
+type mergeConflictError struct {
+	Paths []string
+}
+
+func (e *mergeConflictError) Error() string {
+	return fmt.Sprintf("can't merge with storage, backing up would overwrite or drop newer files there: %s", strings.Join(e.Paths, ", "))
+}
+
+// keepRemoteFiles changes the plan so that it keeps the drifted files whose version in storage is
+// at least as new as the one on disk, or that are no longer on disk: they're neither uploaded nor
+// removed. Batches that only hold such files are left alone, but if a batch has to be rewritten or
+// deleted while it holds one, there's no way to keep it, so a *mergeConflictError is returned.
+func keepRemoteFiles(logger logging.Logger, db *DB, plan *backupPlan, remote map[string]time.Time) error {
+	if len(remote) == 0 {
+		return nil
+	}
+	onDisk := make(map[string]*BackupFile)
+	for _, batch := range plan.Batches {
+		for _, file := range batch.Files {
+			onDisk[file.Path] = file
+		}
+	}
+	keep := make(map[string]bool)
+	for path, modTime := range remote {
+		file, ok := onDisk[path]
+		if !ok || !file.ModTime.Truncate(modTimePrecision).After(modTime.Truncate(modTimePrecision)) {
+			keep[path] = true
+		}
+	}
+
+	var removed []string
+	for _, path := range plan.Summary.FilesRemoved {
+		if !keep[path] {
+			removed = append(removed, path)
+		}
+	}
+	plan.Summary.FilesRemoved = removed
+
+	var conflicts []string
+	var batchesToDelete []BatchMeta
+	for _, batch := range plan.BatchesToDelete {
+		files, err := db.GetFilesInBatch(batch.Path)
+		if err != nil {
+			return fmt.Errorf("error getting files in batch %q: %v", batch.Path, err)
+		}
+		var kept []string
+		for _, path := range files {
+			if keep[path] {
+				kept = append(kept, path)
+			}
+		}
+		if len(kept) == 0 {
+			batchesToDelete = append(batchesToDelete, batch)
+		} else if len(kept) < len(files) {
+			conflicts = append(conflicts, kept...)
+		}
+	}
+	plan.BatchesToDelete = batchesToDelete
+
+	for _, batch := range plan.Batches {
+		// The version on disk isn't uploaded over the one in storage, unless something else means the
+		// batch is uploaded anyway.
+		var kept []string
+		for _, file := range batch.Files {
+			if file.IsDirty && keep[file.Path] {
+				logger.Infof("keeping the newer version of %q in storage, recover it to update the local copy", file.Path)
+				file.IsDirty = false
+				kept = append(kept, file.Path)
+			}
+		}
+		dirty, err := batchNeedsBackup(logger, db, batch)
+		if err != nil {
+			return err
+		}
+		files, err := db.GetFilesInBatch(batch.Root)
+		if err != nil {
+			return fmt.Errorf("error getting files in batch %q: %v", batch.Root, err)
+		}
+		for _, path := range files {
+			if _, ok := onDisk[path]; ok {
+				continue
+			}
+			if keep[path] {
+				kept = append(kept, path)
+			} else {
+				// The archive has to be rewritten without the removed file.
+				dirty = true
+			}
+		}
+		if dirty {
+			conflicts = append(conflicts, kept...)
+		}
+	}
+	if len(conflicts) > 0 {
+		return &mergeConflictError{Paths: conflicts}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stretchr/testify/assert"
+
+	"local/backup/lib/logging"
+	"local/backup/lib/s3_helpers"
+	"local/backup/lib/util"
+)
+
+// newDriftTest backs up a tree to memory storage, and returns the tree, the local db, and a function
+// that backs the tree up with the given db. Backing up with a copy of the db stands in for another
+// machine backing up to the same place.
+func newDriftTest(t *testing.T) (string, string, func(dbFile string, options BackupOptions) error) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	storage := s3_helpers.NewMemoryClient("bucket")
+	testBaseDir := t.TempDir()
+	dbFile := filepath.Join(t.TempDir(), "test-backup.db")
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "big.txt"), 500))
+	must(createTestFile(filepath.Join(testBaseDir, "dir/b.txt"), 10))
+	must(createTestFile(filepath.Join(testBaseDir, "dir/c.txt"), 20))
+
+	backup := func(dbFile string, options BackupOptions) error {
+		options.Storage = storage
+		return BackupFiles(context.Background(), logger, &aws.Config{}, dbFile, testBaseDir, "bucket", "backups", "test-backup", 100, options)
+	}
+	must(backup(dbFile, BackupOptions{}))
+	return testBaseDir, dbFile, backup
+}
+
+func TestBackupFiles_MergeRemote(t *testing.T) {
+	testBaseDir, dbFile, backup := newDriftTest(t)
+
+	// Another machine backs up a file that this one doesn't have.
+	otherDBFile := filepath.Join(t.TempDir(), "other.db")
+	must(util.CopyFile(dbFile, otherDBFile))
+	must(createTestFile(filepath.Join(testBaseDir, "extra.txt"), 500))
+	must(backup(otherDBFile, BackupOptions{}))
+	must(os.Remove(filepath.Join(testBaseDir, "extra.txt")))
+
+	// Meanwhile, files change here.
+	must(createTestFile(filepath.Join(testBaseDir, "big.txt"), 600))
+	must(createTestFile(filepath.Join(testBaseDir, "dir/c.txt"), 30))
+
+	assert.ErrorContains(t, backup(dbFile, BackupOptions{}), "files have changed in storage")
+	must(backup(dbFile, BackupOptions{MergeRemote: true}))
+
+	// The other machine's file is kept, and the changed files are updated.
+	db, err := NewDB(dbFile)
+	must(err)
+	defer db.Close()
+	files, err := db.GetAllFilesByPath()
+	must(err)
+	assert.Contains(t, files, "extra.txt")
+	for _, path := range []string{"big.txt", "dir/c.txt"} {
+		info, err := os.Stat(filepath.Join(testBaseDir, path))
+		must(err)
+		assert.True(t, modTimesEqual(info.ModTime(), files[path].ModTime), path)
+	}
+
+	// Now the backups agree, so the other machine's db is behind, and this one's backs up cleanly.
+	must(backup(dbFile, BackupOptions{}))
+	assert.ErrorContains(t, backup(otherDBFile, BackupOptions{}), "files have changed in storage")
+}
+
+func TestBackupFiles_MergeRemoteConflict(t *testing.T) {
+	testBaseDir, dbFile, backup := newDriftTest(t)
+
+	// Another machine backs up a new version of a file that's in a batch with others.
+	otherDBFile := filepath.Join(t.TempDir(), "other.db")
+	must(util.CopyFile(dbFile, otherDBFile))
+	must(createTestFile(filepath.Join(testBaseDir, "dir/b.txt"), 15))
+	must(backup(otherDBFile, BackupOptions{}))
+
+	// Here, the file is older than that version, so it's not uploaded over it.
+	old := time.Now().Add(-time.Hour)
+	must(os.Chtimes(filepath.Join(testBaseDir, "dir/b.txt"), old, old))
+	mergedDBFile := filepath.Join(t.TempDir(), "merged.db")
+	must(util.CopyFile(dbFile, mergedDBFile))
+	must(backup(mergedDBFile, BackupOptions{MergeRemote: true}))
+	db, err := NewDB(mergedDBFile)
+	must(err)
+	kept, err := db.GetFileInfo("dir/b.txt")
+	db.Close()
+	must(err)
+	assert.False(t, modTimesEqual(old, kept.ModTime))
+
+	// But if another file in its batch changes, the batch can't be uploaded without it.
+	must(createTestFile(filepath.Join(testBaseDir, "dir/c.txt"), 30))
+	err = backup(dbFile, BackupOptions{MergeRemote: true})
+	var conflict *mergeConflictError
+	if assert.True(t, errors.As(err, &conflict), "expected a merge conflict, got %v", err) {
+		assert.Equal(t, []string{"dir/b.txt"}, conflict.Paths)
+	}
+}
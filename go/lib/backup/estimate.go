@@ -0,0 +1,161 @@
+package backup
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"local/backup/lib/logging"
+)
+
+type EstimateOptions struct {
+	// If positive, gzips up to this many bytes of the files that would be uploaded to measure how
+	// well they compress. Otherwise the compressed size is assumed to be the same as the logical size.
+	SampleBytes int64
+	// The options the backup would run with. Only the ones that decide which files are backed up,
+	// like the ignore rules, Since and Path, apply.
+	Backup BackupOptions
+}
+
+// EstimateReport describes how much a backup would upload if it were run right now.
+type EstimateReport struct {
+	// Number of batches that would be uploaded. Moved files that can be copied server-side aren't
+	// counted.
+	Batches int
+	// Total size of the files in those batches.
+	LogicalBytes int64
+	// LogicalBytes scaled by the sampled compression ratio.
+	EstimatedCompressedBytes int64
+	// Number of bytes that were compressed to measure the ratio.
+	SampledBytes int64
+}
+
+// Estimate scans the local tree and works out the size of the next backup, without uploading
+// anything. Unlike a dry run it doesn't touch remote storage at all.
+func Estimate(
+	logger logging.Logger,
+	dbFile string,
+	localRoot string,
+	sizeThreshold int64,
+	options EstimateOptions,
+) (*EstimateReport, error) {
+	roots := []backupRoot{{Path: filepath.Clean(localRoot)}}
+	return estimate(logger, dbFile, roots, sizeThreshold, options)
+}
+
+// EstimateRoots is Estimate for a backup of several directories, like BackupRoots.
+func EstimateRoots(
+	logger logging.Logger,
+	dbFile string,
+	localRoots []string,
+	sizeThreshold int64,
+	options EstimateOptions,
+) (*EstimateReport, error) {
+	roots, err := newBackupRoots(localRoots)
+	if err != nil {
+		return nil, err
+	}
+	return estimate(logger, dbFile, roots, sizeThreshold, options)
+}
+
+func estimate(
+	logger logging.Logger,
+	dbFile string,
+	roots []backupRoot,
+	sizeThreshold int64,
+	options EstimateOptions,
+) (*EstimateReport, error) {
+	if err := options.Backup.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid options: %v", err)
+	}
+	if roots[0].Label != "" && options.Backup.Path != "" {
+		return nil, fmt.Errorf("can't back up a subtree of a backup with several roots")
+	}
+	db, err := NewDB(dbFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading db: %v", err)
+	}
+	defer db.Close()
+
+	plan, err := planBackupRoots(logger, db, roots, sizeThreshold, options.Backup.scanOptions())
+	if err != nil {
+		return nil, err
+	}
+
+	copied := make(map[*BackupBatch]bool)
+	for _, c := range plan.Copies {
+		copied[c.Batch] = true
+	}
+
+	report := &EstimateReport{}
+	var toWrite []*BackupBatch
+	for _, batch := range plan.Batches {
+		if copied[batch] {
+			continue
+		}
+		needsBackup, err := batchNeedsBackup(logger, plan.FileInfos, batch)
+		if err != nil {
+			return nil, err
+		}
+		if needsBackup {
+			toWrite = append(toWrite, batch)
+		}
+	}
+	report.Batches = len(toWrite)
+	report.LogicalBytes = sumSizes(toWrite)
+	report.EstimatedCompressedBytes = report.LogicalBytes
+
+	if options.SampleBytes > 0 && report.LogicalBytes > 0 {
+		sampled, compressed, err := sampleCompression(roots, toWrite, options.SampleBytes)
+		if err != nil {
+			return nil, err
+		}
+		report.SampledBytes = sampled
+		if sampled > 0 {
+			ratio := float64(compressed) / float64(sampled)
+			logger.Verbosef("sampled compression ratio %.3f over %d bytes", ratio, sampled)
+			report.EstimatedCompressedBytes = int64(float64(report.LogicalBytes) * ratio)
+		}
+	}
+
+	return report, nil
+}
+
+// sampleCompression gzips files from the batches, in order, until maxBytes have been read. It
+// returns the number of bytes read and the size they compressed to.
+func sampleCompression(roots []backupRoot, batches []*BackupBatch, maxBytes int64) (int64, int64, error) {
+	counter := &countingWriter{}
+	gw := gzip.NewWriter(counter)
+	var read int64
+	for _, batch := range batches {
+		for _, file := range batch.Files {
+			if read >= maxBytes {
+				break
+			}
+			f, err := openRegularFile(filepath.Join(localRootFor(roots, file.Path), file.Path))
+			if err != nil {
+				return 0, 0, fmt.Errorf("failed to open %q for sampling: %v", file.Path, err)
+			}
+			n, err := io.Copy(gw, io.LimitReader(f, maxBytes-read))
+			f.Close()
+			if err != nil {
+				return 0, 0, fmt.Errorf("failed to sample %q: %v", file.Path, err)
+			}
+			read += n
+		}
+	}
+	if err := gw.Close(); err != nil {
+		return 0, 0, fmt.Errorf("failed to close gzip writer: %v", err)
+	}
+	return read, counter.n, nil
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,86 @@
+package backup
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"local/backup/lib/logging"
+)
+
+func TestEstimate_MatchesBackup(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+	config.SizeThreshold = 100
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "big.txt"), 500))
+	must(createTestFile(filepath.Join(testBaseDir, "subdir-1/b.txt"), 10))
+	must(createTestFile(filepath.Join(testBaseDir, "subdir-1/c.txt"), 20))
+	must(createTestFile(filepath.Join(testBaseDir, "subdir-2/d.txt"), 300))
+
+	report, err := Estimate(logger, config.DBFile, testBaseDir, config.SizeThreshold, EstimateOptions{SampleBytes: 1000})
+	must(err)
+	assert.Equal(t, int64(835), report.LogicalBytes)
+	assert.Equal(t, int64(835), report.SampledBytes)
+	assert.Greater(t, report.EstimatedCompressedBytes, int64(0))
+
+	counter := &countingUploadClient{}
+	cfg := GetMinioConfig(minioUrl)
+	cfg.HTTPClient = counter
+	must(BackupFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		testBaseDir,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		config.SizeThreshold,
+		BackupOptions{},
+	))
+	assert.NotEmpty(t, counter.puts)
+	assert.Equal(t, len(counter.puts), report.Batches)
+
+	// Once everything is backed up, there's nothing left to upload.
+	report, err = Estimate(logger, config.DBFile, testBaseDir, config.SizeThreshold, EstimateOptions{SampleBytes: 1000})
+	must(err)
+	assert.Equal(t, 0, report.Batches)
+	assert.Equal(t, int64(0), report.LogicalBytes)
+}
+
+func TestEstimate_BackupOptions(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	testBaseDir := t.TempDir()
+	dbFile := filepath.Join(t.TempDir(), "test-backup.db")
+
+	photos := filepath.Join(testBaseDir, "a", "photos")
+	music := filepath.Join(testBaseDir, "b", "music")
+	must(createTestFile(filepath.Join(photos, "1.jpg"), 200))
+	must(createTestFile(filepath.Join(photos, "debug.log"), 1000))
+	must(createTestFile(filepath.Join(music, "song.mp3"), 300))
+
+	// Excluded files aren't counted, and every root is.
+	report, err := EstimateRoots(logger, dbFile, []string{photos, music}, 100, EstimateOptions{
+		SampleBytes: 1000,
+		Backup:      BackupOptions{Exclude: []string{"*.log"}},
+	})
+	must(err)
+	assert.Equal(t, 2, report.Batches)
+	assert.Equal(t, int64(500), report.LogicalBytes)
+	assert.Equal(t, int64(500), report.SampledBytes)
+
+	_, err = EstimateRoots(logger, dbFile, []string{photos, music}, 100, EstimateOptions{
+		Backup: BackupOptions{Path: "photos"},
+	})
+	assert.Error(t, err)
+}
@@ -0,0 +1,264 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"local/backup/lib/logging"
+	"local/backup/lib/s3_helpers"
+)
+
+type GCOptions struct {
+	// Orphaned objects are only deleted if this is set. Otherwise GC just reports what it would
+	// delete.
+	Confirm bool
+	// If true, runs even if the remote db differs from the local one.
+	Force bool
+	// Where to download the remote db to. Defaults to os.TempDir().
+	TempDir string
+	// If set, deleted objects are deleted from this bucket too. See mirror.go.
+	SecondaryBucket string
+	// What to do when deleting from SecondaryBucket fails. Defaults to MirrorFail.
+	SecondaryPolicy MirrorPolicy
+	// If set, a line recording the GC and its outcome is appended to this file. See audit.go.
+	AuditLog string
+}
+
+// GC deletes objects under the backup's prefix (and archive directory, see keytemplate.go) that
+// aren't referenced by the local db, e.g. ones left behind by crashed runs. Complete snapshots are
+// kept, see snapshot.go. It returns the keys of the orphaned objects it found.
+func GC(
+	logger logging.Logger,
+	cfg *aws.Config,
+	dbFile string,
+	bucket string,
+	prefixBase string,
+	name string,
+	options GCOptions,
+) ([]string, error) {
+	orphans, deleted, err := runGC(logger, cfg, dbFile, bucket, prefixBase, name, options)
+	counts := map[string]int{
+		"orphans_found":   len(orphans),
+		"objects_deleted": deleted,
+	}
+	appendAuditLog(logger, options.AuditLog, newAuditEntry("gc", name, counts, err))
+	return orphans, err
+}
+
+// runGC is GC, apart from writing to the audit log. It also returns how many objects it deleted.
+func runGC(
+	logger logging.Logger,
+	cfg *aws.Config,
+	dbFile string,
+	bucket string,
+	prefixBase string,
+	name string,
+	options GCOptions,
+) ([]string, int, error) {
+	client, err := withMirror(logger, s3.NewFromConfig(*cfg), bucket, options.SecondaryBucket, options.SecondaryPolicy)
+	if err != nil {
+		return nil, 0, err
+	}
+	objects, err := findOrphans(logger, client, dbFile, bucket, prefixBase, name, options.Force, options.TempDir)
+	if err != nil {
+		return nil, 0, err
+	}
+	var orphans []string
+	for _, object := range objects {
+		orphans = append(orphans, aws.ToString(object.Key))
+	}
+
+	if !options.Confirm {
+		for _, key := range orphans {
+			logger.Infof("would have deleted orphaned object %q", key)
+		}
+		return orphans, 0, nil
+	}
+
+	deleted := 0
+	for _, key := range orphans {
+		logger.Infof("deleting orphaned object %q", key)
+		_, err := client.DeleteObjects(context.TODO(), &s3.DeleteObjectsInput{
+			Bucket: aws.String(bucket),
+			Delete: &types.Delete{
+				Objects: []types.ObjectIdentifier{
+					{
+						Key: aws.String(key),
+					},
+				},
+			},
+		})
+		if err != nil {
+			return nil, deleted, fmt.Errorf("failed to delete orphaned object %q: %v", key, err)
+		}
+		deleted++
+	}
+	return orphans, deleted, nil
+}
+
+// findOrphans lists the objects under the backup's prefix that aren't referenced by the local db.
+// Unless force is set, it fails if the local db doesn't match the remote one.
+func findOrphans(
+	logger logging.Logger,
+	client s3_helpers.Client,
+	dbFile string,
+	bucket string,
+	prefixBase string,
+	name string,
+	force bool,
+	tmpDir string,
+) ([]types.Object, error) {
+	prefix := s3Key(prefixBase, name)
+
+	// If the local db is stale we'd end up deleting objects that another backup still needs, so make
+	// sure it matches the remote db first.
+	changes, err := downloadAndCompareDB(logger, client, dbFile, bucket, prefixBase, name, tmpDir)
+	if err != nil {
+		return nil, fmt.Errorf("error downloading and comparing db: %v", err)
+	}
+	if len(changes) > 0 {
+		logger.Infof("files have changed in storage since the last backup:")
+		printChanges(changes)
+		if !force {
+			return nil, fmt.Errorf("files have changed in storage since the last backup")
+		}
+		logger.Infof("forcing despite changes in storage")
+	}
+
+	db, err := NewDB(dbFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading db: %v", err)
+	}
+	defer db.Close()
+
+	expectedKeys := make(map[string]struct{})
+	expectedKeys[dbKey(prefixBase, name)] = struct{}{}
+	contentAddressed, err := db.IsContentAddressed()
+	if err != nil {
+		return nil, fmt.Errorf("error reading storage mode from db: %v", err)
+	}
+	chunked, err := db.GetAllFileChunks()
+	if err != nil {
+		return nil, fmt.Errorf("error fetching chunks from db: %v", err)
+	}
+	for _, chunks := range chunked {
+		for _, chunk := range chunks {
+			expectedKeys[chunkKey(prefix, chunk.Hash)] = struct{}{}
+		}
+	}
+	streams, err := db.GetAllStreams()
+	if err != nil {
+		return nil, fmt.Errorf("error fetching streams from db: %v", err)
+	}
+	for _, stream := range streams {
+		expectedKeys[streamKey(prefix, stream.Name)] = struct{}{}
+	}
+	dir, err := archiveDir(db, prefixBase, name)
+	if err != nil {
+		return nil, err
+	}
+	archives, err := expectedArchives(db, dir)
+	if err != nil {
+		return nil, err
+	}
+	for key := range archives {
+		expectedKeys[key] = struct{}{}
+	}
+	if contentAddressed {
+		files, err := db.GetAllFiles()
+		if err != nil {
+			return nil, fmt.Errorf("error fetching files from db: %v", err)
+		}
+		for _, file := range files {
+			if _, ok := chunked[file.Path]; !ok && file.Batch == file.Path {
+				expectedKeys[blobKey(prefix, file.Hash)] = struct{}{}
+			}
+		}
+	}
+
+	// Snapshots are complete backups of their own, nested under the prefix, so nothing in them is an
+	// orphan. Objects of a snapshot that never got its db, e.g. because it was interrupted, are.
+	snapshots, err := listSnapshots(client, bucket, prefixBase, name)
+	if err != nil {
+		return nil, err
+	}
+	expectedKeys[s3Key(prefix, latestSnapshotPointer)] = struct{}{}
+	var snapshotDirs []string
+	for _, snapshotID := range snapshots {
+		snapshotPrefixBase, snapshotName := snapshotLocation(prefixBase, name, snapshotID)
+		expectedKeys[dbKey(snapshotPrefixBase, snapshotName)] = struct{}{}
+		snapshotDirs = append(snapshotDirs, s3Key(snapshotPrefixBase, snapshotName)+"/")
+	}
+	inSnapshot := func(key string) bool {
+		for _, dir := range snapshotDirs {
+			if strings.HasPrefix(key, dir) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// With a key template, the archives may be stored outside the prefix, so look there too.
+	listPrefixes := []string{prefix + "/"}
+	if !strings.HasPrefix(dir+"/", prefix+"/") {
+		listPrefixes = append(listPrefixes, dir+"/")
+	}
+	var orphans []types.Object
+	for _, listPrefix := range listPrefixes {
+		paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+			Bucket: aws.String(bucket),
+			Prefix: aws.String(listPrefix),
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(context.TODO())
+			if err != nil {
+				return nil, fmt.Errorf("failed to list objects: %v", err)
+			}
+			for _, object := range page.Contents {
+				key := aws.ToString(object.Key)
+				if _, ok := expectedKeys[key]; !ok && !inSnapshot(key) {
+					orphans = append(orphans, object)
+				}
+			}
+		}
+	}
+	return orphans, nil
+}
+
+// expectedArchives returns the keys of the archives that the db's batches are stored in, under dir,
+// mapped to the batches' paths. A batch of a single file that's stored as a blob or in chunks
+// doesn't have an archive.
+func expectedArchives(db *DB, dir string) (map[string]string, error) {
+	batches, err := db.GetExistingBatches(false)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching existing batches from db: %v", err)
+	}
+	contentAddressed, err := db.IsContentAddressed()
+	if err != nil {
+		return nil, fmt.Errorf("error reading storage mode from db: %v", err)
+	}
+	obfuscateKeys, err := db.ObfuscatesKeys()
+	if err != nil {
+		return nil, fmt.Errorf("error reading storage mode from db: %v", err)
+	}
+	chunked, err := db.GetAllFileChunks()
+	if err != nil {
+		return nil, fmt.Errorf("error fetching chunks from db: %v", err)
+	}
+	archives := make(map[string]string)
+	for _, batch := range batches {
+		if contentAddressed && batch.IsSingleFile {
+			continue
+		}
+		if _, ok := chunked[batch.Path]; ok && batch.IsSingleFile {
+			continue
+		}
+		archives[batchKey(dir, batch, obfuscateKeys)] = batch.Path
+	}
+	return archives, nil
+}
@@ -0,0 +1,140 @@
+package backup
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+
+	"local/backup/lib/logging"
+)
+
+func TestGC_RemovesOnlyOrphans(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "b.txt"), 9))
+	must(createTestFile(filepath.Join(testBaseDir, "subdir-1/c.txt"), 2000))
+	config.SizeThreshold = 1000
+
+	cfg := GetMinioConfig(minioUrl)
+	client := s3.NewFromConfig(*cfg)
+	must(BackupFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		testBaseDir,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		config.SizeThreshold,
+		BackupOptions{},
+	))
+	assertBatchCount(t, config, 2)
+
+	// Seed an object that isn't referenced by the db, as if a previous run crashed.
+	orphanKey := config.FullS3Prefix + "/stale/_files.tar.gz"
+	_, err := client.PutObject(context.TODO(), &s3.PutObjectInput{
+		Bucket: aws.String(config.Bucket),
+		Key:    aws.String(orphanKey),
+		Body:   strings.NewReader("orphan"),
+	})
+	must(err)
+
+	// Without confirmation nothing should be deleted.
+	orphans, err := GC(logger, cfg, config.DBFile, config.Bucket, config.S3Prefix, config.BackupName, GCOptions{})
+	must(err)
+	assert.Equal(t, []string{orphanKey}, orphans)
+	output, err := client.ListObjectsV2(context.TODO(), &s3.ListObjectsV2Input{
+		Bucket: aws.String(config.Bucket),
+		Prefix: aws.String(config.FullS3Prefix + "/"),
+	})
+	must(err)
+	assert.Len(t, output.Contents, 3)
+
+	orphans, err = GC(logger, cfg, config.DBFile, config.Bucket, config.S3Prefix, config.BackupName, GCOptions{Confirm: true})
+	must(err)
+	assert.Equal(t, []string{orphanKey}, orphans)
+	assertBatchCount(t, config, 2)
+
+	// The db object must survive.
+	_, err = client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+		Bucket: aws.String(config.Bucket),
+		Key:    aws.String(config.S3Prefix + "/" + config.BackupName + ".db.gz"),
+	})
+	must(err)
+}
+
+func TestGC_KeepsSnapshots(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+	cfg := GetMinioConfig(minioUrl)
+	client := s3.NewFromConfig(*cfg)
+
+	backup := func() {
+		must(BackupFiles(
+			context.Background(),
+			logger,
+			cfg,
+			config.DBFile,
+			testBaseDir,
+			config.Bucket,
+			config.S3Prefix,
+			config.BackupName,
+			config.SizeThreshold,
+			BackupOptions{Snapshot: true},
+		))
+	}
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "subdir-1/b.txt"), 9))
+	backup()
+	must(createTestFile(filepath.Join(testBaseDir, "subdir-2/c.txt"), 12))
+	backup()
+	snapshots, err := ListSnapshots(cfg, config.Bucket, config.S3Prefix, config.BackupName)
+	must(err)
+	assert.Len(t, snapshots, 2)
+
+	orphanKey := config.FullS3Prefix + "/stale/_files.tar.gz"
+	_, err = client.PutObject(context.TODO(), &s3.PutObjectInput{
+		Bucket: aws.String(config.Bucket),
+		Key:    aws.String(orphanKey),
+		Body:   strings.NewReader("orphan"),
+	})
+	must(err)
+
+	orphans, err := GC(logger, cfg, config.DBFile, config.Bucket, config.S3Prefix, config.BackupName, GCOptions{Confirm: true})
+	must(err)
+	assert.Equal(t, []string{orphanKey}, orphans)
+
+	// Both snapshots can still be recovered.
+	for _, snapshot := range snapshots {
+		must(RecoverFiles(
+			context.Background(),
+			logger,
+			cfg,
+			config.DBFile,
+			config.Bucket,
+			config.S3Prefix,
+			config.BackupName,
+			t.TempDir(),
+			RecoveryOptions{Snapshot: snapshot},
+		))
+	}
+	recoveryDir := t.TempDir()
+	must(RecoverFiles(context.Background(), logger, cfg, config.DBFile, config.Bucket, config.S3Prefix, config.BackupName, recoveryDir, RecoveryOptions{}))
+	compareDirectories(testBaseDir, recoveryDir, t)
+}
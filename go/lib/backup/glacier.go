@@ -0,0 +1,101 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"local/backup/lib/logging"
+	"local/backup/lib/s3_helpers"
+)
+
+const (
+	defaultRestoreDays         = 1
+	defaultRestorePollInterval = time.Minute
+)
+
+func isArchivedStorageClass(storageClass string) bool {
+	return storageClass == string(types.StorageClassGlacier) ||
+		storageClass == string(types.StorageClassDeepArchive)
+}
+
+// ensureObjectRestored makes sure an object in an archival storage class (e.g. GLACIER) can be
+// downloaded, requesting a restore if one hasn't been started yet. It returns false if the object
+// isn't available yet and options.WaitForRestore isn't set.
+func ensureObjectRestored(
+	logger logging.Logger,
+	client s3_helpers.Client,
+	bucket string,
+	key string,
+	options RecoveryOptions,
+) (bool, error) {
+	head, err := client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to get object info for %q: %v", key, err)
+	}
+	if !isArchivedStorageClass(string(head.StorageClass)) {
+		return true, nil
+	}
+
+	// The Restore header is only set once a restore has been requested. It looks like:
+	//   ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"
+	restore := aws.ToString(head.Restore)
+	if restore == "" {
+		days := options.RestoreDays
+		if days == 0 {
+			days = defaultRestoreDays
+		}
+		tier := options.RestoreTier
+		if tier == "" {
+			tier = types.TierStandard
+		}
+		logger.Infof("requesting restore of archived object %q (tier: %s, days: %d)", key, tier, days)
+		_, err := client.RestoreObject(context.TODO(), &s3.RestoreObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+			RestoreRequest: &types.RestoreRequest{
+				Days: aws.Int32(days),
+				GlacierJobParameters: &types.GlacierJobParameters{
+					Tier: tier,
+				},
+			},
+		})
+		if err != nil {
+			return false, fmt.Errorf("failed to request restore of %q: %v", key, err)
+		}
+	} else if strings.Contains(restore, `ongoing-request="false"`) {
+		return true, nil
+	}
+
+	if !options.WaitForRestore {
+		return false, nil
+	}
+
+	pollInterval := options.RestorePollInterval
+	if pollInterval == 0 {
+		pollInterval = defaultRestorePollInterval
+	}
+	for {
+		logger.Verbosef("waiting for restore of %q", key)
+		time.Sleep(pollInterval)
+		head, err := client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return false, fmt.Errorf("failed to get object info for %q: %v", key, err)
+		}
+		if strings.Contains(aws.ToString(head.Restore), `ongoing-request="false"`) {
+			logger.Infof("restore of %q complete", key)
+			return true, nil
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package backup
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+
+	"local/backup/lib/logging"
+	"local/backup/lib/s3_helpers"
+)
+
+// glacierFakeClient returns a scripted sequence of HeadObject responses and records restore
+// requests.
+type glacierFakeClient struct {
+	s3_helpers.Client
+	heads           []*s3.HeadObjectOutput
+	restoreRequests []*s3.RestoreObjectInput
+}
+
+func (c *glacierFakeClient) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	head := c.heads[0]
+	if len(c.heads) > 1 {
+		c.heads = c.heads[1:]
+	}
+	return head, nil
+}
+
+func (c *glacierFakeClient) RestoreObject(ctx context.Context, params *s3.RestoreObjectInput, optFns ...func(*s3.Options)) (*s3.RestoreObjectOutput, error) {
+	c.restoreRequests = append(c.restoreRequests, params)
+	return &s3.RestoreObjectOutput{}, nil
+}
+
+func TestEnsureObjectRestored(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	archived := &s3.HeadObjectOutput{StorageClass: types.StorageClassGlacier}
+	inProgress := &s3.HeadObjectOutput{
+		StorageClass: types.StorageClassGlacier,
+		Restore:      aws.String(`ongoing-request="true"`),
+	}
+	restored := &s3.HeadObjectOutput{
+		StorageClass: types.StorageClassGlacier,
+		Restore:      aws.String(`ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"`),
+	}
+
+	t.Run("not archived", func(t *testing.T) {
+		client := &glacierFakeClient{heads: []*s3.HeadObjectOutput{{StorageClass: types.StorageClassStandard}}}
+		available, err := ensureObjectRestored(logger, client, "bucket", "key", RecoveryOptions{})
+		must(err)
+		assert.True(t, available)
+		assert.Empty(t, client.restoreRequests)
+	})
+
+	t.Run("requests restore without waiting", func(t *testing.T) {
+		client := &glacierFakeClient{heads: []*s3.HeadObjectOutput{archived}}
+		available, err := ensureObjectRestored(logger, client, "bucket", "key", RecoveryOptions{})
+		must(err)
+		assert.False(t, available)
+		assert.Len(t, client.restoreRequests, 1)
+	})
+
+	t.Run("waits for restore", func(t *testing.T) {
+		client := &glacierFakeClient{heads: []*s3.HeadObjectOutput{archived, inProgress, inProgress, restored}}
+		available, err := ensureObjectRestored(logger, client, "bucket", "key", RecoveryOptions{
+			RestoreDays:         3,
+			RestoreTier:         types.TierExpedited,
+			WaitForRestore:      true,
+			RestorePollInterval: time.Millisecond,
+		})
+		must(err)
+		assert.True(t, available)
+		assert.Len(t, client.restoreRequests, 1)
+		request := client.restoreRequests[0].RestoreRequest
+		assert.Equal(t, int32(3), aws.ToInt32(request.Days))
+		assert.Equal(t, types.TierExpedited, request.GlacierJobParameters.Tier)
+	})
+
+	t.Run("already restored", func(t *testing.T) {
+		client := &glacierFakeClient{heads: []*s3.HeadObjectOutput{restored}}
+		available, err := ensureObjectRestored(logger, client, "bucket", "key", RecoveryOptions{})
+		must(err)
+		assert.True(t, available)
+		assert.Empty(t, client.restoreRequests)
+	})
+}
@@ -0,0 +1,38 @@
+package backup
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+)
+
+// With BackupOptions.PreserveHardlinks, files that are hard links to the same file are only stored
+// once per archive: the first one is stored as usual, and the others as tar.TypeLink entries that
+// point at it. Recovery recreates them as hard links. Links are only detected between files that
+// end up in the same archive, so files in different batches are still stored separately. Detecting
+// links depends on the platform, see fileIdentity.
+
+// fileID identifies a file on disk, whichever of its hard links it's reached by.
+type fileID struct {
+	Dev uint64
+	Ino uint64
+}
+
+// addLinkToArchive writes a hard link entry for the file, pointing at linkname, which must already
+// be in the archive. Like the rest of the archive's names, linkname is relative to baseDir.
+func addLinkToArchive(tw *tar.Writer, baseDir string, filename string, info os.FileInfo, linkname string) error {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	relativePath, err := filepath.Rel(baseDir, filename)
+	if err != nil {
+		return err
+	}
+	header.Name = relativePath
+	header.Typeflag = tar.TypeLink
+	header.Linkname = linkname
+	header.Size = 0
+	header.Format = tar.FormatPAX
+	return tw.WriteHeader(header)
+}
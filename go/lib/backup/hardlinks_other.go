@@ -0,0 +1,12 @@
+//go:build !unix
+
+package backup
+
+import (
+	"os"
+)
+
+// fileIdentity can't detect hard links on this platform, so every file is stored separately.
+func fileIdentity(info os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
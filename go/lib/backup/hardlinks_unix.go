@@ -0,0 +1,17 @@
+//go:build unix
+
+package backup
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileIdentity returns the device and inode of a file that has more than one hard link.
+func fileIdentity(info os.FileInfo) (fileID, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || stat.Nlink < 2 {
+		return fileID{}, false
+	}
+	return fileID{Dev: uint64(stat.Dev), Ino: uint64(stat.Ino)}, true
+}
@@ -0,0 +1,66 @@
+//go:build unix
+
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"local/backup/lib/logging"
+)
+
+func TestBackupFiles_PreserveHardlinks(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+	// Links are only preserved within a batch.
+	config.SizeThreshold = 1000
+
+	must(createTestFile(filepath.Join(testBaseDir, "subdir/a.txt"), 50))
+	must(os.Link(filepath.Join(testBaseDir, "subdir/a.txt"), filepath.Join(testBaseDir, "subdir/b.txt")))
+	must(createTestFile(filepath.Join(testBaseDir, "subdir/c.txt"), 5))
+
+	cfg := GetMinioConfig(minioUrl)
+	must(BackupFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		testBaseDir,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		config.SizeThreshold,
+		BackupOptions{PreserveHardlinks: true},
+	))
+
+	recoveryDir := t.TempDir()
+	must(RecoverFiles(
+		context.Background(),
+		logger,
+		cfg,
+		filepath.Join(t.TempDir(), "recovered.db"),
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		recoveryDir,
+		RecoveryOptions{Verify: true},
+	))
+	compareDirectories(testBaseDir, recoveryDir, t)
+
+	inode := func(path string) uint64 {
+		info, err := os.Stat(filepath.Join(recoveryDir, path))
+		must(err)
+		return uint64(info.Sys().(*syscall.Stat_t).Ino)
+	}
+	assert.Equal(t, inode("subdir/a.txt"), inode("subdir/b.txt"))
+	assert.NotEqual(t, inode("subdir/a.txt"), inode("subdir/c.txt"))
+}
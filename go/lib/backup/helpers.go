@@ -5,22 +5,26 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/md5"
+	"errors"
 	"fmt"
 	"io"
 	"local/backup/lib/logging"
-	"log"
+	"local/backup/lib/s3_helpers"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
-// XXX: unused right now, since we need the tar archive to preserve modtimes
-func backupFileNoArchive(logger logging.Logger, client *s3.Client, bucket string, prefix string, localRoot string, localPath string) error {
-	key := localPath + ".gz"
-	key = filepath.Join(prefix, key)
-	absolutePath := filepath.Join(localRoot, localPath)
-
+// backupFileNoArchive gzips a file and uploads it, returning the size of the uploaded object. It's
+// used for the db; other files need the tar archive to preserve modtimes.
+func backupFileNoArchive(logger logging.Logger, client s3_helpers.Client, bucket string, key string, localPath string) (int64, error) {
 	logger.Verbosef("backing up file %q to %q", localPath, key)
 
 	// Create a buffer to write the file into
@@ -30,43 +34,45 @@ func backupFileNoArchive(logger logging.Logger, client *s3.Client, bucket string
 	gw := gzip.NewWriter(buf)
 
 	// Write the file to the gzip writer
-	file, err := os.Open(absolutePath)
+	file, err := os.Open(localPath)
 	if err != nil {
-		return fmt.Errorf("failed to open file %q: %+v", localPath, err)
+		return 0, fmt.Errorf("failed to open file %q: %+v", localPath, err)
 	}
 	defer file.Close()
 	_, err = io.Copy(gw, file)
 	if err != nil {
-		return fmt.Errorf("failed to copy file %q to gzip writer: %+v", localPath, err)
+		return 0, fmt.Errorf("failed to copy file %q to gzip writer: %+v", localPath, err)
 	}
 
 	// Close writers to complete the archive
 	if err := gw.Close(); err != nil {
-		return fmt.Errorf("failed to close gzip writer: %v", err)
+		return 0, fmt.Errorf("failed to close gzip writer: %v", err)
 	}
 
 	// Write the results of the buffer to s3
 	_, err = client.PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket: &bucket,
-		Key:    &key,
-		Body:   bytes.NewReader(buf.Bytes()),
+		Bucket:      &bucket,
+		Key:         &key,
+		Body:        bytes.NewReader(buf.Bytes()),
+		ContentType: aws.String(gzipContentType),
 	})
 	if err != nil {
-		return fmt.Errorf("failed to upload file %q to %q: %v", localPath, key, err)
+		return 0, fmt.Errorf("failed to upload file %q to %q: %v", localPath, key, err)
 	}
-	return nil
+	return int64(buf.Len()), nil
 }
 
 func backupFile(
 	logger logging.Logger,
-	client *s3.Client,
+	client s3_helpers.Client,
 	bucket string,
 	prefix string,
 	localRoot string,
 	// Relative to the local root
 	filePath string,
-) error {
-	archiveName := filePath + ".tar.gz"
+	options archiveOptions,
+) (*uploadedArchive, error) {
+	archiveName := batchArchiveName(BatchMeta{Path: filePath, IsSingleFile: true})
 
 	logger.Verbosef(
 		"backing up file %q to %q",
@@ -85,35 +91,38 @@ func backupFile(
 		localRoot,
 		filepath.Dir(filePath),
 		[]string{filePath},
+		options,
 	)
 }
 
 // Mostly from https://www.arthurkoziel.com/writing-tar-gz-files-in-go/
 func backupDirectory(
 	logger logging.Logger,
-	client *s3.Client,
+	client s3_helpers.Client,
 	bucket string,
 	prefix string,
 	localRoot string,
 	// This should be relative to the root
 	localBatchRoot string,
 	files []string,
-) error {
+	options archiveOptions,
+) (*uploadedArchive, error) {
 	return backupFilesToArchive(
 		logger,
 		client,
 		bucket,
 		prefix,
-		filepath.Join(localBatchRoot, "_files.tar.gz"),
+		batchArchiveName(BatchMeta{Path: localBatchRoot}),
 		localRoot,
 		localBatchRoot,
 		files,
+		options,
 	)
 }
 
 func backupFilesToArchive(
 	logger logging.Logger,
-	client *s3.Client,
+	client s3_helpers.Client,
 	bucket string,
 	prefix string,
 	// S3 key relative to the prefix
@@ -123,69 +132,286 @@ func backupFilesToArchive(
 	// Relative to the local root
 	localBatchRoot string,
 	files []string,
-) error {
-	key := filepath.Join(prefix, archiveName)
+	options archiveOptions,
+) (*uploadedArchive, error) {
+	key := archiveKey(prefix, archiveName, options.ObfuscateKeys)
 	logger.Verbosef("backing up directory %q -> %q", localBatchRoot, key)
 
-	// Create a buffer to write the files into
-	buf := &bytes.Buffer{}
+	// Build the archive in memory, or in a temporary file if it's too big for that.
+	buf := newSpoolWriter(options.MaxBufferBytes, options.TempDir)
+	defer buf.Close()
 
-	// Streams for tar archive and gzip
-	gw := gzip.NewWriter(buf)
-	tw := tar.NewWriter(gw)
+	// Streams for tar archive and gzip. Each file is compressed at its own level, so files that are
+	// already compressed can be stored as is.
+	gw, err := newLevelWriter(buf, gzip.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	tarBytes := &countingWriter{}
+	tw := tar.NewWriter(io.MultiWriter(gw, tarBytes))
 
 	// Scan all the specified files and back them up to the archive.
+	archived := make(map[string]*archivedFile)
+	// The first file archived for each set of hard links.
+	links := make(map[fileID]string)
 	for _, filename := range files {
 		logger.Verbosef("  archiving file %q", filename)
+		// Finish the previous file, including its padding, before changing the level.
+		if err := tw.Flush(); err != nil {
+			return nil, fmt.Errorf("failed to flush tar writer: %v", err)
+		}
+		if err := gw.SetLevel(compressionLevel(filename, options.NoCompressExtensions)); err != nil {
+			return nil, fmt.Errorf("failed to set compression level: %v", err)
+		}
 		absoluteArchiveRoot := filepath.Join(localRoot, localBatchRoot)
 		absoluteFilename := filepath.Join(localRoot, filename)
-		if err := addFileToArchive(tw, absoluteArchiveRoot, absoluteFilename); err != nil {
-			return fmt.Errorf("failed to add file %q to archive: %+v", filename, err)
+
+		var id fileID
+		isLink := false
+		if options.PreserveHardlinks {
+			if info, err := os.Stat(absoluteFilename); err == nil {
+				id, isLink = fileIdentity(info)
+				if first, ok := links[id]; isLink && ok {
+					logger.Verbosef("  %q is a hard link to %q", filename, first)
+					linkname, err := filepath.Rel(absoluteArchiveRoot, filepath.Join(localRoot, first))
+					if err != nil {
+						return nil, err
+					}
+					if err := addLinkToArchive(tw, absoluteArchiveRoot, absoluteFilename, info, linkname); err != nil {
+						return nil, &fileError{Path: filename, Err: err}
+					}
+					// The link has the same contents as the file it points at.
+					af := *archived[first]
+					archived[filename] = &af
+					continue
+				}
+			}
+		}
+
+		af, err := addFileToArchive(tw, absoluteArchiveRoot, absoluteFilename)
+		if errors.Is(err, errUnreadableFile) && options.SkipUnreadable {
+			logger.Infof("skipping file %q: %v", filename, err)
+			archived[filename] = &archivedFile{Err: err}
+			continue
+		}
+		if err != nil {
+			return nil, &fileError{Path: filename, Err: err}
+		}
+		archived[filename] = af
+		if isLink {
+			links[id] = filename
 		}
 	}
 
 	// Explicitly close those writers so the tar archive and gzip file are complete before we write
 	// the buffer to S3. Make sure to close the tar writer first to flush all archive bytes to the
 	// gzip compressor.
-	// TODO: ideally we'd do this in a streaming manner
 	if err := tw.Close(); err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("failed to close tar writer: %v", err)
 	}
 	if err := gw.Close(); err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("failed to close gzip writer: %v", err)
+	}
+	if buf.Spooled() {
+		logger.Verbosef("archive %q is %d bytes, uploading it from a temporary file", key, buf.Size())
+	}
+	uploaded := &uploadedArchive{
+		Files:    archived,
+		Checksum: buf.Checksum(),
+		Size:     buf.Size(),
+		Compression: CompressionStats{
+			Uncompressed: tarBytes.n,
+			Compressed:   buf.Size(),
+		},
+	}
+
+	// If the last backup was interrupted after uploading this archive but before recording it in the
+	// db, the archive that's stored is the same as this one, so it doesn't need to be uploaded again.
+	// With a secondary bucket, the interruption may have come between the two writes, so it has to be
+	// stored in both.
+	if archiveStored(client, key, uploaded.Checksum, bucket, options.SecondaryBucket) {
+		logger.Infof("archive %q is already stored, not uploading it again", key)
+		uploaded.Size = 0
+		return uploaded, nil
+	}
+
+	body, err := buf.Reader()
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := make(map[string]string)
+	for k, v := range options.Metadata {
+		metadata[k] = v
+	}
+	metadata[metadataFileCount] = fmt.Sprint(countArchived(archived))
+	// The source path would give away what an obfuscated key hides.
+	if !options.ObfuscateKeys {
+		metadata[metadataSourcePath] = filepath.ToSlash(localBatchRoot)
 	}
 
 	// Write the results of the buffer to s3
-	_, err := client.PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket: &bucket,
-		Key:    &key,
-		// TODO: is this optimal?
-		Body: bytes.NewReader(buf.Bytes()),
+	err = uploadArchive(client, &s3.PutObjectInput{
+		Bucket:      &bucket,
+		Key:         &key,
+		Body:        body,
+		ContentType: aws.String(gzipContentType),
+		Metadata:    metadata,
+	}, options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload local directory %q to %q: %v", localBatchRoot, key, err)
+	}
+	return uploaded, nil
+}
+
+// archiveStored returns whether the object with the given key and MD5 is stored in every one of the
+// given buckets. Empty bucket names are skipped.
+func archiveStored(client s3_helpers.Client, key string, checksum string, buckets ...string) bool {
+	for _, bucket := range buckets {
+		if bucket != "" && storedChecksum(client, bucket, key) != checksum {
+			return false
+		}
+	}
+	return true
+}
+
+// storedChecksum returns the MD5 of the object with the given key, or "" if it doesn't exist or its
+// MD5 isn't known. S3 only reports the MD5, as the ETag, for objects that were uploaded in one piece
+// without KMS encryption, so archives uploaded in parts (see multipart.go) are never skipped.
+func storedChecksum(client s3_helpers.Client, bucket string, key string) string {
+	output, err := client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
 	})
 	if err != nil {
-		return fmt.Errorf("failed to upload local directory %q to %q: %v", localBatchRoot, key, err)
+		return ""
+	}
+	etag := strings.Trim(aws.ToString(output.ETag), `"`)
+	if len(etag) != 2*md5.Size {
+		return ""
+	}
+	return etag
+}
+
+type archiveOptions struct {
+	// If true, files that can't be opened are left out of the archive and reported in their
+	// archivedFile instead of failing the whole archive.
+	SkipUnreadable bool
+	// If true, the archive is stored under a hash of its name. See obfuscate.go.
+	ObfuscateKeys bool
+	// If true, hard links to a file that's already in the archive are stored as links. See
+	// hardlinks.go.
+	PreserveHardlinks bool
+	// Metadata attached to the uploaded object, along with the archive's file count and source path.
+	// See objectMetadata.
+	Metadata map[string]string
+	// Files with these extensions are stored without compression. See compressionLevel.
+	NoCompressExtensions []string
+	// See BackupOptions.MaxBufferBytes.
+	MaxBufferBytes int64
+	// Where bigger archives are spooled. See BackupOptions.TempDir.
+	TempDir string
+	// See BackupOptions.SecondaryBucket. An archive is only taken to be already stored if it's in
+	// both buckets.
+	SecondaryBucket string
+	// See BackupOptions.PartSize.
+	PartSize int64
+	// See BackupOptions.PartConcurrency.
+	PartConcurrency int
+}
+
+// Keys of the metadata attached to uploaded archives.
+const (
+	metadataBackupName = "backup-name"
+	metadataFileCount  = "file-count"
+	// The archive's directory, or the file's path for a single file, relative to the backup root.
+	metadataSourcePath = "source-path"
+)
+
+// objectMetadata returns the metadata to attach to every archive in the given backup: the custom
+// metadata from the options, plus the backup's name.
+func objectMetadata(name string, custom map[string]string) map[string]string {
+	metadata := make(map[string]string)
+	for k, v := range custom {
+		metadata[k] = v
+	}
+	metadata[metadataBackupName] = name
+	return metadata
+}
+
+// countArchived returns how many files actually made it into an archive.
+func countArchived(archived map[string]*archivedFile) int {
+	n := 0
+	for _, af := range archived {
+		if af.Err == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// uploadedArchive describes an object that was written to storage.
+type uploadedArchive struct {
+	// The files in the archive, by path relative to the backup root.
+	Files map[string]*archivedFile
+	// MD5 of the object's bytes.
+	Checksum string
+	// The number of bytes that were uploaded, which is 0 if the object was already stored.
+	Size int64
+	// How well the contents compressed, whether or not they were uploaded.
+	Compression CompressionStats
+	// For a file stored in chunks, its chunks, in order. They're recorded in the db along with the
+	// file.
+	Chunks []chunkRef
+}
+
+// archivedFile describes the version of a file that was written to an archive.
+type archivedFile struct {
+	ModTime time.Time
+	// Hash of the bytes that were written to the archive.
+	Hash string
+	// True if the file was modified while it was being archived, i.e. the archived contents may not
+	// match any version of the file.
+	Changed bool
+	// Set if the file couldn't be read, in which case it isn't in the archive.
+	Err error
+}
+
+// Returned by addFileToArchive if the file couldn't be read. Nothing has been written to the
+// archive in that case, so it's still usable.
+var errUnreadableFile = errors.New("unreadable file")
+
+// openRegularFile opens a file for reading, after making sure that it (or the file a symlink points
+// to) is a regular file. Opening a FIFO would block until something writes to it.
+func openRegularFile(filename string) (*os.File, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%q isn't a regular file (%s)", filename, info.Mode().Type())
 	}
-	return nil
+	return os.Open(filename)
 }
 
-func addFileToArchive(tw *tar.Writer, baseDir string, filename string) error {
+func addFileToArchive(tw *tar.Writer, baseDir string, filename string) (*archivedFile, error) {
 	// Open the file which will be written into the archive
-	file, err := os.Open(filename)
+	file, err := openRegularFile(filename)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("%w: %v", errUnreadableFile, err)
 	}
 	defer file.Close()
 
 	// Get FileInfo about our file providing file size, mode, etc.
 	info, err := file.Stat()
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("%w: %v", errUnreadableFile, err)
 	}
 
 	// Create a tar Header from the FileInfo data
 	header, err := tar.FileInfoHeader(info, info.Name())
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Use full path as name (FileInfoHeader only takes the basename)
@@ -194,24 +420,52 @@ func addFileToArchive(tw *tar.Writer, baseDir string, filename string) error {
 	// https://golang.org/src/archive/tar/common.go?#L626
 	relativePath, err := filepath.Rel(baseDir, filename)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	header.Name = relativePath
 
 	// Update the header's format to preserve sub-second modtime resolution (see https://pkg.go.dev/archive/tar#Format)
 	header.Format = tar.FormatPAX
+	// PAX would also record the access and change times, but reading the file to archive it can
+	// change its access time, so leave them out to make the archive the same every time it's built.
+	header.AccessTime = time.Time{}
+	header.ChangeTime = time.Time{}
 
 	// Write file header to the tar archive
 	err = tw.WriteHeader(header)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Copy file content to tar archive
-	_, err = io.Copy(tw, file)
+	// Copy file content to tar archive, hashing it on the way through. Only copy as many bytes as the
+	// header says, in case the file has grown since we stat-ed it.
+	h := md5.New()
+	_, err = io.CopyN(io.MultiWriter(tw, h), file, info.Size())
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	// Check whether the file was modified while we were reading it.
+	after, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	changed := !after.ModTime().Equal(info.ModTime()) || after.Size() != info.Size()
+
+	return &archivedFile{
+		ModTime: info.ModTime(),
+		Hash:    fmt.Sprintf("%x", h.Sum(nil)),
+		Changed: changed,
+	}, nil
+}
+
+// displayPath returns the path as is, for listing it in logs, unless it contains characters that
+// would make the log ambiguous, like a newline, in which case it's quoted.
+func displayPath(path string) string {
+	for _, r := range path {
+		if !unicode.IsPrint(r) && r != ' ' {
+			return strconv.Quote(path)
+		}
+	}
+	return path
 }
@@ -1,22 +1,102 @@
 package backup
 
 import (
+	"errors"
+	"fmt"
 	"os"
+	"path"
+	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 )
 
+// The .dbignore file in the backup root holds regular expressions, one per line, matched against
+// paths relative to the root. A path that any of them matches is ignored, and blank lines are
+// skipped. When scanning, directories are matched with a trailing "/", so "^build/" ignores the
+// whole directory without descending into it.
+//
+// If enabled, .gitignore files are also honored, with gitignore's glob syntax, and apply to the
+// directory they're in. The last pattern that matches a path decides whether it's ignored, a
+// pattern starting with "!" re-includes paths that an earlier pattern ignored, and lines starting
+// with "#" are comments. Extra ignore files, such as a global one shared by several backups, use the
+// same syntax and apply to the backup root. Rules are merged in order: .gitignore files, then the
+// extra files in the order they were given, then the .dbignore, so a later file can re-include what
+// an earlier one ignored, and nothing can re-include what the .dbignore ignores.
+//
+// Hidden files and directories, whose names start with ".", can be ignored as well. That rule comes
+// before all the others, so a .gitignore or an extra ignore file can re-include them.
+//
+// Finally, globs given with BackupOptions.Exclude and BackupOptions.Include, in gitignore's syntax,
+// apply on top of every ignore file, so a one-off run can ignore or re-include paths without editing
+// them. Includes come after excludes, so "-exclude '*.log' -include 'keep.log'" keeps keep.log. As
+// with any other rule, a path inside an ignored directory can't be re-included, since the scan never
+// descends into it.
+
+const (
+	dbignoreFilename  = ".dbignore"
+	gitignoreFilename = ".gitignore"
+)
+
+type IgnoreRule struct {
+	Pattern *regexp.Regexp
+	// Re-includes matching paths instead of ignoring them.
+	Negate bool
+	// Only matches directories.
+	DirOnly bool
+}
+
 type IgnoreFile struct {
+	// The .dbignore patterns. A path that matches any of them is ignored.
 	Ignore []*regexp.Regexp
+	// The gitignore rules. The last one that matches a path decides whether it's ignored.
+	Rules []IgnoreRule
 }
 
+// IsIgnored reports whether the given slash-separated file path is ignored. A path is also ignored
+// by the gitignore rules if one of its parent directories is.
 func (i *IgnoreFile) IsIgnored(path string) bool {
 	for _, regex := range i.Ignore {
 		if regex.MatchString(path) {
 			return true
 		}
 	}
-	return false
+	parts := strings.Split(path, "/")
+	for n := 1; n < len(parts); n++ {
+		if ignored, _ := i.matchRules(strings.Join(parts[:n], "/")+"/", true); ignored {
+			return true
+		}
+	}
+	ignored, _ := i.matchRules(path, false)
+	return ignored
+}
+
+// match returns whether the path is ignored, and whether any pattern matched it at all.
+func (i *IgnoreFile) match(path string, isDir bool) (bool, bool) {
+	if isDir {
+		path += "/"
+	}
+	for _, regex := range i.Ignore {
+		if regex.MatchString(path) {
+			return true, true
+		}
+	}
+	return i.matchRules(path, isDir)
+}
+
+// matchRules returns whether the last rule that matches the path ignores it, and whether any rule
+// matched at all. Directories are given with a trailing "/".
+func (i *IgnoreFile) matchRules(path string, isDir bool) (bool, bool) {
+	ignored, matched := false, false
+	for _, rule := range i.Rules {
+		if rule.DirOnly && !isDir {
+			continue
+		}
+		if rule.Pattern.MatchString(path) {
+			ignored, matched = !rule.Negate, true
+		}
+	}
+	return ignored, matched
 }
 
 func LoadIgnoreFile(path string) (*IgnoreFile, error) {
@@ -25,18 +105,289 @@ func LoadIgnoreFile(path string) (*IgnoreFile, error) {
 		return nil, err
 	}
 
-	return LoadIgnoreFileFromString(string(ignoreFile))
+	return loadIgnoreFile(path, string(ignoreFile))
 }
 
+// LoadIgnoreFileFromString parses .dbignore patterns.
 func LoadIgnoreFileFromString(str string) (*IgnoreFile, error) {
-	ignore := strings.Split(str, "\n")
+	return loadIgnoreFile(dbignoreFilename, str)
+}
+
+// loadIgnoreFile parses .dbignore patterns. The filename is only used in errors.
+func loadIgnoreFile(filename string, str string) (*IgnoreFile, error) {
+	lines := strings.Split(str, "\n")
 	// Ignore the ignore file itself.
-	ignore = append(ignore, `\.dbignore$`)
+	lines = append(lines, `\.dbignore$`)
 
-	ignoreRegexes := make([]*regexp.Regexp, len(ignore))
-	for i, pattern := range ignore {
-		ignoreRegexes[i] = regexp.MustCompile(pattern)
+	ignoreFile := &IgnoreFile{}
+	for n, pattern := range lines {
+		// An empty pattern would match every path.
+		if pattern == "" {
+			continue
+		}
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid pattern %q: %v", filename, n+1, pattern, err)
+		}
+		ignoreFile.Ignore = append(ignoreFile.Ignore, regex)
+	}
+	return ignoreFile, nil
+}
+
+// LoadGitignoreFromString parses .gitignore patterns.
+func LoadGitignoreFromString(str string) (*IgnoreFile, error) {
+	return loadGitignore(gitignoreFilename, str)
+}
+
+// loadGitignore parses .gitignore patterns. The filename is only used in errors.
+func loadGitignore(filename string, str string) (*IgnoreFile, error) {
+	ignoreFile := &IgnoreFile{}
+	for n, line := range strings.Split(str, "\n") {
+		pattern, negate, ok := parseIgnoreLine(line)
+		if !ok {
+			continue
+		}
+		rule, err := globRule(pattern, negate)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, n+1, err)
+		}
+		ignoreFile.Rules = append(ignoreFile.Rules, rule)
+	}
+	return ignoreFile, nil
+}
+
+// loadGlobs turns the exclude and include globs from the command line into rules, with the
+// includes last so they take precedence.
+func loadGlobs(exclude []string, include []string) (*IgnoreFile, error) {
+	ignoreFile := &IgnoreFile{}
+	for _, glob := range exclude {
+		rule, err := globRule(glob, false)
+		if err != nil {
+			return nil, fmt.Errorf("exclude: %v", err)
+		}
+		ignoreFile.Rules = append(ignoreFile.Rules, rule)
+	}
+	for _, glob := range include {
+		rule, err := globRule(glob, true)
+		if err != nil {
+			return nil, fmt.Errorf("include: %v", err)
+		}
+		ignoreFile.Rules = append(ignoreFile.Rules, rule)
 	}
+	return ignoreFile, nil
+}
 
-	return &IgnoreFile{Ignore: ignoreRegexes}, nil
+// globRule compiles a gitignore glob into a rule. A trailing "/" only matches directories.
+func globRule(glob string, negate bool) (IgnoreRule, error) {
+	regex, err := regexp.Compile(globToRegexp(strings.TrimSuffix(glob, "/")))
+	if err != nil {
+		return IgnoreRule{}, fmt.Errorf("invalid pattern %q: %v", glob, err)
+	}
+	return IgnoreRule{
+		Pattern: regex,
+		Negate:  negate,
+		DirOnly: strings.HasSuffix(glob, "/"),
+	}, nil
+}
+
+// parseIgnoreLine returns the pattern on the line and whether it's negated, or false if the line
+// has no pattern.
+func parseIgnoreLine(line string) (string, bool, bool) {
+	line = strings.TrimRight(line, "\r")
+	if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+		return "", false, false
+	}
+	if strings.HasPrefix(line, "!") {
+		return line[1:], true, true
+	}
+	return line, false, true
+}
+
+// globToRegexp translates a gitignore glob into a regular expression that matches paths relative
+// to the .gitignore's directory, with or without a trailing "/". As in git, a glob with a "/" at
+// the start or in the middle is anchored to that directory, and one without matches at any depth.
+// "*" and "?" don't match "/", but "**" does, and a leading or inner "**/" matches zero or more
+// directories.
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	if strings.Contains(glob, "/") {
+		glob = strings.TrimPrefix(glob, "/")
+		b.WriteString(`^`)
+	} else {
+		b.WriteString(`(^|/)`)
+	}
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString(`(.*/)?`)
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(`.*`)
+			i++
+		case c == '*':
+			b.WriteString(`[^/]*`)
+		case c == '?':
+			b.WriteString(`[^/]`)
+		case c == '[':
+			// Character classes are passed through, apart from gitignore's "!" for negation.
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(regexp.QuoteMeta(glob[i:]))
+				i = len(glob)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			b.WriteString(regexp.QuoteMeta(glob[i+1 : i+2]))
+			i++
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString(`/?$`)
+	return b.String()
+}
+
+// ignoreMatcher decides which paths under a backup root are ignored.
+type ignoreMatcher struct {
+	root string
+	// For a backup with several roots, the root's top-level directory in the backup, which is
+	// stripped from paths before they're matched. See roots.go.
+	label          string
+	gitignore      bool
+	ignoreDotfiles bool
+	// .gitignore files by the directory they're in, relative to the root. Loaded as directories are
+	// scanned, which may be several at once; nil if a directory doesn't have one.
+	mu         sync.Mutex
+	gitignores map[string]*IgnoreFile
+	extra      []*IgnoreFile
+	dbignore   *IgnoreFile
+	// The exclude and include globs, which have the final say.
+	globs *IgnoreFile
+}
+
+// newIgnoreMatcher loads the extra ignore files in the scan options and the root's .dbignore, if
+// there is one.
+func newIgnoreMatcher(root string, scan scanOptions) (*ignoreMatcher, error) {
+	m := &ignoreMatcher{
+		root:           filepath.Join(root, scan.label),
+		label:          scan.label,
+		gitignore:      scan.Gitignore,
+		ignoreDotfiles: scan.IgnoreDotfiles,
+		gitignores:     make(map[string]*IgnoreFile),
+	}
+	for _, path := range scan.IgnoreFiles {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error loading ignore file: %v", err)
+		}
+		extra, err := loadGitignore(path, string(data))
+		if err != nil {
+			return nil, fmt.Errorf("error loading ignore file: %v", err)
+		}
+		m.extra = append(m.extra, extra)
+	}
+	dbignore, err := LoadIgnoreFile(filepath.Join(m.root, dbignoreFilename))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("error loading ignore file: %v", err)
+	}
+	m.dbignore = dbignore
+	m.globs, err = loadGlobs(scan.Exclude, scan.Include)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// IsIgnored reports whether the given path, relative to the root, is ignored. Parent directories
+// aren't checked, since the scan never descends into ignored directories.
+func (m *ignoreMatcher) IsIgnored(relPath string, isDir bool) (bool, error) {
+	relPath = filepath.ToSlash(relPath)
+	if m.label != "" {
+		relPath = strings.TrimPrefix(relPath, m.label+"/")
+	}
+	ignored := m.ignoreDotfiles && strings.HasPrefix(path.Base(relPath), ".")
+	if m.gitignore {
+		// Check the .gitignore of every directory above the path, from the root down, so deeper ones
+		// take precedence.
+		dir := "."
+		rest := relPath
+		for {
+			gitignore, err := m.loadGitignore(dir)
+			if err != nil {
+				return false, err
+			}
+			if gitignore != nil {
+				if ig, ok := gitignore.match(rest, isDir); ok {
+					ignored = ig
+				}
+			}
+			elem, remaining, found := strings.Cut(rest, "/")
+			if !found {
+				break
+			}
+			dir, rest = path.Join(dir, elem), remaining
+		}
+	}
+	for _, extra := range m.extra {
+		if ig, ok := extra.match(relPath, isDir); ok {
+			ignored = ig
+		}
+	}
+	if m.dbignore != nil {
+		if ig, ok := m.dbignore.match(relPath, isDir); ok {
+			ignored = ig
+		}
+	}
+	if ig, ok := m.globs.match(relPath, isDir); ok {
+		ignored = ig
+	}
+	return ignored, nil
+}
+
+func (m *ignoreMatcher) loadGitignore(dir string) (*IgnoreFile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if gitignore, ok := m.gitignores[dir]; ok {
+		return gitignore, nil
+	}
+	filename := filepath.Join(m.root, filepath.FromSlash(dir), gitignoreFilename)
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		m.gitignores[dir] = nil
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	gitignore, err := loadGitignore(filename, string(data))
+	if err != nil {
+		return nil, fmt.Errorf("error loading ignore file: %v", err)
+	}
+	m.gitignores[dir] = gitignore
+	return gitignore, nil
+}
+
+// hasExtension reports whether the file has one of the given extensions, or whether there are no
+// extensions to check against. A leading "." on the extensions is optional.
+func hasExtension(path string, extensions []string) bool {
+	if len(extensions) == 0 {
+		return true
+	}
+	ext := strings.TrimPrefix(filepath.Ext(path), ".")
+	if ext == "" {
+		return false
+	}
+	for _, allowed := range extensions {
+		if strings.EqualFold(ext, strings.TrimPrefix(allowed, ".")) {
+			return true
+		}
+	}
+	return false
 }
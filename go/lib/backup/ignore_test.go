@@ -1,10 +1,16 @@
 package backup
 
 import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+
+	"local/backup/lib/logging"
 )
 
 func TestIgnoreFile(t *testing.T) {
@@ -26,6 +32,193 @@ func TestIgnoreFile(t *testing.T) {
 
 	// Also make sure that the ignore file itself is ignored.
 	assert.True(t, ignoreFile.IsIgnored(".dbignore"))
+
+	// Every line is a regular expression, even ones that look like gitignore comments or negations.
+	ignoreFile, err = LoadIgnoreFileFromString("#notes\n!important\n")
+	must(err)
+	assert.True(t, ignoreFile.IsIgnored("#notes.txt"))
+	assert.True(t, ignoreFile.IsIgnored("!important"))
+	assert.False(t, ignoreFile.IsIgnored("important"))
+	assert.False(t, ignoreFile.IsIgnored("a.txt"))
+}
+
+func TestIgnoreFile_InvalidPattern(t *testing.T) {
+	_, err := LoadIgnoreFileFromString("\\.txt$\n# comment\nfoo(bar\n")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), ".dbignore:3:")
+		assert.Contains(t, err.Error(), `"foo(bar"`)
+	}
+
+	root := t.TempDir()
+	must(os.WriteFile(filepath.Join(root, ".dbignore"), []byte("a\n[z-a]\n"), 0644))
+	_, err = newIgnoreMatcher(root, scanOptions{})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), filepath.Join(root, ".dbignore")+":2:")
+	}
+}
+
+func TestGitignore(t *testing.T) {
+	patterns := []string{
+		"# Dependencies",
+		"node_modules/",
+		"*.log",
+		"!keep.log",
+		"build/**/*.o",
+	}
+	ignoreFile, err := LoadGitignoreFromString(strings.Join(patterns, "\n"))
+	if err != nil {
+		t.Fatalf("error loading ignore file: %v", err)
+	}
+
+	assert.True(t, ignoreFile.IsIgnored("node_modules/a.js"))
+	assert.True(t, ignoreFile.IsIgnored("web/node_modules/lib/a.js"))
+	// Only directories match a pattern with a trailing slash.
+	assert.False(t, ignoreFile.IsIgnored("node_modules"))
+	assert.True(t, ignoreFile.IsIgnored("debug.log"))
+	assert.True(t, ignoreFile.IsIgnored("logs/debug.log"))
+	assert.False(t, ignoreFile.IsIgnored("keep.log"))
+	assert.True(t, ignoreFile.IsIgnored("build/x/y/a.o"))
+	assert.False(t, ignoreFile.IsIgnored("build/a.c"))
+	assert.False(t, ignoreFile.IsIgnored("a.txt"))
+}
+
+func TestGitignore_Anchoring(t *testing.T) {
+	anchored, err := LoadGitignoreFromString("/tmp")
+	must(err)
+	assert.True(t, anchored.IsIgnored("tmp"))
+	assert.True(t, anchored.IsIgnored("tmp/a.txt"))
+	assert.False(t, anchored.IsIgnored("sub/tmp/a.txt"))
+	assert.False(t, anchored.IsIgnored("sub/deeper/tmp/a.txt"))
+
+	anywhere, err := LoadGitignoreFromString("tmp/")
+	must(err)
+	assert.False(t, anywhere.IsIgnored("tmp"))
+	assert.True(t, anywhere.IsIgnored("tmp/a.txt"))
+	assert.True(t, anywhere.IsIgnored("sub/tmp/a.txt"))
+	assert.True(t, anywhere.IsIgnored("sub/deeper/tmp/a.txt"))
+
+	// A slash in the middle anchors the pattern too.
+	inner, err := LoadGitignoreFromString("sub/tmp")
+	must(err)
+	assert.True(t, inner.IsIgnored("sub/tmp/a.txt"))
+	assert.False(t, inner.IsIgnored("x/sub/tmp/a.txt"))
+
+	// Unless it starts with "**/".
+	deep, err := LoadGitignoreFromString("**/sub/tmp\na/**/b")
+	must(err)
+	assert.True(t, deep.IsIgnored("sub/tmp/a.txt"))
+	assert.True(t, deep.IsIgnored("x/sub/tmp/a.txt"))
+	assert.True(t, deep.IsIgnored("a/b/c.txt"))
+	assert.True(t, deep.IsIgnored("a/x/y/b/c.txt"))
+	assert.False(t, deep.IsIgnored("x/a/b/c.txt"))
+}
+
+func TestIgnoreMatcher_NestedGitignoreAnchoring(t *testing.T) {
+	root := t.TempDir()
+	must(os.MkdirAll(filepath.Join(root, "web"), os.ModePerm))
+	// Anchored to web/, not to the backup root.
+	must(os.WriteFile(filepath.Join(root, "web/.gitignore"), []byte("/tmp\n"), 0644))
+
+	m, err := newIgnoreMatcher(root, scanOptions{Gitignore: true})
+	must(err)
+	for path, expected := range map[string]bool{
+		"tmp":         false,
+		"web/tmp":     true,
+		"web/sub/tmp": false,
+	} {
+		ignored, err := m.IsIgnored(path, true)
+		must(err)
+		assert.Equal(t, expected, ignored, path)
+	}
+}
+
+func TestBackupFiles_Gitignore(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "node_modules/x/index.js"), 9))
+	must(createTestFile(filepath.Join(testBaseDir, "web/b.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "web/node_modules/y/index.js"), 9))
+	must(createTestFile(filepath.Join(testBaseDir, "web/debug.log"), 9))
+	must(os.WriteFile(filepath.Join(testBaseDir, ".gitignore"), []byte("node_modules/\n"), 0644))
+	// The .dbignore takes precedence over the .gitignore files, which can't re-include what it
+	// ignores.
+	must(os.WriteFile(filepath.Join(testBaseDir, "web/.gitignore"), []byte("*.log\n!b.txt\n"), 0644))
+	must(os.WriteFile(filepath.Join(testBaseDir, ".dbignore"), []byte("^web/b\\.txt$\n"), 0644))
+
+	must(BackupFiles(
+		context.Background(),
+		logger,
+		GetMinioConfig(minioUrl),
+		config.DBFile,
+		testBaseDir,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		config.SizeThreshold,
+		BackupOptions{Gitignore: true},
+	))
+
+	db, err := NewDB(config.DBFile)
+	must(err)
+	defer db.Close()
+	files, err := db.GetAllFiles()
+	must(err)
+	var paths []string
+	for _, file := range files {
+		paths = append(paths, file.Path)
+	}
+	sort.Strings(paths)
+	assert.Equal(t, []string{
+		".gitignore",
+		"a.txt",
+		"web/.gitignore",
+	}, paths)
+}
+
+func TestIgnoreMatcher_MergesIgnoreFiles(t *testing.T) {
+	root := t.TempDir()
+	dir := t.TempDir()
+	globalFile := filepath.Join(dir, "global")
+	must(os.WriteFile(globalFile, []byte("*.txt\n*.tmp\n"), 0644))
+	// The extra file re-includes files that the global one ignores.
+	extraFile := filepath.Join(dir, "extra")
+	must(os.WriteFile(extraFile, []byte("!/notes.tmp\n!keep.txt\n"), 0644))
+	// The .dbignore has the final say.
+	must(os.WriteFile(filepath.Join(root, ".dbignore"), []byte("^sub/keep\\.txt$\n"), 0644))
+
+	m, err := newIgnoreMatcher(root, scanOptions{IgnoreFiles: []string{globalFile, extraFile}})
+	must(err)
+	for path, expected := range map[string]bool{
+		"a.txt":        true,
+		"keep.txt":     false,
+		"sub/b.txt":    true,
+		"sub/keep.txt": true,
+		"c.tmp":        true,
+		"notes.tmp":    false,
+		"a.md":         false,
+		".dbignore":    true,
+		"sub/keep.md":  false,
+	} {
+		ignored, err := m.IsIgnored(path, false)
+		must(err)
+		assert.Equal(t, expected, ignored, path)
+	}
+
+	// The order of the extra files matters.
+	m, err = newIgnoreMatcher(root, scanOptions{IgnoreFiles: []string{extraFile, globalFile}})
+	must(err)
+	ignored, err := m.IsIgnored("notes.tmp", false)
+	must(err)
+	assert.True(t, ignored)
+
+	_, err = newIgnoreMatcher(root, scanOptions{IgnoreFiles: []string{filepath.Join(dir, "missing")}})
+	assert.Error(t, err)
 }
 
 /*
@@ -56,3 +249,168 @@ func TestRoundTrip_IgnoreFile(t *testing.T) {
 	roundTripTest(config, t)
 }
 */
+
+func TestBackupFiles_IgnoreDotfiles(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	for _, ignoreDotfiles := range []bool{false, true} {
+		config := getDefaultTestConfig()
+		defer config.Cleanup()
+		testBaseDir := config.TestBaseDir
+
+		must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 5))
+		must(createTestFile(filepath.Join(testBaseDir, ".env"), 5))
+		must(createTestFile(filepath.Join(testBaseDir, ".cache/b.txt"), 5))
+		must(createTestFile(filepath.Join(testBaseDir, ".config/app.conf"), 5))
+		must(createTestFile(filepath.Join(testBaseDir, "sub/.hidden"), 5))
+		must(createTestFile(filepath.Join(testBaseDir, "sub/c.txt"), 5))
+		// Negations re-include hidden paths.
+		ignoreFile := filepath.Join(t.TempDir(), "ignore")
+		must(os.WriteFile(ignoreFile, []byte("!/.config/\n"), 0644))
+
+		must(BackupFiles(
+			context.Background(),
+			logger,
+			GetMinioConfig(minioUrl),
+			config.DBFile,
+			testBaseDir,
+			config.Bucket,
+			config.S3Prefix,
+			config.BackupName,
+			config.SizeThreshold,
+			BackupOptions{IgnoreDotfiles: ignoreDotfiles, IgnoreFiles: []string{ignoreFile}},
+		))
+
+		db, err := NewDB(config.DBFile)
+		must(err)
+		files, err := db.GetAllFiles()
+		must(err)
+		db.Close()
+		var paths []string
+		for _, file := range files {
+			paths = append(paths, file.Path)
+		}
+		sort.Strings(paths)
+		if ignoreDotfiles {
+			assert.Equal(t, []string{".config/app.conf", "a.txt", "sub/c.txt"}, paths)
+		} else {
+			assert.Equal(t, []string{".cache/b.txt", ".config/app.conf", ".env", "a.txt", "sub/.hidden", "sub/c.txt"}, paths)
+		}
+	}
+}
+
+func TestBackupFiles_ExcludeInclude(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "debug.log"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "sub/trace.log"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "sub/keep.log"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "build/out.bin"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "b.tmp"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "c.tmp"), 5))
+	// The globs apply on top of the .dbignore, so an include re-includes what it ignores.
+	must(os.WriteFile(filepath.Join(testBaseDir, ".dbignore"), []byte("\\.tmp$\n"), 0644))
+
+	// As parsed from "-exclude '*.log' -exclude build/ -include keep.log -include c.tmp".
+	must(BackupFiles(
+		context.Background(),
+		logger,
+		GetMinioConfig(minioUrl),
+		config.DBFile,
+		testBaseDir,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		config.SizeThreshold,
+		BackupOptions{
+			Exclude: []string{"*.log", "build/"},
+			Include: []string{"keep.log", "c.tmp"},
+		},
+	))
+
+	db, err := NewDB(config.DBFile)
+	must(err)
+	defer db.Close()
+	files, err := db.GetAllFiles()
+	must(err)
+	var paths []string
+	for _, file := range files {
+		paths = append(paths, file.Path)
+	}
+	sort.Strings(paths)
+	assert.Equal(t, []string{"a.txt", "c.tmp", "sub/keep.log"}, paths)
+
+	assert.Error(t, BackupOptions{Exclude: []string{""}}.Validate())
+	_, err = newIgnoreMatcher(testBaseDir, scanOptions{Include: []string{"[z-a]"}})
+	assert.Error(t, err)
+}
+
+func TestPlanBackup_Extensions(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.jpg"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "b.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "photos/c.RAW"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "photos/d.jpg.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "photos/skip/e.jpg"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "photos/jpg"), 5))
+	// Extensions compose with ignore rules.
+	must(os.WriteFile(filepath.Join(testBaseDir, ".dbignore"), []byte("^photos/skip/\n"), 0644))
+
+	db, err := NewDB(config.DBFile)
+	must(err)
+	defer db.Close()
+
+	plan, err := planBackup(logger, db, testBaseDir, config.SizeThreshold, scanOptions{Extensions: []string{".jpg", "raw"}})
+	must(err)
+	var paths []string
+	for _, batch := range plan.Batches {
+		for _, file := range batch.Files {
+			paths = append(paths, file.Path)
+		}
+	}
+	sort.Strings(paths)
+	assert.Equal(t, []string{"a.jpg", "photos/c.RAW"}, paths)
+	assert.Empty(t, plan.Summary.FilesRemoved)
+	assert.ElementsMatch(t, []string{"b.txt", "photos/d.jpg.txt", "photos/jpg"}, plan.Summary.FilesSkipped)
+}
+
+func TestPlanBackup_CountsIgnored(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "a.log"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "sub/b.log"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "sub/deeper/c.log"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "sub/c.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "tmp/d.txt"), 5))
+	must(os.WriteFile(filepath.Join(testBaseDir, ".dbignore"), []byte("\\.log$\n^tmp/\n"), 0644))
+
+	db, err := NewDB(config.DBFile)
+	must(err)
+	defer db.Close()
+
+	plan, err := planBackup(logger, db, testBaseDir, config.SizeThreshold, scanOptions{})
+	must(err)
+	// The .dbignore ignores itself.
+	assert.ElementsMatch(t, []string{".dbignore", "a.log", "sub/b.log", "sub/deeper/c.log"}, plan.Summary.FilesIgnored)
+	assert.Equal(t, []string{"tmp"}, plan.Summary.DirsIgnored)
+	assert.ElementsMatch(t, []string{"a.txt", "sub/c.txt"}, plan.Summary.FilesAdded)
+}
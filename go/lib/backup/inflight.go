@@ -0,0 +1,92 @@
+package backup
+
+import (
+	"context"
+	"sync"
+)
+
+// With BackupOptions.MaxInFlightBytes, batches are uploaded concurrently, weighted by their size:
+// a batch only starts once it fits in the budget alongside the batches already in flight. Lots of
+// small batches go up in parallel, while a batch bigger than the whole budget waits for everything
+// else to finish and then goes up on its own, so the archives being built at once, which may be
+// buffered in memory, never add up to much more than the budget. Only the uploads overlap; each
+// batch still checks and updates the db, which isn't safe to use concurrently, one at a time.
+
+// inFlightBudget is a semaphore weighted by bytes.
+type inFlightBudget struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	max  int64
+	used int64
+}
+
+func newInFlightBudget(max int64) *inFlightBudget {
+	b := &inFlightBudget{max: max}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// acquire waits until n more bytes fit in the budget. More than the whole budget fits once nothing
+// else is in flight.
+func (b *inFlightBudget) acquire(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.used > 0 && b.used+n > b.max {
+		b.cond.Wait()
+	}
+	b.used += n
+}
+
+func (b *inFlightBudget) release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+	b.cond.Broadcast()
+}
+
+// backupConcurrently calls backup for every batch, running as many at once as fit in maxBytes. It
+// stops starting batches once ctx is done or a batch fails, and returns the first failure once the
+// batches that were started have finished.
+func backupConcurrently(ctx context.Context, batches []*BackupBatch, maxBytes int64, backup func(*BackupBatch) error) error {
+	budget := newInFlightBudget(maxBytes)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr != nil
+	}
+	for _, batch := range batches {
+		size := batch.Size()
+		budget.acquire(size)
+		if ctx.Err() != nil || failed() {
+			budget.release(size)
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer budget.release(size)
+			if err := backup(batch); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// lockBatch locks the db and summary for a batch, if batches are being backed up concurrently, and
+// returns the function that unlocks them.
+func (o BackupOptions) lockBatch() func() {
+	if o.batchLock == nil {
+		return func() {}
+	}
+	o.batchLock.Lock()
+	return o.batchLock.Unlock
+}
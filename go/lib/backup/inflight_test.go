@@ -0,0 +1,89 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+
+	"local/backup/lib/logging"
+	"local/backup/lib/s3_helpers"
+)
+
+// slowUploadClient takes a while over every upload, so that concurrent uploads overlap.
+type slowUploadClient struct {
+	s3_helpers.Client
+}
+
+func (c *slowUploadClient) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	time.Sleep(20 * time.Millisecond)
+	return c.Client.PutObject(ctx, params, optFns...)
+}
+
+// inFlightObserver tracks the batches that are in flight at once.
+type inFlightObserver struct {
+	NoopObserver
+	mu       sync.Mutex
+	bytes    int64
+	count    int
+	maxCount int
+	// Moments when more than one batch was in flight, and together they were over the budget.
+	overBudget []string
+	budget     int64
+}
+
+func (o *inFlightObserver) BatchStarted(event BatchEvent) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.bytes += event.Bytes
+	o.count++
+	o.maxCount = max(o.maxCount, o.count)
+	if o.count > 1 && o.bytes > o.budget {
+		o.overBudget = append(o.overBudget, fmt.Sprintf("%d batches, %d bytes", o.count, o.bytes))
+	}
+}
+
+func (o *inFlightObserver) BatchFinished(event BatchEvent, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.bytes -= event.Bytes
+	o.count--
+}
+
+func TestBackupFiles_MaxInFlightBytes(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getMemoryTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+
+	// Each file is over the size threshold, so each is its own batch. The big one is over the budget.
+	for i := 0; i < 20; i++ {
+		must(createTestFile(filepath.Join(testBaseDir, fmt.Sprintf("dir-%d/%d.txt", i%3, i)), 50+i*10))
+	}
+	must(createTestFile(filepath.Join(testBaseDir, "big.txt"), 2000))
+
+	observer := &inFlightObserver{budget: 500}
+	storage := &slowUploadClient{Client: config.Storage}
+	must(BackupFiles(context.Background(), logger, &aws.Config{}, config.DBFile, testBaseDir, config.Bucket, config.S3Prefix, config.BackupName, 10, BackupOptions{
+		Storage:          storage,
+		MaxInFlightBytes: observer.budget,
+		Observer:         observer,
+	}))
+	assert.Empty(t, observer.overBudget)
+	assert.Greater(t, observer.maxCount, 1)
+	assert.Zero(t, observer.count)
+
+	recoveryDir := t.TempDir()
+	must(RecoverFiles(context.Background(), logger, &aws.Config{}, config.DBFile, config.Bucket, config.S3Prefix, config.BackupName, recoveryDir, RecoveryOptions{
+		Storage: storage,
+	}))
+	compareDirectories(testBaseDir, recoveryDir, t)
+}
@@ -0,0 +1,77 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// s3Key joins the given elements into an S3 key. Keys always use forward slashes, regardless of the
+// local platform's path separator, so that a backup made on one platform can be read on another.
+// Local paths (e.g. batch paths from the db) can be passed in directly.
+func s3Key(elems ...string) string {
+	return joinKey(filepath.Separator, elems...)
+}
+
+func joinKey(separator rune, elems ...string) string {
+	parts := make([]string, len(elems))
+	for i, elem := range elems {
+		parts[i] = strings.ReplaceAll(elem, string(separator), "/")
+	}
+	return path.Join(parts...)
+}
+
+// dbKey returns the S3 key of the compressed db for the given backup.
+func dbKey(prefixBase string, name string) string {
+	return s3Key(prefixBase, fmt.Sprintf("%s.db.gz", name))
+}
+
+// archiveKey returns the S3 key of an archive, given its name relative to the prefix. If obfuscate
+// is set, the name is hashed so the key doesn't reveal any paths.
+func archiveKey(prefix string, archiveName string, obfuscate bool) string {
+	if obfuscate {
+		return s3Key(prefix, "objects", fmt.Sprintf("%x", sha256.Sum256([]byte(s3Key(archiveName)))))
+	}
+	return s3Key(prefix, archiveName)
+}
+
+const (
+	// A grouped batch's files live in an archive with this name inside the batch's directory, so the
+	// root directory's batch is stored in <prefix>/_files.tar.gz.
+	groupedArchiveName = "_files.tar.gz"
+	// A single file's archive is named after the file, with this extension.
+	archiveExtension = ".tar.gz"
+)
+
+// batchArchiveName returns the name of the archive holding the given batch, relative to the prefix.
+// Everything that stores, finds or deletes a batch's archive goes through here (or parseArchiveName),
+// so that they all agree on the key.
+func batchArchiveName(batch BatchMeta) string {
+	if batch.IsSingleFile {
+		return s3Key(batch.Path) + archiveExtension
+	}
+	return s3Key(batch.Path, groupedArchiveName)
+}
+
+// parseArchiveName returns the batch stored in the archive with the given name, relative to the
+// prefix, or false if the name isn't an archive's. The batch's path uses forward slashes.
+func parseArchiveName(name string) (BatchMeta, bool) {
+	if path.Base(name) == groupedArchiveName {
+		return BatchMeta{Path: path.Dir(name)}, true
+	}
+	if strings.HasSuffix(name, archiveExtension) {
+		return BatchMeta{Path: strings.TrimSuffix(name, archiveExtension), IsSingleFile: true}, true
+	}
+	return BatchMeta{}, false
+}
+
+// archiveEntriesDir returns the directory that the entries in the batch's archive are named relative
+// to: the batch's own directory for a grouped batch, and the file's directory for a single file.
+func archiveEntriesDir(batch BatchMeta) string {
+	if batch.IsSingleFile {
+		return path.Dir(s3Key(batch.Path))
+	}
+	return s3Key(batch.Path)
+}
@@ -0,0 +1,93 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+
+	"local/backup/lib/logging"
+)
+
+func TestJoinKey_WindowsSeparator(t *testing.T) {
+	assert.Equal(t, "backups/name/subdir-1/a.txt.tar.gz", joinKey('\\', `backups`, `name`, `subdir-1\a.txt.tar.gz`))
+	assert.Equal(t, "backups/name/subdir-1/two/_files.tar.gz", joinKey('\\', `backups\name`, `subdir-1\two`, "_files.tar.gz"))
+	// The root batch shouldn't leave a dangling "." in the key.
+	assert.Equal(t, "backups/name/_files.tar.gz", joinKey('\\', `backups\name`, ".", "_files.tar.gz"))
+}
+
+func TestS3Key(t *testing.T) {
+	assert.Equal(t, "backups/name/subdir-1/a.txt.tar.gz", s3Key("backups", "name", "subdir-1/a.txt.tar.gz"))
+}
+
+func TestBatchArchiveName(t *testing.T) {
+	for _, test := range []struct {
+		batch      BatchMeta
+		name       string
+		entriesDir string
+	}{
+		{BatchMeta{Path: "."}, "_files.tar.gz", "."},
+		{BatchMeta{Path: "dir/nested"}, "dir/nested/_files.tar.gz", "dir/nested"},
+		{BatchMeta{Path: "a.txt", IsSingleFile: true}, "a.txt.tar.gz", "."},
+		{BatchMeta{Path: "dir/a.txt", IsSingleFile: true}, "dir/a.txt.tar.gz", "dir"},
+	} {
+		name := batchArchiveName(test.batch)
+		assert.Equal(t, test.name, name)
+		parsed, ok := parseArchiveName(name)
+		assert.True(t, ok, name)
+		assert.Equal(t, test.batch, parsed)
+		assert.Equal(t, test.entriesDir, archiveEntriesDir(parsed))
+	}
+	_, ok := parseArchiveName("test-backup.db.gz")
+	assert.False(t, ok)
+}
+
+func TestBackupFiles_RootBatchKey(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getMemoryTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "b.txt"), 9))
+
+	backup := func() {
+		must(BackupFiles(context.Background(), logger, &aws.Config{}, config.DBFile, testBaseDir, config.Bucket, config.S3Prefix, config.BackupName, 1000, BackupOptions{
+			Storage: config.Storage,
+		}))
+	}
+	listKeys := func() []string {
+		output, err := config.Storage.ListObjectsV2(context.TODO(), &s3.ListObjectsV2Input{
+			Bucket: aws.String(config.Bucket),
+			Prefix: aws.String(config.FullS3Prefix + "/"),
+		})
+		must(err)
+		var keys []string
+		for _, object := range output.Contents {
+			keys = append(keys, aws.ToString(object.Key))
+		}
+		return keys
+	}
+	backup()
+
+	// The root batch is stored right under the prefix, where recovery looks for it.
+	rootKey := batchKey(config.FullS3Prefix, BatchMeta{Path: "."}, false)
+	assert.Equal(t, config.FullS3Prefix+"/_files.tar.gz", rootKey)
+	assert.Equal(t, []string{rootKey}, listKeys())
+	recoveryDir := t.TempDir()
+	must(RecoverFiles(context.Background(), logger, &aws.Config{}, config.DBFile, config.Bucket, config.S3Prefix, config.BackupName, recoveryDir, RecoveryOptions{
+		Storage: config.Storage,
+	}))
+	compareDirectories(testBaseDir, recoveryDir, t)
+
+	// With only one file left, the root batch is replaced by the file's own, and its archive deleted.
+	must(os.Remove(filepath.Join(testBaseDir, "b.txt")))
+	backup()
+	assert.Equal(t, []string{batchKey(config.FullS3Prefix, BatchMeta{Path: "a.txt", IsSingleFile: true}, false)}, listKeys())
+}
@@ -0,0 +1,135 @@
+package backup
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// By default, archives are stored under <prefix base>/<name>/<path>. A key template changes where
+// they go, relative to the prefix base, with these placeholders:
+//
+//	{name}  the backup's name
+//	{path}  the archive's path within the backup
+//	{date}  the date (UTC, as YYYY-MM-DD) the backup was first made
+//
+// so "archives/{date}/{name}/{path}" stores them under <prefix base>/archives/2024-01-02/<name>/.
+// {path} must come last, after a "/", so every path still maps to its own key, and {name} must
+// appear, so that backups sharing a prefix base don't overlap. (A template can still put archives
+// under another backup's prefix, like "other/{name}/{path}" next to a backup named "other", whose gc
+// would then delete them.) Everything before {path} is the directory the backup's archives are
+// stored in; blobs, chunks, streams and the db stay under the usual prefix. The template and date are recorded in the db, so that recovery, verification and gc
+// find the archives, and the template can't change once the backup has files in it. Reconcile only
+// knows the default layout, so it can't rebuild the db of a backup with a template.
+
+const (
+	keyTemplateName = "{name}"
+	keyTemplatePath = "{path}"
+	keyTemplateDate = "{date}"
+)
+
+// The layout the default keys follow.
+const defaultKeyTemplate = keyTemplateName + "/" + keyTemplatePath
+
+var keyTemplatePlaceholder = regexp.MustCompile(`\{[^{}]*\}`)
+
+// validateKeyTemplate makes sure every path in a backup maps to its own key under the template.
+func validateKeyTemplate(template string) error {
+	for _, placeholder := range keyTemplatePlaceholder.FindAllString(template, -1) {
+		switch placeholder {
+		case keyTemplateName, keyTemplatePath, keyTemplateDate:
+		default:
+			return fmt.Errorf("key template %q has unknown placeholder %s", template, placeholder)
+		}
+	}
+	if strings.Count(template, keyTemplatePath) != 1 || !strings.HasSuffix(template, "/"+keyTemplatePath) {
+		return fmt.Errorf("key template %q must end with a single /%s", template, keyTemplatePath)
+	}
+	if strings.Count(template, keyTemplateName) != 1 {
+		return fmt.Errorf("key template %q must have a single %s", template, keyTemplateName)
+	}
+	if strings.Count(template, keyTemplateDate) > 1 {
+		return fmt.Errorf("key template %q can't have more than one %s", template, keyTemplateDate)
+	}
+	for _, segment := range strings.Split(template, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return fmt.Errorf("key template %q can't have empty, . or .. path segments", template)
+		}
+	}
+	return nil
+}
+
+// keyTemplateDir renders the part of the template before {path}: the directory the backup's
+// archives are stored in.
+func keyTemplateDir(prefixBase string, name string, template string, date string) string {
+	dir := strings.TrimSuffix(template, "/"+keyTemplatePath)
+	dir = strings.ReplaceAll(dir, keyTemplateName, name)
+	dir = strings.ReplaceAll(dir, keyTemplateDate, date)
+	return s3Key(prefixBase, dir)
+}
+
+// checkKeyTemplate makes sure a backup doesn't switch templates, which would leave the db pointing at
+// the wrong keys, and returns the directory the backup's archives go in, along with the date to
+// record if the backup doesn't have one yet. An empty template means the default one.
+func checkKeyTemplate(db *DB, prefixBase string, name string, template string, now time.Time) (string, string, error) {
+	if template == "" {
+		template = defaultKeyTemplate
+	}
+	stored, date, err := db.KeyTemplate()
+	if err != nil {
+		return "", "", err
+	}
+	if date == "" {
+		date = now.UTC().Format("2006-01-02")
+	}
+	if stored != template {
+		files, err := db.GetAllFiles()
+		if err != nil {
+			return "", "", err
+		}
+		// Nothing has been stored yet, so the template can still be picked.
+		if len(files) > 0 {
+			return "", "", fmt.Errorf("backup has key template %q, but %q was given", stored, template)
+		}
+	}
+	return keyTemplateDir(prefixBase, name, template, date), date, nil
+}
+
+// setKeyTemplate records the template and date the backup's keys are made with.
+func (db *DB) setKeyTemplate(template string, date string) error {
+	if template == "" {
+		template = defaultKeyTemplate
+	}
+	if err := db.setMeta(metaKeyTemplate, template); err != nil {
+		return err
+	}
+	return db.setMeta(metaKeyDate, date)
+}
+
+// KeyTemplate returns the template the backup's keys are made with, and the date it was first used,
+// if it has been recorded.
+func (db *DB) KeyTemplate() (string, string, error) {
+	template, err := db.getMeta(metaKeyTemplate)
+	if err == sql.ErrNoRows {
+		return defaultKeyTemplate, "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	date, err := db.getMeta(metaKeyDate)
+	if err != nil && err != sql.ErrNoRows {
+		return "", "", err
+	}
+	return template, date, nil
+}
+
+// archiveDir returns the directory that the db says the backup's archives are stored in.
+func archiveDir(db *DB, prefixBase string, name string) (string, error) {
+	template, date, err := db.KeyTemplate()
+	if err != nil {
+		return "", fmt.Errorf("error reading key template from db: %v", err)
+	}
+	return keyTemplateDir(prefixBase, name, template, date), nil
+}
@@ -0,0 +1,136 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+
+	"local/backup/lib/logging"
+)
+
+func TestValidateKeyTemplate(t *testing.T) {
+	for _, template := range []string{
+		"{name}/{path}",
+		"archives/{date}/{name}/{path}",
+		"{name}-{date}/files/{path}",
+	} {
+		assert.NoError(t, validateKeyTemplate(template), template)
+	}
+	for _, template := range []string{
+		"{name}",
+		"{path}/{name}",
+		"{name}/{path}/{path}",
+		"{name}{path}",
+		"archives/{path}",
+		"{name}/{name}/{path}",
+		"{date}/{date}/{name}/{path}",
+		"{user}/{name}/{path}",
+		"/{name}/{path}",
+		"a//{name}/{path}",
+		"../{name}/{path}",
+	} {
+		assert.Error(t, validateKeyTemplate(template), template)
+	}
+}
+
+func TestKeyTemplateDir(t *testing.T) {
+	assert.Equal(t, "base/my-backup", keyTemplateDir("base", "my-backup", defaultKeyTemplate, "2024-01-02"))
+	assert.Equal(t, "base/archives/2024-01-02/my-backup", keyTemplateDir("base", "my-backup", "archives/{date}/{name}/{path}", "2024-01-02"))
+}
+
+func TestBackupFiles_KeyTemplate(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+	config.SizeThreshold = 100
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "big.txt"), 500))
+	must(createTestFile(filepath.Join(testBaseDir, "dir/b.txt"), 10))
+	must(createTestFile(filepath.Join(testBaseDir, "dir/c.txt"), 20))
+	must(createTestFile(filepath.Join(testBaseDir, "dir/nested/d.txt"), 300))
+
+	cfg := GetMinioConfig(minioUrl)
+	client := s3.NewFromConfig(*cfg)
+	backup := func(options BackupOptions) error {
+		return BackupFiles(
+			context.Background(),
+			logger,
+			cfg,
+			config.DBFile,
+			testBaseDir,
+			config.Bucket,
+			config.S3Prefix,
+			config.BackupName,
+			config.SizeThreshold,
+			options,
+		)
+	}
+	const template = "archives/{date}/{name}/{path}"
+	must(backup(BackupOptions{KeyTemplate: template}))
+
+	archiveDir := s3Key(config.S3Prefix, "archives", time.Now().UTC().Format("2006-01-02"), config.BackupName)
+	listKeys := func(prefix string) []string {
+		output, err := client.ListObjectsV2(context.TODO(), &s3.ListObjectsV2Input{
+			Bucket: aws.String(config.Bucket),
+			Prefix: aws.String(prefix + "/"),
+		})
+		must(err)
+		var keys []string
+		for _, object := range output.Contents {
+			keys = append(keys, strings.TrimPrefix(aws.ToString(object.Key), prefix+"/"))
+		}
+		return keys
+	}
+	assert.ElementsMatch(t, []string{"a.txt.tar.gz", "big.txt.tar.gz", "dir/_files.tar.gz", "dir/nested/d.txt.tar.gz"}, listKeys(archiveDir))
+	// Nothing is stored in the usual place.
+	assert.Empty(t, listKeys(config.FullS3Prefix))
+
+	// Switching templates on an existing backup is refused.
+	assert.Error(t, backup(BackupOptions{}))
+
+	// Nothing is considered orphaned, and gc finds the archives that are.
+	orphans, err := GC(logger, cfg, config.DBFile, config.Bucket, config.S3Prefix, config.BackupName, GCOptions{})
+	must(err)
+	assert.Empty(t, orphans)
+	_, err = client.PutObject(context.TODO(), &s3.PutObjectInput{
+		Bucket: aws.String(config.Bucket),
+		Key:    aws.String(s3Key(archiveDir, "orphan.tar.gz")),
+		Body:   strings.NewReader("orphan"),
+	})
+	must(err)
+	orphans, err = GC(logger, cfg, config.DBFile, config.Bucket, config.S3Prefix, config.BackupName, GCOptions{Confirm: true})
+	must(err)
+	assert.Equal(t, []string{s3Key(archiveDir, "orphan.tar.gz")}, orphans)
+
+	// Deleting a file removes its archive from the templated location.
+	must(os.Remove(filepath.Join(testBaseDir, "big.txt")))
+	must(backup(BackupOptions{KeyTemplate: template}))
+	assert.NotContains(t, listKeys(archiveDir), "big.txt.tar.gz")
+
+	testRecoveryDir, err := os.MkdirTemp("/tmp", "dave-recovery-test-")
+	must(err)
+	defer os.RemoveAll(testRecoveryDir)
+	must(RecoverFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		testRecoveryDir,
+		RecoveryOptions{Verify: true},
+	))
+	compareDirectories(testBaseDir, testRecoveryDir, t)
+}
@@ -0,0 +1,86 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"local/backup/lib/logging"
+)
+
+// A lock file next to the db keeps two runs from working on the same backup at once. It holds the
+// owner's pid and the time it was taken, so a lock left behind by a crashed run can be recognized
+// and broken once it's old enough.
+
+// Returned when another run holds the lock.
+var ErrLocked = errors.New("backup is locked by another run")
+
+const staleLockAge = 24 * time.Hour
+
+type lockInfo struct {
+	PID      int
+	Acquired time.Time
+}
+
+func lockFile(dbFile string) string {
+	return dbFile + ".lock"
+}
+
+// acquireLock takes the lock for the given db, breaking it if it's stale. The returned function
+// releases the lock.
+func acquireLock(logger logging.Logger, dbFile string) (func(), error) {
+	filename := lockFile(dbFile)
+	// The lock is taken before the db is opened, so its directory may not exist yet.
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create db directory: %v", err)
+	}
+	for attempt := 0; ; attempt++ {
+		f, err := os.OpenFile(filename, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			_, err = fmt.Fprintf(f, "%d %s\n", os.Getpid(), time.Now().UTC().Format(time.RFC3339))
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(filename)
+				return nil, fmt.Errorf("failed to write lock file %q: %v", filename, err)
+			}
+			return func() { os.Remove(filename) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("failed to create lock file %q: %v", filename, err)
+		}
+
+		info, err := readLock(filename)
+		if err != nil {
+			return nil, err
+		}
+		if attempt > 0 || time.Since(info.Acquired) < staleLockAge {
+			return nil, fmt.Errorf("%w (pid %d, since %s, lock file %q)", ErrLocked, info.PID, info.Acquired.Format(time.RFC3339), filename)
+		}
+		logger.Infof("breaking stale lock held by pid %d since %s", info.PID, info.Acquired.Format(time.RFC3339))
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to remove stale lock file %q: %v", filename, err)
+		}
+	}
+}
+
+func readLock(filename string) (*lockInfo, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lock file %q: %v", filename, err)
+	}
+	info := &lockInfo{}
+	var acquired string
+	if _, err := fmt.Sscanf(strings.TrimSpace(string(data)), "%d %s", &info.PID, &acquired); err != nil {
+		return nil, fmt.Errorf("malformed lock file %q: %v", filename, err)
+	}
+	info.Acquired, err = time.Parse(time.RFC3339, acquired)
+	if err != nil {
+		return nil, fmt.Errorf("malformed lock file %q: %v", filename, err)
+	}
+	return info, nil
+}
@@ -0,0 +1,75 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"local/backup/lib/logging"
+)
+
+func TestBackupFiles_RefusesConcurrentRun(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 5))
+
+	cfg := GetMinioConfig(minioUrl)
+	backup := func() error {
+		return BackupFiles(
+			context.Background(),
+			logger,
+			cfg,
+			config.DBFile,
+			testBaseDir,
+			config.Bucket,
+			config.S3Prefix,
+			config.BackupName,
+			config.SizeThreshold,
+			BackupOptions{},
+		)
+	}
+
+	// Hold the lock as if another run were in progress.
+	unlock, err := acquireLock(logger, config.DBFile)
+	must(err)
+	err = backup()
+	assert.True(t, errors.Is(err, ErrLocked), "expected ErrLocked, got %v", err)
+
+	unlock()
+	must(backup())
+	_, err = os.Stat(lockFile(config.DBFile))
+	assert.True(t, os.IsNotExist(err), "lock file should be removed after the run")
+}
+
+func TestAcquireLock_BreaksStaleLock(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	dbFile := filepath.Join(t.TempDir(), "test.db")
+
+	// A lock left behind by a run that crashed long ago.
+	stale := time.Now().Add(-2 * staleLockAge).UTC().Format(time.RFC3339)
+	must(os.WriteFile(lockFile(dbFile), []byte(fmt.Sprintf("12345 %s\n", stale)), 0644))
+
+	unlock, err := acquireLock(logger, dbFile)
+	must(err)
+	info, err := readLock(lockFile(dbFile))
+	must(err)
+	assert.Equal(t, os.Getpid(), info.PID)
+
+	// A fresh lock is respected.
+	_, err = acquireLock(logger, dbFile)
+	assert.True(t, errors.Is(err, ErrLocked), "expected ErrLocked, got %v", err)
+	unlock()
+}
@@ -0,0 +1,58 @@
+package backup
+
+import "fmt"
+
+// A db can import another backup's index (MergeDB), e.g. to consolidate the backups of two
+// machines. Only the files table is merged: each file keeps the batch it was recorded with, and the
+// objects themselves stay where they are, so the merged db doesn't describe a backup that can be
+// recovered until its batches have been copied under one prefix.
+
+// MergePolicy decides what happens when both dbs have a file at the same path.
+type MergePolicy string
+
+const (
+	// Keep whichever version has the newer modtime, or this db's if they're the same.
+	MergeNewest MergePolicy = "newest"
+	// Fail if the versions have different hashes. If they're the same, the newer modtime is kept.
+	MergeErrorOnConflict MergePolicy = "error"
+)
+
+func ParseMergePolicy(s string) (MergePolicy, error) {
+	switch policy := MergePolicy(s); policy {
+	case MergeNewest, MergeErrorOnConflict:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown merge policy %q", s)
+}
+
+// MergeDB imports the files from the other db. Either every file is merged or, if there's an error,
+// none of them are.
+func (db *DB) MergeDB(other *DB, policy MergePolicy) error {
+	if _, err := ParseMergePolicy(string(policy)); err != nil {
+		return err
+	}
+	otherFiles, err := other.GetAllFiles()
+	if err != nil {
+		return fmt.Errorf("error loading files from other db: %v", err)
+	}
+	files, err := db.GetAllFilesByPath()
+	if err != nil {
+		return fmt.Errorf("error loading files from db: %v", err)
+	}
+
+	var toMark []*FileInfo
+	for _, theirs := range otherFiles {
+		ours, ok := files[theirs.Path]
+		if !ok {
+			toMark = append(toMark, theirs)
+			continue
+		}
+		if policy == MergeErrorOnConflict && ours.Hash != theirs.Hash {
+			return fmt.Errorf("file %q has diverged: hash %s here, %s in the other db", theirs.Path, ours.Hash, theirs.Hash)
+		}
+		if theirs.ModTime.Truncate(modTimePrecision).After(ours.ModTime.Truncate(modTimePrecision)) {
+			toMark = append(toMark, theirs)
+		}
+	}
+	return db.MarkFiles(toMark)
+}
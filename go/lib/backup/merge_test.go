@@ -0,0 +1,62 @@
+package backup
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_MergeDB(t *testing.T) {
+	older := time.UnixMilli(1700000000000)
+	newer := older.Add(time.Hour)
+	setup := func() (*DB, *DB) {
+		db := newTestDB(t)
+		must(db.MarkFiles([]*FileInfo{
+			{Path: "ours.txt", ModTime: older, Hash: "ours", Batch: "."},
+			{Path: "same.txt", ModTime: older, Hash: "same", Batch: "."},
+			{Path: "diverged.txt", ModTime: newer, Hash: "ours-diverged", Batch: "."},
+			{Path: "updated.txt", ModTime: older, Hash: "ours-updated", Batch: "."},
+		}))
+		other := newTestDB(t)
+		must(other.MarkFiles([]*FileInfo{
+			{Path: "sub/theirs.txt", ModTime: older, Hash: "theirs", Batch: "sub"},
+			{Path: "same.txt", ModTime: newer, Hash: "same", Batch: "."},
+			{Path: "diverged.txt", ModTime: older, Hash: "theirs-diverged", Batch: "."},
+			{Path: "updated.txt", ModTime: newer, Hash: "theirs-updated", Batch: "."},
+		}))
+		return db, other
+	}
+	hashes := func(db *DB) map[string]string {
+		files, err := db.GetAllFiles()
+		must(err)
+		hashes := make(map[string]string)
+		for _, file := range files {
+			hashes[file.Path] = file.Hash
+		}
+		return hashes
+	}
+
+	// The newest version of each file wins.
+	db, other := setup()
+	must(db.MergeDB(other, MergeNewest))
+	assert.Equal(t, map[string]string{
+		"ours.txt":       "ours",
+		"sub/theirs.txt": "theirs",
+		"same.txt":       "same",
+		"diverged.txt":   "ours-diverged",
+		"updated.txt":    "theirs-updated",
+	}, hashes(db))
+	same, err := db.GetFileInfo("same.txt")
+	must(err)
+	assert.True(t, same.ModTime.Equal(newer))
+
+	// Divergent hashes are an error, and nothing is merged.
+	db, other = setup()
+	before := hashes(db)
+	err = db.MergeDB(other, MergeErrorOnConflict)
+	assert.ErrorContains(t, err, "diverged.txt")
+	assert.Equal(t, before, hashes(db))
+
+	assert.Error(t, db.MergeDB(other, "bogus"))
+}
@@ -0,0 +1,84 @@
+package backup
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics receives events from backups, for monitoring scheduled runs. Set BackupOptions.Metrics to
+// use it; CounterMetrics is a ready-made implementation.
+type Metrics interface {
+	// ArchiveUploaded is called for every archive that's written to storage, with its size.
+	ArchiveUploaded(bytes int64)
+	// Error is called for every batch that fails, including ones that ContinueOnError skips past.
+	Error()
+	// BackupFinished is called at the end of every backup, with the error it failed with, if any.
+	BackupFinished(duration time.Duration, err error)
+}
+
+// CounterMetrics counts backup events, and can write them in the Prometheus text format. It's safe
+// to use from multiple goroutines.
+type CounterMetrics struct {
+	ArchivesUploaded atomic.Int64
+	BytesUploaded    atomic.Int64
+	Errors           atomic.Int64
+	BackupsSucceeded atomic.Int64
+	BackupsFailed    atomic.Int64
+	// In Unix seconds, or 0 if no backup has succeeded yet.
+	LastSuccess atomic.Int64
+	// Of the most recent backup, in nanoseconds.
+	LastDuration atomic.Int64
+}
+
+func (m *CounterMetrics) ArchiveUploaded(bytes int64) {
+	m.ArchivesUploaded.Add(1)
+	m.BytesUploaded.Add(bytes)
+}
+
+func (m *CounterMetrics) Error() {
+	m.Errors.Add(1)
+}
+
+func (m *CounterMetrics) BackupFinished(duration time.Duration, err error) {
+	m.LastDuration.Store(int64(duration))
+	if err != nil {
+		m.BackupsFailed.Add(1)
+		return
+	}
+	m.BackupsSucceeded.Add(1)
+	m.LastSuccess.Store(time.Now().Unix())
+}
+
+// WritePrometheus writes the counters in the Prometheus text exposition format.
+func (m *CounterMetrics) WritePrometheus(w io.Writer) error {
+	metrics := []struct {
+		name  string
+		kind  string
+		help  string
+		value string
+	}{
+		{"dbackup_archives_uploaded_total", "counter", "Archives written to storage.", fmt.Sprint(m.ArchivesUploaded.Load())},
+		{"dbackup_uploaded_bytes_total", "counter", "Bytes of archives written to storage.", fmt.Sprint(m.BytesUploaded.Load())},
+		{"dbackup_errors_total", "counter", "Batches that failed to back up.", fmt.Sprint(m.Errors.Load())},
+		{"dbackup_backups_succeeded_total", "counter", "Backups that succeeded.", fmt.Sprint(m.BackupsSucceeded.Load())},
+		{"dbackup_backups_failed_total", "counter", "Backups that failed.", fmt.Sprint(m.BackupsFailed.Load())},
+		{"dbackup_last_success_timestamp_seconds", "gauge", "When the last successful backup finished.", fmt.Sprint(m.LastSuccess.Load())},
+		{"dbackup_last_duration_seconds", "gauge", "How long the most recent backup took.", fmt.Sprint(time.Duration(m.LastDuration.Load()).Seconds())},
+	}
+	for _, metric := range metrics {
+		_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", metric.name, metric.help, metric.name, metric.kind, metric.name, metric.value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// noopMetrics is used when no metrics are configured.
+type noopMetrics struct{}
+
+func (noopMetrics) ArchiveUploaded(bytes int64)                      {}
+func (noopMetrics) Error()                                           {}
+func (noopMetrics) BackupFinished(duration time.Duration, err error) {}
@@ -0,0 +1,92 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"local/backup/lib/logging"
+)
+
+func TestBackupFiles_Metrics(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+	config.SizeThreshold = 100
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 200))
+	must(createTestFile(filepath.Join(testBaseDir, "b.txt"), 200))
+	must(createTestFile(filepath.Join(testBaseDir, "subdir/c.txt"), 5))
+
+	metrics := &CounterMetrics{}
+	backup := func(options BackupOptions) error {
+		options.Metrics = metrics
+		return BackupFiles(
+			context.Background(),
+			logger,
+			GetMinioConfig(minioUrl),
+			config.DBFile,
+			testBaseDir,
+			config.Bucket,
+			config.S3Prefix,
+			config.BackupName,
+			config.SizeThreshold,
+			options,
+		)
+	}
+
+	must(backup(BackupOptions{}))
+	assert.Equal(t, int64(3), metrics.ArchivesUploaded.Load())
+	assert.Greater(t, metrics.BytesUploaded.Load(), int64(200))
+	assert.Equal(t, int64(1), metrics.BackupsSucceeded.Load())
+	assert.NotZero(t, metrics.LastSuccess.Load())
+	assert.NotZero(t, metrics.LastDuration.Load())
+
+	// Nothing changed, so nothing is uploaded.
+	bytesUploaded := metrics.BytesUploaded.Load()
+	must(backup(BackupOptions{}))
+	assert.Equal(t, int64(3), metrics.ArchivesUploaded.Load())
+	assert.Equal(t, bytesUploaded, metrics.BytesUploaded.Load())
+	assert.Equal(t, int64(2), metrics.BackupsSucceeded.Load())
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 200))
+	must(backup(BackupOptions{}))
+	assert.Equal(t, int64(4), metrics.ArchivesUploaded.Load())
+	assert.Greater(t, metrics.BytesUploaded.Load(), bytesUploaded)
+
+	assert.Error(t, backup(BackupOptions{Force: true, DryRun: true}))
+	assert.Equal(t, int64(3), metrics.BackupsSucceeded.Load())
+	assert.Equal(t, int64(1), metrics.BackupsFailed.Load())
+	assert.Zero(t, metrics.Errors.Load())
+
+	// A batch that fails counts as an error, even if the backup carries on.
+	must(createTestFile(filepath.Join(testBaseDir, "b.txt"), 200))
+	failingCfg := GetMinioConfig(minioUrl)
+	failingCfg.HTTPClient = &failingUploadClient{suffix: "b.txt.tar.gz"}
+	err := BackupFiles(
+		context.Background(),
+		logger,
+		failingCfg,
+		config.DBFile,
+		testBaseDir,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		config.SizeThreshold,
+		BackupOptions{ContinueOnError: true, Metrics: metrics},
+	)
+	assert.Error(t, err)
+	assert.Equal(t, int64(1), metrics.Errors.Load())
+	assert.Equal(t, int64(2), metrics.BackupsFailed.Load())
+
+	buf := &bytes.Buffer{}
+	must(metrics.WritePrometheus(buf))
+	assert.Contains(t, buf.String(), "# TYPE dbackup_archives_uploaded_total counter\ndbackup_archives_uploaded_total 4\n")
+	assert.Contains(t, buf.String(), "dbackup_backups_failed_total 2\n")
+}
@@ -0,0 +1,182 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"local/backup/lib/logging"
+	"local/backup/lib/s3_helpers"
+)
+
+// With a secondary bucket (e.g. in another region), every object that's written to or deleted from
+// the backup's bucket is written to or deleted from the secondary bucket too, under the same key, so
+// the backup survives losing either bucket. Reads prefer the primary bucket, and fall back to the
+// secondary one if an object can't be read from the primary. Only the primary bucket is listed,
+// e.g. by GC and recovery, so if it's lost altogether, recover from the secondary bucket as the
+// bucket instead.
+
+// MirrorPolicy says what to do when writing to the secondary bucket fails.
+type MirrorPolicy string
+
+const (
+	// Fail the operation, as if writing to the primary bucket had failed. This is the default.
+	MirrorFail MirrorPolicy = "fail"
+	// Log a warning and carry on, leaving the secondary bucket behind the primary one.
+	MirrorWarn MirrorPolicy = "warn"
+)
+
+func ParseMirrorPolicy(s string) (MirrorPolicy, error) {
+	switch policy := MirrorPolicy(s); policy {
+	case MirrorFail, MirrorWarn:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown mirror policy %q", s)
+}
+
+// validateMirror checks the secondary bucket options that the backup, GC and prune options share.
+func validateMirror(secondaryBucket string, policy MirrorPolicy) error {
+	if policy == "" {
+		return nil
+	}
+	if secondaryBucket == "" {
+		return fmt.Errorf("a mirror policy requires a secondary bucket")
+	}
+	_, err := ParseMirrorPolicy(string(policy))
+	return err
+}
+
+// mirrorClient writes to a secondary bucket after every successful write to the primary one, and
+// reads from the secondary bucket when reading from the primary one fails.
+type mirrorClient struct {
+	s3_helpers.Client
+	logger    logging.Logger
+	secondary string
+	policy    MirrorPolicy
+}
+
+// withMirror wraps the client to mirror the bucket to the secondary bucket, if any.
+func withMirror(logger logging.Logger, client s3_helpers.Client, bucket string, secondaryBucket string, policy MirrorPolicy) (s3_helpers.Client, error) {
+	if err := validateMirror(secondaryBucket, policy); err != nil {
+		return nil, err
+	}
+	if secondaryBucket == "" {
+		return client, nil
+	}
+	if secondaryBucket == bucket {
+		return nil, fmt.Errorf("secondary bucket %q is the same as the primary bucket", bucket)
+	}
+	if policy == "" {
+		policy = MirrorFail
+	}
+	return &mirrorClient{Client: client, logger: logger, secondary: secondaryBucket, policy: policy}, nil
+}
+
+// mirrored applies the policy to the outcome of writing to the secondary bucket.
+func (c *mirrorClient) mirrored(action string, key string, err error) error {
+	if err == nil {
+		return nil
+	}
+	err = fmt.Errorf("failed to %s %q in secondary bucket %q: %v", action, key, c.secondary, err)
+	if c.policy == MirrorWarn {
+		c.logger.Infof("warning: %v", err)
+		return nil
+	}
+	return err
+}
+
+func (c *mirrorClient) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	// The body is uploaded twice, so it has to be rewound in between.
+	var seeker io.Seeker
+	var start int64
+	if params.Body != nil {
+		var ok bool
+		if seeker, ok = params.Body.(io.Seeker); !ok {
+			return nil, fmt.Errorf("can't mirror upload of %q, since its body can't be re-read", aws.ToString(params.Key))
+		}
+		var err error
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+	}
+	out, err := c.Client.PutObject(ctx, params, optFns...)
+	if err != nil {
+		return nil, err
+	}
+	if seeker != nil {
+		if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+			return out, c.mirrored("upload", aws.ToString(params.Key), err)
+		}
+	}
+	mirror := *params
+	mirror.Bucket = aws.String(c.secondary)
+	_, err = c.Client.PutObject(ctx, &mirror, optFns...)
+	return out, c.mirrored("upload", aws.ToString(params.Key), err)
+}
+
+func (c *mirrorClient) CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	out, err := c.Client.CopyObject(ctx, params, optFns...)
+	if err != nil {
+		return nil, err
+	}
+	// Copies within the primary bucket become copies within the secondary one.
+	mirror := *params
+	mirror.Bucket = aws.String(c.secondary)
+	if source, ok := strings.CutPrefix(aws.ToString(params.CopySource), aws.ToString(params.Bucket)+"/"); ok {
+		mirror.CopySource = aws.String(c.secondary + "/" + source)
+	}
+	_, err = c.Client.CopyObject(ctx, &mirror, optFns...)
+	return out, c.mirrored("copy", aws.ToString(params.Key), err)
+}
+
+func (c *mirrorClient) DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	out, err := c.Client.DeleteObjects(ctx, params, optFns...)
+	if err != nil {
+		return nil, err
+	}
+	mirror := *params
+	mirror.Bucket = aws.String(c.secondary)
+	mirrorOut, err := c.Client.DeleteObjects(ctx, &mirror, optFns...)
+	if err == nil && len(mirrorOut.Errors) > 0 {
+		failed := mirrorOut.Errors[0]
+		return out, c.mirrored("delete", aws.ToString(failed.Key), fmt.Errorf("%s", aws.ToString(failed.Message)))
+	}
+	return out, c.mirrored("delete", fmt.Sprintf("%d object(s)", len(params.Delete.Objects)), err)
+}
+
+func (c *mirrorClient) CreateBucket(ctx context.Context, params *s3.CreateBucketInput, optFns ...func(*s3.Options)) (*s3.CreateBucketOutput, error) {
+	out, err := c.Client.CreateBucket(ctx, params, optFns...)
+	if err != nil {
+		return nil, err
+	}
+	mirror := *params
+	mirror.Bucket = aws.String(c.secondary)
+	_, err = c.Client.CreateBucket(ctx, &mirror, optFns...)
+	var owned *types.BucketAlreadyOwnedByYou
+	if errors.As(err, &owned) {
+		err = nil
+	}
+	return out, c.mirrored("create", c.secondary, err)
+}
+
+func (c *mirrorClient) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	out, err := c.Client.GetObject(ctx, params, optFns...)
+	if err == nil || ctx.Err() != nil {
+		return out, err
+	}
+	fallback := *params
+	fallback.Bucket = aws.String(c.secondary)
+	out, fallbackErr := c.Client.GetObject(ctx, &fallback, optFns...)
+	if fallbackErr != nil {
+		// Report the primary bucket's error, so e.g. a missing object is still recognized as one.
+		return nil, err
+	}
+	c.logger.Infof("failed to download %q from bucket %q, used secondary bucket %q instead: %v", aws.ToString(params.Key), aws.ToString(params.Bucket), c.secondary, err)
+	return out, nil
+}
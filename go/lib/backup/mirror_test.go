@@ -0,0 +1,220 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+
+	"local/backup/lib/logging"
+	"local/backup/lib/util"
+)
+
+const secondaryBucket = "test-bucket-secondary"
+
+func createSecondaryBucket(client *s3.Client) {
+	_, err := client.CreateBucket(context.TODO(), &s3.CreateBucketInput{Bucket: aws.String(secondaryBucket)})
+	var owned *types.BucketAlreadyOwnedByYou
+	var exists *types.BucketAlreadyExists
+	if err != nil && !errors.As(err, &owned) && !errors.As(err, &exists) {
+		must(err)
+	}
+}
+
+func listKeys(client *s3.Client, bucket string, prefix string) []string {
+	var keys []string
+	paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix + "/"),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.TODO())
+		must(err)
+		for _, object := range page.Contents {
+			keys = append(keys, aws.ToString(object.Key))
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// listETags returns the ETags of the archives under the prefix, by key.
+func listETags(client *s3.Client, bucket string, prefix string) map[string]string {
+	etags := make(map[string]string)
+	for _, key := range listKeys(client, bucket, prefix) {
+		if !strings.HasSuffix(key, ".tar.gz") {
+			continue
+		}
+		output, err := client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		must(err)
+		etags[key] = aws.ToString(output.ETag)
+	}
+	return etags
+}
+
+func TestBackupFiles_SecondaryBucket(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+
+	cfg := GetMinioConfig(minioUrl)
+	client := s3.NewFromConfig(*cfg)
+	createSecondaryBucket(client)
+	defer func() { must(clearBucket(client, secondaryBucket, config.S3Prefix)) }()
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "big.txt"), 200))
+	must(createTestFile(filepath.Join(testBaseDir, "subdir/c.txt"), 500))
+
+	backup := func(options BackupOptions) error {
+		return BackupFiles(
+			context.Background(),
+			logger,
+			cfg,
+			config.DBFile,
+			testBaseDir,
+			config.Bucket,
+			config.S3Prefix,
+			config.BackupName,
+			config.SizeThreshold,
+			options,
+		)
+	}
+	options := BackupOptions{SecondaryBucket: secondaryBucket, KeepDBVersions: 2}
+	must(backup(options))
+	primary := listKeys(client, config.Bucket, config.S3Prefix)
+	assert.NotEmpty(t, primary)
+	assert.Equal(t, primary, listKeys(client, secondaryBucket, config.S3Prefix))
+
+	// Replaced archives and db versions are mirrored, and so are deletions.
+	must(createTestFile(filepath.Join(testBaseDir, "big.txt"), 300))
+	must(os.RemoveAll(filepath.Join(testBaseDir, "subdir")))
+	must(backup(options))
+	primary = listKeys(client, config.Bucket, config.S3Prefix)
+	assert.Equal(t, primary, listKeys(client, secondaryBucket, config.S3Prefix))
+
+	// A secondary bucket that can't be written to fails the backup, unless it's only warned about.
+	must(createTestFile(filepath.Join(testBaseDir, "d.txt"), 5))
+	options.SecondaryBucket = "missing-bucket"
+	assert.ErrorContains(t, backup(options), "secondary bucket")
+	options.SecondaryPolicy = MirrorWarn
+	must(backup(options))
+
+	options.SecondaryBucket = config.Bucket
+	assert.Error(t, backup(options))
+	assert.Error(t, BackupOptions{SecondaryPolicy: MirrorWarn}.Validate())
+	assert.Error(t, BackupOptions{SecondaryBucket: secondaryBucket, SecondaryPolicy: "sometimes"}.Validate())
+}
+
+// failingSecondaryClient fails every upload to the secondary bucket.
+type failingSecondaryClient struct{}
+
+func (c *failingSecondaryClient) Do(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodPut && strings.HasPrefix(req.URL.Path, "/"+secondaryBucket+"/") {
+		return (&failingUploadClient{}).Do(req)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+func TestBackupFiles_SecondaryBucketRerunAfterCrash(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+
+	client := s3.NewFromConfig(*GetMinioConfig(minioUrl))
+	createSecondaryBucket(client)
+	defer func() { must(clearBucket(client, secondaryBucket, config.S3Prefix)) }()
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 5))
+	backup := func(httpClient aws.HTTPClient) error {
+		cfg := GetMinioConfig(minioUrl)
+		cfg.HTTPClient = httpClient
+		return BackupFiles(
+			context.Background(),
+			logger,
+			cfg,
+			config.DBFile,
+			testBaseDir,
+			config.Bucket,
+			config.S3Prefix,
+			config.BackupName,
+			config.SizeThreshold,
+			BackupOptions{SecondaryBucket: secondaryBucket},
+		)
+	}
+	must(backup(http.DefaultClient))
+	savedDB := config.DBFile + ".saved"
+	must(util.CopyFile(config.DBFile, savedDB))
+	defer os.Remove(savedDB)
+
+	// Crash after the archive is uploaded to the primary bucket, but before it's mirrored: the primary
+	// bucket has the archive, and neither the secondary bucket nor the db know about it.
+	must(createTestFile(filepath.Join(testBaseDir, "dir1/b.txt"), 5))
+	assert.Error(t, backup(&failingSecondaryClient{}))
+	must(util.CopyFile(savedDB, config.DBFile))
+	assert.NotEqual(t, listETags(client, config.Bucket, config.S3Prefix), listETags(client, secondaryBucket, config.S3Prefix))
+
+	// The rerun doesn't skip the archive just because the primary bucket has it.
+	must(backup(http.DefaultClient))
+	assert.Equal(t, listETags(client, config.Bucket, config.S3Prefix), listETags(client, secondaryBucket, config.S3Prefix))
+}
+
+func TestMirrorClient_ReadFallsBackToSecondary(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+
+	cfg := GetMinioConfig(minioUrl)
+	client := s3.NewFromConfig(*cfg)
+	createSecondaryBucket(client)
+	defer func() { must(clearBucket(client, secondaryBucket, config.S3Prefix)) }()
+
+	mirror, err := withMirror(logger, client, config.Bucket, secondaryBucket, "")
+	must(err)
+	key := s3Key(config.S3Prefix, "only-secondary")
+	_, err = client.PutObject(context.TODO(), &s3.PutObjectInput{
+		Bucket: aws.String(secondaryBucket),
+		Key:    aws.String(key),
+		Body:   strings.NewReader("hello"),
+	})
+	must(err)
+
+	out, err := mirror.GetObject(context.TODO(), &s3.GetObjectInput{
+		Bucket: aws.String(config.Bucket),
+		Key:    aws.String(key),
+	})
+	must(err)
+	data, err := io.ReadAll(out.Body)
+	must(err)
+	out.Body.Close()
+	assert.Equal(t, "hello", string(data))
+
+	// Objects missing from both buckets get the primary bucket's error.
+	_, err = mirror.GetObject(context.TODO(), &s3.GetObjectInput{
+		Bucket: aws.String(config.Bucket),
+		Key:    aws.String(s3Key(config.S3Prefix, "missing")),
+	})
+	var noSuchKey *types.NoSuchKey
+	assert.ErrorAs(t, err, &noSuchKey)
+}
@@ -0,0 +1,179 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stretchr/testify/assert"
+
+	"local/backup/lib/logging"
+)
+
+func TestModTime_BackupRecoverBackupIsClean(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+
+	testRecoveryDir, err := os.MkdirTemp("/tmp", "dave-recovery-test-")
+	must(err)
+	defer os.RemoveAll(testRecoveryDir)
+
+	files := []string{"a.txt", "b.txt", "subdir-1/c.txt", "subdir-1/d.txt"}
+	for i, file := range files {
+		path := filepath.Join(testBaseDir, file)
+		must(createTestFile(path, 5+i))
+		// Use modtimes with sub-millisecond components to make sure the precision is consistent.
+		modTime := time.Unix(1700000000+int64(i), 123456789)
+		must(os.Chtimes(path, modTime, modTime))
+	}
+
+	cfg := GetMinioConfig(minioUrl)
+	must(BackupFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		testBaseDir,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		config.SizeThreshold,
+		BackupOptions{},
+	))
+	must(RecoverFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		testRecoveryDir,
+		RecoveryOptions{},
+	))
+	compareDirectories(testBaseDir, testRecoveryDir, t)
+
+	// Backing up the restored tree should find nothing to upload.
+	report, err := Status(
+		logger,
+		cfg,
+		config.DBFile,
+		testRecoveryDir,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		config.SizeThreshold,
+		StatusOptions{CompareRemote: true},
+	)
+	must(err)
+	assert.Empty(t, report.NewFiles)
+	assert.Empty(t, report.ChangedFiles)
+	assert.Empty(t, report.BatchesToWrite)
+	assert.Empty(t, report.RemoteChanges)
+}
+
+func TestModTime_DirectoriesRoundTrip(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+	config.SizeThreshold = 100
+
+	// One directory whose files are split across batches, and nested ones that are grouped.
+	must(createTestFile(filepath.Join(testBaseDir, "dir1/big.txt"), 200))
+	must(createTestFile(filepath.Join(testBaseDir, "dir1/small.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "dir2/nested/a.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "dir2/b.txt"), 5))
+	for i, dir := range []string{"dir1", "dir2", "dir2/nested"} {
+		modTime := time.Date(2020, 1, i+1, 12, 0, 0, 0, time.UTC)
+		must(os.Chtimes(filepath.Join(testBaseDir, dir), modTime, modTime))
+	}
+
+	cfg := GetMinioConfig(minioUrl)
+	must(BackupFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		testBaseDir,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		config.SizeThreshold,
+		BackupOptions{},
+	))
+
+	testRecoveryDir := t.TempDir()
+	must(RecoverFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		testRecoveryDir,
+		RecoveryOptions{},
+	))
+	compareDirectoriesWithOptions(testBaseDir, testRecoveryDir, compareOptions{DirModTimes: true}, t)
+
+	// Touching a directory is picked up by the next backup, even if none of its files changed.
+	modTime := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	must(os.Chtimes(filepath.Join(testBaseDir, "dir2"), modTime, modTime))
+	must(BackupFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		testBaseDir,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		config.SizeThreshold,
+		BackupOptions{},
+	))
+	db, err := NewDB(config.DBFile)
+	must(err)
+	defer db.Close()
+	dirs, err := db.GetDirModTimes()
+	must(err)
+	assert.True(t, modTimesEqual(modTime, dirs["dir2"]))
+	assert.Len(t, dirs, 3)
+}
+
+func TestModTime_SingleFileBatchKeepsSubSecond(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getMemoryTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+
+	// Big enough to be a batch of its own, with a modtime that has nanoseconds.
+	path := filepath.Join(testBaseDir, "single.txt")
+	must(createTestFile(path, 500))
+	modTime := time.Unix(1700000000, 123456789)
+	must(os.Chtimes(path, modTime, modTime))
+
+	must(BackupFiles(context.Background(), logger, &aws.Config{}, config.DBFile, testBaseDir, config.Bucket, config.S3Prefix, config.BackupName, 100, BackupOptions{
+		Storage: config.Storage,
+	}))
+	recoveryDir := t.TempDir()
+	must(RecoverFiles(context.Background(), logger, &aws.Config{}, config.DBFile, config.Bucket, config.S3Prefix, config.BackupName, recoveryDir, RecoveryOptions{
+		Storage: config.Storage,
+	}))
+
+	// The file's PAX header keeps the full modtime, not just what the db records.
+	info, err := os.Stat(filepath.Join(recoveryDir, "single.txt"))
+	must(err)
+	assert.True(t, modTime.Equal(info.ModTime()), "restored modtime %v, expected %v", info.ModTime(), modTime)
+}
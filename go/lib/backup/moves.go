@@ -0,0 +1,137 @@
+package backup
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"local/backup/lib/logging"
+	"local/backup/lib/s3_helpers"
+)
+
+// When a large file is moved or copied within the tree, its new single-file batch would have the
+// same contents as an archive that's already in storage. Instead of uploading it again, the existing
+// archive is copied server-side. Since the archive also records the file's name and modtime, this is
+// only possible if those match too.
+
+// batchCopy is a new single-file batch that can be copied from an existing single-file batch.
+type batchCopy struct {
+	Batch  *BackupBatch
+	Source *FileInfo
+}
+
+// findBatchCopies looks for new single-file batches whose contents are already stored in another
+// single-file batch.
+func findBatchCopies(logger logging.Logger, root string, batches []*BackupBatch, fileInfos fileInfoCache) ([]*batchCopy, error) {
+	// Index the existing single-file batches by name and modtime, which are cheap to compare, so we
+	// only hash the files that have a chance of matching.
+	type candidateKey struct {
+		Name    string
+		ModTime int64
+	}
+	candidates := make(map[candidateKey][]*FileInfo)
+	for _, fi := range fileInfos {
+		if fi.Batch != fi.Path {
+			continue
+		}
+		key := candidateKey{filepath.Base(fi.Path), fi.ModTime.Truncate(modTimePrecision).UnixNano()}
+		candidates[key] = append(candidates[key], fi)
+	}
+	for _, c := range candidates {
+		sort.Slice(c, func(i, j int) bool { return c[i].Path < c[j].Path })
+	}
+
+	var copies []*batchCopy
+	for _, batch := range batches {
+		if len(batch.Files) != 1 || batch.Root != batch.Files[0].Path || !batch.Files[0].IsDirty {
+			continue
+		}
+		file := batch.Files[0]
+		if _, ok := fileInfos[file.Path]; ok {
+			// The file changed in place, so its contents can't match what's stored.
+			continue
+		}
+		matches := candidates[candidateKey{filepath.Base(file.Path), file.ModTime.Truncate(modTimePrecision).UnixNano()}]
+		if len(matches) == 0 {
+			continue
+		}
+		hash, err := getFileHash(filepath.Join(root, file.Path))
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash file %q: %v", file.Path, err)
+		}
+		for _, source := range matches {
+			if source.Hash == hash {
+				logger.Debugf("file %q has the same contents as %q", file.Path, source.Path)
+				copies = append(copies, &batchCopy{Batch: batch, Source: source})
+				break
+			}
+		}
+	}
+	return copies, nil
+}
+
+// copyBatch copies the source batch's archive to the new batch's key and records the file in the
+// db. The file is no longer dirty afterwards, so the batch won't be uploaded.
+func copyBatch(
+	logger logging.Logger,
+	db *DB,
+	client s3_helpers.Client,
+	bucket string,
+	prefix string,
+	c *batchCopy,
+	options BackupOptions,
+) error {
+	sourceKey := batchKey(options.archiveDirFor(prefix), BatchMeta{Path: c.Source.Path, IsSingleFile: true}, options.ObfuscateKeys)
+	key := batchKey(options.archiveDirFor(prefix), BatchMeta{Path: c.Batch.Root, IsSingleFile: true}, options.ObfuscateKeys)
+
+	if options.DryRun {
+		logger.Infof("dry run, would have copied %q to %q", sourceKey, key)
+		return nil
+	}
+
+	logger.Verbosef("copying %q to %q", sourceKey, key)
+	_, err := client.CopyObject(context.TODO(), &s3.CopyObjectInput{
+		Bucket:     aws.String(bucket),
+		CopySource: aws.String(copySource(bucket, sourceKey)),
+		Key:        aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to copy %q to %q: %v", sourceKey, key, err)
+	}
+
+	file := c.Batch.Files[0]
+	err = db.MarkFiles([]*FileInfo{{
+		Path:    file.Path,
+		ModTime: c.Source.ModTime,
+		Hash:    c.Source.Hash,
+		Batch:   c.Batch.Root,
+	}})
+	if err != nil {
+		return fmt.Errorf("error marking file %q as processed: %v", file.Path, err)
+	}
+	checksum, err := db.GetBatchChecksum(c.Source.Path)
+	if err == nil {
+		err = db.SetBatchChecksum(c.Batch.Root, checksum)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("error recording checksum of batch %q: %v", c.Batch.Root, err)
+	}
+	file.IsDirty = false
+	return nil
+}
+
+// copySource formats a CopyObject source, which must be URL-encoded.
+func copySource(bucket string, key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return bucket + "/" + strings.Join(segments, "/")
+}
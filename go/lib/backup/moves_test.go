@@ -0,0 +1,75 @@
+package backup
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"local/backup/lib/logging"
+)
+
+// countingUploadClient counts archive uploads and server-side copies.
+type countingUploadClient struct {
+	mu     sync.Mutex
+	puts   []string
+	copies []string
+}
+
+func (c *countingUploadClient) Do(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodPut && strings.HasSuffix(req.URL.Path, ".tar.gz") {
+		c.mu.Lock()
+		if req.Header.Get("X-Amz-Copy-Source") != "" {
+			c.copies = append(c.copies, req.URL.Path)
+		} else {
+			c.puts = append(c.puts, req.URL.Path)
+		}
+		c.mu.Unlock()
+	}
+	return http.DefaultClient.Do(req)
+}
+
+func TestBackupFiles_CopiesMovedFile(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+	config.SizeThreshold = 1000
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "old/big.bin"), 5000))
+	must(os.MkdirAll(filepath.Join(testBaseDir, "new"), os.ModePerm))
+	roundTripTest(config, t)
+
+	must(os.Rename(filepath.Join(testBaseDir, "old/big.bin"), filepath.Join(testBaseDir, "new/big.bin")))
+
+	counter := &countingUploadClient{}
+	cfg := GetMinioConfig(minioUrl)
+	cfg.HTTPClient = counter
+	must(BackupFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		testBaseDir,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		config.SizeThreshold,
+		BackupOptions{},
+	))
+	assert.Len(t, counter.copies, 1)
+	assert.Empty(t, counter.puts)
+	assertBatchCount(t, config, 2)
+
+	// The copied archive recovers to the new location.
+	config.LeaveBucketContents = true
+	roundTripTest(config, t)
+}
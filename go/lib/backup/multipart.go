@@ -0,0 +1,47 @@
+package backup
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"local/backup/lib/s3_helpers"
+)
+
+// Archives are uploaded with manager.Uploader, which sends an archive bigger than the part size as a
+// multipart upload, several parts at once. BackupOptions.PartSize and BackupOptions.PartConcurrency
+// tune it: bigger parts and more of them at once for fast networks, smaller parts where memory is
+// short. Multipart uploads need S3 itself, so archives are uploaded in one piece to other storage,
+// such as SFTP, and through the wrappers that mirror or checksum uploads, which only handle
+// PutObject.
+
+// archiveUploader uploads an archive. *manager.Uploader implements it.
+type archiveUploader interface {
+	Upload(ctx context.Context, input *s3.PutObjectInput, optFns ...func(*manager.Uploader)) (*manager.UploadOutput, error)
+}
+
+// newArchiveUploader creates the uploader for the given client. Tests replace it to see what the
+// uploader is configured with.
+var newArchiveUploader = func(client manager.UploadAPIClient, optFns ...func(*manager.Uploader)) archiveUploader {
+	return manager.NewUploader(client, optFns...)
+}
+
+// uploadArchive uploads the archive in parts if the client supports it, and in one piece otherwise.
+func uploadArchive(client s3_helpers.Client, input *s3.PutObjectInput, options archiveOptions) error {
+	multipart, ok := client.(manager.UploadAPIClient)
+	if !ok {
+		_, err := client.PutObject(context.TODO(), input)
+		return err
+	}
+	uploader := newArchiveUploader(multipart, func(u *manager.Uploader) {
+		if options.PartSize > 0 {
+			u.PartSize = options.PartSize
+		}
+		if options.PartConcurrency > 0 {
+			u.Concurrency = options.PartConcurrency
+		}
+	})
+	_, err := uploader.Upload(context.TODO(), input)
+	return err
+}
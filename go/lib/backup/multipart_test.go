@@ -0,0 +1,159 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+
+	"local/backup/lib/logging"
+	"local/backup/lib/s3_helpers"
+)
+
+// multipartStorage is storage that claims to support multipart uploads. The archives in the tests
+// using it are smaller than a part, so they're still uploaded with PutObject.
+type multipartStorage struct {
+	s3_helpers.Client
+}
+
+var errNoMultipart = errors.New("multipart uploads aren't supported")
+
+func (c *multipartStorage) CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	return nil, errNoMultipart
+}
+
+func (c *multipartStorage) UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	return nil, errNoMultipart
+}
+
+func (c *multipartStorage) CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	return nil, errNoMultipart
+}
+
+func (c *multipartStorage) AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	return nil, errNoMultipart
+}
+
+// recordUploaders replaces newArchiveUploader for the rest of the test with one that records the
+// uploaders it creates.
+func recordUploaders(t *testing.T) *[]*manager.Uploader {
+	var uploaders []*manager.Uploader
+	saved := newArchiveUploader
+	newArchiveUploader = func(client manager.UploadAPIClient, optFns ...func(*manager.Uploader)) archiveUploader {
+		uploader := manager.NewUploader(client, optFns...)
+		uploaders = append(uploaders, uploader)
+		return uploader
+	}
+	t.Cleanup(func() { newArchiveUploader = saved })
+	return &uploaders
+}
+
+func TestBackupFiles_PartOptions(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getMemoryTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+	uploaders := recordUploaders(t)
+
+	backup := func(options BackupOptions) {
+		must(BackupFiles(
+			context.Background(),
+			logger,
+			GetMinioConfig(minioUrl),
+			config.DBFile,
+			testBaseDir,
+			config.Bucket,
+			config.S3Prefix,
+			config.BackupName,
+			config.SizeThreshold,
+			options,
+		))
+	}
+	storage := &multipartStorage{Client: config.Storage}
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 5))
+	backup(BackupOptions{Storage: storage})
+	if assert.Len(t, *uploaders, 1) {
+		assert.Equal(t, int64(manager.DefaultUploadPartSize), (*uploaders)[0].PartSize)
+		assert.Equal(t, manager.DefaultUploadConcurrency, (*uploaders)[0].Concurrency)
+	}
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 6))
+	backup(BackupOptions{Storage: storage, PartSize: 16 * 1024 * 1024, PartConcurrency: 2})
+	if assert.Len(t, *uploaders, 2) {
+		assert.Equal(t, int64(16*1024*1024), (*uploaders)[1].PartSize)
+		assert.Equal(t, 2, (*uploaders)[1].Concurrency)
+	}
+
+	// Storage that can't do multipart uploads gets the archive in one piece.
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 7))
+	backup(BackupOptions{Storage: config.Storage, PartSize: 16 * 1024 * 1024})
+	assert.Len(t, *uploaders, 2)
+}
+
+// partCountingClient counts the parts uploaded through it.
+type partCountingClient struct {
+	parts atomic.Int32
+}
+
+func (c *partCountingClient) Do(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodPut && req.URL.Query().Has("partNumber") {
+		c.parts.Add(1)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+func TestBackupFiles_MultipartUpload(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getMinioTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+	recoveryDir := t.TempDir()
+
+	// Random data doesn't compress, so the archive is bigger than one part.
+	data := make([]byte, manager.MinUploadPartSize+1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	must(os.WriteFile(filepath.Join(testBaseDir, "big.bin"), data, 0644))
+
+	cfg := GetMinioConfig(minioUrl)
+	parts := &partCountingClient{}
+	cfg.HTTPClient = parts
+	must(BackupFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		testBaseDir,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		config.SizeThreshold,
+		BackupOptions{PartSize: manager.MinUploadPartSize},
+	))
+	assert.Equal(t, int32(2), parts.parts.Load())
+
+	must(RecoverFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		recoveryDir,
+		RecoveryOptions{},
+	))
+	compareDirectories(testBaseDir, recoveryDir, t)
+}
@@ -0,0 +1,41 @@
+package backup
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"local/backup/lib/logging"
+	"local/backup/lib/s3_helpers"
+)
+
+// With BackupOptions.NoDelete, a backup still uploads changed batches and updates the db, but never
+// deletes anything from the bucket, e.g. for buckets with object lock or credentials that can't
+// delete. Batches that no longer exist are dropped from the db as usual, so their archives become
+// orphans that a later GC removes. Besides archives, a backup deletes the temporary copy of the db
+// it uploads and old db versions beyond KeepDBVersions; those are left in place too, and the
+// temporary copy is simply overwritten by the next backup.
+
+// noDeleteClient ignores requests to delete objects.
+type noDeleteClient struct {
+	s3_helpers.Client
+	logger logging.Logger
+}
+
+func (c *noDeleteClient) DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	if params.Delete != nil {
+		for _, object := range params.Delete.Objects {
+			c.logger.Debugf("deletes are disabled, not deleting %q", aws.ToString(object.Key))
+		}
+	}
+	return &s3.DeleteObjectsOutput{}, nil
+}
+
+// withNoDelete wraps the client to ignore deletes, if requested.
+func withNoDelete(logger logging.Logger, client s3_helpers.Client, noDelete bool) s3_helpers.Client {
+	if !noDelete {
+		return client
+	}
+	return &noDeleteClient{Client: client, logger: logger}
+}
@@ -0,0 +1,78 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+
+	"local/backup/lib/logging"
+	"local/backup/lib/s3_helpers"
+)
+
+// deleteCountingClient counts DeleteObjects calls.
+type deleteCountingClient struct {
+	s3_helpers.Client
+	mu      sync.Mutex
+	deletes int
+}
+
+func (c *deleteCountingClient) DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	c.mu.Lock()
+	c.deletes++
+	c.mu.Unlock()
+	return c.Client.DeleteObjects(ctx, params, optFns...)
+}
+
+func TestBackupFiles_NoDelete(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	storage := &deleteCountingClient{Client: s3_helpers.NewMemoryClient("bucket")}
+	testBaseDir := t.TempDir()
+	dbFile := filepath.Join(t.TempDir(), "test-backup.db")
+	cfg := &aws.Config{}
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "big.txt"), 500))
+
+	backup := func(options BackupOptions) {
+		options.Storage = storage
+		must(BackupFiles(context.Background(), logger, cfg, dbFile, testBaseDir, "bucket", "backups", "test-backup", 100, options))
+	}
+	backup(BackupOptions{})
+
+	// The big file's batch goes away and a new one appears, but nothing is deleted.
+	must(os.Remove(filepath.Join(testBaseDir, "big.txt")))
+	must(createTestFile(filepath.Join(testBaseDir, "other.txt"), 500))
+	storage.deletes = 0
+	backup(BackupOptions{NoDelete: true, KeepDBVersions: 1})
+	assert.Equal(t, 0, storage.deletes)
+
+	exists, err := s3_helpers.ObjectExists(storage, "bucket", "backups/test-backup/other.txt.tar.gz")
+	must(err)
+	assert.True(t, exists)
+	exists, err = s3_helpers.ObjectExists(storage, "bucket", "backups/test-backup/big.txt.tar.gz")
+	must(err)
+	assert.True(t, exists)
+
+	// The stale archive is no longer in the backup, so it isn't recovered.
+	recoveryDir := t.TempDir()
+	must(RecoverFiles(context.Background(), logger, cfg, dbFile, "bucket", "backups", "test-backup", recoveryDir, RecoveryOptions{
+		Storage: storage,
+	}))
+	compareDirectories(testBaseDir, recoveryDir, t)
+
+	// Without the option, deletes happen as usual.
+	must(os.Remove(filepath.Join(testBaseDir, "other.txt")))
+	backup(BackupOptions{})
+	assert.NotZero(t, storage.deletes)
+	exists, err = s3_helpers.ObjectExists(storage, "bucket", "backups/test-backup/other.txt.tar.gz")
+	must(err)
+	assert.False(t, exists)
+}
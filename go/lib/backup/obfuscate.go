@@ -0,0 +1,66 @@
+package backup
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// With obfuscated keys, archives are stored under the hash of their usual name instead:
+//
+//	<prefix>/objects/<sha256(name)>
+//
+// so the keys don't reveal the names of any files or directories. The hash is derived from the
+// batch's path, so the batches in the db are the mapping back to the real paths; recovery hashes
+// each of them to find out which archive holds which batch. Content-addressed blobs are already
+// named by their contents and are stored as usual, as is the db. Since the db is the only record of
+// the paths, Reconcile can't rebuild it for such a backup.
+
+// checkObfuscateKeys makes sure a backup doesn't switch key modes, which would leave the db pointing
+// at the wrong keys.
+func checkObfuscateKeys(db *DB, obfuscate bool) error {
+	stored, err := db.ObfuscatesKeys()
+	if err != nil {
+		return err
+	}
+	if stored == obfuscate {
+		return nil
+	}
+	files, err := db.GetAllFiles()
+	if err != nil {
+		return err
+	}
+	// Nothing has been stored yet, so the mode can still be picked.
+	if len(files) == 0 {
+		return nil
+	}
+	if stored {
+		return fmt.Errorf("backup has obfuscated keys, but key obfuscation isn't enabled")
+	}
+	return fmt.Errorf("backup doesn't have obfuscated keys, but key obfuscation is enabled")
+}
+
+// ObfuscatesKeys reports whether the backup stores archives under hashed keys.
+func (db *DB) ObfuscatesKeys() (bool, error) {
+	value, err := db.getMeta(metaObfuscateKeys)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return value == "true", nil
+}
+
+// archiveNamesByKey maps the obfuscated key of every batch in the db back to its archive's name.
+func archiveNamesByKey(db *DB, prefix string) (map[string]string, error) {
+	batches, err := db.GetExistingBatches(false)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching existing batches from db: %v", err)
+	}
+	names := make(map[string]string)
+	for _, batch := range batches {
+		name := batchArchiveName(batch)
+		names[archiveKey(prefix, name, true)] = name
+	}
+	return names, nil
+}
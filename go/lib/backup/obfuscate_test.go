@@ -0,0 +1,101 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+
+	"local/backup/lib/logging"
+)
+
+func TestBackupFiles_ObfuscateKeys(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+	config.SizeThreshold = 100
+
+	must(createTestFile(filepath.Join(testBaseDir, "secret-a.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "secret-big.txt"), 500))
+	must(createTestFile(filepath.Join(testBaseDir, "secret-dir/b.txt"), 10))
+	must(createTestFile(filepath.Join(testBaseDir, "secret-dir/c.txt"), 20))
+	must(createTestFile(filepath.Join(testBaseDir, "secret-dir/nested/d.txt"), 300))
+
+	cfg := GetMinioConfig(minioUrl)
+	client := s3.NewFromConfig(*cfg)
+	backup := func(options BackupOptions) error {
+		return BackupFiles(
+			context.Background(),
+			logger,
+			cfg,
+			config.DBFile,
+			testBaseDir,
+			config.Bucket,
+			config.S3Prefix,
+			config.BackupName,
+			config.SizeThreshold,
+			options,
+		)
+	}
+	must(backup(BackupOptions{ObfuscateKeys: true}))
+
+	output, err := client.ListObjectsV2(context.TODO(), &s3.ListObjectsV2Input{
+		Bucket: aws.String(config.Bucket),
+		Prefix: aws.String(config.FullS3Prefix + "/"),
+	})
+	must(err)
+	assert.NotEmpty(t, output.Contents)
+	for _, object := range output.Contents {
+		key := aws.ToString(object.Key)
+		assert.True(t, strings.HasPrefix(key, config.FullS3Prefix+"/objects/"), key)
+		assert.NotContains(t, key, "secret")
+		assert.NotContains(t, key, ".tar.gz")
+	}
+
+	// Switching modes on an existing backup is refused.
+	assert.Error(t, backup(BackupOptions{}))
+
+	// Nothing is considered orphaned.
+	orphans, err := GC(logger, cfg, config.DBFile, config.Bucket, config.S3Prefix, config.BackupName, GCOptions{})
+	must(err)
+	assert.Empty(t, orphans)
+
+	// Deleting a file removes its object.
+	must(os.Remove(filepath.Join(testBaseDir, "secret-big.txt")))
+	must(backup(BackupOptions{ObfuscateKeys: true}))
+	output, err = client.ListObjectsV2(context.TODO(), &s3.ListObjectsV2Input{
+		Bucket: aws.String(config.Bucket),
+		Prefix: aws.String(config.FullS3Prefix + "/"),
+	})
+	must(err)
+	db, err := NewDB(config.DBFile)
+	must(err)
+	batches, err := db.GetExistingBatches(false)
+	must(err)
+	must(db.Close())
+	assert.Len(t, output.Contents, len(batches))
+
+	testRecoveryDir, err := os.MkdirTemp("/tmp", "dave-recovery-test-")
+	must(err)
+	defer os.RemoveAll(testRecoveryDir)
+	must(RecoverFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		testRecoveryDir,
+		RecoveryOptions{Verify: true},
+	))
+	compareDirectories(testBaseDir, testRecoveryDir, t)
+}
@@ -0,0 +1,73 @@
+package backup
+
+// Observer receives structured events from backups and recoveries, e.g. to drive a progress UI. Set
+// BackupOptions.Observer or RecoveryOptions.Observer to use one. Embed NoopObserver to only handle
+// some of the events.
+type Observer interface {
+	// BatchStarted is called before a batch with files that need backing up is uploaded.
+	BatchStarted(event BatchEvent)
+	// BatchFinished is called after a started batch has been uploaded and recorded, with the error it
+	// failed with, if any.
+	BatchFinished(event BatchEvent, err error)
+	// FileSkipped is called for every file that's left out of a backup.
+	FileSkipped(event FileSkippedEvent)
+	// ArchiveRecovered is called after each archive has been recovered, with the error it failed
+	// with, if any. Archives are recovered concurrently, so it may be called from several goroutines
+	// at once.
+	ArchiveRecovered(event ArchiveEvent, err error)
+}
+
+type BatchEvent struct {
+	Root string
+	// The files in the batch, relative to the backup root.
+	Files []string
+	// The total size of the files.
+	Bytes int64
+}
+
+// Why a file was left out of a backup.
+type SkipReason string
+
+const (
+	// Matched by an ignore rule. See ignore.go.
+	SkipIgnored SkipReason = "ignored"
+	// Doesn't have one of BackupOptions.Extensions.
+	SkipExtension SkipReason = "extension"
+	// Couldn't be read, and BackupOptions.ContinueOnError is set.
+	SkipUnreadable SkipReason = "unreadable"
+	// Failed to back up too many times. See quarantine.go.
+	SkipQuarantined SkipReason = "quarantined"
+	// Not a regular file, like a FIFO, socket or device.
+	SkipSpecial SkipReason = "special"
+	// Empty, and BackupOptions.SkipEmptyFiles is set.
+	SkipEmpty SkipReason = "empty"
+)
+
+type FileSkippedEvent struct {
+	// Relative to the backup root. Ignored directories are reported once, rather than per file.
+	Path   string
+	IsDir  bool
+	Reason SkipReason
+	// Set for unreadable files.
+	Err error
+}
+
+type ArchiveEvent struct {
+	Key string
+}
+
+// NoopObserver ignores every event.
+type NoopObserver struct{}
+
+func (NoopObserver) BatchStarted(event BatchEvent)                  {}
+func (NoopObserver) BatchFinished(event BatchEvent, err error)      {}
+func (NoopObserver) FileSkipped(event FileSkippedEvent)             {}
+func (NoopObserver) ArchiveRecovered(event ArchiveEvent, err error) {}
+
+// observerOrNoop returns the observer, or a no-op one if it's nil.
+func observerOrNoop(observer Observer) Observer {
+	if observer == nil {
+		return NoopObserver{}
+	}
+	return observer
+}
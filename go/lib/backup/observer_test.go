@@ -0,0 +1,117 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"local/backup/lib/logging"
+)
+
+// recordingObserver records events as strings, in the order they happened.
+type recordingObserver struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (o *recordingObserver) record(format string, args ...any) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events = append(o.events, fmt.Sprintf(format, args...))
+}
+
+func (o *recordingObserver) BatchStarted(event BatchEvent) {
+	o.record("start %s %v %d", event.Root, event.Files, event.Bytes)
+}
+
+func (o *recordingObserver) BatchFinished(event BatchEvent, err error) {
+	o.record("finish %s %v", event.Root, err)
+}
+
+func (o *recordingObserver) FileSkipped(event FileSkippedEvent) {
+	o.record("skip %s %s", event.Path, event.Reason)
+}
+
+func (o *recordingObserver) ArchiveRecovered(event ArchiveEvent, err error) {
+	o.record("recover %s %v", event.Key, err)
+}
+
+func TestObserver_Events(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+	config.SizeThreshold = 100
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 200))
+	must(createTestFile(filepath.Join(testBaseDir, "subdir/b.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "subdir/c.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "x.log"), 5))
+	must(os.WriteFile(filepath.Join(testBaseDir, ".dbignore"), []byte("\\.log$\n"), 0644))
+
+	observer := &recordingObserver{}
+	cfg := GetMinioConfig(minioUrl)
+	must(BackupFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		testBaseDir,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		config.SizeThreshold,
+		BackupOptions{Observer: observer},
+	))
+	assert.Equal(t, []string{
+		"skip .dbignore ignored",
+		"skip x.log ignored",
+		"start a.txt [a.txt] 200",
+		"finish a.txt <nil>",
+		"start subdir [subdir/b.txt subdir/c.txt] 10",
+		"finish subdir <nil>",
+	}, observer.events)
+
+	// Unchanged batches aren't started at all.
+	observer.events = nil
+	must(BackupFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		testBaseDir,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		config.SizeThreshold,
+		BackupOptions{Observer: observer},
+	))
+	assert.Equal(t, []string{"skip .dbignore ignored", "skip x.log ignored"}, observer.events)
+
+	observer.events = nil
+	recoveryDir := t.TempDir()
+	must(RecoverFiles(
+		context.Background(),
+		logger,
+		cfg,
+		filepath.Join(recoveryDir, "recovered.db"),
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		recoveryDir,
+		RecoveryOptions{Observer: observer},
+	))
+	sort.Strings(observer.events)
+	assert.Equal(t, []string{
+		"recover " + s3Key(config.FullS3Prefix, "a.txt.tar.gz") + " <nil>",
+		"recover " + s3Key(config.FullS3Prefix, "subdir/_files.tar.gz") + " <nil>",
+	}, observer.events)
+}
@@ -0,0 +1,146 @@
+package backup
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+)
+
+// Validate rejects options that contradict each other.
+func (o BackupOptions) Validate() error {
+	if o.Force && o.DryRun {
+		return fmt.Errorf("can't force a dry run, since it doesn't write anything")
+	}
+	if o.MergeRemote && o.Force {
+		return fmt.Errorf("can't both merge with and overwrite changes in storage")
+	}
+	if o.MergeRemote && o.SkipRemoteCheck {
+		return fmt.Errorf("can't merge with changes in storage without comparing the remote db")
+	}
+	if o.MergeRemote && o.DryRun {
+		return fmt.Errorf("can't merge in a dry run, since merging updates the local db")
+	}
+	if o.Snapshot && o.Path != "" {
+		return fmt.Errorf("a snapshot must include the whole tree, so it can't be limited to a path")
+	}
+	if o.Snapshot && !o.Since.IsZero() {
+		return fmt.Errorf("a snapshot starts from an empty db, so it can't skip files by modtime")
+	}
+	if o.KeepDBVersions < 0 {
+		return fmt.Errorf("number of db versions to keep can't be negative")
+	}
+	if o.ChunkThreshold < 0 {
+		return fmt.Errorf("chunk threshold can't be negative")
+	}
+	if o.VacuumEvery < 0 {
+		return fmt.Errorf("number of backups between vacuums can't be negative")
+	}
+	if o.ScanConcurrency < 0 {
+		return fmt.Errorf("scan concurrency can't be negative")
+	}
+	if o.MaxBufferBytes < 0 {
+		return fmt.Errorf("max buffer size can't be negative")
+	}
+	if o.MaxInFlightBytes < 0 {
+		return fmt.Errorf("max in-flight bytes can't be negative")
+	}
+	if o.PartSize != 0 && o.PartSize < manager.MinUploadPartSize {
+		return fmt.Errorf("part size must be at least %d bytes", manager.MinUploadPartSize)
+	}
+	if o.PartConcurrency < 0 {
+		return fmt.Errorf("part upload concurrency can't be negative")
+	}
+	if o.QuarantineAfter < 0 {
+		return fmt.Errorf("number of failures before quarantine can't be negative")
+	}
+	if o.KeyTemplate != "" {
+		if err := validateKeyTemplate(o.KeyTemplate); err != nil {
+			return err
+		}
+		if o.ObfuscateKeys {
+			return fmt.Errorf("obfuscated keys are hashed, so they can't follow a key template")
+		}
+	}
+	if err := validateMirror(o.SecondaryBucket, o.SecondaryPolicy); err != nil {
+		return err
+	}
+	if o.ChecksumAlgorithm != "" {
+		if _, err := parseChecksumAlgorithm(o.ChecksumAlgorithm); err != nil {
+			return err
+		}
+	}
+	for k := range o.ObjectMetadata {
+		if k == "" {
+			return fmt.Errorf("object metadata keys can't be empty")
+		}
+	}
+	for _, glob := range append(append([]string(nil), o.Exclude...), o.Include...) {
+		if strings.TrimSpace(glob) == "" {
+			return fmt.Errorf("exclude and include patterns can't be empty")
+		}
+	}
+	for _, ext := range append(append([]string(nil), o.Extensions...), o.NoCompressExtensions...) {
+		if strings.TrimPrefix(ext, ".") == "" {
+			return fmt.Errorf("extensions can't be empty")
+		}
+	}
+	return nil
+}
+
+// validateSizeThreshold makes sure files can be batched by the given threshold.
+func validateSizeThreshold(sizeThreshold int64) error {
+	if sizeThreshold <= 0 {
+		return fmt.Errorf("size threshold must be positive, got %d", sizeThreshold)
+	}
+	return nil
+}
+
+// Validate rejects options that contradict each other.
+func (o RecoveryOptions) Validate() error {
+	if o.Concurrency < 0 {
+		return fmt.Errorf("concurrency can't be negative")
+	}
+	if o.StripComponents < 0 {
+		return fmt.Errorf("number of components to strip can't be negative")
+	}
+	if o.WithPrefix != "" && o.ReplacePrefix == "" {
+		return fmt.Errorf("a prefix to replace is required along with the prefix to replace it with")
+	}
+	if o.OriginalLocations && (o.StripComponents > 0 || o.ReplacePrefix != "") {
+		return fmt.Errorf("paths can't be rewritten when recovering to their original locations")
+	}
+	if o.RestoreDays < 0 {
+		return fmt.Errorf("number of days to restore for can't be negative")
+	}
+	if o.RestorePollInterval < 0 {
+		return fmt.Errorf("restore poll interval can't be negative")
+	}
+	if o.Conflict != "" {
+		if _, err := ParseConflictPolicy(string(o.Conflict)); err != nil {
+			return err
+		}
+	}
+	if o.Staging && o.OriginalLocations {
+		return fmt.Errorf("can't stage a recovery to the original locations, since there's no single root to replace")
+	}
+	if o.Staging && o.Conflict != "" && o.Conflict != ConflictOverwrite {
+		return fmt.Errorf("a staged recovery replaces the whole root, so it can't keep existing files")
+	}
+	if o.Staging && o.VerifyOnly {
+		return fmt.Errorf("a verify-only recovery doesn't write any files to stage")
+	}
+	if o.MaxExtractedBytes < 0 || o.MaxExtractedFileBytes < 0 {
+		return fmt.Errorf("extraction limits can't be negative")
+	}
+	if o.DBVersion < 0 {
+		return fmt.Errorf("db version can't be negative")
+	}
+	if o.DBVersion != 0 && o.Snapshot != "" {
+		return fmt.Errorf("a snapshot's db isn't versioned, so a db version can't be recovered from it")
+	}
+	if o.DBVersion != 0 && o.VerifyOnly {
+		return fmt.Errorf("a verify-only recovery checks the latest db, so it can't use a db version")
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package backup
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"local/backup/lib/logging"
+)
+
+func TestBackupOptions_Validate(t *testing.T) {
+	assert.NoError(t, BackupOptions{}.Validate())
+	assert.NoError(t, BackupOptions{Force: true, Snapshot: true, KeepDBVersions: 3}.Validate())
+
+	for name, options := range map[string]BackupOptions{
+		"force dry run":         {Force: true, DryRun: true},
+		"force merge":           {Force: true, MergeRemote: true},
+		"merge unchecked":       {MergeRemote: true, SkipRemoteCheck: true},
+		"merge dry run":         {MergeRemote: true, DryRun: true},
+		"snapshot of a subtree": {Snapshot: true, Path: "subdir-1"},
+		"snapshot since":        {Snapshot: true, Since: time.Now()},
+		"negative db versions":  {KeepDBVersions: -1},
+		"empty extension":       {Extensions: []string{"jpg", "."}},
+		"empty metadata key":    {ObjectMetadata: map[string]string{"": "a"}},
+		"negative quarantine":   {QuarantineAfter: -1},
+		"negative vacuum every": {VacuumEvery: -1},
+		"negative max buffer":   {MaxBufferBytes: -1},
+		"negative in flight":    {MaxInFlightBytes: -1},
+		"negative scan threads": {ScanConcurrency: -1},
+		"small part size":       {PartSize: 1024 * 1024},
+		"negative part threads": {PartConcurrency: -1},
+		"unknown checksum":      {ChecksumAlgorithm: "md5"},
+		"bad key template":      {KeyTemplate: "{path}/{name}"},
+		"obfuscated template":   {KeyTemplate: "archives/{name}/{path}", ObfuscateKeys: true},
+	} {
+		assert.Error(t, options.Validate(), name)
+	}
+}
+
+func TestRecoveryOptions_Validate(t *testing.T) {
+	assert.NoError(t, RecoveryOptions{}.Validate())
+	assert.NoError(t, RecoveryOptions{Concurrency: 2, ReplacePrefix: "a", Conflict: ConflictKeepNewer}.Validate())
+
+	for name, options := range map[string]RecoveryOptions{
+		"negative concurrency":      {Concurrency: -1},
+		"negative strip components": {StripComponents: -1},
+		"with prefix only":          {WithPrefix: "b"},
+		"negative restore days":     {RestoreDays: -1},
+		"negative poll interval":    {RestorePollInterval: -time.Second},
+		"unknown conflict policy":   {Conflict: "ask"},
+		"remapped original paths":   {OriginalLocations: true, StripComponents: 1},
+		"negative db version":       {DBVersion: -1},
+		"negative extraction limit": {MaxExtractedBytes: -1},
+		"negative file limit":       {MaxExtractedFileBytes: -1},
+		"db version of a snapshot":  {DBVersion: 1, Snapshot: "abc"},
+		"verify db version":         {DBVersion: 1, VerifyOnly: true},
+	} {
+		assert.Error(t, options.Validate(), name)
+	}
+}
+
+func TestBackupFiles_RejectsInvalidOptions(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	cfg := GetMinioConfig(minioUrl)
+
+	backup := func(sizeThreshold int64, options BackupOptions) error {
+		return BackupFiles(
+			context.Background(),
+			logger,
+			cfg,
+			config.DBFile,
+			config.TestBaseDir,
+			config.Bucket,
+			config.S3Prefix,
+			config.BackupName,
+			sizeThreshold,
+			options,
+		)
+	}
+	assert.Error(t, backup(config.SizeThreshold, BackupOptions{Force: true, DryRun: true}))
+	assert.Error(t, backup(0, BackupOptions{}))
+	assert.Error(t, backup(-1, BackupOptions{}))
+
+	err := RecoverFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		t.TempDir(),
+		RecoveryOptions{Concurrency: -1},
+	)
+	assert.Error(t, err)
+}
@@ -0,0 +1,113 @@
+package backup
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// planTreeNode is a directory or file in the tree rendered by RenderBatchTree, with the batch rooted
+// at it, if any.
+type planTreeNode struct {
+	children map[string]*planTreeNode
+	batch    *BackupBatch
+}
+
+func (n *planTreeNode) child(name string) *planTreeNode {
+	if n.children == nil {
+		n.children = make(map[string]*planTreeNode)
+	}
+	c, ok := n.children[name]
+	if !ok {
+		c = &planTreeNode{}
+		n.children[name] = c
+	}
+	return c
+}
+
+// RenderBatchTree renders the batches as an indented tree of the directories they're rooted in, to
+// show how the files were split up. Each batch is marked as a single file or a group, with its size
+// and how many of its files are dirty, and a group's files are listed beneath it, relative to the
+// group's root. Dirty files are marked with why they need to be backed up, if that's known.
+func RenderBatchTree(batches []*BackupBatch) string {
+	root := &planTreeNode{}
+	for _, batch := range batches {
+		node := root
+		if batch.Root != "." {
+			for _, name := range strings.Split(filepath.ToSlash(batch.Root), "/") {
+				node = node.child(name)
+			}
+		}
+		node.batch = batch
+	}
+
+	var sb strings.Builder
+	sb.WriteString("./")
+	if root.batch != nil {
+		sb.WriteString(" " + describeBatch(root.batch))
+	}
+	sb.WriteString("\n")
+	renderPlanTreeNode(&sb, root, 1)
+	return sb.String()
+}
+
+func renderPlanTreeNode(sb *strings.Builder, node *planTreeNode, depth int) {
+	indent := strings.Repeat("  ", depth)
+	if node.batch != nil && !isSingleFileBatch(node.batch) {
+		files := append([]*BackupFile(nil), node.batch.Files...)
+		sort.Slice(files, func(i, j int) bool {
+			return files[i].Path < files[j].Path
+		})
+		for _, file := range files {
+			name := file.Path
+			if rel, err := filepath.Rel(node.batch.Root, file.Path); err == nil {
+				name = rel
+			}
+			fmt.Fprintf(sb, "%s%s%s (%d bytes)\n", indent, file.dirtyMarker(), displayPath(filepath.ToSlash(name)), file.Size())
+		}
+	}
+
+	names := make([]string, 0, len(node.children))
+	for name := range node.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		child := node.children[name]
+		line := displayPath(name)
+		if child.batch == nil || !isSingleFileBatch(child.batch) {
+			line += "/"
+		}
+		if child.batch != nil {
+			line += " " + describeBatch(child.batch)
+		}
+		fmt.Fprintf(sb, "%s%s\n", indent, line)
+		renderPlanTreeNode(sb, child, depth+1)
+	}
+}
+
+// isSingleFileBatch reports whether the batch is a file on its own, rather than a group of files
+// rooted at a directory.
+func isSingleFileBatch(batch *BackupBatch) bool {
+	return len(batch.Files) == 1 && batch.Files[0].Path == batch.Root
+}
+
+func describeBatch(batch *BackupBatch) string {
+	if isSingleFileBatch(batch) {
+		dirty := ""
+		if file := batch.Files[0]; file.IsDirty && file.reason != backupReasonNone {
+			dirty = fmt.Sprintf(", dirty: %s", file.reason)
+		} else if file.IsDirty {
+			dirty = ", dirty"
+		}
+		return fmt.Sprintf("[single file, %d bytes%s]", batch.Size(), dirty)
+	}
+	dirty := 0
+	for _, file := range batch.Files {
+		if file.IsDirty {
+			dirty++
+		}
+	}
+	return fmt.Sprintf("[group of %d files, %d bytes, %d dirty]", len(batch.Files), batch.Size(), dirty)
+}
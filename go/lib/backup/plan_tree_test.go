@@ -0,0 +1,60 @@
+package backup
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderBatchTree(t *testing.T) {
+	batches := []*BackupBatch{
+		{
+			Root:      "photos/2023/big.raw",
+			TotalSize: 5000,
+			Files:     []*BackupFile{{Path: "photos/2023/big.raw", FileSize: 5000, IsDirty: true}},
+		},
+		{
+			Root:      ".",
+			TotalSize: 30,
+			Files: []*BackupFile{
+				{Path: "notes.txt", FileSize: 10},
+				{Path: "docs/a.txt", FileSize: 20, IsDirty: true},
+			},
+		},
+		{
+			Root:      "photos/2023",
+			TotalSize: 300,
+			Files: []*BackupFile{
+				{Path: "photos/2023/b.jpg", FileSize: 200},
+				{Path: "photos/2023/a.jpg", FileSize: 100},
+			},
+		},
+		{
+			Root:      "music/song.flac",
+			TotalSize: 4000,
+			Files:     []*BackupFile{{Path: "music/song.flac", FileSize: 4000}},
+		},
+	}
+
+	expected := `./ [group of 2 files, 30 bytes, 1 dirty]
+  [dirty] docs/a.txt (20 bytes)
+  notes.txt (10 bytes)
+  music/
+    song.flac [single file, 4000 bytes]
+  photos/
+    2023/ [group of 2 files, 300 bytes, 0 dirty]
+      a.jpg (100 bytes)
+      b.jpg (200 bytes)
+      big.raw [single file, 5000 bytes, dirty]
+`
+	assert.Equal(t, expected, RenderBatchTree(batches))
+
+	// The order of the batches doesn't matter.
+	reversed := make([]*BackupBatch, len(batches))
+	for i, batch := range batches {
+		reversed[len(batches)-1-i] = batch
+	}
+	assert.Equal(t, expected, RenderBatchTree(reversed))
+
+	assert.Equal(t, "./\n", RenderBatchTree(nil))
+}
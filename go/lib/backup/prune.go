@@ -0,0 +1,248 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"local/backup/lib/logging"
+	"local/backup/lib/s3_helpers"
+)
+
+const defaultPruneMinAge = 24 * time.Hour
+
+type PruneOptions struct {
+	// The recorded objects are only deleted if this is set. Otherwise a run with a prune in progress
+	// just reports what it would delete.
+	Confirm bool
+	// How long after the first phase the second phase may run. Gives other backups time to finish
+	// and the user time to abort. Defaults to defaultPruneMinAge.
+	MinAge time.Duration
+	// Discards the recorded prune intent without deleting anything.
+	Abort bool
+	// If true, runs even if the remote db differs from the local one.
+	Force bool
+	// Where to download the remote db to. Defaults to os.TempDir().
+	TempDir string
+	// If set, deleted objects are deleted from this bucket too. See mirror.go.
+	SecondaryBucket string
+	// What to do when deleting from SecondaryBucket fails. Defaults to MirrorFail.
+	SecondaryPolicy MirrorPolicy
+	// If set, a line recording the prune and its outcome is appended to this file. See audit.go.
+	AuditLog string
+}
+
+type PruneReport struct {
+	// Objects recorded for deletion by the first phase. On an unconfirmed run with a prune in
+	// progress, the recorded objects a confirmed run would delete.
+	Marked []string
+	// Objects deleted by the second phase.
+	Deleted []string
+	// Recorded objects that were referenced or rewritten after being marked, so weren't deleted.
+	Spared []string
+}
+
+// pruneIntent is stored as the time it was made, followed by one line per marked object.
+type pruneIntent struct {
+	MarkedAt time.Time
+	Objects  []markedObject
+}
+
+// markedObject is an object recorded by the first phase of a prune. The ETag and LastModified are
+// the ones storage reported when it was marked, so a rewrite can be detected without comparing
+// storage's clock to ours.
+type markedObject struct {
+	Key          string
+	ETag         string
+	LastModified time.Time
+}
+
+// pruneIntentKey returns the S3 key of the given backup's prune intent. It's outside of the backup's
+// prefix so it's never considered an orphan itself.
+func pruneIntentKey(prefixBase string, name string) string {
+	return s3Key(prefixBase, fmt.Sprintf("%s.prune", name))
+}
+
+// Prune is a safer GC that works in two phases. The first run only records the orphaned objects it
+// finds in a prune intent stored next to the db. A later confirmed run deletes the recorded objects
+// that are still orphaned and haven't been rewritten since they were recorded, which spares anything
+// a concurrent backup wrote or started referencing in between. Until then the prune can be aborted.
+func Prune(
+	logger logging.Logger,
+	cfg *aws.Config,
+	dbFile string,
+	bucket string,
+	prefixBase string,
+	name string,
+	options PruneOptions,
+) (*PruneReport, error) {
+	report, err := runPrune(logger, cfg, dbFile, bucket, prefixBase, name, options)
+	var counts map[string]int
+	if report != nil {
+		counts = map[string]int{
+			"objects_marked":  len(report.Marked),
+			"objects_deleted": len(report.Deleted),
+			"objects_spared":  len(report.Spared),
+		}
+	}
+	appendAuditLog(logger, options.AuditLog, newAuditEntry("prune", name, counts, err))
+	return report, err
+}
+
+// runPrune is Prune, apart from writing to the audit log.
+func runPrune(
+	logger logging.Logger,
+	cfg *aws.Config,
+	dbFile string,
+	bucket string,
+	prefixBase string,
+	name string,
+	options PruneOptions,
+) (*PruneReport, error) {
+	client, err := withMirror(logger, s3.NewFromConfig(*cfg), bucket, options.SecondaryBucket, options.SecondaryPolicy)
+	if err != nil {
+		return nil, err
+	}
+	intentKey := pruneIntentKey(prefixBase, name)
+
+	intent, err := readPruneIntent(client, bucket, intentKey)
+	if err != nil && !errors.Is(err, s3_helpers.ErrNotFound) {
+		return nil, fmt.Errorf("failed to read prune intent: %v", err)
+	}
+
+	if options.Abort {
+		if intent == nil {
+			logger.Infof("no prune in progress")
+			return &PruneReport{}, nil
+		}
+		logger.Infof("aborting prune of %d object(s) marked at %s", len(intent.Objects), intent.MarkedAt.Format(time.RFC3339))
+		if err := deleteObject(client, bucket, intentKey); err != nil {
+			return nil, fmt.Errorf("failed to delete prune intent: %v", err)
+		}
+		return &PruneReport{}, nil
+	}
+
+	if intent != nil && options.Confirm {
+		minAge := options.MinAge
+		if minAge <= 0 {
+			minAge = defaultPruneMinAge
+		}
+		if wait := intent.MarkedAt.Add(minAge).Sub(time.Now()); wait > 0 {
+			return nil, fmt.Errorf("prune was marked at %s, it can be confirmed in %v", intent.MarkedAt.Format(time.RFC3339), wait.Round(time.Second))
+		}
+	}
+
+	orphans, err := findOrphans(logger, client, dbFile, bucket, prefixBase, name, options.Force, options.TempDir)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &PruneReport{}
+	if intent == nil {
+		intent = &pruneIntent{MarkedAt: time.Now()}
+		for _, object := range orphans {
+			key := aws.ToString(object.Key)
+			logger.Infof("marking orphaned object %q for deletion", key)
+			intent.Objects = append(intent.Objects, markedObject{
+				Key:          key,
+				ETag:         aws.ToString(object.ETag),
+				LastModified: aws.ToTime(object.LastModified),
+			})
+			report.Marked = append(report.Marked, key)
+		}
+		if len(intent.Objects) == 0 {
+			logger.Infof("no orphaned objects found")
+			return report, nil
+		}
+		if err := s3_helpers.UploadBytes(client, bucket, intentKey, intent.encode()); err != nil {
+			return nil, fmt.Errorf("failed to write prune intent: %v", err)
+		}
+		return report, nil
+	}
+
+	stillOrphaned := make(map[string]types.Object)
+	for _, object := range orphans {
+		stillOrphaned[aws.ToString(object.Key)] = object
+	}
+	for _, marked := range intent.Objects {
+		key := marked.Key
+		object, ok := stillOrphaned[key]
+		if !ok || aws.ToString(object.ETag) != marked.ETag || !aws.ToTime(object.LastModified).Equal(marked.LastModified) {
+			logger.Infof("sparing object %q, it's been referenced or rewritten since it was marked", key)
+			report.Spared = append(report.Spared, key)
+			continue
+		}
+		if !options.Confirm {
+			logger.Infof("would have deleted orphaned object %q", key)
+			report.Marked = append(report.Marked, key)
+			continue
+		}
+		logger.Infof("deleting orphaned object %q", key)
+		if err := deleteObject(client, bucket, key); err != nil {
+			return nil, fmt.Errorf("failed to delete orphaned object %q: %v", key, err)
+		}
+		report.Deleted = append(report.Deleted, key)
+	}
+	if !options.Confirm {
+		return report, nil
+	}
+	if err := deleteObject(client, bucket, intentKey); err != nil {
+		return nil, fmt.Errorf("failed to delete prune intent: %v", err)
+	}
+	return report, nil
+}
+
+// Each object is stored as its key, ETag and last modified time, separated by tabs.
+func (p *pruneIntent) encode() []byte {
+	lines := []string{p.MarkedAt.UTC().Format(time.RFC3339Nano)}
+	for _, object := range p.Objects {
+		lines = append(lines, strings.Join([]string{object.Key, object.ETag, object.LastModified.UTC().Format(time.RFC3339Nano)}, "\t"))
+	}
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+// readPruneIntent returns s3_helpers.ErrNotFound if there's no prune in progress.
+func readPruneIntent(client s3_helpers.Client, bucket string, key string) (*pruneIntent, error) {
+	data, err := s3_helpers.DownloadBytes(client, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	markedAt, err := time.Parse(time.RFC3339Nano, lines[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid prune intent %q: %v", key, err)
+	}
+	intent := &pruneIntent{MarkedAt: markedAt}
+	for _, line := range lines[1:] {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid prune intent %q: malformed line %q", key, line)
+		}
+		lastModified, err := time.Parse(time.RFC3339Nano, fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid prune intent %q: %v", key, err)
+		}
+		intent.Objects = append(intent.Objects, markedObject{Key: fields[0], ETag: fields[1], LastModified: lastModified})
+	}
+	return intent, nil
+}
+
+func deleteObject(client s3_helpers.Client, bucket string, key string) error {
+	_, err := client.DeleteObjects(context.TODO(), &s3.DeleteObjectsInput{
+		Bucket: aws.String(bucket),
+		Delete: &types.Delete{
+			Objects: []types.ObjectIdentifier{
+				{
+					Key: aws.String(key),
+				},
+			},
+		},
+	})
+	return err
+}
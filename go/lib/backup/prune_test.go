@@ -0,0 +1,153 @@
+package backup
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+
+	"local/backup/lib/logging"
+	"local/backup/lib/s3_helpers"
+)
+
+func TestPrune_TwoPhases(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+	config.SizeThreshold = 1000
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "subdir-1/c.txt"), 2000))
+
+	cfg := GetMinioConfig(minioUrl)
+	client := s3.NewFromConfig(*cfg)
+	backup := func() {
+		must(BackupFiles(
+			context.Background(),
+			logger,
+			cfg,
+			config.DBFile,
+			testBaseDir,
+			config.Bucket,
+			config.S3Prefix,
+			config.BackupName,
+			config.SizeThreshold,
+			BackupOptions{},
+		))
+	}
+	backup()
+
+	// Seed three unreferenced objects. A later backup will write one of them for real, and another
+	// is rewritten without being referenced.
+	staleKey := config.FullS3Prefix + "/stale/_files.tar.gz"
+	reusedKey := config.FullS3Prefix + "/big.txt.tar.gz"
+	rewrittenKey := config.FullS3Prefix + "/rewritten/_files.tar.gz"
+	for _, key := range []string{staleKey, reusedKey, rewrittenKey} {
+		_, err := client.PutObject(context.TODO(), &s3.PutObjectInput{
+			Bucket: aws.String(config.Bucket),
+			Key:    aws.String(key),
+			Body:   strings.NewReader("orphan"),
+		})
+		must(err)
+	}
+
+	report, err := Prune(logger, cfg, config.DBFile, config.Bucket, config.S3Prefix, config.BackupName, PruneOptions{})
+	must(err)
+	assert.ElementsMatch(t, []string{staleKey, reusedKey, rewrittenKey}, report.Marked)
+	assert.Empty(t, report.Deleted)
+	exists, err := s3_helpers.ObjectExists(client, config.Bucket, staleKey)
+	must(err)
+	assert.True(t, exists)
+
+	// The second phase refuses to run before MinAge, which has a default, has passed.
+	_, err = Prune(logger, cfg, config.DBFile, config.Bucket, config.S3Prefix, config.BackupName, PruneOptions{Confirm: true})
+	assert.Error(t, err)
+	_, err = Prune(logger, cfg, config.DBFile, config.Bucket, config.S3Prefix, config.BackupName, PruneOptions{Confirm: true, MinAge: time.Hour})
+	assert.Error(t, err)
+
+	// Between the phases, a backup starts referencing one of the marked objects, and another is
+	// rewritten.
+	must(createTestFile(filepath.Join(testBaseDir, "big.txt"), 2000))
+	backup()
+	must(s3_helpers.UploadBytes(client, config.Bucket, rewrittenKey, []byte("rewritten")))
+
+	// Without Confirm, the second phase only reports what it would delete.
+	report, err = Prune(logger, cfg, config.DBFile, config.Bucket, config.S3Prefix, config.BackupName, PruneOptions{MinAge: time.Nanosecond})
+	must(err)
+	assert.Equal(t, []string{staleKey}, report.Marked)
+	assert.Empty(t, report.Deleted)
+	exists, err = s3_helpers.ObjectExists(client, config.Bucket, staleKey)
+	must(err)
+	assert.True(t, exists)
+
+	report, err = Prune(logger, cfg, config.DBFile, config.Bucket, config.S3Prefix, config.BackupName, PruneOptions{Confirm: true, MinAge: time.Nanosecond})
+	must(err)
+	assert.Equal(t, []string{staleKey}, report.Deleted)
+	assert.ElementsMatch(t, []string{reusedKey, rewrittenKey}, report.Spared)
+
+	exists, err = s3_helpers.ObjectExists(client, config.Bucket, staleKey)
+	must(err)
+	assert.False(t, exists)
+	for _, key := range []string{reusedKey, rewrittenKey} {
+		exists, err = s3_helpers.ObjectExists(client, config.Bucket, key)
+		must(err)
+		assert.True(t, exists)
+	}
+	exists, err = s3_helpers.ObjectExists(client, config.Bucket, pruneIntentKey(config.S3Prefix, config.BackupName))
+	must(err)
+	assert.False(t, exists)
+	// The rewritten object is still orphaned, it's just left for the next prune.
+	must(deleteObject(client, config.Bucket, rewrittenKey))
+	assertBatchCount(t, config, 3)
+	config.LeaveBucketContents = true
+	roundTripTest(config, t)
+}
+
+func TestPrune_Abort(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	must(createTestFile(filepath.Join(config.TestBaseDir, "a.txt"), 5))
+
+	cfg := GetMinioConfig(minioUrl)
+	client := s3.NewFromConfig(*cfg)
+	must(BackupFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		config.TestBaseDir,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		config.SizeThreshold,
+		BackupOptions{},
+	))
+	staleKey := config.FullS3Prefix + "/stale/_files.tar.gz"
+	must(s3_helpers.UploadBytes(client, config.Bucket, staleKey, []byte("orphan")))
+
+	report, err := Prune(logger, cfg, config.DBFile, config.Bucket, config.S3Prefix, config.BackupName, PruneOptions{})
+	must(err)
+	assert.Equal(t, []string{staleKey}, report.Marked)
+	_, err = Prune(logger, cfg, config.DBFile, config.Bucket, config.S3Prefix, config.BackupName, PruneOptions{Abort: true})
+	must(err)
+
+	// After aborting, the next run starts over with the first phase.
+	report, err = Prune(logger, cfg, config.DBFile, config.Bucket, config.S3Prefix, config.BackupName, PruneOptions{})
+	must(err)
+	assert.Equal(t, []string{staleKey}, report.Marked)
+	assert.Empty(t, report.Deleted)
+	exists, err := s3_helpers.ObjectExists(client, config.Bucket, staleKey)
+	must(err)
+	assert.True(t, exists)
+}
@@ -0,0 +1,124 @@
+package backup
+
+import (
+	"fmt"
+	"time"
+)
+
+// Every file that fails to back up is recorded in the db, with the modtime it had at the time. If
+// it keeps failing without being modified, e.g. because it's a device node or keeps vanishing, it's
+// quarantined once it reaches BackupOptions.QuarantineAfter failures: later backups skip it and
+// report it, rather than failing on it every time. Modifying the file lifts the quarantine, and
+// backing it up successfully clears its record.
+
+// fileError is returned when a particular file couldn't be added to an archive.
+type fileError struct {
+	// Relative to the backup root.
+	Path string
+	Err  error
+}
+
+func (e *fileError) Error() string {
+	return fmt.Sprintf("failed to add file %q to archive: %v", e.Path, e.Err)
+}
+
+func (e *fileError) Unwrap() error {
+	return e.Err
+}
+
+// FileFailure describes a file that has failed to back up.
+type FileFailure struct {
+	Path string
+	// The file's modtime when it last failed.
+	ModTime time.Time
+	// How many times in a row it has failed with that modtime.
+	Count     int
+	LastError string
+}
+
+// RecordFailure counts a failure to back up the file, and returns how many times in a row it has
+// failed. The count starts over if the file has been modified since its last failure.
+func (db *DB) RecordFailure(path string, modTime time.Time, failure error) (int, error) {
+	_, err := db.db.Exec(`
+		INSERT INTO failures (path, mod_time, count, last_error)
+		VALUES (?, ?, 1, ?)
+		ON CONFLICT (path) DO UPDATE SET
+			count = CASE WHEN mod_time = excluded.mod_time THEN count + 1 ELSE 1 END,
+			mod_time = excluded.mod_time,
+			last_error = excluded.last_error
+	`, path, modTime.UnixMilli(), failure.Error())
+	if err != nil {
+		return 0, err
+	}
+	var count int
+	err = db.db.QueryRow(`SELECT count FROM failures WHERE path = ?`, path).Scan(&count)
+	return count, err
+}
+
+// ClearFailures forgets any failures of the given files, once they've been backed up.
+func (db *DB) ClearFailures(paths []string) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(`DELETE FROM failures WHERE path = ?`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, path := range paths {
+		if _, err := stmt.Exec(path); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to clear failures of file %q: %v", path, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// GetFailures returns every file that has failed to back up, by path.
+func (db *DB) GetFailures() (map[string]*FileFailure, error) {
+	rows, err := db.db.Query(`SELECT path, mod_time, count, last_error FROM failures`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	failures := make(map[string]*FileFailure)
+	for rows.Next() {
+		var f FileFailure
+		var modTimeMS int64
+		if err := rows.Scan(&f.Path, &modTimeMS, &f.Count, &f.LastError); err != nil {
+			return nil, err
+		}
+		f.ModTime = time.UnixMilli(modTimeMS)
+		failures[f.Path] = &f
+	}
+	return failures, rows.Err()
+}
+
+// quarantinedFiles returns the files that have failed at least threshold times, or nothing if the
+// threshold isn't positive.
+func quarantinedFiles(db *DB, threshold int) (map[string]*FileFailure, error) {
+	if threshold <= 0 {
+		return nil, nil
+	}
+	failures, err := db.GetFailures()
+	if err != nil {
+		return nil, fmt.Errorf("error loading failed files from db: %v", err)
+	}
+	quarantined := make(map[string]*FileFailure)
+	for path, f := range failures {
+		if f.Count >= threshold {
+			quarantined[path] = f
+		}
+	}
+	return quarantined, nil
+}
+
+// isQuarantined reports whether a file with the given modtime is still quarantined.
+func isQuarantined(quarantined map[string]*FileFailure, relPath string, modTime time.Time) bool {
+	f, ok := quarantined[relPath]
+	return ok && modTimesEqual(f.ModTime, modTime)
+}
@@ -0,0 +1,106 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"local/backup/lib/logging"
+)
+
+func TestBackupFiles_QuarantinesFailingFile(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+
+	// Batches are backed up in path order, so this isn't uploaded until the bad file is out of the
+	// way.
+	must(createTestFile(filepath.Join(testBaseDir, "c.txt"), 5))
+	// A dangling symlink can be scanned, but not opened.
+	badFile := filepath.Join(testBaseDir, "bad.txt")
+	must(os.Symlink(filepath.Join(testBaseDir, "missing"), badFile))
+
+	backup := func() (*Report, error) {
+		return backupFiles(
+			context.Background(),
+			logger,
+			GetMinioConfig(minioUrl),
+			config.DBFile,
+			testBaseDir,
+			config.Bucket,
+			config.S3Prefix,
+			config.BackupName,
+			config.SizeThreshold,
+			BackupOptions{QuarantineAfter: 2},
+		)
+	}
+
+	// The file blocks the backup until it has failed enough times.
+	for i := 0; i < 2; i++ {
+		_, err := backup()
+		assert.ErrorContains(t, err, "bad.txt")
+	}
+
+	report, err := backup()
+	must(err)
+	assert.Equal(t, []string{"bad.txt"}, report.FilesQuarantined)
+	assert.Equal(t, []string{"c.txt"}, report.FilesAdded)
+	assert.Equal(t, 1, report.BatchesWritten)
+
+	// Replacing the file lifts the quarantine, and starts the count over.
+	time.Sleep(10 * time.Millisecond)
+	must(os.Remove(badFile))
+	must(os.Symlink(filepath.Join(testBaseDir, "missing-2"), badFile))
+	_, err = backup()
+	assert.ErrorContains(t, err, "bad.txt")
+
+	// Once it's backed up, its failures are forgotten.
+	must(os.Remove(badFile))
+	must(createTestFile(badFile, 5))
+	report, err = backup()
+	must(err)
+	assert.Empty(t, report.FilesQuarantined)
+	db, err := NewDB(config.DBFile)
+	must(err)
+	defer db.Close()
+	failures, err := db.GetFailures()
+	must(err)
+	assert.Empty(t, failures)
+}
+
+func TestDB_RecordFailure(t *testing.T) {
+	db := newTestDB(t)
+	modTime := time.Now()
+	failure := os.ErrNotExist
+
+	count, err := db.RecordFailure("a.txt", modTime, failure)
+	must(err)
+	assert.Equal(t, 1, count)
+	count, err = db.RecordFailure("a.txt", modTime, failure)
+	must(err)
+	assert.Equal(t, 2, count)
+	// A modified file starts over.
+	count, err = db.RecordFailure("a.txt", modTime.Add(time.Second), failure)
+	must(err)
+	assert.Equal(t, 1, count)
+
+	quarantined, err := quarantinedFiles(db, 1)
+	must(err)
+	assert.True(t, isQuarantined(quarantined, "a.txt", modTime.Add(time.Second)))
+	assert.False(t, isQuarantined(quarantined, "a.txt", modTime))
+	quarantined, err = quarantinedFiles(db, 2)
+	must(err)
+	assert.Empty(t, quarantined)
+
+	must(db.ClearFailures([]string{"a.txt"}))
+	failures, err := db.GetFailures()
+	must(err)
+	assert.Empty(t, failures)
+}
@@ -0,0 +1,159 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"local/backup/lib/logging"
+	"local/backup/lib/s3_helpers"
+)
+
+type ReconcileOptions struct {
+	// If true, ignores the remote db and rebuilds the local db by reading the headers of every
+	// archive in the backup.
+	FromArchives bool
+}
+
+// ReconcileDB rebuilds the local db file from what's in storage, so that subsequent backups can be
+// incremental again after the local db is lost or corrupted. By default the remote db is used if it
+// exists, falling back to scanning the archives.
+func ReconcileDB(
+	logger logging.Logger,
+	cfg *aws.Config,
+	dbFile string,
+	bucket string,
+	prefixBase string,
+	name string,
+	options ReconcileOptions,
+) error {
+	client := s3.NewFromConfig(*cfg)
+
+	if !options.FromArchives {
+		remoteDBFile, err := downloadDB(logger, client, bucket, prefixBase, name, filepath.Dir(dbFile))
+		if err == nil {
+			if remoteDBFile != dbFile {
+				logger.Verbosef("renaming remote db file %q to %q", remoteDBFile, dbFile)
+				if err := os.Rename(remoteDBFile, dbFile); err != nil {
+					return fmt.Errorf("failed to move remote db into place: %v", err)
+				}
+			}
+			logger.Infof("restored local db from remote db")
+			return nil
+		}
+		if !errors.Is(err, s3_helpers.ErrNotFound) {
+			return fmt.Errorf("failed to download remote db file: %v", err)
+		}
+		logger.Infof("remote db not found, rebuilding local db from archives")
+	}
+
+	// Build the new db next to the old one and swap it in at the end, so a failure part-way through
+	// doesn't leave a half-built db behind.
+	tmpDBFile := dbFile + ".reconcile"
+	os.Remove(tmpDBFile)
+	db, err := NewDB(tmpDBFile)
+	if err != nil {
+		return fmt.Errorf("error creating db: %v", err)
+	}
+	defer os.Remove(tmpDBFile)
+
+	keyPrefix := s3Key(prefixBase, name) + "/"
+	paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(keyPrefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			db.Close()
+			return fmt.Errorf("failed to list objects: %v", err)
+		}
+		for _, object := range page.Contents {
+			key := aws.ToString(object.Key)
+			if err := reconcileArchive(logger, client, db, bucket, key, filepath.FromSlash(strings.TrimPrefix(key, keyPrefix))); err != nil {
+				db.Close()
+				return fmt.Errorf("failed to reconcile archive %q: %v", key, err)
+			}
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpDBFile, dbFile); err != nil {
+		return fmt.Errorf("failed to move rebuilt db into place: %v", err)
+	}
+	return nil
+}
+
+// reconcileArchive reads every entry of the archive at the given key and marks it in the db. The
+// archive name is the key relative to the backup's prefix.
+func reconcileArchive(
+	logger logging.Logger,
+	client s3_helpers.Client,
+	db *DB,
+	bucket string,
+	key string,
+	archiveName string,
+) error {
+	// Work out which batch the archive represents, and the directory its entries are relative to.
+	meta, ok := parseArchiveName(filepath.ToSlash(archiveName))
+	if !ok {
+		logger.Infof("skipping unrecognized object %q", key)
+		return nil
+	}
+	batch := filepath.FromSlash(meta.Path)
+	batchDir := filepath.FromSlash(archiveEntriesDir(meta))
+	logger.Verbosef("reconciling batch %q from %q", batch, key)
+
+	output, err := client.GetObject(context.TODO(), &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return err
+	}
+	defer output.Body.Close()
+
+	gzr, err := gzip.NewReader(output.Body)
+	if err != nil {
+		return err
+	}
+	defer gzr.Close()
+
+	tr := tar.NewReader(gzr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		// Hash the contents as we stream through them, the same way getFileHash does for local files.
+		h := md5.New()
+		if _, err := io.Copy(h, tr); err != nil {
+			return err
+		}
+		path := filepath.Join(batchDir, header.Name)
+		logger.Debugf("  %s", displayPath(path))
+		err = db.MarkFile(path, header.ModTime, fmt.Sprintf("%x", h.Sum(nil)), batch)
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"local/backup/lib/logging"
+)
+
+func TestReconcileDB_FromArchives(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "b.txt"), 9))
+	must(createTestFile(filepath.Join(testBaseDir, "c.txt"), 25))
+	must(createTestFile(filepath.Join(testBaseDir, "subdir-1/four/five/six/b.txt"), 9))
+	must(createTestFile(filepath.Join(testBaseDir, "subdir-1/four/five/six/big.txt"), 2000))
+	must(createTestFile(filepath.Join(testBaseDir, "subdir-2/one/two/three/a.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "subdir-2/seven/eight/nine/c.txt"), 25))
+	config.SizeThreshold = 1000
+
+	cfg := GetMinioConfig(minioUrl)
+	must(BackupFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		testBaseDir,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		config.SizeThreshold,
+		BackupOptions{},
+	))
+
+	db, err := NewDB(config.DBFile)
+	must(err)
+	expectedFiles, err := db.GetAllFiles()
+	must(err)
+	must(db.Close())
+
+	// Lose the local db, then rebuild it from the archives in storage.
+	must(os.Remove(config.DBFile))
+	must(ReconcileDB(
+		logger,
+		cfg,
+		config.DBFile,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		ReconcileOptions{FromArchives: true},
+	))
+
+	db, err = NewDB(config.DBFile)
+	must(err)
+	actualFiles, err := db.GetAllFiles()
+	must(err)
+	must(db.Close())
+
+	sortFiles := func(files []*FileInfo) {
+		sort.Slice(files, func(i, j int) bool {
+			return files[i].Path < files[j].Path
+		})
+	}
+	sortFiles(expectedFiles)
+	sortFiles(actualFiles)
+	assert.Equal(t, expectedFiles, actualFiles)
+
+	// The next backup should have nothing to upload.
+	report, err := Status(
+		logger,
+		cfg,
+		config.DBFile,
+		testBaseDir,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		config.SizeThreshold,
+		StatusOptions{CompareRemote: true},
+	)
+	must(err)
+	assert.Empty(t, report.NewFiles)
+	assert.Empty(t, report.ChangedFiles)
+	assert.Empty(t, report.DeletedFiles)
+	assert.Empty(t, report.BatchesToWrite)
+	assert.Empty(t, report.BatchesToDelete)
+	assert.Empty(t, report.RemoteChanges)
+}
@@ -0,0 +1,186 @@
+package backup
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+
+	"local/backup/lib/logging"
+	"local/backup/lib/s3_helpers"
+)
+
+// RecoverFile recovers the file at relPath, relative to the backup root, to dest, or into dest if
+// it's an existing directory. Only the object holding the file is downloaded, and only the file is
+// extracted from it. The file is looked up in the remote db, which is downloaded to a temporary file,
+// so the local db isn't needed or updated. Of the options, only the ones about where to recover from
+// (Snapshot, DBVersion, SecondaryBucket and Storage), TempDir, Conflict and the extraction limits
+// apply.
+func RecoverFile(
+	ctx context.Context,
+	logger logging.Logger,
+	cfg *aws.Config,
+	bucket string,
+	prefixBase string,
+	name string,
+	relPath string,
+	dest string,
+	options RecoveryOptions,
+) error {
+	if err := options.Validate(); err != nil {
+		return fmt.Errorf("invalid options: %v", err)
+	}
+	relPath = path.Clean(filepath.ToSlash(relPath))
+	if info, err := os.Stat(dest); err == nil && info.IsDir() {
+		dest = filepath.Join(dest, path.Base(relPath))
+	}
+	options.extractLimit = newExtractLimit(options.MaxExtractedFileBytes, options.MaxExtractedBytes)
+
+	client, err := withMirror(logger, storageClient(cfg, options.Storage), bucket, options.SecondaryBucket, "")
+	if err != nil {
+		return err
+	}
+	snapshotID, err := recoverySnapshot(client, bucket, prefixBase, name, options.Snapshot)
+	if err != nil {
+		return err
+	}
+	if snapshotID != "" {
+		logger.Infof("recovering from snapshot %s", snapshotID)
+		prefixBase, name = snapshotLocation(prefixBase, name, snapshotID)
+	}
+	prefix := s3Key(prefixBase, name)
+
+	tmpDir, err := os.MkdirTemp(options.TempDir, "dbackup-recover-file-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	remoteDBKey := dbKey(prefixBase, name)
+	if options.DBVersion != 0 {
+		remoteDBKey = dbVersionKey(prefixBase, name, options.DBVersion)
+	}
+	dbFile, err := downloadDBKey(logger, client, bucket, remoteDBKey, name, tmpDir)
+	if err != nil {
+		return fmt.Errorf("failed to download remote db file: %v", err)
+	}
+	db, err := NewDB(dbFile)
+	if err != nil {
+		return fmt.Errorf("error loading db: %v", err)
+	}
+	defer db.Close()
+
+	file, err := db.GetFileInfo(relPath)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("file %q isn't in the backup", relPath)
+	}
+	if err != nil {
+		return fmt.Errorf("error looking up file %q: %v", relPath, err)
+	}
+	write, err := shouldWriteFile(dest, file.ModTime, options.Conflict)
+	if err != nil {
+		return err
+	}
+	if !write {
+		logger.Infof("keeping existing file %q", dest)
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	// Like a full recovery, large files may be stored in chunks or, in a content-addressed backup,
+	// as blobs, rather than in archives.
+	chunked, err := db.GetAllFileChunks()
+	if err != nil {
+		return fmt.Errorf("error loading chunks from db: %v", err)
+	}
+	contentAddressed, err := db.IsContentAddressed()
+	if err != nil {
+		return fmt.Errorf("error reading storage mode from db: %v", err)
+	}
+	isSingleFile := file.Batch == file.Path
+	if chunks, ok := chunked[file.Path]; ok && isSingleFile {
+		logger.Infof("recovering %q from %d chunks to %q", relPath, len(chunks), dest)
+		if err := restoreChunks(client, bucket, prefix, chunks, dest, options.extractLimit); err != nil {
+			return fmt.Errorf("failed to restore %q: %w", dest, err)
+		}
+		return os.Chtimes(dest, file.ModTime, file.ModTime)
+	}
+	if contentAddressed && isSingleFile {
+		key := blobKey(prefix, file.Hash)
+		logger.Infof("recovering %q from blob %q to %q", relPath, key, dest)
+		blobFile := filepath.Join(tmpDir, file.Hash)
+		if err := s3_helpers.DownloadFile(client, bucket, key, blobFile); err != nil {
+			return fmt.Errorf("failed to download blob for %q: %w", relPath, err)
+		}
+		if err := gunzipFile(blobFile, dest, options.extractLimit); err != nil {
+			return fmt.Errorf("failed to restore %q: %w", dest, err)
+		}
+		return os.Chtimes(dest, file.ModTime, file.ModTime)
+	}
+
+	dir, err := archiveDir(db, prefixBase, name)
+	if err != nil {
+		return err
+	}
+	obfuscateKeys, err := db.ObfuscatesKeys()
+	if err != nil {
+		return fmt.Errorf("error reading storage mode from db: %v", err)
+	}
+	batch := BatchMeta{Path: file.Batch, IsSingleFile: isSingleFile}
+	key := batchKey(dir, batch, obfuscateKeys)
+	logger.Infof("recovering %q from %q to %q", relPath, key, dest)
+	archivePath := filepath.Join(tmpDir, "archive"+archiveExtension)
+	if err := s3_helpers.DownloadFile(client, bucket, key, archivePath); err != nil {
+		return fmt.Errorf("failed to download %q: %w", key, err)
+	}
+	checksums, err := db.GetBatchChecksums()
+	if err != nil {
+		return fmt.Errorf("error loading batch checksums from db: %v", err)
+	}
+	if expected, ok := checksums[batch.Path]; ok {
+		checksum, err := getFileHash(archivePath)
+		if err != nil {
+			return err
+		}
+		if checksum != expected {
+			return fmt.Errorf("checksum mismatch for %q: got %s, expected %s", key, checksum, expected)
+		}
+	}
+
+	// Extract just the file, under dest's name. The conflict policy was applied above, so it's
+	// overwritten here.
+	batchDir := archiveEntriesDir(batch)
+	found := false
+	err = unTar(archivePath, filepath.Dir(dest), extractOptions{
+		MapName: func(name string) (string, bool) {
+			if path.Join(batchDir, name) != relPath {
+				return "", false
+			}
+			found = true
+			return filepath.Base(dest), true
+		},
+		Limit: options.extractLimit,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to extract %q from archive %q: %w", relPath, key, err)
+	}
+	if !found {
+		return fmt.Errorf("file %q isn't in archive %q", relPath, key)
+	}
+	// A file that was stored as a hard link to another one in its batch isn't extracted on its own,
+	// so make sure the file really was recovered.
+	hash, err := getFileHash(dest)
+	if err != nil {
+		return fmt.Errorf("failed to check recovered file %q: %v", dest, err)
+	}
+	if hash != file.Hash {
+		return fmt.Errorf("recovered file %q doesn't match the backup: hash %s, expected %s", dest, hash, file.Hash)
+	}
+	return nil
+}
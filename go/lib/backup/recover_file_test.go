@@ -0,0 +1,53 @@
+package backup
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stretchr/testify/assert"
+
+	"local/backup/lib/logging"
+	"local/backup/lib/s3_helpers"
+)
+
+func TestRecoverFile(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	storage := s3_helpers.NewMemoryClient("bucket")
+	testBaseDir := t.TempDir()
+	dbFile := filepath.Join(t.TempDir(), "test-backup.db")
+	cfg := &aws.Config{}
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "big.txt"), 500))
+	must(createTestFile(filepath.Join(testBaseDir, "dir/b.txt"), 10))
+	must(createTestFile(filepath.Join(testBaseDir, "dir/c.txt"), 20))
+	must(BackupFiles(context.Background(), logger, cfg, dbFile, testBaseDir, "bucket", "backups", "test-backup", 100, BackupOptions{
+		Storage: storage,
+	}))
+
+	recoverFile := func(relPath string, dest string) error {
+		return RecoverFile(context.Background(), logger, cfg, "bucket", "backups", "test-backup", relPath, dest, RecoveryOptions{
+			Storage: storage,
+		})
+	}
+
+	// A file from a grouped batch, to a path of its own.
+	dest := filepath.Join(t.TempDir(), "elsewhere", "renamed.txt")
+	must(recoverFile("dir/c.txt", dest))
+	assert.NoError(t, compareFiles(filepath.Join(testBaseDir, "dir/c.txt"), dest))
+	assert.NoDirExists(t, filepath.Join(filepath.Dir(dest), "dir"))
+	assert.NoFileExists(t, filepath.Join(filepath.Dir(dest), "b.txt"))
+
+	// Files from the root's batch and from single-file batches, into a directory.
+	destDir := t.TempDir()
+	must(recoverFile("a.txt", destDir))
+	must(recoverFile("big.txt", destDir))
+	assert.NoError(t, compareFiles(filepath.Join(testBaseDir, "a.txt"), filepath.Join(destDir, "a.txt")))
+	assert.NoError(t, compareFiles(filepath.Join(testBaseDir, "big.txt"), filepath.Join(destDir, "big.txt")))
+
+	assert.ErrorContains(t, recoverFile("dir/missing.txt", destDir), "isn't in the backup")
+}
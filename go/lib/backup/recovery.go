@@ -2,25 +2,157 @@ package backup
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"local/backup/lib/logging"
 	"local/backup/lib/s3_helpers"
+	"local/backup/lib/util"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
 type RecoveryOptions struct {
 	Force bool
+	// The snapshot to recover, if the backup was made with snapshots. Defaults to the latest one.
+	Snapshot string
+
+	// Objects in an archival storage class (e.g. GLACIER) need to be restored before they can be
+	// downloaded. These control the restore requests that recovery makes for them.
+	RestoreDays int32
+	RestoreTier types.Tier
+	// If true, waits for restores to complete, checking every RestorePollInterval. Otherwise the
+	// restores are requested and recovery fails, to be run again later.
+	WaitForRestore      bool
+	RestorePollInterval time.Duration
+
+	// Rewrite the paths of recovered files, e.g. to recover "subdir-1/..." into the root. Paths are
+	// relative to the backup root. The first StripComponents elements are removed (files with no
+	// elements left are skipped), then a leading ReplacePrefix is replaced with WithPrefix.
+	StripComponents int
+	ReplacePrefix   string
+	WithPrefix      string
+
+	// What to do when a file being recovered already exists locally. Defaults to overwriting it.
+	Conflict ConflictPolicy
+
+	// Max number of archives to download and extract at once. Defaults to
+	// defaultRecoveryConcurrency.
+	Concurrency int
+
+	// If true, re-hashes every recovered file afterwards and returns a *VerificationError if any of
+	// them don't match the db.
+	Verify bool
+	// If true, checks that every object in the backup can be downloaded and decompressed, without
+	// writing any files, and returns a *VerificationError if any of them can't. With Verify, the
+	// files' contents are also checked against the db. See verify.go.
+	VerifyOnly bool
+
+	// If set, receives structured events as the recovery progresses. See observer.go.
+	Observer Observer
+
+	// Where to put temporary files, such as downloaded archives before they're extracted. Defaults to
+	// os.TempDir().
+	TempDir string
+
+	// If true, recovers a backup with several roots to the directories they were backed up from,
+	// rather than under the recovery root, which is ignored. See roots.go.
+	OriginalLocations bool
+
+	// If true, recovers into a staging directory, which replaces the recovery root only once the
+	// whole recovery has succeeded, so a failed recovery leaves the recovery root untouched. See
+	// staging.go.
+	Staging bool
+
+	// If set, objects that can't be downloaded from the bucket are downloaded from this one instead.
+	// See mirror.go.
+	SecondaryBucket string
+
+	// If set, a line recording the recovery and its outcome is appended to this file. See audit.go.
+	AuditLog string
+
+	// If set, the backup is recovered from here instead of from S3. See BackupOptions.Storage.
+	Storage s3_helpers.Client
+
+	// If true, the archives that are downloaded are left in a temporary directory in TempDir, which
+	// is logged, instead of being deleted once they've been extracted. Useful for looking into a
+	// recovery that went wrong.
+	KeepArchives bool
+
+	// If true, objects that the db refers to but that are missing from the bucket, e.g. after a
+	// manual deletion or a partial gc, are reported in Report.MissingObjects and the rest of the
+	// backup is still recovered. Otherwise recovery fails with a *MissingObjectsError. With Verify,
+	// the files they held are reported as mismatches.
+	BestEffort bool
+
+	// If positive, recovery fails with ErrExtractLimitExceeded once it would write more than this
+	// many bytes in total, or a single file bigger than MaxExtractedFileBytes, to protect the host
+	// from archives that decompress to far more than they should, e.g. when recovering from a bucket
+	// that others can write to. See extractLimit.
+	MaxExtractedBytes     int64
+	MaxExtractedFileBytes int64
+
+	// If set, recovers from this kept version of the remote db (see db_versions.go) instead of the
+	// latest one, to get the tree back as it was before a later backup. The local db isn't updated.
+	// Archives are replaced in place when their batches are backed up again, so only batches that
+	// haven't changed since can be recovered this way: changed ones fail their checksum check, and
+	// deleted ones are missing. Files added since are left out.
+	DBVersion int64
+
+	// Set by recoverFiles when recovering to the original locations.
+	rootParents map[string]string
+	// Set by runRecovery from MaxExtractedBytes and MaxExtractedFileBytes.
+	extractLimit *extractLimit
 }
 
-// TODO: return errors vs. Fatal-ing
+const defaultRecoveryConcurrency = 4
+
+// recoverySnapshot returns the snapshot to recover: the requested one, or the latest if the backup
+// has snapshots, or "" if it doesn't.
+func recoverySnapshot(client s3_helpers.Client, bucket string, prefixBase string, name string, snapshotID string) (string, error) {
+	if snapshotID != "" {
+		return snapshotID, nil
+	}
+	latest, err := getLatestSnapshot(client, bucket, prefixBase, name)
+	if err != nil && !errors.Is(err, s3_helpers.ErrNotFound) {
+		return "", fmt.Errorf("failed to look up latest snapshot: %v", err)
+	}
+	return latest, nil
+}
+
+// remapPath applies the options' path rewriting to a slash-separated path relative to the backup
+// root. It returns false if the file should be skipped.
+func (o RecoveryOptions) remapPath(relPath string) (string, bool) {
+	if o.StripComponents > 0 {
+		parts := strings.Split(relPath, "/")
+		if len(parts) <= o.StripComponents {
+			return "", false
+		}
+		relPath = strings.Join(parts[o.StripComponents:], "/")
+	}
+	if o.ReplacePrefix != "" && (relPath == o.ReplacePrefix || strings.HasPrefix(relPath, o.ReplacePrefix+"/")) {
+		relPath = path.Join(o.WithPrefix, strings.TrimPrefix(strings.TrimPrefix(relPath, o.ReplacePrefix), "/"))
+	}
+	if o.rootParents != nil {
+		return remapToOriginalRoot(o.rootParents, relPath)
+	}
+	return relPath, true
+}
+
+// RecoverFiles recovers the backup into localRoot. Cancelling ctx, or reaching its deadline, stops
+// the recovery from starting on any more archives, leaving the files recovered so far in place.
 func RecoverFiles(
+	ctx context.Context,
 	logger logging.Logger,
 	cfg *aws.Config,
 	dbFile string,
@@ -30,20 +162,83 @@ func RecoverFiles(
 	localRoot string,
 	options RecoveryOptions,
 ) error {
-	prefix := filepath.Join(prefixBase, name)
+	_, err := recoverFiles(ctx, logger, cfg, dbFile, bucket, prefixBase, name, localRoot, options)
+	return err
+}
 
-	// Create an Amazon S3 service client
-	client := s3.NewFromConfig(*cfg)
+// recoverFiles does the work of RecoverFiles, and reports what it did, including to the audit log.
+// Cancelling ctx stops it from starting on any more archives.
+func recoverFiles(
+	ctx context.Context,
+	logger logging.Logger,
+	cfg *aws.Config,
+	dbFile string,
+	bucket string,
+	prefixBase string,
+	name string,
+	localRoot string,
+	options RecoveryOptions,
+) (*Report, error) {
+	report, err := runRecovery(ctx, logger, cfg, dbFile, bucket, prefixBase, name, localRoot, options)
+	appendAuditLog(logger, options.AuditLog, newAuditEntry("recover", name, report.auditCounts(), err))
+	return report, err
+}
 
+// runRecovery is recoverFiles, apart from writing to the audit log.
+func runRecovery(
+	ctx context.Context,
+	logger logging.Logger,
+	cfg *aws.Config,
+	dbFile string,
+	bucket string,
+	prefixBase string,
+	name string,
+	localRoot string,
+	options RecoveryOptions,
+) (*Report, error) {
+	if err := options.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid options: %v", err)
+	}
+	if options.Staging {
+		return recoverStaged(ctx, logger, cfg, dbFile, bucket, prefixBase, name, localRoot, options)
+	}
+	report := &Report{}
+	options.extractLimit = newExtractLimit(options.MaxExtractedFileBytes, options.MaxExtractedBytes)
+
+	// Create an Amazon S3 service client, unless the backup is stored elsewhere
+	client, err := withMirror(logger, storageClient(cfg, options.Storage), bucket, options.SecondaryBucket, "")
+	if err != nil {
+		return nil, err
+	}
+
+	// If the backup has snapshots, recover the requested one (or the latest).
+	snapshotID, err := recoverySnapshot(client, bucket, prefixBase, name, options.Snapshot)
+	if err != nil {
+		return nil, err
+	}
+	if snapshotID != "" {
+		logger.Infof("recovering snapshot %s", snapshotID)
+		report.SnapshotID = snapshotID
+		prefixBase, name = snapshotLocation(prefixBase, name, snapshotID)
+	}
+
+	prefix := s3Key(prefixBase, name)
 	if len(prefix) == 0 {
-		return fmt.Errorf("S3 key prefix is required")
+		return nil, fmt.Errorf("S3 key prefix is required")
+	}
+
+	if options.VerifyOnly {
+		return report, verifyBackup(ctx, logger, client, bucket, prefixBase, name, options, report)
 	}
 
 	// Download the backup db from S3 and check if any files have changed since the last time we did a
-	// backup or recovery.
-	changes, err := downloadAndCompareDB(logger, client, dbFile, bucket, prefixBase, name)
-	if err != nil {
-		log.Fatalf("error downloading and comparing db: %v", err)
+	// backup or recovery. Snapshots never change once written, so there's nothing to check.
+	var changes []string
+	if snapshotID == "" && options.DBVersion == 0 {
+		changes, err = downloadAndCompareDB(logger, client, dbFile, bucket, prefixBase, name, options.TempDir)
+		if err != nil {
+			return nil, fmt.Errorf("error downloading and comparing db: %v", err)
+		}
 	}
 	if len(changes) > 0 {
 		logger.Infof("files have changed in storage since the last backup or recovery, aborting:")
@@ -51,68 +246,193 @@ func RecoverFiles(
 		if options.Force {
 			logger.Infof("forcing recovery despite changes in storage")
 		} else {
-			return fmt.Errorf("files have changed in storage since the last backup or recovery")
+			return nil, fmt.Errorf("files have changed in storage since the last backup or recovery")
 		}
 	}
 
-	keyPrefix := prefix
-	if !strings.HasSuffix(keyPrefix, "/") {
-		keyPrefix += "/"
+	if options.DBVersion != 0 {
+		// The version is only used for this recovery, so the local db still matches the latest remote
+		// db afterwards.
+		versionDir, err := os.MkdirTemp(options.TempDir, "dbackup-db-version-")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(versionDir)
+		logger.Infof("recovering from db version %d", options.DBVersion)
+		dbFile, err = downloadDBKey(logger, client, bucket, dbVersionKey(prefixBase, name, options.DBVersion), name, versionDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to download db version %d: %v", options.DBVersion, err)
+		}
+	} else {
+		// Download the backup db from S3 so we can compare it to the remote DB next time we do a
+		// recovery.
+		remoteDBFile, err := downloadDB(logger, client, bucket, prefixBase, name, filepath.Dir(dbFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to download remote db file: %v", err)
+		}
+		if remoteDBFile != dbFile {
+			logger.Verbosef("renaming remote db file %q to %q", remoteDBFile, dbFile)
+			os.Rename(remoteDBFile, dbFile)
+		}
+		logger.Verbosef("downloaded remote db file to %q", dbFile)
 	}
 
-	logger.Verbosef("> Recovering files from %s", keyPrefix)
-
-	// Download the backup db from S3 so we can compare it to the remote DB next time we do a recovery.
-	remoteDBFile, err := downloadDB(logger, client, bucket, prefixBase, name, filepath.Dir(dbFile))
+	db, err := NewDB(dbFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading db: %v", err)
+	}
+	defer db.Close()
+	if options.OriginalLocations {
+		localRoot, options.rootParents, err = originalRootParents(db)
+		if err != nil {
+			return nil, err
+		}
+		logger.Infof("recovering roots to their original locations")
+	}
+	contentAddressed, err := db.IsContentAddressed()
+	if err != nil {
+		return nil, fmt.Errorf("error reading storage mode from db: %v", err)
+	}
+	var archiveNames map[string]string
+	obfuscateKeys, err := db.ObfuscatesKeys()
+	if err != nil {
+		return nil, fmt.Errorf("error reading storage mode from db: %v", err)
+	}
+	if obfuscateKeys {
+		archiveNames, err = archiveNamesByKey(db, prefix)
+		if err != nil {
+			return nil, err
+		}
+	}
+	checksums, err := db.GetBatchChecksums()
+	if err != nil {
+		return nil, fmt.Errorf("error loading batch checksums from db: %v", err)
+	}
+	// Only recover the batches the db knows about. The bucket may also hold archives that are no
+	// longer in the backup, and that GC hasn't removed yet, e.g. from a backup with NoDelete, and an
+	// older db doesn't know about the batches that were added since.
+	batches, err := db.GetExistingBatches(false)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching existing batches from db: %v", err)
+	}
+	dbBatches := make(map[string]bool)
+	for _, batch := range batches {
+		dbBatches[batchArchiveName(batch)] = true
+	}
+	dir, err := archiveDir(db, prefixBase, name)
 	if err != nil {
-		return fmt.Errorf("failed to download remote db file: %v", err)
+		return nil, err
 	}
-	if remoteDBFile != dbFile {
-		logger.Verbosef("renaming remote db file %q to %q", remoteDBFile, dbFile)
-		os.Rename(remoteDBFile, dbFile)
+	keyPrefix := dir
+	if !strings.HasSuffix(keyPrefix, "/") {
+		keyPrefix += "/"
 	}
-	logger.Verbosef("downloaded remote db file to %q", dbFile)
 
-	// Get the first page of results for ListObjectsV2 for a bucket
-	output, err := client.ListObjectsV2(context.TODO(), &s3.ListObjectsV2Input{
+	logger.Verbosef("> Recovering files from %s", keyPrefix)
+
+	var objects []types.Object
+	paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
 		Bucket: aws.String(bucket),
 		// Return only files with the given prefix
 		Prefix: aws.String(keyPrefix),
 	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects: %v", err)
+		}
+		objects = append(objects, page.Contents...)
+	}
+
+	// Make sure every archive the db refers to is there before recovering any of them.
+	missing, err := missingArchives(logger, db, dir, objects)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	if len(missing) > 0 && !options.BestEffort {
+		return report, &MissingObjectsError{Keys: missing}
+	}
+	report.MissingObjects = append(report.MissingObjects, missing...)
 
-	// TODO: integrity check between files and db?
 	// TODO: only download changes?
 
-	for _, object := range output.Contents {
-		log.Printf("key=%s size=%d", aws.ToString(object.Key), object.Size)
-		log.Printf("downloading...")
-		localPath := filepath.Join(localRoot, strings.TrimPrefix(*object.Key, keyPrefix))
-		if err := s3_helpers.DownloadFile(client, bucket, *object.Key, localPath); err != nil {
-			log.Fatalf("%s", err)
-		}
-		log.Printf("downloaded %q to local file %q", *object.Key, localPath)
-		if filepath.Base(localPath) == "_files.tar.gz" {
-			log.Printf("extracting files from archive %q", localPath)
-			err := unTar(localPath, filepath.Dir(localPath))
-			if err != nil {
-				log.Fatalf("failed to extract files from archive %q: %v", localPath, err)
+	tmpDir, err := os.MkdirTemp(options.TempDir, "dbackup-recover-")
+	if err != nil {
+		return nil, err
+	}
+	if options.KeepArchives {
+		logger.Infof("keeping downloaded archives in %q", tmpDir)
+	} else {
+		defer os.RemoveAll(tmpDir)
+	}
+
+	var pendingRestores []string
+	var keys []string
+	for _, object := range objects {
+		log.Printf("key=%q size=%d", aws.ToString(object.Key), object.Size)
+		if contentAddressed && isBlobKey(prefix, aws.ToString(object.Key)) {
+			// Blobs are restored from the db below.
+			continue
+		}
+		if isChunkKey(prefix, aws.ToString(object.Key)) {
+			// So are chunks.
+			continue
+		}
+		if isStreamKey(prefix, aws.ToString(object.Key)) {
+			// Streams aren't part of the tree. See RecoverStream.
+			continue
+		}
+		if obfuscateKeys {
+			if _, ok := archiveNames[aws.ToString(object.Key)]; !ok {
+				logger.Infof("skipping object %q, it isn't in the db", aws.ToString(object.Key))
+				continue
 			}
-			// Delete the archive
-			log.Printf("deleting archive %q", localPath)
-			os.Remove(localPath)
-		} else {
-			log.Printf("extracting single file %q", localPath)
-			//_, err := decompressFile(localPath, filepath.Dir(localPath))
-			err := unTar(localPath, filepath.Dir(localPath))
+		}
+		archiveName := strings.TrimPrefix(aws.ToString(object.Key), keyPrefix)
+		if name, ok := archiveNames[aws.ToString(object.Key)]; ok {
+			archiveName = name
+		}
+		if !dbBatches[archiveName] {
+			logger.Verbosef("skipping object %q, it isn't in the db", aws.ToString(object.Key))
+			continue
+		}
+		if isArchivedStorageClass(string(object.StorageClass)) {
+			available, err := ensureObjectRestored(logger, client, bucket, *object.Key, options)
 			if err != nil {
-				log.Fatalf("failed to decompress file %q: %v", localPath, err)
+				return nil, err
+			}
+			if !available {
+				pendingRestores = append(pendingRestores, *object.Key)
+				continue
 			}
-			log.Printf("deleting compressed file %q", localPath)
-			os.Remove(localPath)
 		}
+		keys = append(keys, *object.Key)
+	}
+	recovered, err := recoverArchives(ctx, client, bucket, keys, keyPrefix, archiveNames, localRoot, tmpDir, checksums, options)
+	report.ArchivesRecovered = recovered
+	if err != nil {
+		return report, err
+	}
+	if err := ctx.Err(); err != nil {
+		return report, fmt.Errorf("recovery interrupted after %d of %d archives: %w", recovered, len(keys), err)
+	}
+
+	if contentAddressed {
+		missing, err := recoverBlobs(logger, client, db, bucket, prefix, localRoot, options)
+		report.MissingObjects = append(report.MissingObjects, missing...)
+		if err != nil {
+			return report, err
+		}
+	}
+	missing, err = recoverChunkedFiles(logger, client, db, bucket, prefix, localRoot, options)
+	report.MissingObjects = append(report.MissingObjects, missing...)
+	if err != nil {
+		return report, err
+	}
+	// Writing the files updated their directories' modtimes, so they're only set once everything
+	// has been extracted.
+	if err := restoreDirModTimes(logger, db, localRoot, options); err != nil {
+		return report, err
 	}
 
 	// Go through the db and update all the files' modtimes to match the remote DB.
@@ -120,5 +440,174 @@ func RecoverFiles(
 
 	log.Println("< Recovering files")
 
+	if len(pendingRestores) > 0 {
+		logger.Infof("objects waiting to be restored from archival storage:")
+		for _, key := range pendingRestores {
+			logger.Infof("  %s", displayPath(key))
+		}
+		report.PendingRestores = pendingRestores
+		return report, fmt.Errorf("restore requested for %d archived object(s), run recovery again once they're available", len(pendingRestores))
+	}
+
+	if len(report.MissingObjects) > 0 {
+		logger.Infof("objects missing from the bucket, their files weren't recovered:")
+		for _, key := range report.MissingObjects {
+			logger.Infof("  %s", displayPath(key))
+		}
+	}
+
+	if options.Verify {
+		if err := verifyRecovery(logger, db, localRoot, options); err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
+
+// MissingObjectsError is returned by RecoverFiles when objects that the db refers to aren't in the
+// bucket, e.g. because they were deleted by hand, unless RecoveryOptions.BestEffort is set.
+type MissingObjectsError struct {
+	Keys []string
+}
+
+func (e *MissingObjectsError) Error() string {
+	return fmt.Sprintf("%d object(s) are missing from the bucket: %s", len(e.Keys), strings.Join(util.Map(e.Keys, displayPath), ", "))
+}
+
+// missingArchives returns the keys of the archives that the db refers to, but that aren't among the
+// listed objects, and logs which batch each of them holds.
+func missingArchives(logger logging.Logger, db *DB, dir string, objects []types.Object) ([]string, error) {
+	archives, err := expectedArchives(db, dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, object := range objects {
+		delete(archives, aws.ToString(object.Key))
+	}
+	var missing []string
+	for key, batchPath := range archives {
+		logger.Infof("object %q, holding %q, is missing from the bucket", key, displayPath(batchPath))
+		missing = append(missing, key)
+	}
+	sort.Strings(missing)
+	return missing, nil
+}
+
+// recoverArchives recovers the given archives using a pool of workers, and returns how many were
+// recovered. Every batch extracts to different files, so the archives can be extracted in any
+// order. Cancelling ctx stops it from starting on any more archives.
+func recoverArchives(
+	ctx context.Context,
+	client s3_helpers.Client,
+	bucket string,
+	keys []string,
+	keyPrefix string,
+	// Archive names by key, for backups with obfuscated keys.
+	archiveNames map[string]string,
+	localRoot string,
+	tmpDir string,
+	// Expected object checksums, by batch.
+	checksums map[string]string,
+	options RecoveryOptions,
+) (int, error) {
+	concurrency := options.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultRecoveryConcurrency
+	}
+
+	observer := observerOrNoop(options.Observer)
+	var mu sync.Mutex
+	var errs []error
+	recovered := 0
+	var wg sync.WaitGroup
+	jobs := make(chan string)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range jobs {
+				err := recoverArchive(client, bucket, key, keyPrefix, archiveNames, localRoot, tmpDir, checksums, options)
+				observer.ArchiveRecovered(ArchiveEvent{Key: key}, err)
+				mu.Lock()
+				if err != nil {
+					errs = append(errs, err)
+				} else {
+					recovered++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			break
+		}
+		jobs <- key
+	}
+	close(jobs)
+	wg.Wait()
+	return recovered, errors.Join(errs...)
+}
+
+// recoverArchive downloads a batch's archive and extracts its files under localRoot.
+func recoverArchive(
+	client s3_helpers.Client,
+	bucket string,
+	key string,
+	keyPrefix string,
+	archiveNames map[string]string,
+	localRoot string,
+	tmpDir string,
+	checksums map[string]string,
+	options RecoveryOptions,
+) error {
+	relKey := strings.TrimPrefix(key, keyPrefix)
+	if name, ok := archiveNames[key]; ok {
+		relKey = name
+	}
+	archivePath := filepath.Join(tmpDir, filepath.FromSlash(relKey))
+	log.Printf("downloading...")
+	if err := s3_helpers.DownloadFile(client, bucket, key, archivePath); err != nil {
+		return err
+	}
+	if !options.KeepArchives {
+		defer os.Remove(archivePath)
+	}
+	log.Printf("downloaded %q to local file %q", key, archivePath)
+
+	batchDir, batch := archiveBatch(relKey)
+	if expected, ok := checksums[batch]; ok {
+		checksum, err := getFileHash(archivePath)
+		if err != nil {
+			return err
+		}
+		if checksum != expected {
+			return fmt.Errorf("checksum mismatch for %q: got %s, expected %s", key, checksum, expected)
+		}
+	}
+	log.Printf("extracting files from archive %q", archivePath)
+	err := unTar(archivePath, localRoot, extractOptions{
+		MapName: func(name string) (string, bool) {
+			return options.remapPath(path.Join(batchDir, name))
+		},
+		Conflict: options.Conflict,
+		Limit:    options.extractLimit,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to extract files from archive %q: %w", archivePath, err)
+	}
 	return nil
 }
+
+// archiveBatch returns the batch that's stored in the archive with the given name, relative to the
+// backup's prefix, along with the directory its entries are named relative to. That's the
+// directory the archive is stored in, for both grouped (<dir>/_files.tar.gz) and single-file
+// (<dir>/<file>.tar.gz) batches.
+func archiveBatch(relKey string) (string, string) {
+	batch, ok := parseArchiveName(relKey)
+	if !ok {
+		return path.Dir(relKey), relKey
+	}
+	return archiveEntriesDir(batch), batch.Path
+}
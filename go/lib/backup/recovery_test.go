@@ -0,0 +1,831 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+
+	"local/backup/lib/logging"
+	"local/backup/lib/s3_helpers"
+)
+
+func TestRecoverFiles_StripComponents(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+	config.SizeThreshold = 1000
+
+	must(createTestFile(filepath.Join(testBaseDir, "subdir-1/a.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "subdir-1/nested/b.txt"), 2000))
+	must(createTestFile(filepath.Join(testBaseDir, "c.txt"), 5))
+
+	cfg := GetMinioConfig(minioUrl)
+	must(BackupFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		testBaseDir,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		config.SizeThreshold,
+		BackupOptions{},
+	))
+
+	testRecoveryDir, err := os.MkdirTemp("/tmp", "dave-recovery-test-")
+	must(err)
+	defer os.RemoveAll(testRecoveryDir)
+	must(RecoverFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		testRecoveryDir,
+		RecoveryOptions{StripComponents: 1},
+	))
+
+	// subdir-1's contents end up in the root, and files at the root are skipped.
+	compareDirectories(filepath.Join(testBaseDir, "subdir-1"), testRecoveryDir, t)
+	_, err = os.Stat(filepath.Join(testRecoveryDir, "c.txt"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRecoverFiles_Timeout(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getMemoryTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 20))
+	must(createTestFile(filepath.Join(testBaseDir, "b.txt"), 20))
+	roundTripTest(config, t)
+
+	// The deadline has passed by the time there are archives to recover, so none are.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	recoveryDir := t.TempDir()
+	err := RecoverFiles(ctx, logger, &aws.Config{}, config.DBFile, config.Bucket, config.S3Prefix, config.BackupName, recoveryDir, RecoveryOptions{
+		Storage: config.Storage,
+	})
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "expected context.DeadlineExceeded, got %v", err)
+	assert.ErrorContains(t, err, "after 0 of 2 archives")
+	assert.NoFileExists(t, filepath.Join(recoveryDir, "a.txt"))
+}
+
+func TestRemapPath(t *testing.T) {
+	cases := []struct {
+		options  RecoveryOptions
+		path     string
+		expected string
+		ok       bool
+	}{
+		{RecoveryOptions{}, "a/b.txt", "a/b.txt", true},
+		{RecoveryOptions{StripComponents: 1}, "a/b.txt", "b.txt", true},
+		{RecoveryOptions{StripComponents: 1}, "b.txt", "", false},
+		{RecoveryOptions{ReplacePrefix: "a", WithPrefix: "x/y"}, "a/b.txt", "x/y/b.txt", true},
+		{RecoveryOptions{ReplacePrefix: "a", WithPrefix: ""}, "a/b.txt", "b.txt", true},
+		{RecoveryOptions{ReplacePrefix: "a", WithPrefix: "x"}, "ab/c.txt", "ab/c.txt", true},
+		{RecoveryOptions{StripComponents: 1, ReplacePrefix: "b", WithPrefix: "c"}, "a/b/d.txt", "c/d.txt", true},
+	}
+	for _, c := range cases {
+		actual, ok := c.options.remapPath(c.path)
+		assert.Equal(t, c.ok, ok, "%+v %q", c.options, c.path)
+		assert.Equal(t, c.expected, actual, "%+v %q", c.options, c.path)
+	}
+}
+
+func TestSafeJoin_RejectsTraversal(t *testing.T) {
+	root := "/tmp/root"
+	for _, name := range []string{"../a.txt", "a/../../b.txt", "/etc/passwd", "..", "."} {
+		_, err := safeJoin(root, name)
+		assert.Error(t, err, name)
+	}
+	joined, err := safeJoin(root, "a/../b.txt")
+	must(err)
+	assert.Equal(t, filepath.Join(root, "b.txt"), joined)
+}
+
+// writeTarGz writes a gzipped tar of files of zeros with the given sizes, which compresses to almost
+// nothing.
+func writeTarGz(path string, sizes map[string]int) {
+	f, err := os.Create(path)
+	must(err)
+	defer f.Close()
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+	names := make([]string, 0, len(sizes))
+	for name := range sizes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		must(tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(sizes[name]), Typeflag: tar.TypeReg}))
+		_, err := tw.Write(make([]byte, sizes[name]))
+		must(err)
+	}
+	must(tw.Close())
+	must(gw.Close())
+}
+
+func TestUnTar_ExtractLimit(t *testing.T) {
+	archive := filepath.Join(t.TempDir(), "bomb.tar.gz")
+	writeTarGz(archive, map[string]int{"a.bin": 600 << 10, "b.bin": 600 << 10})
+	info, err := os.Stat(archive)
+	must(err)
+	assert.Less(t, info.Size(), int64(10<<10))
+
+	// Unlimited, everything is extracted.
+	must(unTar(archive, t.TempDir(), extractOptions{}))
+
+	// Each file is under the limit per file, but together they're over the total.
+	dir := t.TempDir()
+	err = unTar(archive, dir, extractOptions{Limit: newExtractLimit(1<<20, 1<<20)})
+	assert.ErrorIs(t, err, ErrExtractLimitExceeded)
+	info, err = os.Stat(filepath.Join(dir, "b.bin"))
+	if err == nil {
+		assert.LessOrEqual(t, info.Size(), int64(1<<20-600<<10))
+	}
+
+	// A file over the limit per file is refused before anything is written.
+	dir = t.TempDir()
+	err = unTar(archive, dir, extractOptions{Limit: newExtractLimit(100<<10, 0)})
+	assert.ErrorIs(t, err, ErrExtractLimitExceeded)
+	assert.NoFileExists(t, filepath.Join(dir, "a.bin"))
+}
+
+func TestRecoverFiles_ExtractLimit(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 200))
+	must(createTestFile(filepath.Join(testBaseDir, "subdir/b.txt"), 5))
+
+	cfg := GetMinioConfig(minioUrl)
+	must(BackupFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		testBaseDir,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		config.SizeThreshold,
+		BackupOptions{},
+	))
+
+	recover := func(options RecoveryOptions) error {
+		return RecoverFiles(
+			context.Background(),
+			logger,
+			cfg,
+			config.DBFile,
+			config.Bucket,
+			config.S3Prefix,
+			config.BackupName,
+			t.TempDir(),
+			options,
+		)
+	}
+	assert.ErrorIs(t, recover(RecoveryOptions{MaxExtractedFileBytes: 100}), ErrExtractLimitExceeded)
+	assert.ErrorIs(t, recover(RecoveryOptions{MaxExtractedBytes: 100}), ErrExtractLimitExceeded)
+	must(recover(RecoveryOptions{MaxExtractedFileBytes: 200, MaxExtractedBytes: 205}))
+}
+
+func TestRecoverFiles_ConflictPolicies(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+
+	must(createTestFile(filepath.Join(testBaseDir, "older.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "newer.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "missing.txt"), 5))
+	backupTime := time.Now().Add(-time.Hour)
+	for _, name := range []string{"older.txt", "newer.txt", "missing.txt"} {
+		must(os.Chtimes(filepath.Join(testBaseDir, name), backupTime, backupTime))
+	}
+
+	cfg := GetMinioConfig(minioUrl)
+	must(BackupFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		testBaseDir,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		config.SizeThreshold,
+		BackupOptions{},
+	))
+
+	readFile := func(path string) string {
+		data, err := os.ReadFile(path)
+		must(err)
+		return string(data)
+	}
+	original := map[string]string{}
+	for _, name := range []string{"older.txt", "newer.txt", "missing.txt"} {
+		original[name] = readFile(filepath.Join(testBaseDir, name))
+	}
+
+	cases := []struct {
+		policy ConflictPolicy
+		// Whether each existing file should have been replaced with the backed up version.
+		olderReplaced bool
+		newerReplaced bool
+	}{
+		{ConflictOverwrite, true, true},
+		{ConflictSkipExisting, false, false},
+		{ConflictKeepNewer, true, false},
+	}
+	for _, c := range cases {
+		t.Run(string(c.policy), func(t *testing.T) {
+			recoveryDir := t.TempDir()
+			// Local edits from before and after the backup was taken.
+			must(os.WriteFile(filepath.Join(recoveryDir, "older.txt"), []byte("local"), 0644))
+			olderTime := backupTime.Add(-time.Hour)
+			must(os.Chtimes(filepath.Join(recoveryDir, "older.txt"), olderTime, olderTime))
+			must(os.WriteFile(filepath.Join(recoveryDir, "newer.txt"), []byte("local"), 0644))
+
+			must(RecoverFiles(
+				context.Background(),
+				logger,
+				cfg,
+				config.DBFile,
+				config.Bucket,
+				config.S3Prefix,
+				config.BackupName,
+				recoveryDir,
+				RecoveryOptions{Force: true, Conflict: c.policy},
+			))
+
+			expected := func(name string, replaced bool) string {
+				if replaced {
+					return original[name]
+				}
+				return "local"
+			}
+			assert.Equal(t, expected("older.txt", c.olderReplaced), readFile(filepath.Join(recoveryDir, "older.txt")))
+			assert.Equal(t, expected("newer.txt", c.newerReplaced), readFile(filepath.Join(recoveryDir, "newer.txt")))
+			assert.Equal(t, original["missing.txt"], readFile(filepath.Join(recoveryDir, "missing.txt")))
+		})
+	}
+}
+
+func TestRecoverFiles_Concurrent(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Info,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+	config.SizeThreshold = 100
+
+	// Lots of directories, each with a file that gets its own batch and a couple of grouped ones.
+	for i := 0; i < 20; i++ {
+		dir := filepath.Join(testBaseDir, fmt.Sprintf("dir-%d", i))
+		must(createTestFile(filepath.Join(dir, "big.txt"), 200))
+		must(createTestFile(filepath.Join(dir, "small-1.txt"), 10))
+		must(createTestFile(filepath.Join(dir, "nested/small-2.txt"), 10))
+	}
+
+	cfg := GetMinioConfig(minioUrl)
+	must(BackupFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		testBaseDir,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		config.SizeThreshold,
+		BackupOptions{},
+	))
+
+	testRecoveryDir, err := os.MkdirTemp("/tmp", "dave-recovery-test-")
+	must(err)
+	defer os.RemoveAll(testRecoveryDir)
+	must(RecoverFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		testRecoveryDir,
+		RecoveryOptions{Concurrency: 8},
+	))
+	compareDirectories(testBaseDir, testRecoveryDir, t)
+}
+
+func TestRecoverFiles_VerifyFlagsCorruptedFile(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+	config.SizeThreshold = 100
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 200))
+	must(createTestFile(filepath.Join(testBaseDir, "b.txt"), 200))
+	must(createTestFile(filepath.Join(testBaseDir, "subdir/c.txt"), 5))
+
+	cfg := GetMinioConfig(minioUrl)
+	must(BackupFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		testBaseDir,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		config.SizeThreshold,
+		BackupOptions{},
+	))
+
+	recover := func() error {
+		recoveryDir := t.TempDir()
+		return RecoverFiles(
+			context.Background(),
+			logger,
+			cfg,
+			config.DBFile,
+			config.Bucket,
+			config.S3Prefix,
+			config.BackupName,
+			recoveryDir,
+			RecoveryOptions{Verify: true},
+		)
+	}
+	must(recover())
+
+	// Replace a.txt's archive with one holding different contents, without updating the db.
+	client := s3.NewFromConfig(*cfg)
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 200))
+	_, err := backupFile(logger, client, config.Bucket, config.FullS3Prefix, testBaseDir, "a.txt", archiveOptions{})
+	must(err)
+	// Drop the object's checksum, as if it had been uploaded by an older version, so that only
+	// verification can catch the corruption.
+	db, err := NewDB(config.DBFile)
+	must(err)
+	_, err = db.db.Exec("DELETE FROM batches WHERE batch = ?", "a.txt")
+	must(err)
+	must(db.Close())
+	must(backupDB(logger, client, config.DBFile, config.Bucket, config.S3Prefix, config.BackupName))
+
+	err = recover()
+	var verificationErr *VerificationError
+	if assert.True(t, errors.As(err, &verificationErr), "expected a VerificationError, got %v", err) {
+		assert.Equal(t, []string{"a.txt"}, verificationErr.Mismatches)
+	}
+}
+
+func TestRecoverFiles_ChecksumMismatch(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+	config.SizeThreshold = 100
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 200))
+	must(createTestFile(filepath.Join(testBaseDir, "subdir/b.txt"), 5))
+
+	cfg := GetMinioConfig(minioUrl)
+	client := s3.NewFromConfig(*cfg)
+	must(BackupFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		testBaseDir,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		config.SizeThreshold,
+		BackupOptions{},
+	))
+
+	// The recorded checksums match the stored objects.
+	db, err := NewDB(config.DBFile)
+	must(err)
+	defer db.Close()
+	batches, err := db.GetExistingBatches(false)
+	must(err)
+	assert.Len(t, batches, 2)
+	for _, batch := range batches {
+		data, err := s3_helpers.DownloadBytes(client, config.Bucket, batchKey(config.FullS3Prefix, batch, false))
+		must(err)
+		checksum, err := db.GetBatchChecksum(batch.Path)
+		must(err)
+		assert.Equal(t, fmt.Sprintf("%x", md5.Sum(data)), checksum, batch.Path)
+	}
+
+	// Replace a.txt's archive without updating the db.
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 200))
+	_, err = backupFile(logger, client, config.Bucket, config.FullS3Prefix, testBaseDir, "a.txt", archiveOptions{})
+	must(err)
+
+	err = RecoverFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		t.TempDir(),
+		RecoveryOptions{},
+	)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "checksum mismatch")
+	}
+}
+
+// tempDirObserver records the temporary directories under dir while archives are being recovered.
+type tempDirObserver struct {
+	NoopObserver
+	dir string
+
+	mu   sync.Mutex
+	seen []string
+}
+
+func (o *tempDirObserver) ArchiveRecovered(event ArchiveEvent, err error) {
+	matches, _ := filepath.Glob(filepath.Join(o.dir, "dbackup-recover-*"))
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.seen = append(o.seen, matches...)
+}
+
+func TestTempDir(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Info,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 200))
+	must(createTestFile(filepath.Join(testBaseDir, "subdir/b.txt"), 5))
+
+	cfg := GetMinioConfig(minioUrl)
+	backup := func(tempDir string) error {
+		return BackupFiles(
+			context.Background(),
+			logger,
+			cfg,
+			config.DBFile,
+			testBaseDir,
+			config.Bucket,
+			config.S3Prefix,
+			config.BackupName,
+			config.SizeThreshold,
+			BackupOptions{TempDir: tempDir},
+		)
+	}
+	must(backup(""))
+
+	// Once there's a local db, the remote one is downloaded to the temp dir to compare them.
+	tempDir := t.TempDir()
+	assert.Error(t, backup(filepath.Join(tempDir, "missing")))
+	must(backup(tempDir))
+
+	// Archives are downloaded to the temp dir before they're extracted.
+	testRecoveryDir := t.TempDir()
+	observer := &tempDirObserver{dir: tempDir}
+	must(RecoverFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		testRecoveryDir,
+		RecoveryOptions{TempDir: tempDir, Observer: observer, Force: true},
+	))
+	compareDirectories(testBaseDir, testRecoveryDir, t)
+	assert.NotEmpty(t, observer.seen)
+
+	// Everything is cleaned up afterwards.
+	entries, err := os.ReadDir(tempDir)
+	must(err)
+	assert.Empty(t, entries)
+}
+
+func TestRecoverFiles_VerifyOnly(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+	config.SizeThreshold = 100
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 200))
+	must(createTestFile(filepath.Join(testBaseDir, "b.txt"), 200))
+	must(createTestFile(filepath.Join(testBaseDir, "subdir/c.txt"), 5))
+
+	cfg := GetMinioConfig(minioUrl)
+	must(BackupFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		testBaseDir,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		config.SizeThreshold,
+		BackupOptions{},
+	))
+	must(BackupStream(logger, cfg, config.DBFile, config.Bucket, config.S3Prefix, config.BackupName, "dump.sql", strings.NewReader("dump"), StreamOptions{}))
+	localDB, err := os.ReadFile(config.DBFile)
+	must(err)
+
+	recoveryDir := filepath.Join(t.TempDir(), "recovery")
+	verifyOnly := func(verify bool) (*Report, error) {
+		return recoverFiles(
+			context.Background(),
+			logger,
+			cfg,
+			config.DBFile,
+			config.Bucket,
+			config.S3Prefix,
+			config.BackupName,
+			recoveryDir,
+			RecoveryOptions{VerifyOnly: true, Verify: verify},
+		)
+	}
+	report, err := verifyOnly(true)
+	must(err)
+	// Three archives and the stream.
+	assert.Equal(t, 4, report.ObjectsVerified)
+	assert.Equal(t, 0, report.ArchivesRecovered)
+	// Nothing was written, not even the local db.
+	assert.NoDirExists(t, recoveryDir)
+	after, err := os.ReadFile(config.DBFile)
+	must(err)
+	assert.Equal(t, localDB, after)
+
+	// Replace a.txt's archive with one holding different contents, and drop its checksum, so that
+	// only hashing the files can catch it.
+	client := s3.NewFromConfig(*cfg)
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 200))
+	_, err = backupFile(logger, client, config.Bucket, config.FullS3Prefix, testBaseDir, "a.txt", archiveOptions{})
+	must(err)
+	db, err := NewDB(config.DBFile)
+	must(err)
+	_, err = db.db.Exec("DELETE FROM batches WHERE batch = ?", "a.txt")
+	must(err)
+	must(db.Close())
+	must(backupDB(logger, client, config.DBFile, config.Bucket, config.S3Prefix, config.BackupName))
+	_, err = verifyOnly(false)
+	must(err)
+	_, err = verifyOnly(true)
+	var verificationErr *VerificationError
+	if assert.True(t, errors.As(err, &verificationErr), "expected a VerificationError, got %v", err) {
+		assert.Equal(t, []string{"a.txt"}, verificationErr.Mismatches)
+		assert.Empty(t, verificationErr.Corrupted)
+	}
+
+	// An archive that can't be decompressed is reported, whether or not the files are hashed.
+	bKey := s3Key(config.FullS3Prefix, "b.txt.tar.gz")
+	must(s3_helpers.UploadBytes(client, config.Bucket, bKey, []byte("not a gzip file")))
+	_, err = verifyOnly(false)
+	if assert.True(t, errors.As(err, &verificationErr), "expected a VerificationError, got %v", err) {
+		assert.Equal(t, []string{bKey}, verificationErr.Corrupted)
+		assert.Empty(t, verificationErr.Mismatches)
+	}
+}
+
+func TestRecoverFiles_Staging(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+	config.SizeThreshold = 100
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 200))
+	must(createTestFile(filepath.Join(testBaseDir, "subdir/b.txt"), 5))
+
+	cfg := GetMinioConfig(minioUrl)
+	must(BackupFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		testBaseDir,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		config.SizeThreshold,
+		BackupOptions{},
+	))
+
+	parent := t.TempDir()
+	target := filepath.Join(parent, "target")
+	must(createTestFile(filepath.Join(target, "old.txt"), 10))
+	recover := func() error {
+		return RecoverFiles(
+			context.Background(),
+			logger,
+			cfg,
+			config.DBFile,
+			config.Bucket,
+			config.S3Prefix,
+			config.BackupName,
+			target,
+			RecoveryOptions{Staging: true, Verify: true},
+		)
+	}
+	stagingDirs := func() []string {
+		matches, err := filepath.Glob(filepath.Join(parent, ".target.dbackup-staging-*"))
+		must(err)
+		return matches
+	}
+
+	// The existing target is replaced as a whole, and kept alongside.
+	must(recover())
+	compareDirectories(testBaseDir, target, t)
+	old, err := filepath.Glob(filepath.Join(parent, "target.dbackup-old-*"))
+	must(err)
+	if assert.Len(t, old, 1) {
+		assert.FileExists(t, filepath.Join(old[0], "old.txt"))
+	}
+	assert.Empty(t, stagingDirs())
+
+	// Replace a.txt's archive without updating the db, so the recovery fails partway.
+	client := s3.NewFromConfig(*cfg)
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 200))
+	_, err = backupFile(logger, client, config.Bucket, config.FullS3Prefix, testBaseDir, "a.txt", archiveOptions{})
+	must(err)
+	must(os.WriteFile(filepath.Join(target, "marker.txt"), []byte("still here"), 0644))
+	before, err := os.ReadFile(filepath.Join(target, "a.txt"))
+	must(err)
+
+	assert.ErrorContains(t, recover(), "checksum mismatch")
+	after, err := os.ReadFile(filepath.Join(target, "a.txt"))
+	must(err)
+	assert.Equal(t, before, after)
+	assert.FileExists(t, filepath.Join(target, "marker.txt"))
+	assert.FileExists(t, filepath.Join(target, "subdir/b.txt"))
+	assert.Empty(t, stagingDirs())
+
+	assert.Error(t, RecoveryOptions{Staging: true, OriginalLocations: true}.Validate())
+	assert.Error(t, RecoveryOptions{Staging: true, Conflict: ConflictSkipExisting}.Validate())
+}
+
+func TestRecoverFiles_BestEffort(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+	config.SizeThreshold = 100
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 200))
+	must(createTestFile(filepath.Join(testBaseDir, "subdir/b.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "subdir/c.txt"), 10))
+
+	cfg := GetMinioConfig(minioUrl)
+	client := s3.NewFromConfig(*cfg)
+	must(BackupFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		testBaseDir,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		config.SizeThreshold,
+		BackupOptions{},
+	))
+
+	// Delete a.txt's archive behind the backup's back.
+	missingKey := batchKey(config.FullS3Prefix, BatchMeta{Path: "a.txt", IsSingleFile: true}, false)
+	must(deleteObject(client, config.Bucket, missingKey))
+
+	recover := func(options RecoveryOptions) (*Report, string, error) {
+		recoveryDir := t.TempDir()
+		report, err := recoverFiles(
+			context.Background(),
+			logger,
+			cfg,
+			config.DBFile,
+			config.Bucket,
+			config.S3Prefix,
+			config.BackupName,
+			recoveryDir,
+			options,
+		)
+		return report, recoveryDir, err
+	}
+
+	// Without best effort, the recovery fails before recovering anything.
+	_, recoveryDir, err := recover(RecoveryOptions{})
+	var missingErr *MissingObjectsError
+	if assert.True(t, errors.As(err, &missingErr), "%v", err) {
+		assert.Equal(t, []string{missingKey}, missingErr.Keys)
+	}
+	assert.NoFileExists(t, filepath.Join(recoveryDir, "subdir/b.txt"))
+
+	// With it, everything else is recovered and the missing object is reported.
+	report, recoveryDir, err := recover(RecoveryOptions{BestEffort: true})
+	must(err)
+	assert.Equal(t, []string{missingKey}, report.MissingObjects)
+	must(os.Remove(filepath.Join(testBaseDir, "a.txt")))
+	compareDirectories(testBaseDir, recoveryDir, t)
+}
+
+func TestRecoverFiles_KeepArchives(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+	config.SizeThreshold = 100
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 200))
+	must(createTestFile(filepath.Join(testBaseDir, "subdir/b.txt"), 5))
+
+	cfg := GetMinioConfig(minioUrl)
+	must(BackupFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		testBaseDir,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		config.SizeThreshold,
+		BackupOptions{},
+	))
+
+	tempDir := t.TempDir()
+	testRecoveryDir := t.TempDir()
+	must(RecoverFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		testRecoveryDir,
+		RecoveryOptions{TempDir: tempDir, KeepArchives: true},
+	))
+	compareDirectories(testBaseDir, testRecoveryDir, t)
+
+	// The archives are still there, as they were downloaded.
+	dirs, err := filepath.Glob(filepath.Join(tempDir, "dbackup-recover-*"))
+	must(err)
+	if assert.Len(t, dirs, 1) {
+		assert.FileExists(t, filepath.Join(dirs[0], "a.txt.tar.gz"))
+		assert.FileExists(t, filepath.Join(dirs[0], "subdir", "b.txt.tar.gz"))
+	}
+}
@@ -0,0 +1,339 @@
+package backup
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+
+	"local/backup/lib/logging"
+	"local/backup/lib/s3_helpers"
+)
+
+// A backup can cover several unrelated directories (BackupRoots). Each root is stored under a
+// top-level directory of its own, named after the root's base name, so "/home/me/photos" and
+// "/srv/music" are backed up as "photos/..." and "music/...", all tracked in the same db. Every
+// root is scanned as a subtree of its parent directory (see subtree.go), so batches never span
+// roots, and a root that's left out of a later backup is kept as it was.
+//
+// The roots' original locations are recorded in the db. Recovering with
+// RecoveryOptions.OriginalLocations puts every root back where it came from; otherwise the roots are
+// recovered side by side under the recovery root.
+//
+// The directory that a backup with a single root was made from is recorded too. A backup refuses to
+// run (unless forced) if the recorded directories don't match the ones it's given, since that most
+// likely means two unrelated backups ended up with the same name.
+
+type backupRoot struct {
+	// The root's top-level directory in the backup, or empty for a backup with a single root, which
+	// is stored at the top level.
+	Label string
+	// The root's local directory.
+	Path string
+}
+
+// localRoot returns the directory that the root's paths in the backup are relative to.
+func (r backupRoot) localRoot() string {
+	if r.Label == "" {
+		return r.Path
+	}
+	return filepath.Dir(r.Path)
+}
+
+// newBackupRoots labels the given directories by their base names, which must be distinct.
+func newBackupRoots(dirs []string) ([]backupRoot, error) {
+	if len(dirs) == 0 {
+		return nil, fmt.Errorf("at least one root directory is required")
+	}
+	var roots []backupRoot
+	labels := make(map[string]string)
+	for _, dir := range dirs {
+		absDir, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		label := filepath.Base(absDir)
+		if label == string(filepath.Separator) || label == "." {
+			return nil, fmt.Errorf("root %q has no name to store it under", dir)
+		}
+		if other, ok := labels[label]; ok {
+			return nil, fmt.Errorf("roots %q and %q have the same name", other, dir)
+		}
+		labels[label] = dir
+		roots = append(roots, backupRoot{Label: label, Path: absDir})
+	}
+	return roots, nil
+}
+
+// localRootFor returns the local directory that a path in the backup is relative to.
+func localRootFor(roots []backupRoot, relPath string) string {
+	label, _, _ := strings.Cut(filepath.ToSlash(relPath), "/")
+	for _, root := range roots {
+		if root.Label == "" || root.Label == label {
+			return root.localRoot()
+		}
+	}
+	return ""
+}
+
+// BackupRoots backs up several directories as one backup. See roots.go for how they're laid out.
+func BackupRoots(
+	ctx context.Context,
+	logger logging.Logger,
+	cfg *aws.Config,
+	dbFile string,
+	localRoots []string,
+	bucket string,
+	prefixBase string,
+	name string,
+	sizeThreshold int64,
+	options BackupOptions,
+) error {
+	roots, err := newBackupRoots(localRoots)
+	if err != nil {
+		return err
+	}
+	_, err = backupRoots(ctx, logger, cfg, dbFile, roots, bucket, prefixBase, name, sizeThreshold, options)
+	return err
+}
+
+// planBackupRoots plans the backup of each root, and merges the plans.
+func planBackupRoots(
+	logger logging.Logger,
+	db *DB,
+	roots []backupRoot,
+	sizeThreshold int64,
+	scan scanOptions,
+) (*backupPlan, error) {
+	if len(roots) == 1 && roots[0].Label == "" {
+		return planBackup(logger, db, roots[0].Path, sizeThreshold, scan)
+	}
+	merged := &backupPlan{
+		Summary:     &backupSummary{},
+		DirModTimes: make(map[string]time.Time),
+	}
+	for _, root := range roots {
+		rootScan := scan
+		rootScan.Path = root.Label
+		rootScan.label = root.Label
+		plan, err := planBackup(logger, db, root.localRoot(), sizeThreshold, rootScan)
+		if err != nil {
+			return nil, fmt.Errorf("error planning backup of root %q: %v", root.Path, err)
+		}
+		merged.Batches = append(merged.Batches, plan.Batches...)
+		merged.BatchesToDelete = append(merged.BatchesToDelete, plan.BatchesToDelete...)
+		merged.Copies = append(merged.Copies, plan.Copies...)
+		merged.FileInfos = plan.FileInfos
+		merged.Summary.merge(plan.Summary)
+		for dir, modTime := range plan.DirModTimes {
+			merged.DirModTimes[dir] = modTime
+		}
+	}
+	return merged, nil
+}
+
+// checkRoots makes sure a backup with several roots isn't updated as if it had a single one, or vice
+// versa, which would treat every file as moved or deleted.
+func checkRoots(db *DB, roots []backupRoot) error {
+	stored, err := db.GetRoots()
+	if err != nil {
+		return err
+	}
+	multiple := roots[0].Label != ""
+	if multiple == (len(stored) > 0) {
+		return nil
+	}
+	files, err := db.GetAllFiles()
+	if err != nil {
+		return err
+	}
+	// Nothing has been stored yet, so the layout can still be picked.
+	if len(files) == 0 {
+		return nil
+	}
+	if multiple {
+		return fmt.Errorf("backup has a single root, but several roots were given")
+	}
+	return fmt.Errorf("backup has several roots, but a single root was given")
+}
+
+// checkSourceRoots makes sure the roots are the ones the backup was made from, rather than another
+// backup's that happens to have the same name, which would be clobbered. The roots are checked
+// against the local db or, if it doesn't record them yet, the remote one.
+func checkSourceRoots(
+	logger logging.Logger,
+	client s3_helpers.Client,
+	db *DB,
+	bucket string,
+	prefixBase string,
+	name string,
+	roots []backupRoot,
+	tmpDir string,
+) error {
+	recorded, err := db.sourceRoots()
+	if err != nil {
+		return fmt.Errorf("error loading roots from db: %v", err)
+	}
+	if len(recorded) == 0 {
+		if tmpDir == "" {
+			tmpDir = os.TempDir()
+		}
+		remoteDBFile, err := downloadDB(logger, client, bucket, prefixBase, name, tmpDir)
+		if errors.Is(err, s3_helpers.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to download remote db: %v", err)
+		}
+		defer os.Remove(remoteDBFile)
+		remoteDB, err := NewDB(remoteDBFile)
+		if err != nil {
+			return fmt.Errorf("failed to open remote db: %v", err)
+		}
+		defer remoteDB.Close()
+		recorded, err = remoteDB.sourceRoots()
+		if err != nil {
+			return fmt.Errorf("error loading roots from remote db: %v", err)
+		}
+	}
+
+	for _, root := range roots {
+		absPath, err := filepath.Abs(root.Path)
+		if err != nil {
+			return err
+		}
+		if path, ok := recorded[root.Label]; ok && path != absPath {
+			return fmt.Errorf("backup %q was made from %q, not %q", name, path, absPath)
+		}
+	}
+	for label, path := range recorded {
+		if (label == "") != (roots[0].Label == "") {
+			return fmt.Errorf("backup %q was made from %q, which isn't one of the given directories", name, path)
+		}
+	}
+	return nil
+}
+
+// setSourceRoot records the directory that a backup with a single root is made from.
+func (db *DB) setSourceRoot(roots []backupRoot) error {
+	if len(roots) != 1 || roots[0].Label != "" {
+		return nil
+	}
+	absPath, err := filepath.Abs(roots[0].Path)
+	if err != nil {
+		return err
+	}
+	return db.setMeta(metaSourceRoot, absPath)
+}
+
+// sourceRoots returns the directories the backup was made from, by their top-level directory in
+// the backup, which is empty for a backup with a single root.
+func (db *DB) sourceRoots() (map[string]string, error) {
+	roots, err := db.GetRoots()
+	if err != nil {
+		return nil, err
+	}
+	sourceRoot, err := db.getMeta(metaSourceRoot)
+	if err == sql.ErrNoRows {
+		return roots, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	roots[""] = sourceRoot
+	return roots, nil
+}
+
+// setRoots records the roots' locations, keeping any roots that weren't backed up this time.
+func (db *DB) setRoots(roots []backupRoot) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(`
+		INSERT INTO roots (label, path)
+		VALUES (?, ?)
+		ON CONFLICT (label) DO UPDATE SET path = excluded.path
+	`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for _, root := range roots {
+		if root.Label == "" {
+			continue
+		}
+		if _, err := stmt.Exec(root.Label, root.Path); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetRoots returns the original location of each root of a backup with several roots, by its
+// top-level directory in the backup. It's empty for a backup with a single root.
+func (db *DB) GetRoots() (map[string]string, error) {
+	rows, err := db.db.Query(`SELECT label, path FROM roots`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roots := make(map[string]string)
+	for rows.Next() {
+		var label, path string
+		if err := rows.Scan(&label, &path); err != nil {
+			return nil, err
+		}
+		roots[label] = path
+	}
+	return roots, rows.Err()
+}
+
+// originalRootParents returns, for each root in the db, its parent directory relative to the
+// filesystem root, so that recovering into the filesystem root (which it also returns) puts every
+// root back where it came from.
+func originalRootParents(db *DB) (string, map[string]string, error) {
+	roots, err := db.GetRoots()
+	if err != nil {
+		return "", nil, fmt.Errorf("error loading roots from db: %v", err)
+	}
+	if len(roots) == 0 {
+		return "", nil, fmt.Errorf("backup doesn't have several roots to recover to their original locations")
+	}
+	fsRoot := ""
+	parents := make(map[string]string)
+	for label, root := range roots {
+		rootFS := filepath.VolumeName(root) + string(filepath.Separator)
+		if fsRoot != "" && rootFS != fsRoot {
+			return "", nil, fmt.Errorf("roots are on different volumes, %q and %q", fsRoot, rootFS)
+		}
+		fsRoot = rootFS
+		parent, err := filepath.Rel(fsRoot, filepath.Dir(root))
+		if err != nil {
+			return "", nil, err
+		}
+		parents[label] = filepath.ToSlash(parent)
+	}
+	return fsRoot, parents, nil
+}
+
+// remapToOriginalRoot moves a slash-separated path in the backup under its root's original parent
+// directory. It returns false if the path doesn't belong to a known root.
+func remapToOriginalRoot(parents map[string]string, relPath string) (string, bool) {
+	label, _, _ := strings.Cut(relPath, "/")
+	parent, ok := parents[label]
+	if !ok {
+		return "", false
+	}
+	return path.Join(parent, relPath), true
+}
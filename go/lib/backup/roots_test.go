@@ -0,0 +1,186 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"local/backup/lib/logging"
+)
+
+func TestNewBackupRoots(t *testing.T) {
+	roots, err := newBackupRoots([]string{"/home/me/photos", "/srv/music/"})
+	must(err)
+	assert.Equal(t, []backupRoot{
+		{Label: "photos", Path: "/home/me/photos"},
+		{Label: "music", Path: "/srv/music"},
+	}, roots)
+	assert.Equal(t, "/home/me", localRootFor(roots, "photos/2020/a.jpg"))
+	assert.Equal(t, "/srv", localRootFor(roots, "music"))
+
+	_, err = newBackupRoots([]string{"/home/me/photos", "/srv/photos"})
+	assert.Error(t, err)
+	_, err = newBackupRoots([]string{"/"})
+	assert.Error(t, err)
+	_, err = newBackupRoots(nil)
+	assert.Error(t, err)
+}
+
+func TestBackupRoots(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+
+	// Two roots in unrelated directories.
+	photos := filepath.Join(testBaseDir, "a", "photos")
+	music := filepath.Join(testBaseDir, "b", "c", "music")
+	must(createTestFile(filepath.Join(photos, "1.jpg"), 200))
+	must(createTestFile(filepath.Join(photos, "2020/2.jpg"), 50))
+	must(createTestFile(filepath.Join(music, "song.mp3"), 300))
+	must(createTestFile(filepath.Join(music, "album/track.mp3"), 20))
+	// Each root's .dbignore applies to it.
+	must(os.WriteFile(filepath.Join(music, ".dbignore"), []byte(`\.tmp$`), 0644))
+	must(createTestFile(filepath.Join(music, "album/partial.tmp"), 20))
+
+	cfg := GetMinioConfig(minioUrl)
+	roots := []string{photos, music}
+	backup := func() error {
+		return BackupRoots(
+			context.Background(),
+			logger,
+			cfg,
+			config.DBFile,
+			roots,
+			config.Bucket,
+			config.S3Prefix,
+			config.BackupName,
+			config.SizeThreshold,
+			BackupOptions{},
+		)
+	}
+	must(backup())
+
+	db, err := NewDB(config.DBFile)
+	must(err)
+	files, err := db.GetAllFilesByPath()
+	must(err)
+	var paths []string
+	for path := range files {
+		paths = append(paths, path)
+	}
+	assert.ElementsMatch(t, []string{
+		"photos/1.jpg",
+		"photos/2020/2.jpg",
+		"music/song.mp3",
+		"music/album/track.mp3",
+	}, paths)
+	storedRoots, err := db.GetRoots()
+	must(err)
+	assert.Equal(t, map[string]string{"photos": photos, "music": music}, storedRoots)
+	db.Close()
+
+	// Backing up only one of the roots leaves the other one alone.
+	roots = []string{photos}
+	must(backup())
+	assertBatchCount(t, config, 4)
+
+	// The backup can't be updated as if it had a single root.
+	err = BackupFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		photos,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		config.SizeThreshold,
+		BackupOptions{},
+	)
+	assert.Error(t, err)
+
+	// By default, the roots are recovered side by side.
+	testRecoveryDir, err := os.MkdirTemp("/tmp", "dave-recovery-test-")
+	must(err)
+	defer os.RemoveAll(testRecoveryDir)
+	must(RecoverFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		testRecoveryDir,
+		RecoveryOptions{},
+	))
+	must(os.Remove(filepath.Join(music, "album/partial.tmp")))
+	must(os.Remove(filepath.Join(music, ".dbignore")))
+	compareDirectories(photos, filepath.Join(testRecoveryDir, "photos"), t)
+	compareDirectories(music, filepath.Join(testRecoveryDir, "music"), t)
+
+	// They can also be put back where they came from.
+	must(os.Rename(filepath.Join(testBaseDir, "a"), filepath.Join(testBaseDir, "a.orig")))
+	must(os.Rename(filepath.Join(testBaseDir, "b"), filepath.Join(testBaseDir, "b.orig")))
+	must(RecoverFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		"",
+		RecoveryOptions{OriginalLocations: true, Verify: true},
+	))
+	compareDirectories(filepath.Join(testBaseDir, "a.orig", "photos"), photos, t)
+	compareDirectories(filepath.Join(testBaseDir, "b.orig", "c", "music"), music, t)
+}
+
+func TestBackupFiles_RejectsOtherSourceRoot(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+
+	first := filepath.Join(testBaseDir, "first")
+	other := filepath.Join(testBaseDir, "other")
+	must(createTestFile(filepath.Join(first, "a.txt"), 50))
+	must(createTestFile(filepath.Join(other, "b.txt"), 50))
+
+	cfg := GetMinioConfig(minioUrl)
+	backup := func(root string, dbFile string, force bool) error {
+		return BackupFiles(
+			context.Background(),
+			logger,
+			cfg,
+			dbFile,
+			root,
+			config.Bucket,
+			config.S3Prefix,
+			config.BackupName,
+			config.SizeThreshold,
+			BackupOptions{Force: force},
+		)
+	}
+	must(backup(first, config.DBFile, false))
+	must(backup(first, config.DBFile, false))
+
+	// Another directory is rejected, whether it's checked against the local db or, from another
+	// machine, the remote one.
+	assert.ErrorContains(t, backup(other, config.DBFile, false), "was made from")
+	otherDBFile := filepath.Join(t.TempDir(), "other.db")
+	assert.ErrorContains(t, backup(other, otherDBFile, false), "was made from")
+
+	// Unless it's forced.
+	must(backup(other, otherDBFile, true))
+	must(backup(other, otherDBFile, false))
+}
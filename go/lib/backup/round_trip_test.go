@@ -7,6 +7,8 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
+
 	"local/backup/lib/util"
 )
 
@@ -134,6 +136,8 @@ func TestRoundTrip_WithAddsAndDeletes(t *testing.T) {
 	must(createTestFile(filepath.Join(testBaseDir, "subdir-1/ham/bur/ger/withcheese.txt"), 13))
 	must(os.Remove(filepath.Join(testBaseDir, "subdir-1/one/two/three/a.txt")))
 
+	// Keep the bucket contents, since only the changed batches get uploaded on the second run.
+	config.LeaveBucketContents = true
 	roundTripTest(config, t)
 }
 
@@ -162,7 +166,7 @@ func TestRoundTrip_BatchingChangesAcrossRuns(t *testing.T) {
 	roundTripTest(config, t)
 
 	// Make sure the batching strategy is as expected (described above)
-	assertBatchCount(t, config.DBFile, config.FullS3Prefix, 6)
+	assertBatchCount(t, config, 6)
 
 	// Remove the large file down the three, causing the entire directory hierarchy to collapse into
 	// one batch. Also tests that file deletion is working properly.
@@ -174,7 +178,7 @@ func TestRoundTrip_BatchingChangesAcrossRuns(t *testing.T) {
 	roundTripTest(config, t)
 
 	// Now that we've removed the large file, we should have one big batch
-	assertBatchCount(t, config.DBFile, config.FullS3Prefix, 1)
+	assertBatchCount(t, config, 1)
 }
 
 func TestRoundTrip_SizeThresholdChanges(t *testing.T) {
@@ -199,7 +203,7 @@ func TestRoundTrip_SizeThresholdChanges(t *testing.T) {
 	roundTripTest(config, t)
 
 	// There should only be one batch, since the threshold is high
-	assertBatchCount(t, config.DBFile, config.FullS3Prefix, 1)
+	assertBatchCount(t, config, 1)
 
 	// Run the test again, _without_ clearing the bucket (so we effectively get the same behavior as a
 	// non-fresh run in real life).
@@ -209,13 +213,13 @@ func TestRoundTrip_SizeThresholdChanges(t *testing.T) {
 
 	// Now that we've reduced the size threshold, we should have two grouped batches and four files as
 	// single-file batches
-	assertBatchCount(t, config.DBFile, config.FullS3Prefix, 6)
+	assertBatchCount(t, config, 6)
 
 	// Change it back and make sure things still work as expected
 	config.LeaveBucketContents = true
 	config.SizeThreshold = 100000
 	roundTripTest(config, t)
-	assertBatchCount(t, config.DBFile, config.FullS3Prefix, 1)
+	assertBatchCount(t, config, 1)
 }
 
 func TestRoundTrip_MultiRun(t *testing.T) {
@@ -275,7 +279,35 @@ func TestRoundTrip_MultiRun(t *testing.T) {
 			must(createTestFile(filepath.Join(testBaseDir, fileSpec.Path), fileSpec.Size))
 		}
 		fmt.Printf("+++ running round trip test for run %d\n", i)
+		// Only the first run starts from an empty bucket, later runs are incremental.
+		config.LeaveBucketContents = i > 0
 		roundTripTest(config, t)
 		fmt.Printf("--- finished round trip test for run %d\n", i)
 	}
 }
+
+func TestRoundTrip_FileRemovedFromBatch(t *testing.T) {
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+
+	must(createTestFile(filepath.Join(testBaseDir, "dir/a.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "dir/b.txt"), 9))
+	must(createTestFile(filepath.Join(testBaseDir, "dir/c.txt"), 25))
+
+	config.SizeThreshold = 1000
+	roundTripTest(config, t)
+
+	// The batch keeps its other files, so it's re-uploaded without the deleted one, rather than
+	// deleted, and only the deleted file's row is removed from the db.
+	must(os.Remove(filepath.Join(testBaseDir, "dir/b.txt")))
+	config.LeaveBucketContents = true
+	roundTripTest(config, t)
+
+	db, err := NewDB(config.DBFile)
+	must(err)
+	defer db.Close()
+	files, err := db.GetFilesInBatch("dir")
+	must(err)
+	assert.ElementsMatch(t, []string{"dir/a.txt", "dir/c.txt"}, files)
+}
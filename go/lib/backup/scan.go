@@ -0,0 +1,90 @@
+package backup
+
+import (
+	"time"
+
+	"local/backup/lib/logging"
+)
+
+// Subdirectories are scanned concurrently, up to this many at once, unless
+// BackupOptions.ScanConcurrency says otherwise.
+const defaultScanConcurrency = 4
+
+// subdirScan is a subdirectory that's being scanned, possibly in a goroutine of its own. It collects
+// everything the scan reports instead of reporting it to the parent directory's scan directly, so
+// that the parent can merge it in the same order as a serial scan would have, and the batches come
+// out exactly the same however many directories are scanned at once.
+type subdirScan struct {
+	done    chan struct{}
+	batches []*BackupBatch
+	err     error
+
+	summary     backupSummary
+	dirModTimes map[string]time.Time
+	skipped     skippedRecorder
+}
+
+// startSubdirScan starts scanning the directory at path. It's scanned in a new goroutine if the
+// scan has a slot free, and right away otherwise, so that a deep tree can't use up every slot and
+// leave all the scans waiting on each other.
+func startSubdirScan(
+	logger logging.Logger,
+	db fileInfoLookup,
+	root string,
+	path string,
+	sizeThreshold int64,
+	scan scanOptions,
+) *subdirScan {
+	s := &subdirScan{done: make(chan struct{})}
+	sub := scan
+	sub.Observer = &s.skipped
+	if scan.dirModTimes != nil {
+		s.dirModTimes = make(map[string]time.Time)
+		sub.dirModTimes = s.dirModTimes
+	}
+	run := func() {
+		defer close(s.done)
+		s.batches, s.err = getFilesToBackup(logger, db, root, path, sizeThreshold, sub, &s.summary)
+	}
+
+	// A nil channel is never ready, so a serial scan always runs right away.
+	select {
+	case scan.slots <- struct{}{}:
+		go func() {
+			defer func() { <-scan.slots }()
+			run()
+		}()
+	default:
+		run()
+	}
+	return s
+}
+
+// merge waits for the scan to finish, reports what it found to the parent's scan and summary, and
+// returns its batches.
+func (s *subdirScan) merge(scan scanOptions, summary *backupSummary) ([]*BackupBatch, error) {
+	<-s.done
+	if s.err != nil {
+		return nil, s.err
+	}
+	summary.merge(&s.summary)
+	for path, modTime := range s.dirModTimes {
+		scan.dirModTimes[path] = modTime
+	}
+	observer := observerOrNoop(scan.Observer)
+	for _, event := range s.skipped.events {
+		observer.FileSkipped(event)
+	}
+	return s.batches, nil
+}
+
+// skippedRecorder records the files a subdirectory's scan skips, to be reported once it's merged.
+// The scan doesn't report any other events.
+type skippedRecorder struct {
+	NoopObserver
+	events []FileSkippedEvent
+}
+
+func (r *skippedRecorder) FileSkipped(event FileSkippedEvent) {
+	r.events = append(r.events, event)
+}
@@ -0,0 +1,182 @@
+package backup
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"local/backup/lib/logging"
+	"local/backup/lib/s3_helpers"
+)
+
+// Snapshots are laid out as independent backups nested under the backup's prefix, each named by
+// its snapshot id:
+//
+//	<prefix>/<name>/<snapshot id>.db.gz
+//	<prefix>/<name>/<snapshot id>/...
+//	<prefix>/<name>/latest
+//
+// where "latest" holds the id of the most recent snapshot. Every snapshot is a full copy of the
+// tree, so older snapshots are never modified by later runs.
+
+const latestSnapshotPointer = "latest"
+
+// checkSnapshotMode makes sure a backup that's made of snapshots isn't updated in place, since
+// recovery would still use the latest snapshot and miss the update. A snapshot can be taken of a
+// backup that was updated in place, after which only snapshots can be taken.
+func checkSnapshotMode(client s3_helpers.Client, db *DB, bucket string, prefixBase string, name string) error {
+	snapshotID, err := db.getMeta(metaSnapshotID)
+	if err == nil {
+		return fmt.Errorf("the local db is from snapshot %s, so the backup can only be updated with a new snapshot", snapshotID)
+	}
+	if err != sql.ErrNoRows {
+		return fmt.Errorf("error reading snapshot id from db: %v", err)
+	}
+	latest, err := getLatestSnapshot(client, bucket, prefixBase, name)
+	if err == nil {
+		return fmt.Errorf("the backup has snapshots, the latest is %s, so it can only be updated with a new snapshot", latest)
+	}
+	if !errors.Is(err, s3_helpers.ErrNotFound) {
+		return fmt.Errorf("failed to look up latest snapshot: %v", err)
+	}
+	return nil
+}
+
+// Snapshot ids sort in the order they were taken.
+func newSnapshotID(t time.Time) string {
+	return t.UTC().Format("20060102T150405.000000000Z")
+}
+
+// snapshotLocation returns the prefix base and backup name to use for the objects of the given
+// snapshot.
+func snapshotLocation(prefixBase string, name string, snapshotID string) (string, string) {
+	return s3Key(prefixBase, name), snapshotID
+}
+
+// getLatestSnapshot returns s3_helpers.ErrNotFound if the backup has no snapshots.
+func getLatestSnapshot(client s3_helpers.Client, bucket string, prefixBase string, name string) (string, error) {
+	data, err := s3_helpers.DownloadBytes(client, bucket, s3Key(prefixBase, name, latestSnapshotPointer))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func setLatestSnapshot(client s3_helpers.Client, bucket string, prefixBase string, name string, snapshotID string) error {
+	return s3_helpers.UploadBytes(client, bucket, s3Key(prefixBase, name, latestSnapshotPointer), []byte(snapshotID))
+}
+
+// ListSnapshots returns the ids of all snapshots of the backup, oldest first.
+func ListSnapshots(cfg *aws.Config, bucket string, prefixBase string, name string) ([]string, error) {
+	return listSnapshots(s3.NewFromConfig(*cfg), bucket, prefixBase, name)
+}
+
+func listSnapshots(client s3_helpers.Client, bucket string, prefixBase string, name string) ([]string, error) {
+	var snapshots []string
+	paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(s3Key(prefixBase, name) + "/"),
+		// Only list the top level, where the snapshot dbs live.
+		Delimiter: aws.String("/"),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return nil, fmt.Errorf("failed to list snapshots: %v", err)
+		}
+		for _, object := range page.Contents {
+			filename := aws.ToString(object.Key)[len(s3Key(prefixBase, name))+1:]
+			if strings.HasSuffix(filename, ".db.gz") {
+				snapshots = append(snapshots, strings.TrimSuffix(filename, ".db.gz"))
+			}
+		}
+	}
+	return snapshots, nil
+}
+
+type SnapshotDiff struct {
+	Added    []string
+	Removed  []string
+	Modified []string
+}
+
+// DiffSnapshots reports which files were added, removed or modified between snapshots a and b. Only
+// the snapshots' dbs are downloaded, not their archives.
+func DiffSnapshots(
+	logger logging.Logger,
+	cfg *aws.Config,
+	bucket string,
+	prefixBase string,
+	name string,
+	a string,
+	b string,
+) (*SnapshotDiff, error) {
+	client := s3.NewFromConfig(*cfg)
+
+	tmpDir, err := os.MkdirTemp("", "dbackup-diff-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	openSnapshotDB := func(snapshotID string) (*DB, error) {
+		snapshotPrefixBase, snapshotName := snapshotLocation(prefixBase, name, snapshotID)
+		dbFile, err := downloadDB(logger, client, bucket, snapshotPrefixBase, snapshotName, tmpDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to download db for snapshot %q: %v", snapshotID, err)
+		}
+		return NewDB(dbFile)
+	}
+	dbA, err := openSnapshotDB(a)
+	if err != nil {
+		return nil, err
+	}
+	defer dbA.Close()
+	dbB, err := openSnapshotDB(b)
+	if err != nil {
+		return nil, err
+	}
+	defer dbB.Close()
+
+	return diffDBs(dbA, dbB)
+}
+
+// diffDBs compares the files recorded in two dbs. A file counts as modified if its contents or
+// modtime changed; moving between batches doesn't count.
+func diffDBs(a *DB, b *DB) (*SnapshotDiff, error) {
+	filesA, err := a.GetAllFilesByPath()
+	if err != nil {
+		return nil, err
+	}
+	filesB, err := b.GetAllFilesByPath()
+	if err != nil {
+		return nil, err
+	}
+
+	diff := &SnapshotDiff{}
+	for path, fileA := range filesA {
+		fileB, ok := filesB[path]
+		if !ok {
+			diff.Removed = append(diff.Removed, path)
+		} else if fileA.Hash != fileB.Hash || !modTimesEqual(fileA.ModTime, fileB.ModTime) {
+			diff.Modified = append(diff.Modified, path)
+		}
+	}
+	for path := range filesB {
+		if _, ok := filesA[path]; !ok {
+			diff.Added = append(diff.Added, path)
+		}
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Modified)
+	return diff, nil
+}
@@ -0,0 +1,169 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"local/backup/lib/logging"
+)
+
+func TestSnapshot_RestoreOlderSnapshot(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+	cfg := GetMinioConfig(minioUrl)
+
+	backup := func() {
+		must(BackupFiles(
+			context.Background(),
+			logger,
+			cfg,
+			config.DBFile,
+			testBaseDir,
+			config.Bucket,
+			config.S3Prefix,
+			config.BackupName,
+			config.SizeThreshold,
+			BackupOptions{Snapshot: true},
+		))
+	}
+	recover := func(snapshot string) string {
+		dir, err := os.MkdirTemp("/tmp", "dave-recovery-test-")
+		must(err)
+		must(RecoverFiles(
+			context.Background(),
+			logger,
+			cfg,
+			config.DBFile,
+			config.Bucket,
+			config.S3Prefix,
+			config.BackupName,
+			dir,
+			RecoveryOptions{Snapshot: snapshot},
+		))
+		return dir
+	}
+
+	// First snapshot
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "b.txt"), 9))
+	must(createTestFile(filepath.Join(testBaseDir, "subdir-1/c.txt"), 25))
+	backup()
+
+	// Move the first version of the tree aside so we can compare against it later, and take a second
+	// snapshot of a different tree.
+	firstTreeDir := testBaseDir + "-first"
+	must(os.Rename(testBaseDir, firstTreeDir))
+	defer os.RemoveAll(firstTreeDir)
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 7))
+	must(createTestFile(filepath.Join(testBaseDir, "subdir-2/d.txt"), 12))
+	backup()
+
+	snapshots, err := ListSnapshots(cfg, config.Bucket, config.S3Prefix, config.BackupName)
+	must(err)
+	assert.Len(t, snapshots, 2)
+
+	// By default the latest snapshot is restored.
+	latestDir := recover("")
+	defer os.RemoveAll(latestDir)
+	compareDirectories(testBaseDir, latestDir, t)
+
+	olderDir := recover(snapshots[0])
+	defer os.RemoveAll(olderDir)
+	compareDirectories(firstTreeDir, olderDir, t)
+
+	diff, err := DiffSnapshots(logger, cfg, config.Bucket, config.S3Prefix, config.BackupName, snapshots[0], snapshots[1])
+	must(err)
+	assert.Equal(t, &SnapshotDiff{
+		Added:    []string{"subdir-2/d.txt"},
+		Removed:  []string{"b.txt", "subdir-1/c.txt"},
+		Modified: []string{"a.txt"},
+	}, diff)
+}
+
+func TestSnapshot_RefusesInPlaceBackup(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+	cfg := GetMinioConfig(minioUrl)
+
+	backup := func(options BackupOptions) error {
+		return BackupFiles(
+			context.Background(),
+			logger,
+			cfg,
+			config.DBFile,
+			testBaseDir,
+			config.Bucket,
+			config.S3Prefix,
+			config.BackupName,
+			config.SizeThreshold,
+			options,
+		)
+	}
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 5))
+	must(backup(BackupOptions{Snapshot: true}))
+
+	// Recovery would still use the latest snapshot, so the new file would be lost.
+	must(createTestFile(filepath.Join(testBaseDir, "b.txt"), 9))
+	assert.ErrorContains(t, backup(BackupOptions{}), "can only be updated with a new snapshot")
+
+	// The same goes for a fresh local db.
+	must(os.Remove(config.DBFile))
+	assert.ErrorContains(t, backup(BackupOptions{}), "can only be updated with a new snapshot")
+
+	must(backup(BackupOptions{Snapshot: true}))
+	recoveryDir := t.TempDir()
+	must(RecoverFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		recoveryDir,
+		RecoveryOptions{},
+	))
+	compareDirectories(testBaseDir, recoveryDir, t)
+}
+
+func TestDiffDBs(t *testing.T) {
+	now := time.Now()
+	a := newTestDB(t)
+	must(a.MarkFiles([]*FileInfo{
+		{Path: "unchanged.txt", ModTime: now, Hash: "1", Batch: "."},
+		{Path: "removed.txt", ModTime: now, Hash: "2", Batch: "."},
+		{Path: "content.txt", ModTime: now, Hash: "3", Batch: "."},
+		{Path: "modtime.txt", ModTime: now, Hash: "4", Batch: "."},
+		{Path: "moved-batch.txt", ModTime: now, Hash: "5", Batch: "."},
+	}))
+	b := newTestDB(t)
+	must(b.MarkFiles([]*FileInfo{
+		{Path: "unchanged.txt", ModTime: now, Hash: "1", Batch: "."},
+		{Path: "content.txt", ModTime: now, Hash: "3-changed", Batch: "."},
+		{Path: "modtime.txt", ModTime: now.Add(time.Second), Hash: "4", Batch: "."},
+		{Path: "moved-batch.txt", ModTime: now, Hash: "5", Batch: "moved-batch.txt"},
+		{Path: "subdir/added.txt", ModTime: now, Hash: "6", Batch: "subdir/added.txt"},
+	}))
+
+	diff, err := diffDBs(a, b)
+	must(err)
+	assert.Equal(t, &SnapshotDiff{
+		Added:    []string{"subdir/added.txt"},
+		Removed:  []string{"removed.txt"},
+		Modified: []string{"content.txt", "modtime.txt"},
+	}, diff)
+}
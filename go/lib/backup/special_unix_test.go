@@ -0,0 +1,79 @@
+//go:build unix
+
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"local/backup/lib/logging"
+)
+
+func TestBackupFiles_SkipsFIFO(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+	config.SizeThreshold = 1000
+
+	must(createTestFile(filepath.Join(testBaseDir, "subdir/a.txt"), 50))
+	must(syscall.Mkfifo(filepath.Join(testBaseDir, "subdir/pipe"), 0644))
+	must(syscall.Mkfifo(filepath.Join(testBaseDir, "pipe"), 0644))
+
+	observer := &recordingObserver{}
+	done := make(chan error, 1)
+	go func() {
+		done <- BackupFiles(
+			context.Background(),
+			logger,
+			GetMinioConfig(minioUrl),
+			config.DBFile,
+			testBaseDir,
+			config.Bucket,
+			config.S3Prefix,
+			config.BackupName,
+			config.SizeThreshold,
+			BackupOptions{Observer: observer},
+		)
+	}()
+	select {
+	case err := <-done:
+		must(err)
+	case <-time.After(30 * time.Second):
+		t.Fatal("backup blocked on a FIFO")
+	}
+	assert.Contains(t, observer.events, "skip subdir/pipe special")
+	assert.Contains(t, observer.events, "skip pipe special")
+
+	db, err := NewDB(config.DBFile)
+	must(err)
+	defer db.Close()
+	files, err := db.GetAllFilesByPath()
+	must(err)
+	assert.Len(t, files, 1)
+	assert.Contains(t, files, "subdir/a.txt")
+}
+
+func TestOpenRegularFile(t *testing.T) {
+	dir := t.TempDir()
+	fifo := filepath.Join(dir, "pipe")
+	must(syscall.Mkfifo(fifo, 0644))
+	// A symlink to a FIFO looks like a symlink to the scan, so it's refused when it's opened.
+	link := filepath.Join(dir, "link")
+	must(os.Symlink(fifo, link))
+
+	_, err := openRegularFile(fifo)
+	assert.Error(t, err)
+	_, err = openRegularFile(link)
+	assert.Error(t, err)
+	_, err = getFileHash(link)
+	assert.Error(t, err)
+}
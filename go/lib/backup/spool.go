@@ -0,0 +1,95 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+// Archives up to this many bytes are built in memory, unless BackupOptions.MaxBufferBytes says
+// otherwise.
+const defaultMaxBufferBytes = 64 * 1024 * 1024
+
+// spoolWriter holds an archive while it's being built, so it can be uploaded once it's complete. It
+// starts out in memory, and moves to a temporary file once it grows past max bytes, so that a file
+// bigger than the available memory can still be backed up. The MD5 of everything written is kept
+// along the way, so the archive doesn't need to be read again for its checksum.
+type spoolWriter struct {
+	max  int64
+	dir  string
+	buf  bytes.Buffer
+	file *os.File
+	hash hash.Hash
+	n    int64
+}
+
+// newSpoolWriter returns a spoolWriter that spills into a temporary file in dir (or the default temp
+// dir) past max bytes. A max of 0 means defaultMaxBufferBytes. The caller must close it.
+func newSpoolWriter(max int64, dir string) *spoolWriter {
+	if max <= 0 {
+		max = defaultMaxBufferBytes
+	}
+	return &spoolWriter{max: max, dir: dir, hash: md5.New()}
+}
+
+func (w *spoolWriter) Write(p []byte) (int, error) {
+	if w.file == nil && int64(w.buf.Len()+len(p)) > w.max {
+		file, err := os.CreateTemp(w.dir, "dbackup-spool-*")
+		if err != nil {
+			return 0, fmt.Errorf("failed to create spool file: %v", err)
+		}
+		w.file = file
+		if _, err := w.buf.WriteTo(file); err != nil {
+			return 0, fmt.Errorf("failed to write spool file: %v", err)
+		}
+	}
+	var n int
+	var err error
+	if w.file != nil {
+		n, err = w.file.Write(p)
+	} else {
+		n, err = w.buf.Write(p)
+	}
+	w.hash.Write(p[:n])
+	w.n += int64(n)
+	return n, err
+}
+
+// Spooled reports whether the contents were moved to a temporary file.
+func (w *spoolWriter) Spooled() bool {
+	return w.file != nil
+}
+
+// Size returns the number of bytes written.
+func (w *spoolWriter) Size() int64 {
+	return w.n
+}
+
+// Checksum returns the hex MD5 of everything written.
+func (w *spoolWriter) Checksum() string {
+	return fmt.Sprintf("%x", w.hash.Sum(nil))
+}
+
+// Reader returns a reader for everything written, from the start. It's only valid until the next
+// write or call to Reader.
+func (w *spoolWriter) Reader() (io.ReadSeeker, error) {
+	if w.file == nil {
+		return bytes.NewReader(w.buf.Bytes()), nil
+	}
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to rewind spool file: %v", err)
+	}
+	return w.file, nil
+}
+
+// Close removes the temporary file, if there is one.
+func (w *spoolWriter) Close() error {
+	if w.file == nil {
+		return nil
+	}
+	w.file.Close()
+	return os.Remove(w.file.Name())
+}
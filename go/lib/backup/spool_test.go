@@ -0,0 +1,52 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpoolWriter(t *testing.T) {
+	dir := t.TempDir()
+	w := newSpoolWriter(10, dir)
+
+	// Small writes stay in memory.
+	_, err := w.Write([]byte("0123456789"))
+	must(err)
+	assert.False(t, w.Spooled())
+	r, err := w.Reader()
+	must(err)
+	data, err := io.ReadAll(r)
+	must(err)
+	assert.Equal(t, "0123456789", string(data))
+
+	// Going past the max moves everything to a file.
+	_, err = w.Write([]byte("abc"))
+	must(err)
+	assert.True(t, w.Spooled())
+	entries, err := os.ReadDir(dir)
+	must(err)
+	assert.Len(t, entries, 1)
+
+	expected := []byte("0123456789abc")
+	assert.Equal(t, int64(len(expected)), w.Size())
+	assert.Equal(t, fmt.Sprintf("%x", md5.Sum(expected)), w.Checksum())
+	// The reader can be read more than once, e.g. when the upload is mirrored.
+	for i := 0; i < 2; i++ {
+		r, err := w.Reader()
+		must(err)
+		data, err := io.ReadAll(r)
+		must(err)
+		assert.True(t, bytes.Equal(expected, data))
+	}
+
+	must(w.Close())
+	entries, err = os.ReadDir(dir)
+	must(err)
+	assert.Empty(t, entries)
+}
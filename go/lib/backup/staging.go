@@ -0,0 +1,89 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+
+	"local/backup/lib/logging"
+)
+
+// With RecoveryOptions.Staging, recovery extracts everything into a staging directory next to the
+// recovery root, and only moves it into place once the whole recovery, including verification, has
+// succeeded. A recovery that fails partway leaves the recovery root as it was, and removes the
+// staging directory. If the recovery root already exists, it's kept by renaming it to
+// <root>.dbackup-old-<timestamp>, rather than being deleted. The staging directory is a sibling of
+// the recovery root so that the swap is a pair of renames on the same filesystem.
+
+// recoverStaged runs the recovery into a staging directory, then swaps it into place.
+func recoverStaged(
+	ctx context.Context,
+	logger logging.Logger,
+	cfg *aws.Config,
+	dbFile string,
+	bucket string,
+	prefixBase string,
+	name string,
+	localRoot string,
+	options RecoveryOptions,
+) (*Report, error) {
+	localRoot, err := filepath.Abs(localRoot)
+	if err != nil {
+		return nil, err
+	}
+	// The recovered root gets the same permissions as the one it replaces.
+	var mode os.FileMode = 0755
+	existing, err := os.Stat(localRoot)
+	if err == nil {
+		if !existing.IsDir() {
+			return nil, fmt.Errorf("recovery root %q isn't a directory", localRoot)
+		}
+		mode = existing.Mode().Perm()
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	parent := filepath.Dir(localRoot)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return nil, err
+	}
+	staging, err := os.MkdirTemp(parent, "."+filepath.Base(localRoot)+".dbackup-staging-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create staging directory: %v", err)
+	}
+	// Once the staging directory has been moved into place, this is a no-op.
+	defer os.RemoveAll(staging)
+	if err := os.Chmod(staging, mode); err != nil {
+		return nil, err
+	}
+
+	logger.Infof("recovering into staging directory %q", staging)
+	options.Staging = false
+	report, err := runRecovery(ctx, logger, cfg, dbFile, bucket, prefixBase, name, staging, options)
+	if err != nil {
+		logger.Infof("recovery failed, leaving %q untouched", localRoot)
+		return report, err
+	}
+
+	if existing != nil {
+		old := fmt.Sprintf("%s.dbackup-old-%d", localRoot, time.Now().Unix())
+		if err := os.Rename(localRoot, old); err != nil {
+			return report, fmt.Errorf("failed to move existing %q aside: %v", localRoot, err)
+		}
+		logger.Infof("moved existing %q to %q", localRoot, old)
+		if err := os.Rename(staging, localRoot); err != nil {
+			if restoreErr := os.Rename(old, localRoot); restoreErr != nil {
+				return report, fmt.Errorf("failed to move recovered files into place: %v, and failed to move %q back: %v", err, old, restoreErr)
+			}
+			return report, fmt.Errorf("failed to move recovered files into place: %v", err)
+		}
+	} else if err := os.Rename(staging, localRoot); err != nil {
+		return report, fmt.Errorf("failed to move recovered files into place: %v", err)
+	}
+	logger.Infof("moved recovered files into place at %q", localRoot)
+	return report, nil
+}
@@ -0,0 +1,92 @@
+package backup
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"local/backup/lib/logging"
+)
+
+type StatusOptions struct {
+	// If true, also downloads the remote db and reports any differences between it and the local db.
+	CompareRemote bool
+	// Where to download the remote db to. Defaults to os.TempDir().
+	TempDir string
+	// The options the backup would run with. Only the ones that decide which files are backed up,
+	// like the ignore rules, Since and Path, apply.
+	Backup BackupOptions
+}
+
+// StatusReport describes what a backup would do if it were run right now. All paths are relative
+// to the backup root.
+type StatusReport struct {
+	NewFiles     []string
+	ChangedFiles []string
+	DeletedFiles []string
+	// Batches that would be (re-)uploaded.
+	BatchesToWrite []string
+	// Batches that would be deleted from storage.
+	BatchesToDelete []string
+	// Differences between the local and remote db. Only populated if CompareRemote is set.
+	RemoteChanges []string
+}
+
+// Status scans the local tree and compares it to the db, without uploading anything. This is the
+// planning stage of BackupFiles exposed on its own.
+func Status(
+	logger logging.Logger,
+	cfg *aws.Config,
+	dbFile string,
+	localRoot string,
+	bucket string,
+	prefixBase string,
+	name string,
+	sizeThreshold int64,
+	options StatusOptions,
+) (*StatusReport, error) {
+	if err := options.Backup.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid options: %v", err)
+	}
+	db, err := NewDB(dbFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading db: %v", err)
+	}
+	defer db.Close()
+
+	report := &StatusReport{}
+
+	if options.CompareRemote {
+		client := s3.NewFromConfig(*cfg)
+		changes, err := downloadAndCompareDB(logger, client, dbFile, bucket, prefixBase, name, options.TempDir)
+		if err != nil {
+			return nil, fmt.Errorf("error downloading and comparing db: %v", err)
+		}
+		report.RemoteChanges = changes
+	}
+
+	plan, err := planBackup(logger, db, filepath.Clean(localRoot), sizeThreshold, options.Backup.scanOptions())
+	if err != nil {
+		return nil, err
+	}
+	report.NewFiles = plan.Summary.FilesAdded
+	report.ChangedFiles = plan.Summary.FilesChanged
+	report.DeletedFiles = plan.Summary.FilesRemoved
+
+	for _, batch := range plan.Batches {
+		needsBackup, err := batchNeedsBackup(logger, plan.FileInfos, batch)
+		if err != nil {
+			return nil, err
+		}
+		if needsBackup {
+			report.BatchesToWrite = append(report.BatchesToWrite, batch.Root)
+		}
+	}
+	for _, batch := range plan.BatchesToDelete {
+		report.BatchesToDelete = append(report.BatchesToDelete, batch.Path)
+	}
+
+	return report, nil
+}
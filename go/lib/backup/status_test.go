@@ -0,0 +1,116 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"local/backup/lib/logging"
+)
+
+func TestStatus_ModifiedAndNewFile(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "b.txt"), 9))
+	must(createTestFile(filepath.Join(testBaseDir, "c.txt"), 25))
+
+	cfg := GetMinioConfig(minioUrl)
+	must(BackupFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		testBaseDir,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		config.SizeThreshold,
+		BackupOptions{},
+	))
+
+	// Modify one file and add a new one. The sizes are chosen so every file stays in its own batch.
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 6))
+	must(createTestFile(filepath.Join(testBaseDir, "d.txt"), 20))
+
+	report, err := Status(
+		logger,
+		cfg,
+		config.DBFile,
+		testBaseDir,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		config.SizeThreshold,
+		StatusOptions{CompareRemote: true},
+	)
+	must(err)
+
+	assert.Equal(t, []string{"d.txt"}, report.NewFiles)
+	assert.Equal(t, []string{"a.txt"}, report.ChangedFiles)
+	assert.Empty(t, report.DeletedFiles)
+	assert.ElementsMatch(t, []string{"a.txt", "d.txt"}, report.BatchesToWrite)
+	assert.Empty(t, report.BatchesToDelete)
+	assert.Empty(t, report.RemoteChanges)
+}
+
+func TestStatus_BackupOptions(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "b.log"), 9))
+	must(createTestFile(filepath.Join(testBaseDir, "tmp", "c.txt"), 25))
+	must(os.WriteFile(filepath.Join(testBaseDir, ".dbignore"), []byte("^tmp/\n"), 0644))
+
+	options := BackupOptions{Exclude: []string{"*.log"}}
+	cfg := GetMinioConfig(minioUrl)
+	must(BackupFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		testBaseDir,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		config.SizeThreshold,
+		options,
+	))
+
+	// Files the backup ignores aren't reported, whether they're new or changed.
+	must(createTestFile(filepath.Join(testBaseDir, "b.log"), 10))
+	must(createTestFile(filepath.Join(testBaseDir, "d.log"), 20))
+	must(createTestFile(filepath.Join(testBaseDir, "tmp", "e.txt"), 20))
+
+	report, err := Status(
+		logger,
+		cfg,
+		config.DBFile,
+		testBaseDir,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		config.SizeThreshold,
+		StatusOptions{Backup: options},
+	)
+	must(err)
+
+	assert.Empty(t, report.NewFiles)
+	assert.Empty(t, report.ChangedFiles)
+	assert.Empty(t, report.DeletedFiles)
+	assert.Empty(t, report.BatchesToWrite)
+	assert.Empty(t, report.BatchesToDelete)
+}
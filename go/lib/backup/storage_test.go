@@ -0,0 +1,151 @@
+package backup
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+
+	"local/backup/lib/logging"
+	"local/backup/lib/s3_helpers"
+)
+
+// newTestSFTPClient serves a temporary directory over SFTP in-process, and returns a client that
+// stores objects in it, along with the directory.
+func newTestSFTPClient(t *testing.T) (*s3_helpers.SFTPClient, string) {
+	root := t.TempDir()
+	serverReader, clientWriter := io.Pipe()
+	clientReader, serverWriter := io.Pipe()
+	server, err := sftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{serverReader, serverWriter})
+	must(err)
+	go server.Serve()
+	client, err := sftp.NewClientPipe(clientReader, clientWriter)
+	must(err)
+	// Closing the server ends the client's connection, which the client waits for when it's closed.
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	return s3_helpers.NewSFTPClient(client, root), root
+}
+
+func TestRoundTrip_SFTP(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	storage, root := newTestSFTPClient(t)
+	testBaseDir := t.TempDir()
+	dbFile := filepath.Join(t.TempDir(), "test-backup.db")
+	cfg := &aws.Config{}
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 5))
+	must(createTestFile(filepath.Join(testBaseDir, "big.txt"), 500))
+	must(createTestFile(filepath.Join(testBaseDir, "dir/b.txt"), 10))
+	must(createTestFile(filepath.Join(testBaseDir, "dir/c.txt"), 20))
+	must(createTestFile(filepath.Join(testBaseDir, "dir/nested/d.txt"), 300))
+
+	backup := func() {
+		must(BackupFiles(context.Background(), logger, cfg, dbFile, testBaseDir, "bucket", "backups", "test-backup", 100, BackupOptions{
+			CreateBucketIfMissing: true,
+			Storage:               storage,
+		}))
+	}
+	recover := func() string {
+		recoveryDir := t.TempDir()
+		must(RecoverFiles(context.Background(), logger, cfg, dbFile, "bucket", "backups", "test-backup", recoveryDir, RecoveryOptions{
+			Verify:  true,
+			Storage: storage,
+		}))
+		return recoveryDir
+	}
+	backup()
+	compareDirectories(testBaseDir, recover(), t)
+
+	// The objects are stored as files, under the same keys as in S3.
+	stored := filepath.Join(root, "bucket", "backups", "test-backup")
+	assert.FileExists(t, filepath.Join(stored, "big.txt.tar.gz"))
+	assert.FileExists(t, filepath.Join(stored, "dir", "_files.tar.gz"))
+
+	// Changes and deletions make it to the server too.
+	must(os.Remove(filepath.Join(testBaseDir, "big.txt")))
+	must(createTestFile(filepath.Join(testBaseDir, "dir/c.txt"), 30))
+	backup()
+	assert.NoFileExists(t, filepath.Join(stored, "big.txt.tar.gz"))
+	compareDirectories(testBaseDir, recover(), t)
+}
+
+func TestSFTPClient_List(t *testing.T) {
+	client, _ := newTestSFTPClient(t)
+	_, err := client.CreateBucket(context.TODO(), &s3.CreateBucketInput{Bucket: aws.String("bucket")})
+	must(err)
+	keys := []string{"a/1", "a/2", "a/b/3", "c", "d/4"}
+	for _, key := range keys {
+		_, err := client.PutObject(context.TODO(), &s3.PutObjectInput{
+			Bucket: aws.String("bucket"),
+			Key:    aws.String(key),
+			Body:   strings.NewReader(key),
+		})
+		must(err)
+	}
+
+	list := func(input s3.ListObjectsV2Input) ([]string, []string) {
+		input.Bucket = aws.String("bucket")
+		var objects, prefixes []string
+		paginator := s3.NewListObjectsV2Paginator(client, &input)
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(context.TODO())
+			must(err)
+			for _, object := range page.Contents {
+				objects = append(objects, aws.ToString(object.Key))
+			}
+			for _, prefix := range page.CommonPrefixes {
+				prefixes = append(prefixes, aws.ToString(prefix.Prefix))
+			}
+		}
+		return objects, prefixes
+	}
+
+	objects, _ := list(s3.ListObjectsV2Input{MaxKeys: aws.Int32(2)})
+	assert.Equal(t, keys, objects)
+	objects, _ = list(s3.ListObjectsV2Input{Prefix: aws.String("a/")})
+	assert.Equal(t, []string{"a/1", "a/2", "a/b/3"}, objects)
+	objects, prefixes := list(s3.ListObjectsV2Input{Delimiter: aws.String("/"), MaxKeys: aws.Int32(1)})
+	assert.Equal(t, []string{"c"}, objects)
+	assert.Equal(t, []string{"a/", "d/"}, prefixes)
+	objects, _ = list(s3.ListObjectsV2Input{Prefix: aws.String("missing/")})
+	assert.Empty(t, objects)
+
+	// Deleting and copying work like S3's, including for objects that don't exist.
+	exists, err := s3_helpers.ObjectExists(client, "bucket", "c")
+	must(err)
+	assert.True(t, exists)
+	assert.NoError(t, deleteObject(client, "bucket", "c"))
+	assert.NoError(t, deleteObject(client, "bucket", "c"))
+	exists, err = s3_helpers.ObjectExists(client, "bucket", "c")
+	must(err)
+	assert.False(t, exists)
+	_, err = client.CopyObject(context.TODO(), &s3.CopyObjectInput{
+		Bucket:     aws.String("bucket"),
+		Key:        aws.String("e"),
+		CopySource: aws.String(copySource("bucket", "a/b/3")),
+	})
+	must(err)
+	data, err := s3_helpers.DownloadBytes(client, "bucket", "e")
+	must(err)
+	assert.Equal(t, "a/b/3", string(data))
+	_, err = s3_helpers.DownloadBytes(client, "bucket", "c")
+	assert.ErrorIs(t, err, s3_helpers.ErrNotFound)
+
+	// Keys that don't map to a path of their own are refused.
+	assert.Error(t, s3_helpers.UploadBytes(client, "bucket", "a/../c", nil))
+}
@@ -0,0 +1,293 @@
+package backup
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"local/backup/lib/logging"
+	"local/backup/lib/s3_helpers"
+)
+
+// Besides files, a backup can hold named streams (BackupStream), like a database dump that's piped
+// straight into the backup. Each stream is stored by itself, gzipped, at
+//
+//	<prefix>/streams/<name>
+//
+// and recorded in the db's streams table, along with the hash and size of its contents. Backing up
+// a stream with the same name again replaces it. Streams aren't part of the directory tree, so
+// recovering files leaves them alone; RecoverStream writes one back out.
+
+// Stream describes a stream that's stored in a backup.
+type Stream struct {
+	Name string
+	// MD5 of the stream's contents.
+	Hash string
+	Size int64
+	// When the stream was backed up.
+	ModTime time.Time
+}
+
+type StreamOptions struct {
+	// If true, backs up the stream even if the remote db differs from the local one.
+	Force bool
+	// Where to stage the compressed stream and download the remote db to. Defaults to
+	// os.TempDir().
+	TempDir string
+	// Custom metadata to attach to the stream's object.
+	ObjectMetadata map[string]string
+}
+
+func streamKey(prefix string, name string) string {
+	return s3Key(prefix, "streams", name)
+}
+
+// isStreamKey tells streams apart from archives of a directory that happens to be called "streams".
+func isStreamKey(prefix string, key string) bool {
+	return strings.HasPrefix(key, s3Key(prefix, "streams")+"/") && !strings.HasSuffix(key, ".tar.gz")
+}
+
+// validateStreamName makes sure a stream's name maps to a single key that can't be mistaken for an
+// archive.
+func validateStreamName(name string) error {
+	if name == "" || name == "." || name == ".." {
+		return fmt.Errorf("invalid stream name %q", name)
+	}
+	if strings.Contains(name, "/") {
+		return fmt.Errorf("stream name %q can't contain slashes", name)
+	}
+	if strings.HasSuffix(name, ".tar.gz") {
+		return fmt.Errorf("stream name %q can't end in .tar.gz", name)
+	}
+	return nil
+}
+
+// BackupStream compresses everything read from r and stores it in the backup under the given
+// stream name, replacing any stream that was stored under that name before.
+func BackupStream(
+	logger logging.Logger,
+	cfg *aws.Config,
+	dbFile string,
+	bucket string,
+	prefixBase string,
+	name string,
+	streamName string,
+	r io.Reader,
+	options StreamOptions,
+) error {
+	if err := validateStreamName(streamName); err != nil {
+		return err
+	}
+	tmpDir := options.TempDir
+	if tmpDir == "" {
+		tmpDir = os.TempDir()
+	}
+
+	// Make sure no other run is working on the same backup.
+	unlock, err := acquireLock(logger, dbFile)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	client := s3.NewFromConfig(*cfg)
+
+	// The db is uploaded along with the stream, so it has to match the remote one, or start out as
+	// a copy of it.
+	if _, err := os.Stat(dbFile); os.IsNotExist(err) {
+		remoteDBFile, err := downloadDB(logger, client, bucket, prefixBase, name, filepath.Dir(dbFile))
+		if err != nil && !errors.Is(err, s3_helpers.ErrNotFound) {
+			return fmt.Errorf("failed to download remote db file: %v", err)
+		}
+		if err == nil && remoteDBFile != dbFile {
+			logger.Verbosef("renaming remote db file %q to %q", remoteDBFile, dbFile)
+			if err := os.Rename(remoteDBFile, dbFile); err != nil {
+				return fmt.Errorf("failed to move remote db into place: %v", err)
+			}
+		}
+	}
+	changes, err := downloadAndCompareDB(logger, client, dbFile, bucket, prefixBase, name, tmpDir)
+	if err != nil {
+		return fmt.Errorf("error downloading and comparing db: %v", err)
+	}
+	if len(changes) > 0 {
+		logger.Infof("files have changed in storage since the last backup:")
+		printChanges(changes)
+		if !options.Force {
+			return fmt.Errorf("files have changed in storage since the last backup")
+		}
+		logger.Infof("forcing backup despite changes in storage")
+	}
+
+	db, err := NewDB(dbFile)
+	if err != nil {
+		return fmt.Errorf("error loading db: %v", err)
+	}
+	defer db.Close()
+
+	// Uploads need to know their size up front, so the compressed stream is staged in a temporary
+	// file first.
+	staged, err := os.CreateTemp(tmpDir, "dbackup-stream-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(staged.Name())
+	defer staged.Close()
+
+	logger.Verbosef("compressing stream %q", streamName)
+	gw := gzip.NewWriter(staged)
+	h := md5.New()
+	size, err := io.Copy(io.MultiWriter(gw, h), r)
+	if err != nil {
+		return fmt.Errorf("failed to read stream %q: %v", streamName, err)
+	}
+	if err := gw.Close(); err != nil {
+		return fmt.Errorf("failed to close gzip writer: %v", err)
+	}
+	if _, err := staged.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	key := streamKey(s3Key(prefixBase, name), streamName)
+	logger.Verbosef("backing up stream %q to %q", streamName, key)
+	_, err = client.PutObject(context.TODO(), &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        staged,
+		ContentType: aws.String(gzipContentType),
+		Metadata:    objectMetadata(name, options.ObjectMetadata),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload stream %q to %q: %v", streamName, key, err)
+	}
+
+	err = db.SetStream(Stream{
+		Name:    streamName,
+		Hash:    fmt.Sprintf("%x", h.Sum(nil)),
+		Size:    size,
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("error recording stream %q: %v", streamName, err)
+	}
+	if err := backupDB(logger, client, dbFile, bucket, prefixBase, name); err != nil {
+		return fmt.Errorf("error backing up db: %v", err)
+	}
+	logger.Infof("backed up stream %q (%d bytes)", streamName, size)
+	return nil
+}
+
+// RecoverStream writes the contents of the named stream to w. The stream is looked up in the remote
+// db, so it can be recovered on a machine that has never backed anything up, and its contents are
+// checked against the hash that was recorded when it was backed up.
+func RecoverStream(
+	logger logging.Logger,
+	cfg *aws.Config,
+	bucket string,
+	prefixBase string,
+	name string,
+	streamName string,
+	w io.Writer,
+	options StreamOptions,
+) error {
+	if err := validateStreamName(streamName); err != nil {
+		return err
+	}
+	tmpDir := options.TempDir
+	if tmpDir == "" {
+		tmpDir = os.TempDir()
+	}
+	client := s3.NewFromConfig(*cfg)
+
+	remoteDBFile, err := downloadDB(logger, client, bucket, prefixBase, name, tmpDir)
+	if err != nil {
+		return fmt.Errorf("failed to download remote db file: %v", err)
+	}
+	defer os.Remove(remoteDBFile)
+	db, err := NewDB(remoteDBFile)
+	if err != nil {
+		return fmt.Errorf("error loading db: %v", err)
+	}
+	defer db.Close()
+	stream, err := db.GetStream(streamName)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("backup %q has no stream named %q", name, streamName)
+	}
+	if err != nil {
+		return fmt.Errorf("error loading stream %q from db: %v", streamName, err)
+	}
+
+	key := streamKey(s3Key(prefixBase, name), streamName)
+	logger.Verbosef("recovering stream %q from %q", streamName, key)
+	body, err := s3_helpers.OpenObject(client, bucket, key)
+	if err != nil {
+		return fmt.Errorf("failed to download stream %q: %v", streamName, err)
+	}
+	defer body.Close()
+
+	h := md5.New()
+	counter := &countingWriter{}
+	if err := gunzipTo(io.MultiWriter(w, h, counter), body); err != nil {
+		return fmt.Errorf("failed to recover stream %q: %v", streamName, err)
+	}
+	if hash := fmt.Sprintf("%x", h.Sum(nil)); hash != stream.Hash || counter.n != stream.Size {
+		return fmt.Errorf("stream %q doesn't match the backup: got %d bytes with hash %s, expected %d bytes with hash %s", streamName, counter.n, hash, stream.Size, stream.Hash)
+	}
+	return nil
+}
+
+// SetStream records a stream, replacing any stream with the same name.
+func (db *DB) SetStream(stream Stream) error {
+	_, err := db.db.Exec(`
+		INSERT INTO streams (name, hash, size, mod_time)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET
+			hash = excluded.hash, size = excluded.size, mod_time = excluded.mod_time
+	`, stream.Name, stream.Hash, stream.Size, stream.ModTime.UnixMilli())
+	return err
+}
+
+// GetStream returns the named stream, or sql.ErrNoRows if there isn't one.
+func (db *DB) GetStream(name string) (*Stream, error) {
+	stream := &Stream{Name: name}
+	var modTime int64
+	err := db.db.QueryRow(`SELECT hash, size, mod_time FROM streams WHERE name = ?`, name).
+		Scan(&stream.Hash, &stream.Size, &modTime)
+	if err != nil {
+		return nil, err
+	}
+	stream.ModTime = time.UnixMilli(modTime)
+	return stream, nil
+}
+
+// GetAllStreams returns every stream in the backup.
+func (db *DB) GetAllStreams() ([]Stream, error) {
+	rows, err := db.db.Query(`SELECT name, hash, size, mod_time FROM streams`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var streams []Stream
+	for rows.Next() {
+		var stream Stream
+		var modTime int64
+		if err := rows.Scan(&stream.Name, &stream.Hash, &stream.Size, &modTime); err != nil {
+			return nil, err
+		}
+		stream.ModTime = time.UnixMilli(modTime)
+		streams = append(streams, stream)
+	}
+	return streams, rows.Err()
+}
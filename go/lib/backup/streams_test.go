@@ -0,0 +1,84 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"local/backup/lib/logging"
+)
+
+func TestBackupStream_RoundTrip(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+
+	must(createTestFile(filepath.Join(testBaseDir, "a.txt"), 50))
+	cfg := GetMinioConfig(minioUrl)
+	backupFiles := func() error {
+		return BackupFiles(
+			context.Background(),
+			logger,
+			cfg,
+			config.DBFile,
+			testBaseDir,
+			config.Bucket,
+			config.S3Prefix,
+			config.BackupName,
+			config.SizeThreshold,
+			BackupOptions{},
+		)
+	}
+	must(backupFiles())
+
+	data := make([]byte, 3*1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	must(BackupStream(logger, cfg, config.DBFile, config.Bucket, config.S3Prefix, config.BackupName, "dump.sql", bytes.NewReader(data), StreamOptions{}))
+
+	// The stream is tracked in the db, so backing up the files again doesn't see any changes in
+	// storage, and GC keeps it.
+	must(backupFiles())
+	orphans, err := GC(logger, cfg, config.DBFile, config.Bucket, config.S3Prefix, config.BackupName, GCOptions{})
+	must(err)
+	assert.Empty(t, orphans)
+
+	var recovered bytes.Buffer
+	must(RecoverStream(logger, cfg, config.Bucket, config.S3Prefix, config.BackupName, "dump.sql", &recovered, StreamOptions{}))
+	assert.Equal(t, data, recovered.Bytes())
+
+	// Backing up the stream again replaces it.
+	must(BackupStream(logger, cfg, config.DBFile, config.Bucket, config.S3Prefix, config.BackupName, "dump.sql", bytes.NewReader([]byte("smaller")), StreamOptions{}))
+	recovered.Reset()
+	must(RecoverStream(logger, cfg, config.Bucket, config.S3Prefix, config.BackupName, "dump.sql", &recovered, StreamOptions{}))
+	assert.Equal(t, "smaller", recovered.String())
+
+	err = RecoverStream(logger, cfg, config.Bucket, config.S3Prefix, config.BackupName, "missing", &recovered, StreamOptions{})
+	assert.ErrorContains(t, err, "no stream named")
+	err = BackupStream(logger, cfg, config.DBFile, config.Bucket, config.S3Prefix, config.BackupName, "a/b", bytes.NewReader(data), StreamOptions{})
+	assert.Error(t, err)
+
+	// Recovering the files leaves the stream out.
+	testRecoveryDir, err := os.MkdirTemp("/tmp", "dave-recovery-test-")
+	must(err)
+	defer os.RemoveAll(testRecoveryDir)
+	must(RecoverFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		testRecoveryDir,
+		RecoveryOptions{Verify: true},
+	))
+	compareDirectories(testBaseDir, testRecoveryDir, t)
+}
@@ -0,0 +1,51 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A backup can be limited to a subtree of the root (BackupOptions.Path). Only that part of the tree
+// is scanned, and batches and files outside of it are left alone rather than being treated as
+// deleted.
+//
+// Batch boundaries depend on the rest of the tree: a small subtree may have been rolled up into a
+// batch belonging to one of its ancestors. To keep the boundaries consistent with a full backup, the
+// scan is widened to the highest ancestor whose batch holds files from the subtree.
+
+// inScope reports whether a path (relative to the backup root) is inside the given scope.
+func inScope(path string, scope string) bool {
+	return scope == "." || path == scope || strings.HasPrefix(path, scope+string(filepath.Separator))
+}
+
+// subtreeScope returns the directory, relative to the root, that has to be scanned to back up the
+// given subtree.
+func subtreeScope(root string, subtree string, fileInfos fileInfoCache) (string, error) {
+	scope := filepath.Clean(filepath.FromSlash(subtree))
+	if filepath.IsAbs(scope) || scope == ".." || strings.HasPrefix(scope, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %q is outside of the backup root", subtree)
+	}
+	info, err := os.Stat(filepath.Join(root, scope))
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("path %q is not a directory", subtree)
+	}
+
+	subtreeScope := scope
+	for _, fi := range fileInfos {
+		// Only grouped batches are named after a directory.
+		if fi.Batch == fi.Path || !inScope(fi.Path, subtreeScope) {
+			continue
+		}
+		// The batch's directory is an ancestor of the subtree, so it either contains the current
+		// scope or is inside it.
+		if inScope(scope, fi.Batch) {
+			scope = fi.Batch
+		}
+	}
+	return scope, nil
+}
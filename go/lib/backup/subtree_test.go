@@ -0,0 +1,89 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"local/backup/lib/logging"
+)
+
+func TestBackupFiles_Subtree(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+	config.SizeThreshold = 100
+
+	must(createTestFile(filepath.Join(testBaseDir, "subdir-1/a.txt"), 200))
+	must(createTestFile(filepath.Join(testBaseDir, "subdir-1/b.txt"), 200))
+	must(createTestFile(filepath.Join(testBaseDir, "subdir-2/c.txt"), 200))
+	must(createTestFile(filepath.Join(testBaseDir, "subdir-2/d.txt"), 200))
+	roundTripTest(config, t)
+
+	// Change a file in each subtree, but only back up one of them.
+	must(createTestFile(filepath.Join(testBaseDir, "subdir-1/a.txt"), 200))
+	must(createTestFile(filepath.Join(testBaseDir, "subdir-2/c.txt"), 200))
+
+	counter := &countingUploadClient{}
+	cfg := GetMinioConfig(minioUrl)
+	cfg.HTTPClient = counter
+	must(BackupFiles(
+		context.Background(),
+		logger,
+		cfg,
+		config.DBFile,
+		testBaseDir,
+		config.Bucket,
+		config.S3Prefix,
+		config.BackupName,
+		config.SizeThreshold,
+		BackupOptions{Path: "subdir-1"},
+	))
+	if assert.Len(t, counter.puts, 1) {
+		assert.True(t, strings.HasSuffix(counter.puts[0], "/subdir-1/a.txt.tar.gz"), counter.puts[0])
+	}
+	// Nothing outside of the subtree was deleted.
+	assertBatchCount(t, config, 4)
+
+	// A full backup picks up the other change.
+	config.LeaveBucketContents = true
+	roundTripTest(config, t)
+}
+
+func TestSubtreeScope(t *testing.T) {
+	root := t.TempDir()
+	must(os.MkdirAll(filepath.Join(root, "a/b/c"), os.ModePerm))
+	must(os.MkdirAll(filepath.Join(root, "x/y"), os.ModePerm))
+	must(createTestFile(filepath.Join(root, "file.txt"), 5))
+
+	fileInfos := fileInfoCache{
+		// a/b's files were rolled up into a's batch.
+		"a/b/c/1.txt": {Path: "a/b/c/1.txt", Batch: "a"},
+		"a/2.txt":     {Path: "a/2.txt", Batch: "a"},
+		// x/y's files are batched on their own.
+		"x/y/3.txt": {Path: "x/y/3.txt", Batch: "x/y/3.txt"},
+		"x/y/4.txt": {Path: "x/y/4.txt", Batch: "x/y"},
+	}
+
+	scope, err := subtreeScope(root, "a/b", fileInfos)
+	must(err)
+	assert.Equal(t, "a", scope)
+	scope, err = subtreeScope(root, "x/y", fileInfos)
+	must(err)
+	assert.Equal(t, "x/y", scope)
+	scope, err = subtreeScope(root, "x", fileInfos)
+	must(err)
+	assert.Equal(t, "x", scope)
+
+	_, err = subtreeScope(root, "../elsewhere", fileInfos)
+	assert.Error(t, err)
+	_, err = subtreeScope(root, "file.txt", fileInfos)
+	assert.Error(t, err)
+}
@@ -23,13 +23,53 @@ const (
 	backupReasonHash
 )
 
+func (r backupReason) String() string {
+	switch r {
+	case backupReasonNew:
+		return "new"
+	case backupReasonModtime:
+		return "modtime"
+	case backupReasonHash:
+		return "hash"
+	default:
+		return "none"
+	}
+}
+
 type backupSummary struct {
 	FilesAdded   []string
 	FilesChanged []string
 	FilesRemoved []string
+	// Why each added or changed file needs to be backed up, by path.
+	Reasons map[string]backupReason
+	// Files that were modified between the scan and being archived. The db records what was actually
+	// archived, so these will be picked up by the next backup if needed.
+	FilesChangedDuringBackup []string
+	// How well each batch that was written compressed, by batch root.
+	Compression map[string]CompressionStats
+	// Paths that were excluded by ignore rules. The scan doesn't descend into ignored directories, so
+	// their files aren't listed individually.
+	FilesIgnored []string
+	DirsIgnored  []string
+	// Files that were skipped because they don't have one of the allowed extensions.
+	FilesSkipped []string
+	// Files that were skipped because they keep failing to back up. See quarantine.go.
+	FilesQuarantined []string
+	// Files that were skipped because they aren't regular files, like FIFOs, sockets and devices.
+	FilesSpecial []string
+	// Empty files, which were skipped because of BackupOptions.SkipEmptyFiles.
+	FilesEmpty []string
+	// Files with a modtime in the future, which were compared by hash only. See isFutureModTime.
+	FilesFutureModTime []string
 }
 
-func (s *backupSummary) AddFile(path string, op backupOp) {
+func (s *backupSummary) AddFile(path string, op backupOp, reason backupReason) {
+	if reason != backupReasonNone {
+		if s.Reasons == nil {
+			s.Reasons = make(map[string]backupReason)
+		}
+		s.Reasons[path] = reason
+	}
 	switch op {
 	case backupOpAdd:
 		s.FilesAdded = append(s.FilesAdded, path)
@@ -44,19 +84,82 @@ func (s *backupSummary) AddFile(path string, op backupOp) {
 	}
 }
 
+func (s *backupSummary) AddIgnored(path string, isDir bool) {
+	if isDir {
+		s.DirsIgnored = append(s.DirsIgnored, path)
+	} else {
+		s.FilesIgnored = append(s.FilesIgnored, path)
+	}
+}
+
+func (s *backupSummary) AddSkipped(path string) {
+	s.FilesSkipped = append(s.FilesSkipped, path)
+}
+
+func (s *backupSummary) AddQuarantined(path string) {
+	s.FilesQuarantined = append(s.FilesQuarantined, path)
+}
+
+func (s *backupSummary) AddSpecial(path string) {
+	s.FilesSpecial = append(s.FilesSpecial, path)
+}
+
+func (s *backupSummary) AddEmpty(path string) {
+	s.FilesEmpty = append(s.FilesEmpty, path)
+}
+
+func (s *backupSummary) AddFutureModTime(path string) {
+	s.FilesFutureModTime = append(s.FilesFutureModTime, path)
+}
+
+func (s *backupSummary) AddChangedDuringBackup(path string) {
+	s.FilesChangedDuringBackup = append(s.FilesChangedDuringBackup, path)
+}
+
+func (s *backupSummary) AddCompression(batch string, stats CompressionStats) {
+	if s.Compression == nil {
+		s.Compression = make(map[string]CompressionStats)
+	}
+	s.Compression[batch] = stats
+}
+
+// merge adds everything in the other summary to this one.
+func (s *backupSummary) merge(other *backupSummary) {
+	s.FilesAdded = append(s.FilesAdded, other.FilesAdded...)
+	s.FilesChanged = append(s.FilesChanged, other.FilesChanged...)
+	s.FilesRemoved = append(s.FilesRemoved, other.FilesRemoved...)
+	for path, reason := range other.Reasons {
+		if s.Reasons == nil {
+			s.Reasons = make(map[string]backupReason)
+		}
+		s.Reasons[path] = reason
+	}
+	s.FilesChangedDuringBackup = append(s.FilesChangedDuringBackup, other.FilesChangedDuringBackup...)
+	for batch, stats := range other.Compression {
+		s.AddCompression(batch, stats)
+	}
+	s.FilesIgnored = append(s.FilesIgnored, other.FilesIgnored...)
+	s.DirsIgnored = append(s.DirsIgnored, other.DirsIgnored...)
+	s.FilesSkipped = append(s.FilesSkipped, other.FilesSkipped...)
+	s.FilesQuarantined = append(s.FilesQuarantined, other.FilesQuarantined...)
+	s.FilesSpecial = append(s.FilesSpecial, other.FilesSpecial...)
+	s.FilesEmpty = append(s.FilesEmpty, other.FilesEmpty...)
+	s.FilesFutureModTime = append(s.FilesFutureModTime, other.FilesFutureModTime...)
+}
+
 func (s *backupSummary) Print(logger logging.Logger) {
 	if len(s.FilesAdded) > 0 {
 		logger.Infof("Files added:")
 		for _, file := range s.FilesAdded {
-			logger.Infof("  %s", file)
+			logger.Infof("  %s", displayPath(file))
 		}
 	} else {
 		logger.Infof("No files added")
 	}
 	if len(s.FilesChanged) > 0 {
-		logger.Infof("Files changed:")
+		logger.Infof("Files changed (and what changed):")
 		for _, file := range s.FilesChanged {
-			logger.Infof("  %s", file)
+			logger.Infof("  %s (%s)", displayPath(file), s.Reasons[file])
 		}
 	} else {
 		logger.Infof("No files changed")
@@ -64,9 +167,64 @@ func (s *backupSummary) Print(logger logging.Logger) {
 	if len(s.FilesRemoved) > 0 {
 		logger.Infof("Files removed:")
 		for _, file := range s.FilesRemoved {
-			logger.Infof("  %s", file)
+			logger.Infof("  %s", displayPath(file))
 		}
 	} else {
 		logger.Infof("No files removed")
 	}
+	if len(s.FilesFutureModTime) > 0 {
+		logger.Infof("Files with modtimes in the future, compared by hash only (is the clock right?):")
+		for _, file := range s.FilesFutureModTime {
+			logger.Infof("  %s", displayPath(file))
+		}
+	}
+	s.printExcluded(logger)
+}
+
+// printExcluded prints how many paths were left out of the backup, and lists them if verbose.
+func (s *backupSummary) printExcluded(logger logging.Logger) {
+	if len(s.FilesIgnored) > 0 || len(s.DirsIgnored) > 0 {
+		logger.Infof("Ignored %d files and %d directories", len(s.FilesIgnored), len(s.DirsIgnored))
+		for _, dir := range s.DirsIgnored {
+			logger.Verbosef("  %s/", displayPath(dir))
+		}
+		for _, file := range s.FilesIgnored {
+			logger.Verbosef("  %s", displayPath(file))
+		}
+	}
+	if len(s.FilesSkipped) > 0 {
+		logger.Infof("Skipped %d files without an allowed extension", len(s.FilesSkipped))
+		for _, file := range s.FilesSkipped {
+			logger.Verbosef("  %s", displayPath(file))
+		}
+	}
+	if len(s.FilesEmpty) > 0 {
+		logger.Infof("Skipped %d empty files", len(s.FilesEmpty))
+		for _, file := range s.FilesEmpty {
+			logger.Verbosef("  %s", displayPath(file))
+		}
+	}
+	if len(s.FilesSpecial) > 0 {
+		logger.Infof("Skipped special files, which can't be backed up:")
+		for _, file := range s.FilesSpecial {
+			logger.Infof("  %s", displayPath(file))
+		}
+	}
+	// Always list these, since they're files that should be backed up but aren't.
+	if len(s.FilesQuarantined) > 0 {
+		logger.Infof("Quarantined files, which keep failing to back up (will be retried once modified):")
+		for _, file := range s.FilesQuarantined {
+			logger.Infof("  %s", displayPath(file))
+		}
+	}
+}
+
+func (s *backupSummary) PrintChangedDuringBackup(logger logging.Logger) {
+	if len(s.FilesChangedDuringBackup) == 0 {
+		return
+	}
+	logger.Infof("Files changed during backup (will be checked again next run):")
+	for _, file := range s.FilesChangedDuringBackup {
+		logger.Infof("  %s", displayPath(file))
+	}
 }
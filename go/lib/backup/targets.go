@@ -0,0 +1,121 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+
+	"local/backup/lib/logging"
+)
+
+// Several backups can be run in one go (BackupTargets), e.g. from a single cron entry, from a
+// targets file that lists them as JSON:
+//
+//	[
+//	  {"root": "/home/me/photos", "bucket": "photos", "prefix": "backups"},
+//	  {"name": "music", "root": "/srv/music", "bucket": "media", "options": {"ContentAddressed": true}}
+//	]
+//
+// Each target is backed up with its own Backuper, so unset fields get the same defaults as
+// BackuperConfig's. The options use BackupOptions' field names.
+
+// TargetDefinition describes one backup to run.
+type TargetDefinition struct {
+	// Defaults to DefaultBackupName(Root).
+	Name   string `json:"name"`
+	Root   string `json:"root"`
+	Bucket string `json:"bucket"`
+	Prefix string `json:"prefix"`
+	// Defaults to DefaultDBFile(Name).
+	DBFile string `json:"db_file"`
+	// Defaults to DefaultSizeThreshold.
+	SizeThreshold int64         `json:"size_threshold"`
+	Options       BackupOptions `json:"options"`
+}
+
+// TargetResult is the outcome of backing up one target.
+type TargetResult struct {
+	// The target's name, or its root if it doesn't have one.
+	Target string
+	// Nil if the backup couldn't start.
+	Report *Report
+	Err    error
+}
+
+type TargetsOptions struct {
+	// If true, the remaining targets are skipped once one fails. Otherwise every target is backed
+	// up regardless.
+	StopOnError bool
+}
+
+// LoadTargets reads a targets file.
+func LoadTargets(path string) ([]TargetDefinition, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var targets []TargetDefinition
+	if err := json.Unmarshal(data, &targets); err != nil {
+		return nil, fmt.Errorf("invalid targets file %q: %v", path, err)
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("targets file %q doesn't list any targets", path)
+	}
+	return targets, nil
+}
+
+// BackupTargets backs up each target in turn, and returns the outcome of each one that was run,
+// along with an error if any of them failed. Cancelling ctx stops the current target's backup, and
+// skips the rest.
+func BackupTargets(
+	ctx context.Context,
+	logger logging.Logger,
+	cfg *aws.Config,
+	targets []TargetDefinition,
+	options TargetsOptions,
+) ([]TargetResult, error) {
+	var results []TargetResult
+	var failures []error
+	for _, target := range targets {
+		if err := ctx.Err(); err != nil {
+			failures = append(failures, err)
+			break
+		}
+		result := TargetResult{Target: target.Name}
+		if result.Target == "" {
+			result.Target = target.Root
+		}
+		logger.Infof("backing up target %q", result.Target)
+		backuper, err := NewBackuper(BackuperConfig{
+			AWS:           cfg,
+			Logger:        logger,
+			Root:          target.Root,
+			Bucket:        target.Bucket,
+			Prefix:        target.Prefix,
+			Name:          target.Name,
+			DBFile:        target.DBFile,
+			SizeThreshold: target.SizeThreshold,
+			Options:       target.Options,
+		})
+		if err == nil {
+			result.Report, err = backuper.Backup(ctx)
+		}
+		result.Err = err
+		results = append(results, result)
+		if err != nil {
+			logger.Infof("target %q failed: %v", result.Target, err)
+			failures = append(failures, fmt.Errorf("target %q: %w", result.Target, err))
+			if options.StopOnError {
+				break
+			}
+		}
+	}
+	if len(failures) > 0 {
+		return results, fmt.Errorf("%d of %d target(s) failed: %w", len(failures), len(targets), errors.Join(failures...))
+	}
+	return results, nil
+}
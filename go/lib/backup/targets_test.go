@@ -0,0 +1,84 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"local/backup/lib/logging"
+)
+
+func TestBackupTargets(t *testing.T) {
+	logger := &logging.DefaultLogger{
+		Level: logging.Debug,
+	}
+	config := getDefaultTestConfig()
+	defer config.Cleanup()
+	testBaseDir := config.TestBaseDir
+	dbDir := t.TempDir()
+
+	photos := filepath.Join(testBaseDir, "photos")
+	music := filepath.Join(testBaseDir, "music")
+	must(createTestFile(filepath.Join(photos, "1.jpg"), 200))
+	must(createTestFile(filepath.Join(music, "song.mp3"), 300))
+	must(createTestFile(filepath.Join(music, "album/track.mp3"), 20))
+
+	// The middle target doesn't have a bucket, so it fails.
+	targetsFile := filepath.Join(t.TempDir(), "targets.json")
+	must(os.WriteFile(targetsFile, []byte(fmt.Sprintf(`[
+		{"root": %q, "bucket": %q, "prefix": %q, "db_file": %q, "size_threshold": 10},
+		{"name": "broken", "root": %q},
+		{"name": "tunes", "root": %q, "bucket": %q, "prefix": %q, "db_file": %q, "options": {"ContentAddressed": true}}
+	]`,
+		photos, config.Bucket, config.S3Prefix, filepath.Join(dbDir, "photos.db"),
+		photos,
+		music, config.Bucket, config.S3Prefix, filepath.Join(dbDir, "tunes.db"),
+	)), 0644))
+	targets, err := LoadTargets(targetsFile)
+	must(err)
+	assert.Len(t, targets, 3)
+	assert.True(t, targets[2].Options.ContentAddressed)
+
+	cfg := GetMinioConfig(minioUrl)
+	results, err := BackupTargets(context.Background(), logger, cfg, targets, TargetsOptions{})
+	assert.ErrorContains(t, err, "1 of 3 target(s) failed")
+	assert.ErrorContains(t, err, `target "broken"`)
+	if assert.Len(t, results, 3) {
+		assert.Equal(t, photos, results[0].Target)
+		assert.NoError(t, results[0].Err)
+		assert.ElementsMatch(t, []string{"1.jpg"}, results[0].Report.FilesAdded)
+		assert.Equal(t, "broken", results[1].Target)
+		assert.Error(t, results[1].Err)
+		assert.Nil(t, results[1].Report)
+		assert.Equal(t, "tunes", results[2].Target)
+		assert.NoError(t, results[2].Err)
+		assert.ElementsMatch(t, []string{"song.mp3", "album/track.mp3"}, results[2].Report.FilesAdded)
+	}
+
+	// Both working targets were backed up under their own names.
+	for _, name := range []string{"photos", "tunes"} {
+		_, err := os.Stat(filepath.Join(dbDir, name+".db"))
+		assert.NoError(t, err)
+	}
+
+	// Stopping on the first failure skips the last target.
+	results, err = BackupTargets(context.Background(), logger, cfg, targets, TargetsOptions{StopOnError: true})
+	assert.Error(t, err)
+	assert.Len(t, results, 2)
+}
+
+func TestLoadTargets_Invalid(t *testing.T) {
+	dir := t.TempDir()
+	for _, contents := range []string{`[]`, `{"root": "/x"}`, `not json`} {
+		path := filepath.Join(dir, "targets.json")
+		must(os.WriteFile(path, []byte(contents), 0644))
+		_, err := LoadTargets(path)
+		assert.Error(t, err, contents)
+	}
+	_, err := LoadTargets(filepath.Join(dir, "missing.json"))
+	assert.Error(t, err)
+}
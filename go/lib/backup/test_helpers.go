@@ -7,12 +7,15 @@ import (
 	"io"
 	"io/fs"
 	"local/backup/lib/logging"
+	"local/backup/lib/s3_helpers"
 	"local/backup/lib/util"
 	"log"
 	"math/rand"
+	"net"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -81,8 +84,7 @@ func compareFiles(file1, file2 string) error {
 	if err != nil {
 		log.Fatal(err)
 	}
-	// As far as I can tell, modtimes are only guaranteed to be equal to the second.
-	if !info1.ModTime().Truncate(time.Second).Equal(info2.ModTime().Truncate(time.Second)) {
+	if !modTimesEqual(info1.ModTime(), info2.ModTime()) {
 		return fmt.Errorf("files have different modtimes: %v != %v", info1.ModTime(), info2.ModTime())
 	}
 
@@ -109,7 +111,16 @@ func compareFiles(file1, file2 string) error {
 	}
 }
 
+type compareOptions struct {
+	// Also check that the directories' modtimes match, apart from the roots'.
+	DirModTimes bool
+}
+
 func compareDirectories(baseDir string, recoveryDir string, t *testing.T) {
+	compareDirectoriesWithOptions(baseDir, recoveryDir, compareOptions{}, t)
+}
+
+func compareDirectoriesWithOptions(baseDir string, recoveryDir string, options compareOptions, t *testing.T) {
 	// Track all seen files so we also get a deletion check.
 	unexpectedFiles := make(map[string]struct{})
 	err := filepath.WalkDir(recoveryDir, func(path string, d fs.DirEntry, err error) error {
@@ -140,6 +151,9 @@ func compareDirectories(baseDir string, recoveryDir string, t *testing.T) {
 		}
 
 		if d.IsDir() {
+			if options.DirModTimes && path != baseDir {
+				return compareDirModTimes(baseDir, recoveryDir, path, t)
+			}
 			// Skip directories
 			return nil
 		}
@@ -171,7 +185,26 @@ func compareDirectories(baseDir string, recoveryDir string, t *testing.T) {
 	}
 }
 
-func clearBucket(client *s3.Client, bucket string, prefix string) error {
+func compareDirModTimes(baseDir string, recoveryDir string, path string, t *testing.T) error {
+	relativePath, err := filepath.Rel(baseDir, path)
+	if err != nil {
+		return err
+	}
+	base, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	recovered, err := os.Stat(filepath.Join(recoveryDir, relativePath))
+	if err != nil {
+		return err
+	}
+	if !modTimesEqual(base.ModTime(), recovered.ModTime()) {
+		t.Errorf("directory modtimes are not equal at path %q: %v != %v", relativePath, base.ModTime(), recovered.ModTime())
+	}
+	return nil
+}
+
+func clearBucket(client s3_helpers.Client, bucket string, prefix string) error {
 	// Get the first page of results for ListObjectsV2 for a bucket
 	output, err := client.ListObjectsV2(context.TODO(), &s3.ListObjectsV2Input{
 		Bucket: aws.String(bucket),
@@ -217,10 +250,38 @@ type roundTripTestConfig struct {
 	LeaveBucketContents bool
 	S3Prefix            string
 	FullS3Prefix        string
-	Cleanup             func()
+	// If set, the backup is stored here instead of in minio.
+	Storage s3_helpers.Client
+	Cleanup func()
 }
 
+// useMemoryStorage reports whether getDefaultTestConfig stores backups in memory instead of in
+// minio: if DBACKUP_TEST_STORAGE is "memory", or if minio isn't running. Only tests that go through
+// the config's Storage, like the round-trip tests, pass without minio, so e.g.
+//
+//	DBACKUP_TEST_STORAGE=memory go test -run TestRoundTrip ./lib/backup
+var useMemoryStorage = sync.OnceValue(func() bool {
+	if os.Getenv("DBACKUP_TEST_STORAGE") == "memory" {
+		return true
+	}
+	conn, err := net.DialTimeout("tcp", strings.TrimPrefix(minioUrl, "http://"), time.Second)
+	if err != nil {
+		log.Printf("minio isn't running at %s, storing backups in memory", minioUrl)
+		return true
+	}
+	conn.Close()
+	return false
+})
+
 func getDefaultTestConfig() *roundTripTestConfig {
+	if useMemoryStorage() {
+		return getMemoryTestConfig()
+	}
+	return getMinioTestConfig()
+}
+
+// getMinioTestConfig returns a config for a backup stored in minio.
+func getMinioTestConfig() *roundTripTestConfig {
 	myPrefix := prefixBase + "-" + randSeq(16)
 
 	testBaseDir, err := os.MkdirTemp("/tmp", "dave-backup-test-")
@@ -250,6 +311,20 @@ func getDefaultTestConfig() *roundTripTestConfig {
 	}
 }
 
+// getMemoryTestConfig is like getMinioTestConfig, but the backup is stored in memory, so tests
+// using it don't need minio.
+func getMemoryTestConfig() *roundTripTestConfig {
+	config := getMinioTestConfig()
+	config.Storage = s3_helpers.NewMemoryClient(config.Bucket)
+	testBaseDir := config.TestBaseDir
+	testDBDir := filepath.Dir(config.DBFile)
+	config.Cleanup = func() {
+		must(os.RemoveAll(testBaseDir))
+		must(os.RemoveAll(testDBDir))
+	}
+	return config
+}
+
 func roundTripTest(testConfig *roundTripTestConfig, t *testing.T) {
 	testRecoveryDir, err := os.MkdirTemp("/tmp", "dave-recovery-test-")
 	must(err)
@@ -260,7 +335,7 @@ func roundTripTest(testConfig *roundTripTestConfig, t *testing.T) {
 	})()
 
 	cfg := GetMinioConfig(minioUrl)
-	client := s3.NewFromConfig(*cfg)
+	client := storageClient(cfg, testConfig.Storage)
 
 	if !testConfig.LeaveBucketContents {
 		must(clearBucket(client, bucket, testConfig.S3Prefix))
@@ -271,6 +346,7 @@ func roundTripTest(testConfig *roundTripTestConfig, t *testing.T) {
 	}
 
 	must(BackupFiles(
+		context.Background(),
 		logger,
 		cfg,
 		testConfig.DBFile,
@@ -279,9 +355,10 @@ func roundTripTest(testConfig *roundTripTestConfig, t *testing.T) {
 		testConfig.S3Prefix,
 		testConfig.BackupName,
 		testConfig.SizeThreshold,
-		BackupOptions{},
+		BackupOptions{Storage: testConfig.Storage},
 	))
 	must(RecoverFiles(
+		context.Background(),
 		logger,
 		cfg,
 		testConfig.DBFile,
@@ -289,7 +366,7 @@ func roundTripTest(testConfig *roundTripTestConfig, t *testing.T) {
 		testConfig.S3Prefix,
 		testConfig.BackupName,
 		testRecoveryDir,
-		RecoveryOptions{},
+		RecoveryOptions{Storage: testConfig.Storage},
 	))
 
 	compareDirectories(testBaseDir, testRecoveryDir, t)
@@ -377,9 +454,9 @@ func roundTripTest(testConfig *roundTripTestConfig, t *testing.T) {
 	}
 }
 
-func assertBatchCount(t *testing.T, dbFile string, s3Prefix string, expected int) {
+func assertBatchCount(t *testing.T, config *roundTripTestConfig, expected int) {
 	// Check the batch count in the DB
-	db, err := NewDB(dbFile)
+	db, err := NewDB(config.DBFile)
 	must(err)
 	batchesInDb, err := db.GetExistingBatches(true)
 	must(err)
@@ -388,11 +465,10 @@ func assertBatchCount(t *testing.T, dbFile string, s3Prefix string, expected int
 	}
 
 	// Check the batch count in S3
-	cfg := GetMinioConfig(minioUrl)
-	client := s3.NewFromConfig(*cfg)
+	client := storageClient(GetMinioConfig(minioUrl), config.Storage)
 	output, err := client.ListObjectsV2(context.TODO(), &s3.ListObjectsV2Input{
 		Bucket: aws.String(bucket),
-		Prefix: aws.String(s3Prefix + "/"),
+		Prefix: aws.String(config.FullS3Prefix + "/"),
 	})
 	if err != nil {
 		log.Fatal(err)
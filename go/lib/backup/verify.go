@@ -0,0 +1,369 @@
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"local/backup/lib/logging"
+	"local/backup/lib/s3_helpers"
+	"local/backup/lib/util"
+)
+
+// VerificationError is returned by RecoverFiles when recovered files don't match the hashes in the
+// db, or with RecoveryOptions.VerifyOnly, when objects in the backup can't be read.
+type VerificationError struct {
+	// Paths of the mismatched files, relative to the backup root.
+	Mismatches []string
+	// Keys of the objects that couldn't be downloaded or decompressed, or didn't match their
+	// checksums.
+	Corrupted []string
+}
+
+func (e *VerificationError) Error() string {
+	var problems []string
+	if len(e.Corrupted) > 0 {
+		problems = append(problems, fmt.Sprintf("%d object(s) are corrupted: %s", len(e.Corrupted), strings.Join(util.Map(e.Corrupted, displayPath), ", ")))
+	}
+	if len(e.Mismatches) > 0 {
+		problems = append(problems, fmt.Sprintf("%d recovered file(s) don't match the backup: %s", len(e.Mismatches), strings.Join(util.Map(e.Mismatches, displayPath), ", ")))
+	}
+	return strings.Join(problems, "; ")
+}
+
+// verifyRecovery re-hashes every recovered file and compares it to the db. Files that recovery
+// intentionally left alone because of the conflict policy (i.e. their modtime doesn't match the
+// backup's) aren't checked.
+func verifyRecovery(logger logging.Logger, db *DB, localRoot string, options RecoveryOptions) error {
+	files, err := db.GetAllFiles()
+	if err != nil {
+		return fmt.Errorf("error loading files from db: %v", err)
+	}
+
+	var mismatches []string
+	for _, file := range files {
+		relPath, ok := options.remapPath(file.Path)
+		if !ok {
+			continue
+		}
+		localPath, err := safeJoin(localRoot, relPath)
+		if err != nil {
+			return err
+		}
+		info, err := os.Stat(localPath)
+		if err != nil {
+			logger.Infof("verification failed, %q is missing: %v", file.Path, err)
+			mismatches = append(mismatches, file.Path)
+			continue
+		}
+		keptLocal := options.Conflict != "" && options.Conflict != ConflictOverwrite
+		if keptLocal && !modTimesEqual(info.ModTime(), file.ModTime) {
+			continue
+		}
+		hash, err := getFileHash(localPath)
+		if err != nil {
+			return fmt.Errorf("failed to hash %q: %v", localPath, err)
+		}
+		if hash != file.Hash {
+			logger.Infof("verification failed, %q has hash %s, expected %s", file.Path, hash, file.Hash)
+			mismatches = append(mismatches, file.Path)
+		}
+	}
+	if len(mismatches) > 0 {
+		sort.Strings(mismatches)
+		return &VerificationError{Mismatches: mismatches}
+	}
+	logger.Infof("verified %d recovered file(s)", len(files))
+	return nil
+}
+
+// verifyBackup checks every object in the backup without writing any files, for
+// RecoveryOptions.VerifyOnly. Archives are read all the way through and compared to their
+// checksums, and blobs, chunks and streams are decompressed. With options.Verify, every file's
+// contents are hashed and compared to the db as well, and files that are missing from their
+// archives are reported. The remote db is downloaded to a temporary file, so the local one is left
+// alone.
+func verifyBackup(
+	ctx context.Context,
+	logger logging.Logger,
+	client s3_helpers.Client,
+	bucket string,
+	prefixBase string,
+	name string,
+	options RecoveryOptions,
+	report *Report,
+) error {
+	prefix := s3Key(prefixBase, name)
+	remoteDBFile, err := downloadDB(logger, client, bucket, prefixBase, name, options.TempDir)
+	if err != nil {
+		return fmt.Errorf("failed to download remote db file: %v", err)
+	}
+	defer os.Remove(remoteDBFile)
+	db, err := NewDB(remoteDBFile)
+	if err != nil {
+		return fmt.Errorf("error loading db: %v", err)
+	}
+	defer db.Close()
+
+	contentAddressed, err := db.IsContentAddressed()
+	if err != nil {
+		return fmt.Errorf("error reading storage mode from db: %v", err)
+	}
+	obfuscateKeys, err := db.ObfuscatesKeys()
+	if err != nil {
+		return fmt.Errorf("error reading storage mode from db: %v", err)
+	}
+	var archiveNames map[string]string
+	if obfuscateKeys {
+		archiveNames, err = archiveNamesByKey(db, prefix)
+		if err != nil {
+			return err
+		}
+	}
+	checksums, err := db.GetBatchChecksums()
+	if err != nil {
+		return fmt.Errorf("error loading batch checksums from db: %v", err)
+	}
+	files, err := db.GetAllFiles()
+	if err != nil {
+		return fmt.Errorf("error loading files from db: %v", err)
+	}
+	chunked, err := db.GetAllFileChunks()
+	if err != nil {
+		return fmt.Errorf("error loading chunks from db: %v", err)
+	}
+	streams, err := db.GetAllStreams()
+	if err != nil {
+		return fmt.Errorf("error loading streams from db: %v", err)
+	}
+
+	// Expected hashes by path, if the files' contents are being checked.
+	var hashes map[string]string
+	if options.Verify {
+		hashes = make(map[string]string)
+		for _, file := range files {
+			hashes[file.Path] = file.Hash
+		}
+	}
+	verr := &VerificationError{}
+	corrupted := func(key string, err error) {
+		logger.Infof("verification failed, %q is corrupted: %v", key, err)
+		verr.Corrupted = append(verr.Corrupted, key)
+	}
+	checkHash := func(filePath string, hash string) {
+		if expected, ok := hashes[filePath]; ok && hash != expected {
+			logger.Infof("verification failed, %q has hash %s, expected %s", filePath, hash, expected)
+			verr.Mismatches = append(verr.Mismatches, filePath)
+		}
+	}
+
+	// Archives, found by listing the backup's objects.
+	dir, err := archiveDir(db, prefixBase, name)
+	if err != nil {
+		return err
+	}
+	keyPrefix := dir + "/"
+	seen := make(map[string]bool)
+	verifiedBatches := make(map[string]bool)
+	paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(keyPrefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return fmt.Errorf("failed to list objects: %v", err)
+		}
+		for _, object := range page.Contents {
+			key := aws.ToString(object.Key)
+			if (contentAddressed && isBlobKey(prefix, key)) || isChunkKey(prefix, key) || isStreamKey(prefix, key) {
+				// These are checked against the db below.
+				continue
+			}
+			relKey := strings.TrimPrefix(key, keyPrefix)
+			if obfuscateKeys {
+				name, ok := archiveNames[key]
+				if !ok {
+					logger.Infof("skipping object %q, it isn't in the db", key)
+					continue
+				}
+				relKey = name
+			}
+			if isArchivedStorageClass(string(object.StorageClass)) {
+				logger.Infof("skipping object %q, it's in archival storage", key)
+				continue
+			}
+			if err := ctx.Err(); err != nil {
+				return fmt.Errorf("verification interrupted after %d objects: %w", report.ObjectsVerified, err)
+			}
+			logger.Verbosef("verifying archive %q", key)
+			batchDir, batch := archiveBatch(relKey)
+			entries, err := verifyArchive(client, bucket, key, checksums[batch])
+			report.ObjectsVerified++
+			if err != nil {
+				corrupted(key, err)
+				continue
+			}
+			verifiedBatches[batch] = true
+			for entry, hash := range entries {
+				filePath := path.Join(batchDir, entry)
+				seen[filePath] = true
+				if hash != "" {
+					checkHash(filePath, hash)
+				}
+			}
+		}
+	}
+
+	// Blobs and chunked files, found through the db.
+	verifiedBlobs := make(map[string]bool)
+	for _, file := range files {
+		if file.Batch != file.Path {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("verification interrupted after %d objects: %w", report.ObjectsVerified, err)
+		}
+		if chunks, ok := chunked[file.Path]; ok {
+			logger.Verbosef("verifying %d chunks of %q", len(chunks), file.Path)
+			seen[file.Path] = true
+			h := md5.New()
+			intact := true
+			for _, chunk := range chunks {
+				key := chunkKey(prefix, chunk.Hash)
+				report.ObjectsVerified++
+				if err := verifyCompressedObject(client, bucket, key, h); err != nil {
+					corrupted(key, err)
+					intact = false
+				}
+			}
+			if intact {
+				checkHash(file.Path, fmt.Sprintf("%x", h.Sum(nil)))
+			}
+		} else if contentAddressed {
+			seen[file.Path] = true
+			if verifiedBlobs[file.Hash] {
+				continue
+			}
+			verifiedBlobs[file.Hash] = true
+			key := blobKey(prefix, file.Hash)
+			logger.Verbosef("verifying blob %q", key)
+			h := md5.New()
+			report.ObjectsVerified++
+			if err := verifyCompressedObject(client, bucket, key, h); err != nil {
+				corrupted(key, err)
+				continue
+			}
+			checkHash(file.Path, fmt.Sprintf("%x", h.Sum(nil)))
+		}
+	}
+
+	// Streams, which always have their hashes checked, as RecoverStream does.
+	for _, stream := range streams {
+		key := streamKey(prefix, stream.Name)
+		logger.Verbosef("verifying stream %q", key)
+		h := md5.New()
+		report.ObjectsVerified++
+		if err := verifyCompressedObject(client, bucket, key, h); err != nil {
+			corrupted(key, err)
+			continue
+		}
+		if hash := fmt.Sprintf("%x", h.Sum(nil)); hash != stream.Hash {
+			corrupted(key, fmt.Errorf("got hash %s, expected %s", hash, stream.Hash))
+		}
+	}
+
+	// Files in archives that were read but didn't contain them.
+	if options.Verify {
+		for _, file := range files {
+			if verifiedBatches[file.Batch] && !seen[file.Path] {
+				logger.Infof("verification failed, %q is missing from its archive", file.Path)
+				verr.Mismatches = append(verr.Mismatches, file.Path)
+			}
+		}
+	}
+
+	if len(verr.Corrupted) > 0 || len(verr.Mismatches) > 0 {
+		sort.Strings(verr.Corrupted)
+		sort.Strings(verr.Mismatches)
+		return verr
+	}
+	logger.Infof("verified %d object(s)", report.ObjectsVerified)
+	return nil
+}
+
+// verifyArchive reads the archive with the given key all the way through, and checks it against the
+// expected checksum, if any. It returns the archive's entries, other than directories, with the
+// hashes of the regular files' contents.
+func verifyArchive(client s3_helpers.Client, bucket string, key string, checksum string) (map[string]string, error) {
+	body, err := s3_helpers.OpenObject(client, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	objectHash := md5.New()
+	object := io.TeeReader(body, objectHash)
+	gzr, err := gzip.NewReader(object)
+	if err != nil {
+		return nil, err
+	}
+	defer gzr.Close()
+
+	entries := make(map[string]string)
+	tr := tar.NewReader(gzr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag == tar.TypeDir {
+			continue
+		}
+		name := filepath.ToSlash(header.Name)
+		entries[name] = ""
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		h := md5.New()
+		if _, err := io.Copy(h, tr); err != nil {
+			return nil, fmt.Errorf("failed to read %q: %v", name, err)
+		}
+		entries[name] = fmt.Sprintf("%x", h.Sum(nil))
+	}
+	// The checksum covers the whole object, including anything after the end of the tar stream.
+	if _, err := io.Copy(io.Discard, gzr); err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(io.Discard, object); err != nil {
+		return nil, err
+	}
+	if hash := fmt.Sprintf("%x", objectHash.Sum(nil)); checksum != "" && hash != checksum {
+		return nil, fmt.Errorf("checksum mismatch: got %s, expected %s", hash, checksum)
+	}
+	return entries, nil
+}
+
+// verifyCompressedObject decompresses the object with the given key to w.
+func verifyCompressedObject(client s3_helpers.Client, bucket string, key string, w io.Writer) error {
+	body, err := s3_helpers.OpenObject(client, bucket, key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return gunzipTo(w, body)
+}
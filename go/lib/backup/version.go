@@ -0,0 +1,5 @@
+package backup
+
+// Version is recorded in the db by each backup. Override it at build time with
+// -ldflags "-X local/backup/lib/backup.Version=..."
+var Version = "dev"
@@ -0,0 +1,89 @@
+package s3_helpers
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// S3 returns at most this many keys per ListObjectsV2 page, unless asked for fewer.
+const maxListKeys = 1000
+
+// listPage returns the page of a bucket's objects that ListObjectsV2 would, for Clients that aren't
+// backed by S3. It filters the objects by the input's prefix itself, and pages through them by
+// using the last key (or common prefix) on a page as the continuation token.
+func listPage(objects []types.Object, params *s3.ListObjectsV2Input) *s3.ListObjectsV2Output {
+	sort.Slice(objects, func(i, j int) bool {
+		return aws.ToString(objects[i].Key) < aws.ToString(objects[j].Key)
+	})
+	prefix := aws.ToString(params.Prefix)
+	delimiter := aws.ToString(params.Delimiter)
+	maxKeys := int(aws.ToInt32(params.MaxKeys))
+	if maxKeys <= 0 || maxKeys > maxListKeys {
+		maxKeys = maxListKeys
+	}
+	after := aws.ToString(params.StartAfter)
+	if token := aws.ToString(params.ContinuationToken); token > after {
+		after = token
+	}
+
+	output := &s3.ListObjectsV2Output{
+		Prefix:            params.Prefix,
+		Delimiter:         params.Delimiter,
+		MaxKeys:           aws.Int32(int32(maxKeys)),
+		ContinuationToken: params.ContinuationToken,
+		StartAfter:        params.StartAfter,
+	}
+	last := ""
+	count := 0
+	for _, object := range objects {
+		key := aws.ToString(object.Key)
+		if !strings.HasPrefix(key, prefix) || key <= after {
+			continue
+		}
+		commonPrefix := ""
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				commonPrefix = key[:len(prefix)+i+len(delimiter)]
+			}
+		}
+		// The rest of a common prefix that ended the previous page, or was just added to this one.
+		if commonPrefix != "" && (commonPrefix == after || commonPrefix == last) {
+			continue
+		}
+		if count == maxKeys {
+			output.IsTruncated = aws.Bool(true)
+			output.NextContinuationToken = aws.String(last)
+			break
+		}
+		if commonPrefix != "" {
+			output.CommonPrefixes = append(output.CommonPrefixes, types.CommonPrefix{Prefix: aws.String(commonPrefix)})
+			last = commonPrefix
+		} else {
+			output.Contents = append(output.Contents, object)
+			last = key
+		}
+		count++
+	}
+	output.KeyCount = aws.Int32(int32(count))
+	if output.IsTruncated == nil {
+		output.IsTruncated = aws.Bool(false)
+	}
+	return output
+}
+
+// parseCopySource returns the bucket and key of a CopyObject source, "<bucket>/<key>" with the key's
+// segments escaped, for Clients that aren't backed by S3.
+func parseCopySource(source *string) (string, string, error) {
+	bucket, escapedKey, _ := strings.Cut(aws.ToString(source), "/")
+	key, err := url.PathUnescape(escapedKey)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid copy source %q: %v", aws.ToString(source), err)
+	}
+	return bucket, key, nil
+}
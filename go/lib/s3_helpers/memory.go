@@ -0,0 +1,201 @@
+package s3_helpers
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// MemoryClient is a Client that keeps objects in memory, so that tests don't need a running S3
+// service. Like S3, it reports an object's MD5 as its ETag and keeps its metadata, but it has no
+// storage classes, so restoring an object does nothing. It's safe for concurrent use.
+type MemoryClient struct {
+	mu      sync.Mutex
+	buckets map[string]map[string]memoryObject
+}
+
+type memoryObject struct {
+	data     []byte
+	metadata map[string]string
+	modTime  time.Time
+}
+
+var _ Client = (*MemoryClient)(nil)
+
+// NewMemoryClient returns a client with the given buckets, which are empty.
+func NewMemoryClient(buckets ...string) *MemoryClient {
+	c := &MemoryClient{buckets: make(map[string]map[string]memoryObject)}
+	for _, bucket := range buckets {
+		c.buckets[bucket] = make(map[string]memoryObject)
+	}
+	return c
+}
+
+// bucket returns the bucket's objects. The caller must hold c.mu.
+func (c *MemoryClient) bucket(name *string) (map[string]memoryObject, error) {
+	objects, ok := c.buckets[aws.ToString(name)]
+	if !ok {
+		return nil, &types.NoSuchBucket{}
+	}
+	return objects, nil
+}
+
+func (c *MemoryClient) HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.buckets[aws.ToString(params.Bucket)]; !ok {
+		return nil, &types.NotFound{}
+	}
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func (c *MemoryClient) CreateBucket(ctx context.Context, params *s3.CreateBucketInput, optFns ...func(*s3.Options)) (*s3.CreateBucketOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.buckets[aws.ToString(params.Bucket)]; ok {
+		return nil, &types.BucketAlreadyOwnedByYou{}
+	}
+	c.buckets[aws.ToString(params.Bucket)] = make(map[string]memoryObject)
+	return &s3.CreateBucketOutput{}, nil
+}
+
+func (c *MemoryClient) CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	srcBucket, srcKey, err := parseCopySource(params.CopySource)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	src, err := c.bucket(aws.String(srcBucket))
+	if err != nil {
+		return nil, err
+	}
+	object, ok := src[srcKey]
+	if !ok {
+		return nil, &types.NoSuchKey{}
+	}
+	dst, err := c.bucket(params.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	// Objects are never modified in place, so the copy can share the source's data.
+	object.modTime = time.Now()
+	dst[aws.ToString(params.Key)] = object
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func (c *MemoryClient) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	objects, err := c.bucket(params.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	var listed []types.Object
+	for key, object := range objects {
+		listed = append(listed, types.Object{
+			Key:          aws.String(key),
+			Size:         aws.Int64(int64(len(object.data))),
+			ETag:         aws.String(object.etag()),
+			LastModified: aws.Time(object.modTime),
+		})
+	}
+	return listPage(listed, params), nil
+}
+
+func (c *MemoryClient) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	objects, err := c.bucket(params.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	object, ok := objects[aws.ToString(params.Key)]
+	if !ok {
+		return nil, &types.NotFound{}
+	}
+	return &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(int64(len(object.data))),
+		ETag:          aws.String(object.etag()),
+		LastModified:  aws.Time(object.modTime),
+		Metadata:      maps.Clone(object.metadata),
+	}, nil
+}
+
+func (c *MemoryClient) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	objects, err := c.bucket(params.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	object, ok := objects[aws.ToString(params.Key)]
+	if !ok {
+		return nil, &types.NoSuchKey{}
+	}
+	return &s3.GetObjectOutput{
+		Body:          io.NopCloser(bytes.NewReader(object.data)),
+		ContentLength: aws.Int64(int64(len(object.data))),
+		ETag:          aws.String(object.etag()),
+		LastModified:  aws.Time(object.modTime),
+		Metadata:      maps.Clone(object.metadata),
+	}, nil
+}
+
+func (c *MemoryClient) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	// Read the body before locking, since it may be slow to produce.
+	var data []byte
+	if params.Body != nil {
+		var err error
+		data, err = io.ReadAll(params.Body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	objects, err := c.bucket(params.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	object := memoryObject{data: data, metadata: maps.Clone(params.Metadata), modTime: time.Now()}
+	objects[aws.ToString(params.Key)] = object
+	return &s3.PutObjectOutput{ETag: aws.String(object.etag())}, nil
+}
+
+func (c *MemoryClient) DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	objects, err := c.bucket(params.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	output := &s3.DeleteObjectsOutput{}
+	if params.Delete == nil {
+		return output, nil
+	}
+	for _, object := range params.Delete.Objects {
+		delete(objects, aws.ToString(object.Key))
+		output.Deleted = append(output.Deleted, types.DeletedObject{Key: object.Key})
+	}
+	return output, nil
+}
+
+func (c *MemoryClient) RestoreObject(ctx context.Context, params *s3.RestoreObjectInput, optFns ...func(*s3.Options)) (*s3.RestoreObjectOutput, error) {
+	return &s3.RestoreObjectOutput{}, nil
+}
+
+// etag is the object's MD5, quoted, like S3's ETag for an object uploaded in one piece.
+func (o memoryObject) etag() string {
+	sum := md5.Sum(o.data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
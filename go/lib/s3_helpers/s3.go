@@ -1,6 +1,7 @@
 package s3_helpers
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -14,7 +15,21 @@ import (
 
 var ErrNotFound = errors.New("not found")
 
-func UploadFile(client *s3.Client, bucket string, key string, localPath string) error {
+// Client is the subset of *s3.Client's methods that the backup code uses, so that tests can wrap or
+// replace the real client.
+type Client interface {
+	HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error)
+	CreateBucket(ctx context.Context, params *s3.CreateBucketInput, optFns ...func(*s3.Options)) (*s3.CreateBucketOutput, error)
+	CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error)
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error)
+	RestoreObject(ctx context.Context, params *s3.RestoreObjectInput, optFns ...func(*s3.Options)) (*s3.RestoreObjectOutput, error)
+}
+
+func UploadFile(client Client, bucket string, key string, localPath string) error {
 	localFile, err := os.Open(localPath)
 	if err != nil {
 		return fmt.Errorf("failed to open local file %q", localPath)
@@ -32,7 +47,7 @@ func UploadFile(client *s3.Client, bucket string, key string, localPath string)
 	return nil
 }
 
-func DownloadFile(client *s3.Client, bucket string, key string, localPath string) error {
+func DownloadFile(client Client, bucket string, key string, localPath string) error {
 	objectDataOutput, err := client.GetObject(context.TODO(), &s3.GetObjectInput{
 		Bucket: &bucket,
 		Key:    &key,
@@ -60,3 +75,67 @@ func DownloadFile(client *s3.Client, bucket string, key string, localPath string
 	}
 	return nil
 }
+
+// OpenObject returns a reader for the contents of the given object, which the caller must close.
+func OpenObject(client Client, bucket string, key string) (io.ReadCloser, error) {
+	objectDataOutput, err := client.GetObject(context.TODO(), &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		var notfound *types.NoSuchKey
+		if errors.As(err, &notfound) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to download file %q: %s", key, err)
+	}
+	return objectDataOutput.Body, nil
+}
+
+func UploadBytes(client Client, bucket string, key string, data []byte) error {
+	_, err := client.PutObject(context.TODO(), &s3.PutObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+		Body:   bytes.NewReader(data),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload to %q: %s", key, err)
+	}
+	return nil
+}
+
+func DownloadBytes(client Client, bucket string, key string) ([]byte, error) {
+	objectDataOutput, err := client.GetObject(context.TODO(), &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		var notfound *types.NoSuchKey
+		if errors.As(err, &notfound) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to download file %q: %s", key, err)
+	}
+	defer objectDataOutput.Body.Close()
+
+	data, err := io.ReadAll(objectDataOutput.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %q: %s", key, err)
+	}
+	return data, nil
+}
+
+func ObjectExists(client Client, bucket string, key string) (bool, error) {
+	_, err := client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		var notfound *types.NotFound
+		if errors.As(err, &notfound) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to get object info for %q: %s", key, err)
+	}
+	return true, nil
+}
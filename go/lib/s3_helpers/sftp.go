@@ -0,0 +1,310 @@
+package s3_helpers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Files being uploaded are written under a name starting with this, next to where they'll end up,
+// and renamed into place once they're complete, so that a failed upload doesn't leave a partial
+// object behind. Listings skip them.
+const sftpUploadPrefix = ".dbackup-upload-"
+
+// SFTPClient is a Client that stores objects as files on an SFTP server, at <root>/<bucket>/<key>,
+// for backing up to any machine that's reachable over SSH. It only supports what the backup code
+// needs: objects have no metadata, checksums or storage classes, so restoring one does nothing.
+type SFTPClient struct {
+	sftp *sftp.Client
+	root string
+	// The SSH connection under sftp, if DialSFTP opened it.
+	conn io.Closer
+}
+
+var _ Client = (*SFTPClient)(nil)
+
+// NewSFTPClient stores objects under root on the server that client is connected to.
+func NewSFTPClient(client *sftp.Client, root string) *SFTPClient {
+	return &SFTPClient{sftp: client, root: root}
+}
+
+// DialSFTP connects to the server in target, a URL like sftp://user@host:22/path/to/dir, logging in
+// with the private key in keyFile and checking the server's host key against knownHostsFile. The
+// port defaults to 22, the user to $USER, and the directory to the user's home directory.
+func DialSFTP(target string, keyFile string, knownHostsFile string) (*SFTPClient, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sftp target %q: %v", target, err)
+	}
+	if u.Scheme != "sftp" || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid sftp target %q: expected sftp://[user@]host[:port][/dir]", target)
+	}
+	user := u.User.Username()
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+	address := u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), "22")
+	}
+
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ssh key: %v", err)
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ssh key %q: %v", keyFile, err)
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read known hosts: %v", err)
+	}
+	conn, err := ssh.Dial("tcp", address, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %q: %v", address, err)
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to start sftp session: %v", err)
+	}
+	// The directory is relative to the home directory, so sftp://host//abs/path is an absolute path,
+	// like scp's host:/abs/path.
+	root := strings.TrimPrefix(u.Path, "/")
+	if root == "" {
+		root = "."
+	}
+	return &SFTPClient{sftp: client, root: root, conn: conn}, nil
+}
+
+// Close closes the SFTP session, and the SSH connection if DialSFTP opened it.
+func (c *SFTPClient) Close() error {
+	err := c.sftp.Close()
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	return err
+}
+
+// bucketPath returns the directory that the bucket's objects are stored in.
+func (c *SFTPClient) bucketPath(bucket *string) (string, error) {
+	name := aws.ToString(bucket)
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return "", fmt.Errorf("invalid bucket name %q", name)
+	}
+	return path.Join(c.root, name), nil
+}
+
+// objectPath returns the file that the object with the given key is stored in. Keys map to paths
+// one-to-one, so keys that paths would clean up, like ones with empty or ".." segments, aren't
+// allowed.
+func (c *SFTPClient) objectPath(bucket *string, key *string) (string, error) {
+	dir, err := c.bucketPath(bucket)
+	if err != nil {
+		return "", err
+	}
+	for _, segment := range strings.Split(aws.ToString(key), "/") {
+		if segment == "" || segment == "." || segment == ".." || strings.HasPrefix(segment, sftpUploadPrefix) {
+			return "", fmt.Errorf("key %q can't be stored over sftp", aws.ToString(key))
+		}
+	}
+	return path.Join(dir, aws.ToString(key)), nil
+}
+
+func (c *SFTPClient) HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	dir, err := c.bucketPath(params.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	info, err := c.sftp.Stat(dir)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && !info.IsDir()) {
+		return nil, &types.NotFound{}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func (c *SFTPClient) CreateBucket(ctx context.Context, params *s3.CreateBucketInput, optFns ...func(*s3.Options)) (*s3.CreateBucketOutput, error) {
+	dir, err := c.bucketPath(params.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.sftp.MkdirAll(dir); err != nil {
+		return nil, err
+	}
+	return &s3.CreateBucketOutput{}, nil
+}
+
+func (c *SFTPClient) CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	bucket, key, err := parseCopySource(params.CopySource)
+	if err != nil {
+		return nil, err
+	}
+	src, err := c.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		return nil, err
+	}
+	defer src.Body.Close()
+	_, err = c.PutObject(ctx, &s3.PutObjectInput{Bucket: params.Bucket, Key: params.Key, Body: src.Body})
+	if err != nil {
+		return nil, err
+	}
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func (c *SFTPClient) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	dir, err := c.bucketPath(params.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	// Only walk the directory the prefix is in.
+	walkDir := dir
+	if i := strings.LastIndex(aws.ToString(params.Prefix), "/"); i >= 0 {
+		walkDir = path.Join(dir, aws.ToString(params.Prefix)[:i])
+	}
+	var objects []types.Object
+	walker := c.sftp.Walk(walkDir)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		info := walker.Stat()
+		if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), sftpUploadPrefix) {
+			continue
+		}
+		objects = append(objects, types.Object{
+			Key:          aws.String(strings.TrimPrefix(walker.Path(), dir+"/")),
+			Size:         aws.Int64(info.Size()),
+			LastModified: aws.Time(info.ModTime()),
+		})
+	}
+	return listPage(objects, params), nil
+}
+
+func (c *SFTPClient) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	p, err := c.objectPath(params.Bucket, params.Key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := c.sftp.Stat(p)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && !info.Mode().IsRegular()) {
+		return nil, &types.NotFound{}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(info.Size()),
+		LastModified:  aws.Time(info.ModTime()),
+	}, nil
+}
+
+func (c *SFTPClient) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	p, err := c.objectPath(params.Bucket, params.Key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := c.sftp.Open(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, &types.NoSuchKey{}
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		file.Close()
+		return nil, &types.NoSuchKey{}
+	}
+	return &s3.GetObjectOutput{
+		Body:          file,
+		ContentLength: aws.Int64(info.Size()),
+		LastModified:  aws.Time(info.ModTime()),
+	}, nil
+}
+
+func (c *SFTPClient) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	p, err := c.objectPath(params.Bucket, params.Key)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.sftp.MkdirAll(path.Dir(p)); err != nil {
+		return nil, err
+	}
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+	tmp := path.Join(path.Dir(p), sftpUploadPrefix+hex.EncodeToString(suffix))
+	file, err := c.sftp.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	if params.Body != nil {
+		_, err = io.Copy(file, params.Body)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = c.sftp.PosixRename(tmp, p)
+	}
+	if err != nil {
+		c.sftp.Remove(tmp)
+		return nil, err
+	}
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (c *SFTPClient) DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	output := &s3.DeleteObjectsOutput{}
+	if params.Delete == nil {
+		return output, nil
+	}
+	for _, object := range params.Delete.Objects {
+		p, err := c.objectPath(params.Bucket, object.Key)
+		if err != nil {
+			return nil, err
+		}
+		// Like S3, deleting an object that doesn't exist succeeds.
+		if err := c.sftp.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		output.Deleted = append(output.Deleted, types.DeletedObject{Key: object.Key})
+	}
+	return output, nil
+}
+
+func (c *SFTPClient) RestoreObject(ctx context.Context, params *s3.RestoreObjectInput, optFns ...func(*s3.Options)) (*s3.RestoreObjectOutput, error) {
+	return &s3.RestoreObjectOutput{}, nil
+}